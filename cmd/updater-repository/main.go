@@ -1,9 +1,12 @@
 package main
 
 import (
+	"os"
+
 	"see_updater/internal/repository"
 )
 
 func main() {
-	repository.NewCommand().Execute()
+	err := repository.NewCommand().Execute()
+	os.Exit(repository.ExitCode(err))
 }
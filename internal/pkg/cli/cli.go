@@ -1,37 +1,68 @@
 package cli
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 )
 
-func AskConfirmation(retries int) bool {
-	fmt.Println("Please type (y)es or (n)o and Enter to continue with the operation:")
-	retryCount := 0
-	return askConfirmation(retries, &retryCount)
+// How a Confirmer answers.
+type Policy int
+
+const (
+	PolicyAsk     Policy = iota // prompt and read the answer
+	PolicyYes                   // confirm without prompting
+	PolicyNoInput               // never prompt, confirmation fails with ErrNoInput
+)
+
+var (
+	ErrDeclined = errors.New("operation declined")
+	ErrNoInput  = errors.New("confirmation required but input is disabled")
+)
+
+// Asks for confirmation on out and reads the answers from in, one per line.
+type Confirmer struct {
+	in      *bufio.Reader
+	out     io.Writer
+	policy  Policy
+	retries int
 }
 
-func askConfirmation(retries int, retryCount *int) bool {
-	var response string
+func NewConfirmer(in io.Reader, out io.Writer, policy Policy) *Confirmer {
+	return &Confirmer{in: bufio.NewReader(in), out: out, policy: policy, retries: 3}
+}
 
-	_, err := fmt.Scanln(&response)
-	if err != nil {
-		fmt.Printf("unrecognized confirmation input\n\terror: %v", err)
-		return false
+// Returns nil if the operation is confirmed, ErrDeclined if the answer is no,
+// unrecognized too many times or missing (end of input).
+func (c *Confirmer) Confirm() error {
+	switch c.policy {
+	case PolicyYes:
+		return nil
+	case PolicyNoInput:
+		return ErrNoInput
 	}
 
-	switch strings.ToLower(response) {
-	case "y", "yes":
-		return true
-	case "n", "no":
-		return false
-	default:
-		*retryCount++
-		if *retryCount == retries {
-			fmt.Printf("reached maximum retries: %d", retries)
-			return false
+	fmt.Fprintln(c.out, "Please type (y)es or (n)o and Enter to continue with the operation:")
+	for retryCount := 0; ; {
+		line, err := c.in.ReadString('\n')
+		if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+			fmt.Fprintf(c.out, "unrecognized confirmation input\n\terror: %v\n", err)
+			return ErrDeclined
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return nil
+		case "n", "no":
+			return ErrDeclined
+		}
+		retryCount++
+		if retryCount == c.retries || err != nil {
+			fmt.Fprintf(c.out, "reached maximum retries: %d\n", c.retries)
+			return ErrDeclined
 		}
-		fmt.Println("I'm sorry but I didn't get what you meant, please type (y)es or (n)o and then press enter:")
-		return askConfirmation(retries, retryCount)
+		fmt.Fprintln(c.out, "I'm sorry but I didn't get what you meant, please type (y)es or (n)o and then press enter:")
 	}
 }
@@ -0,0 +1,376 @@
+// Package custom reads the custom metadata of targets (version, hardware
+// compatibility, ...) from sidecar files or a manifest, checks it against a
+// schema and puts it into the `custom` field of their target file info.
+package custom
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// Sidecar of a file: the JSON object of its custom metadata, next to it.
+const SidecarSuffix = ".meta.json"
+
+// Types of the fields of a Schema
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+	TypeArray   = "array" // Of strings
+	TypeObject  = "object"
+)
+
+var Types = []string{TypeString, TypeInteger, TypeNumber, TypeBoolean, TypeArray, TypeObject}
+
+// Formats of string fields
+const FormatURL = "url" // Absolute http(s) URL
+
+// Custom metadata that a Schema refuses.
+var ErrInvalid = errors.New("invalid custom metadata")
+
+// Constraints of one custom field. Pattern and Enum apply to strings and to
+// the items of arrays.
+type Field struct {
+	Type     string   `yaml:"type"`
+	Required bool     `yaml:"required,omitempty"`
+	Pattern  string   `yaml:"pattern,omitempty"`
+	Enum     []string `yaml:"enum,omitempty"`
+	Format   string   `yaml:"format,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Fields accepted in the custom metadata of a target. Required fields are
+// required of every target that has custom metadata.
+type Schema struct {
+	Fields map[string]*Field `yaml:"fields"`
+	// Accept fields missing from Fields, of any type
+	AdditionalFields bool `yaml:"additional_fields"`
+}
+
+// Schema of the fields used by the updater clients, other fields are
+// accepted.
+func DefaultSchema() *Schema {
+	return &Schema{
+		Fields: map[string]*Field{
+			"version":           {Type: TypeString},
+			"hardware":          {Type: TypeArray},
+			"release_notes_url": {Type: TypeString, Format: FormatURL},
+			"min_from_version":  {Type: TypeString},
+		},
+		AdditionalFields: true,
+	}
+}
+
+// Load a schema from a YAML (or JSON) file.
+func LoadSchema(path string) (*Schema, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(schema); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %w", path, err)
+	}
+	for name, field := range schema.Fields {
+		if field == nil || !slices.Contains(Types, field.Type) {
+			return nil, fmt.Errorf("invalid schema %s: field %s: type must be one of %s", path, name, strings.Join(Types, ", "))
+		}
+		if field.Format != "" && field.Format != FormatURL {
+			return nil, fmt.Errorf("invalid schema %s: field %s: unknown format %q", path, name, field.Format)
+		}
+		if field.Pattern != "" {
+			if field.pattern, err = regexp.Compile(field.Pattern); err != nil {
+				return nil, fmt.Errorf("invalid schema %s: field %s: %w", path, name, err)
+			}
+		}
+	}
+	return schema, nil
+}
+
+// Check values against the schema, every violation is reported.
+func (s *Schema) Validate(values map[string]any) error {
+	problems := []string{}
+	names := []string{}
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	for name := range values {
+		if s.Fields[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field, value := s.Fields[name], values[name]
+		_, ok := values[name]
+		switch {
+		case field == nil && !s.AdditionalFields:
+			problems = append(problems, fmt.Sprintf("%s: unknown field", name))
+		case field == nil:
+		case !ok:
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("%s: missing", name))
+			}
+		default:
+			if err := field.check(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (f *Field) check(value any) error {
+	switch f.Type {
+	case TypeString:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string")
+		}
+		return f.checkString(s)
+	case TypeInteger:
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("expected an integer")
+		}
+	case TypeNumber:
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("expected a number")
+		}
+	case TypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("expected a boolean")
+		}
+	case TypeArray:
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("expected a list of strings")
+		}
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a list of strings")
+			}
+			if err := f.checkString(s); err != nil {
+				return err
+			}
+		}
+	case TypeObject:
+		if _, ok := value.(map[string]any); !ok {
+			return fmt.Errorf("expected an object")
+		}
+	}
+	return nil
+}
+
+func (f *Field) checkString(s string) error {
+	if f.pattern == nil && f.Pattern != "" {
+		pattern, err := regexp.Compile(f.Pattern)
+		if err != nil {
+			return err
+		}
+		f.pattern = pattern
+	}
+	if f.pattern != nil && !f.pattern.MatchString(s) {
+		return fmt.Errorf("%q does not match %s", s, f.Pattern)
+	}
+	if len(f.Enum) > 0 && !slices.Contains(f.Enum, s) {
+		return fmt.Errorf("%q is not one of %s", s, strings.Join(f.Enum, ", "))
+	}
+	if f.Format == FormatURL {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%q is not an http(s) URL", s)
+		}
+	}
+	return nil
+}
+
+// Custom metadata of the sidecar at path, false if there is none.
+func ReadSidecar(path string) (map[string]any, bool, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	values := map[string]any{}
+	if err = json.Unmarshal(content, &values); err != nil {
+		return nil, false, fmt.Errorf("%w: sidecar %s is not a JSON object: %w", ErrInvalid, path, err)
+	}
+	return values, true, nil
+}
+
+// Custom metadata of the manifest at path by file path (relative to the
+// repository dir, '/'-separated). YAML or JSON manifests map paths to
+// objects. CSV manifests have a `path` column and a column per field, cells
+// are converted to the type of their field in schema (arrays are ";"
+// separated), empty cells are left out.
+func LoadManifest(path string, schema *Schema) (map[string]map[string]any, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest map[string]map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		raw := map[string]map[string]any{}
+		if err = yaml.Unmarshal(content, &raw); err != nil {
+			return nil, fmt.Errorf("%w: manifest %s: %w", ErrInvalid, path, err)
+		}
+		// Same types as JSON sidecars, e.g. float64 numbers
+		var bytes []byte
+		if bytes, err = json.Marshal(raw); err == nil {
+			err = json.Unmarshal(bytes, &manifest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: manifest %s: %w", ErrInvalid, path, err)
+		}
+	case ".csv":
+		if manifest, err = readCSV(content, schema); err != nil {
+			return nil, fmt.Errorf("%w: manifest %s: %w", ErrInvalid, path, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: manifest %s: use a .yaml, .yml, .json or .csv file", ErrInvalid, path)
+	}
+
+	normalized := map[string]map[string]any{}
+	for file, values := range manifest {
+		key := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(file)), "./")
+		if _, ok := normalized[key]; ok {
+			return nil, fmt.Errorf("%w: manifest %s: %s is listed twice", ErrInvalid, path, file)
+		}
+		normalized[key] = values
+	}
+	return normalized, nil
+}
+
+func readCSV(content []byte, schema *Schema) (map[string]map[string]any, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) == 0 || strings.TrimSpace(header[0]) != "path" {
+		return nil, fmt.Errorf("the first column must be `path`")
+	}
+	manifest := map[string]map[string]any{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		file := strings.TrimSpace(record[0])
+		if _, ok := manifest[file]; ok {
+			return nil, fmt.Errorf("%s is listed twice", file)
+		}
+		values := map[string]any{}
+		for i, cell := range record[1:] {
+			name := strings.TrimSpace(header[i+1])
+			if cell = strings.TrimSpace(cell); cell == "" {
+				continue
+			}
+			if values[name], err = parseCell(cell, schema.Fields[name]); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", file, name, err)
+			}
+		}
+		manifest[file] = values
+	}
+	return manifest, nil
+}
+
+func parseCell(cell string, field *Field) (any, error) {
+	if field == nil {
+		return cell, nil
+	}
+	switch field.Type {
+	case TypeInteger, TypeNumber:
+		return strconv.ParseFloat(cell, 64)
+	case TypeBoolean:
+		return strconv.ParseBool(cell)
+	case TypeArray:
+		items := []any{}
+		for _, item := range strings.Split(cell, ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	case TypeObject:
+		object := map[string]any{}
+		if err := json.Unmarshal([]byte(cell), &object); err != nil {
+			return nil, fmt.Errorf("expected a JSON object: %w", err)
+		}
+		return object, nil
+	}
+	return cell, nil
+}
+
+// Add values to the custom object of target, keeping what it already has
+// (e.g. a recorded symlink), which values must not redefine.
+func Apply(target *metadata.TargetFiles, values map[string]any) error {
+	object := map[string]any{}
+	if target.Custom != nil {
+		if err := json.Unmarshal(*target.Custom, &object); err != nil {
+			return fmt.Errorf("fail to parse custom metadata of %s: %w", target.Path, err)
+		}
+	}
+	for name, value := range values {
+		if _, ok := object[name]; ok {
+			return fmt.Errorf("%w: field %s of %s is reserved", ErrInvalid, name, target.Path)
+		}
+		object[name] = value
+	}
+	bytes, err := json.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("fail to marshal custom metadata of %s: %w", target.Path, err)
+	}
+	target.Custom = (*json.RawMessage)(&bytes)
+	return nil
+}
+
+// Whether a and b hold the same JSON value, formatting aside. Nil is the same
+// as null.
+func Equal(a *json.RawMessage, b *json.RawMessage) bool {
+	return canonical(a) == canonical(b)
+}
+
+func canonical(raw *json.RawMessage) string {
+	if raw == nil || len(*raw) == 0 {
+		return "null"
+	}
+	var value any
+	if err := json.Unmarshal(*raw, &value); err != nil {
+		return string(*raw)
+	}
+	bytes, _ := json.Marshal(value) // Sorted keys
+	return string(bytes)
+}
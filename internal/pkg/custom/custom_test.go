@@ -0,0 +1,140 @@
+package custom_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/custom"
+	"strings"
+	"testing"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+func write(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	schema := custom.DefaultSchema()
+	valid := map[string]any{"version": "1.2.0", "hardware": []any{"rev-a", "rev-b"},
+		"release_notes_url": "https://example.com/notes", "other": 1.0}
+	if err := schema.Validate(valid); err != nil {
+		t.Fatal(err)
+	}
+	err := schema.Validate(map[string]any{"version": 1.0, "hardware": "rev-a", "release_notes_url": "notes.txt"})
+	if !errors.Is(err, custom.ErrInvalid) || strings.Count(err.Error(), ";") != 2 {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	schema, err = custom.LoadSchema(write(t, dir, "schema.yaml", `fields:
+  version: {type: string, required: true, pattern: '^\d+\.\d+\.\d+$'}
+  channel: {type: string, enum: [stable, beta]}
+  build: {type: integer}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = schema.Validate(map[string]any{"version": "1.0.0", "channel": "beta", "build": 3.0}); err != nil {
+		t.Fatal(err)
+	}
+	for _, values := range []map[string]any{
+		{"channel": "beta"},                   // version missing
+		{"version": "1.0"},                    // pattern
+		{"version": "1.0.0", "channel": "rc"}, // enum
+		{"version": "1.0.0", "build": 1.5},    // integer
+		{"version": "1.0.0", "other": "x"},    // unknown field
+	} {
+		if err = schema.Validate(values); !errors.Is(err, custom.ErrInvalid) {
+			t.Fatal(values, err)
+		}
+	}
+
+	for _, content := range []string{"fields:\n  a: {type: date}\n", "fields:\n  a: {type: string, format: email}\n", "fields:\n  a: {type: string, pattern: '('}\n", "field: {}\n"} {
+		if _, err = custom.LoadSchema(write(t, dir, "bad.yaml", content)); err == nil {
+			t.Fatal("invalid schema accepted", content)
+		}
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	schema := custom.DefaultSchema()
+	yamlManifest, err := custom.LoadManifest(write(t, dir, "manifest.yaml", `./fw/a.bin:
+  version: "1.0"
+  hardware: [rev-a]
+  size: 3
+`), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvManifest, err := custom.LoadManifest(write(t, dir, "manifest.csv", "path,version,hardware,size\nfw/a.bin,1.0,rev-a,3\nfw/b.bin,,rev-a; rev-b,\n"), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same values as a JSON sidecar would give, but the CSV has no schema for size
+	a, _ := json.Marshal(yamlManifest["fw/a.bin"])
+	if string(a) != `{"hardware":["rev-a"],"size":3,"version":"1.0"}` {
+		t.Fatal(string(a))
+	}
+	a, _ = json.Marshal(csvManifest["fw/a.bin"])
+	b, _ := json.Marshal(csvManifest["fw/b.bin"])
+	if string(a) != `{"hardware":["rev-a"],"size":"3","version":"1.0"}` || string(b) != `{"hardware":["rev-a","rev-b"]}` {
+		t.Fatal(string(a), string(b))
+	}
+
+	for name, content := range map[string]string{
+		"twice.yaml": "a.bin: {}\n./a.bin: {}\n",
+		"twice.csv":  "path,version\na.bin,1\na.bin,2\n",
+		"header.csv": "file,version\na.bin,1\n",
+		"other.txt":  "a.bin: {}\n",
+	} {
+		if _, err = custom.LoadManifest(write(t, dir, name, content), schema); !errors.Is(err, custom.ErrInvalid) {
+			t.Fatal(name, err)
+		}
+	}
+}
+
+func TestReadSidecarAndApply(t *testing.T) {
+	dir := t.TempDir()
+	if _, ok, err := custom.ReadSidecar(filepath.Join(dir, "none"+custom.SidecarSuffix)); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, _, err := custom.ReadSidecar(write(t, dir, "list"+custom.SidecarSuffix, "[1]")); !errors.Is(err, custom.ErrInvalid) {
+		t.Fatal(err)
+	}
+	values, ok, err := custom.ReadSidecar(write(t, dir, "a.bin"+custom.SidecarSuffix, `{"version": "2.0"}`))
+	if !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	target, err := metadata.TargetFile().FromBytes("a.bin", []byte("a"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	symlink := json.RawMessage(`{"symlink":"b.bin"}`)
+	target.Custom = &symlink
+	if err = custom.Apply(target, values); err != nil {
+		t.Fatal(err)
+	}
+	want := json.RawMessage(`{"version":"2.0","symlink":"b.bin"}`)
+	if !custom.Equal(target.Custom, &want) {
+		t.Fatal(string(*target.Custom))
+	}
+	// Fields set by the updater are reserved
+	if err = custom.Apply(target, map[string]any{"symlink": "c.bin"}); !errors.Is(err, custom.ErrInvalid) {
+		t.Fatal(err)
+	}
+
+	null := json.RawMessage("null")
+	if !custom.Equal(nil, &null) || custom.Equal(nil, &want) {
+		t.Fatal("unexpected comparison")
+	}
+}
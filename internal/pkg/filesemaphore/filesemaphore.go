@@ -104,7 +104,7 @@ func (s *Semaphore) Write(name SemaphoreName) error {
 		return fmt.Errorf("fail to get semaphore description %s: %w", name, err)
 	}
 
-	f, err := os.OpenFile(semaphoreDesc.Filepath, os.O_CREATE|os.O_EXCL, 0700)
+	f, err := os.OpenFile(semaphoreDesc.Filepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
 	if err != nil {
 		return fmt.Errorf("fail to write semaphore %s: %w", name, err)
 	}
@@ -122,7 +122,7 @@ func (s *Semaphore) Write(name SemaphoreName) error {
 // guarantee that only one semaphore file will be successfully written in a race
 // condition.
 func (s *Semaphore) WriteNew(name SemaphoreName, filename string, content string) error {
-	f, err := os.OpenFile(filepath.Join(s.SemaphoreDir, filename), os.O_CREATE|os.O_EXCL, 0700)
+	f, err := os.OpenFile(filepath.Join(s.SemaphoreDir, filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
 	if err != nil {
 		return fmt.Errorf("fail to write new semaphore %s: %w", name, err)
 	}
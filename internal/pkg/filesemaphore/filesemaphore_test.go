@@ -327,6 +327,8 @@ func TestSemaphore_RemoveAll(t *testing.T) {
 		os.RemoveAll(semaphoreDir)
 		t.Fatal(err)
 	}
+
+	os.RemoveAll(semaphoreDir)
 }
 
 func TestSemaphore_ClearSemaphoreDir(t *testing.T) {
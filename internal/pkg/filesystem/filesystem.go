@@ -3,11 +3,10 @@ package filesystem
 import (
 	"fmt"
 	"io/fs"
-	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
-	"strings"
 )
 
 func IsDirWritable(path string) (bool, error) {
@@ -52,40 +51,19 @@ func WriteBytesToFile(path string, bytes []byte) error {
 	return nil
 }
 
-// Returns all localFilepaths, fullFilepaths in the directory
+// Returns all localFilepaths (the root dirname joined with the path relative
+// to the root, '/'-separated), fullFilepaths in the directory
 func GetAllFilepathsInDir(path string) ([]string, []string, error) {
 	var localFilepaths, fullFilepaths []string
 
-	_, root := filepath.Split(filepath.Clean(path)) // Local root (Last dirname in dirpath)
-	err := filepath.WalkDir(path, func(path string, di fs.DirEntry, err error) error {
-		if err != nil {
-			return fmt.Errorf("fail to access path %q: %w\n", path, err)
-		}
-		// if info.IsDir() && info.Name() == subDirToSkip {
-		// 	fmt.Printf("skipping a dir without errors: %+v \n", info.Name())
-		// 	return filepath.SkipDir
-		// }
-		if !di.IsDir() {
-			// Split full filepath into parts by separator
-			filepathParts := strings.Split(path, string(os.PathSeparator))
-			for i, part := range filepathParts {
-				// Join filepath parts that are after root
-				if part == root {
-					localFilepath := strings.Join(filepathParts[i:], string(os.PathSeparator))
-
-					// Append current filepath to list
-					localFilepaths = append(localFilepaths, localFilepath)
-					fullFilepaths = append(fullFilepaths, path)
-
-					slog.Debug("visited file", slog.String("filepath", path), slog.String("added_as", localFilepath))
-					break
-				}
-			}
-		}
-		return nil
-	})
+	scan, err := ScanDir(path, ScanOptions{})
 	if err != nil {
-		return nil, nil, fmt.Errorf("error walking the path %q: %w", path, err)
+		return nil, nil, err
+	}
+	root := filepath.Base(filepath.Clean(path)) // Local root (Last dirname in dirpath)
+	for _, file := range scan.Files {
+		localFilepaths = append(localFilepaths, root+"/"+file.Path)
+		fullFilepaths = append(fullFilepaths, file.FullPath)
 	}
 	return localFilepaths, fullFilepaths, nil
 }
@@ -191,3 +169,27 @@ func sprintDir(dirPath string, depth int, parentPath string) (string, error) {
 	}
 	return res, nil
 }
+
+// Flush the file content to stable storage.
+func SyncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Flush the directory entries (e.g. after a rename) to stable storage. Not
+// supported on Windows, where it is a no-op.
+func SyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,277 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"see_updater/internal/pkg/ignore"
+)
+
+// Symlink policies of ScanDir
+const (
+	SymlinksFollow = "follow" // Scan what the link points at, inside the root only
+	SymlinksSkip   = "skip"   // Leave links out, reported as skipped
+	SymlinksError  = "error"  // Fail on the first link
+	SymlinksRecord = "record" // Keep the link itself, see ScannedFile.Symlink
+)
+
+var SymlinksPolicies = []string{SymlinksFollow, SymlinksSkip, SymlinksError, SymlinksRecord}
+
+// Symlink refused by the policy of a scan, or pointing outside of the root.
+var ErrSymlink = errors.New("symlink refused")
+
+type ScanOptions struct {
+	Ignore   *ignore.Rules // nil keeps everything
+	Symlinks string        // One of SymlinksPolicies, SymlinksFollow if empty
+}
+
+type ScanResult struct {
+	Files   []ScannedFile
+	Skipped []SkippedFile
+	// Groups of scanned files that are hardlinks of one another, each file is
+	// still scanned
+	Hardlinks [][]string
+}
+
+// File found by ScanDir.
+type ScannedFile struct {
+	Path     string // Relative to the root, '/'-separated
+	FullPath string
+	Symlink  string // SymlinksRecord only: the link target, relative to the link dir, '/'-separated
+}
+
+// File or directory left out of a scan, and the rule deciding it.
+type SkippedFile struct {
+	Path   string `json:"path"` // Relative to the root, '/'-separated
+	Reason string `json:"reason"`
+}
+
+// Walk the files of the directory in lexical order, leaving out what
+// opts.Ignore ignores and special files (pipes, sockets, devices). Rules match
+// the '/'-separated paths relative to the root, an ignored directory is
+// reported once and not walked. Symlinks are handled by opts.Symlinks and
+// must point inside the root.
+func ScanDir(path string, opts ScanOptions) (ScanResult, error) {
+	s := scanner{opts: opts, root: filepath.Clean(path)}
+	if s.opts.Symlinks == "" {
+		s.opts.Symlinks = SymlinksFollow
+	}
+	realRoot, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("fail to access path %q: %w", path, err)
+	}
+	s.realRoot = realRoot
+	s.result = ScanResult{Files: []ScannedFile{}, Skipped: []SkippedFile{}}
+	if err = s.walk(s.root, realRoot, "", map[string]bool{realRoot: true}); err != nil {
+		return ScanResult{}, fmt.Errorf("error walking the path %q: %w", path, err)
+	}
+	s.result.Hardlinks = s.hardlinks()
+	return s.result, nil
+}
+
+// Scan of files listed rather than walked, e.g. the objects under a prefix
+// of object storage: paths are '/'-separated and relative to root, their
+// FullPath is in root but need not exist. Ignore rules apply like in ScanDir,
+// ignored dirs are reported once. There are no symlinks, special files or
+// hardlinks.
+func ScanPaths(root string, paths []string, opts ScanOptions) ScanResult {
+	s := scanner{opts: opts, root: filepath.Clean(root)}
+	s.result = ScanResult{Files: []ScannedFile{}, Skipped: []SkippedFile{}, Hardlinks: [][]string{}}
+	// The order of ScanDir, "a/b" comes before "a.txt"
+	sorted := slices.Clone(paths)
+	slices.SortFunc(sorted, func(a, b string) int {
+		return strings.Compare(strings.ReplaceAll(a, "/", "\x00"), strings.ReplaceAll(b, "/", "\x00"))
+	})
+	dirs := map[string]bool{} // Dir -> ignored, for the dirs already matched
+	for _, rel := range sorted {
+		ignoredDir := false
+		names := strings.Split(rel, "/")
+		for i := 1; i < len(names) && !ignoredDir; i++ {
+			dir := strings.Join(names[:i], "/")
+			ignored, checked := dirs[dir]
+			if !checked {
+				ignored = s.skipIgnored(filepath.Join(s.root, filepath.FromSlash(dir)), dir, true)
+				dirs[dir] = ignored
+			}
+			ignoredDir = ignored
+		}
+		full := filepath.Join(s.root, filepath.FromSlash(rel))
+		if ignoredDir || s.skipIgnored(full, rel, false) {
+			continue
+		}
+		s.add(ScannedFile{Path: rel, FullPath: full}, nil)
+	}
+	return s.result
+}
+
+type scanner struct {
+	opts     ScanOptions
+	root     string
+	realRoot string
+	result   ScanResult
+	infos    []os.FileInfo // By index of result.Files, nil for files reached through a symlink
+}
+
+// Walk dir, at rel from the root. realDir is dir with symlinks resolved,
+// ancestors the real paths of the dirs being walked, to stop symlink loops.
+func (s *scanner) walk(dir string, realDir string, rel string, ancestors map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("fail to access path %q: %w", dir, err)
+	}
+	for _, entry := range entries {
+		full := filepath.Join(dir, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+		mode := entry.Type()
+		if mode&fs.ModeSymlink != 0 {
+			err = s.visitSymlink(full, realDir, entryRel, ancestors)
+		} else if s.skipIgnored(full, entryRel, mode.IsDir()) {
+			continue
+		} else if mode.IsDir() {
+			realSubdir := filepath.Join(realDir, entry.Name())
+			ancestors[realSubdir] = true
+			err = s.walk(full, realSubdir, entryRel, ancestors)
+			delete(ancestors, realSubdir)
+		} else if mode.IsRegular() {
+			var info os.FileInfo
+			if info, err = os.Lstat(full); err != nil {
+				return fmt.Errorf("fail to access path %q: %w", full, err)
+			}
+			s.add(ScannedFile{Path: entryRel, FullPath: full}, info)
+		} else {
+			s.skip(full, entryRel, specialFileReason(mode))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scanner) visitSymlink(full string, realDir string, rel string, ancestors map[string]bool) error {
+	resolved, err := filepath.EvalSymlinks(full)
+	var target os.FileInfo
+	if err == nil {
+		target, err = os.Stat(resolved)
+	}
+	// Like git, a link is a file for the ignore rules unless it is followed
+	followDir := s.opts.Symlinks == SymlinksFollow && err == nil && target.IsDir()
+	if s.skipIgnored(full, rel, followDir) {
+		return nil
+	}
+
+	switch s.opts.Symlinks {
+	case SymlinksSkip:
+		s.skip(full, rel, "symlink")
+		return nil
+	case SymlinksError:
+		return fmt.Errorf("%w: %s is a symlink, refused by the %q policy", ErrSymlink, full, SymlinksError)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s is a broken symlink: %w", ErrSymlink, full, err)
+	}
+	if !isWithin(s.realRoot, resolved) {
+		return fmt.Errorf("%w: %s points outside of the root: %s", ErrSymlink, full, resolved)
+	}
+
+	switch {
+	case s.opts.Symlinks == SymlinksRecord:
+		link, err := filepath.Rel(realDir, resolved)
+		if err != nil {
+			return fmt.Errorf("fail to resolve symlink %q: %w", full, err)
+		}
+		s.add(ScannedFile{Path: rel, FullPath: full, Symlink: filepath.ToSlash(link)}, nil)
+	case target.IsDir():
+		if ancestors[resolved] {
+			s.skip(full, rel, "symlink loop")
+			return nil
+		}
+		ancestors[resolved] = true
+		defer delete(ancestors, resolved)
+		return s.walk(full, resolved, rel, ancestors)
+	case target.Mode().IsRegular():
+		s.add(ScannedFile{Path: rel, FullPath: full}, nil)
+	default:
+		s.skip(full, rel, specialFileReason(target.Mode().Type()))
+	}
+	return nil
+}
+
+func (s *scanner) skipIgnored(full string, rel string, isDir bool) bool {
+	ignored, rule := s.opts.Ignore.Match(rel, isDir)
+	if ignored {
+		s.skip(full, rel, rule)
+	}
+	return ignored
+}
+
+func (s *scanner) skip(full string, rel string, reason string) {
+	slog.Debug("skipped path", slog.String("filepath", full), slog.String("reason", reason))
+	s.result.Skipped = append(s.result.Skipped, SkippedFile{Path: rel, Reason: reason})
+}
+
+func (s *scanner) add(file ScannedFile, info os.FileInfo) {
+	slog.Debug("visited file", slog.String("filepath", file.FullPath), slog.String("added_as", file.Path))
+	s.result.Files = append(s.result.Files, file)
+	s.infos = append(s.infos, info)
+}
+
+// Groups of at least 2 files that are the same file on disk, in scan order.
+func (s *scanner) hardlinks() [][]string {
+	groups := [][]int{}
+	bySize := map[int64][]int{} // Size -> indexes of the groups of that size
+	for i, info := range s.infos {
+		if info == nil {
+			continue
+		}
+		found := false
+		for _, g := range bySize[info.Size()] {
+			if os.SameFile(s.infos[groups[g][0]], info) {
+				groups[g] = append(groups[g], i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			bySize[info.Size()] = append(bySize[info.Size()], len(groups))
+			groups = append(groups, []int{i})
+		}
+	}
+	result := [][]string{}
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		paths := []string{}
+		for _, i := range group {
+			paths = append(paths, s.result.Files[i].Path)
+		}
+		result = append(result, paths)
+	}
+	return result
+}
+
+func specialFileReason(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "special file (named pipe)"
+	case mode&fs.ModeSocket != 0:
+		return "special file (socket)"
+	case mode&fs.ModeDevice != 0, mode&fs.ModeCharDevice != 0:
+		return "special file (device)"
+	}
+	return "special file"
+}
+
+// Whether path is root or inside root, both with symlinks resolved.
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && !filepath.IsAbs(rel) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
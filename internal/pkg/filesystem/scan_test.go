@@ -0,0 +1,182 @@
+package filesystem_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/ignore"
+	"slices"
+	"testing"
+)
+
+// Repository dir with a file, a nested dir, links inside and outside of it
+func scanFixture(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "repo")
+	outside := filepath.Join(dir, "outside.txt")
+	for _, path := range []string{filepath.Join(root, "sub", "repo"), filepath.Join(root, "data")} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, content := range map[string]string{
+		filepath.Join(root, "a.txt"):                "a",
+		filepath.Join(root, "sub", "repo", "b.txt"): "b",
+		filepath.Join(root, "data", "c.txt"):        "c",
+		outside:                                     "outside",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(root, "link.txt"):         "a.txt",
+		filepath.Join(root, "sub", "data-link"): filepath.Join("..", "data"),
+		filepath.Join(root, "sub", "loop"):      "..",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+	return root, outside
+}
+
+func paths(files []filesystem.ScannedFile) []string {
+	result := []string{}
+	for _, file := range files {
+		result = append(result, file.Path)
+	}
+	return result
+}
+
+func TestScanDirSymlinks(t *testing.T) {
+	root, outside := scanFixture(t)
+
+	// follow: links are scanned through, loops are skipped
+	scan, err := filesystem.ScanDir(root, filesystem.ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "data/c.txt", "link.txt", "sub/data-link/c.txt", "sub/repo/b.txt"}; !slices.Equal(paths(scan.Files), want) {
+		t.Fatal(paths(scan.Files))
+	}
+	if len(scan.Skipped) != 1 || scan.Skipped[0].Path != "sub/loop" || scan.Skipped[0].Reason != "symlink loop" {
+		t.Fatal(scan.Skipped)
+	}
+
+	// skip: links are reported as skipped
+	scan, err = filesystem.ScanDir(root, filesystem.ScanOptions{Symlinks: filesystem.SymlinksSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "data/c.txt", "sub/repo/b.txt"}; !slices.Equal(paths(scan.Files), want) || len(scan.Skipped) != 3 {
+		t.Fatal(paths(scan.Files), scan.Skipped)
+	}
+
+	// record: links are kept with their target, relative to the link dir
+	scan, err = filesystem.ScanDir(root, filesystem.ScanOptions{Symlinks: filesystem.SymlinksRecord})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{}
+	for _, file := range scan.Files {
+		links[file.Path] = file.Symlink
+	}
+	if len(scan.Files) != 6 || links["link.txt"] != "a.txt" || links["sub/data-link"] != "../data" || links["sub/loop"] != ".." || links["a.txt"] != "" {
+		t.Fatal(links)
+	}
+
+	// error: the first link fails the scan
+	if _, err = filesystem.ScanDir(root, filesystem.ScanOptions{Symlinks: filesystem.SymlinksError}); !errors.Is(err, filesystem.ErrSymlink) {
+		t.Fatal(err)
+	}
+
+	// Ignored links are not subject to the policy
+	rules := ignore.New()
+	rules.Add("test", "link.txt")
+	rules.Add("test", "sub/")
+	if _, err = filesystem.ScanDir(root, filesystem.ScanOptions{Ignore: rules, Symlinks: filesystem.SymlinksError}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links escaping the root fail with every policy but skip
+	if err = os.Symlink(outside, filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []string{filesystem.SymlinksFollow, filesystem.SymlinksRecord} {
+		if _, err = filesystem.ScanDir(root, filesystem.ScanOptions{Symlinks: policy}); !errors.Is(err, filesystem.ErrSymlink) {
+			t.Fatal(policy, err)
+		}
+	}
+	if _, err = filesystem.ScanDir(root, filesystem.ScanOptions{Symlinks: filesystem.SymlinksSkip}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanDirSpecialFilesAndHardlinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a.txt"), filepath.Join(root, "c.txt")); err != nil {
+		t.Skip("hardlinks not supported:", err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(root, "d.sock"))
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	defer listener.Close()
+
+	scan, err := filesystem.ScanDir(root, filesystem.ScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "b.txt", "c.txt"}; !slices.Equal(paths(scan.Files), want) {
+		t.Fatal(paths(scan.Files))
+	}
+	if len(scan.Skipped) != 1 || scan.Skipped[0].Path != "d.sock" || scan.Skipped[0].Reason != "special file (socket)" {
+		t.Fatal(scan.Skipped)
+	}
+	if len(scan.Hardlinks) != 1 || !slices.Equal(scan.Hardlinks[0], []string{"a.txt", "c.txt"}) {
+		t.Fatal(scan.Hardlinks)
+	}
+}
+
+func TestScanPathsLikeScanDir(t *testing.T) {
+	root := t.TempDir()
+	files := []string{"a.txt", "a/b.txt", "build/out.bin", "build/sub/x.bin", "docs/keep.md", "docs/notes.md"}
+	for _, file := range files {
+		path := filepath.Join(root, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := ignore.New()
+	for _, pattern := range []string{"build/", "*.md", "!docs/keep.md"} {
+		if err := rules.Add("test", pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := filesystem.ScanOptions{Ignore: rules}
+
+	walked, err := filesystem.ScanDir(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := filesystem.ScanPaths(root, []string{"docs/notes.md", "build/sub/x.bin", "a.txt", "docs/keep.md", "a/b.txt", "build/out.bin"}, opts)
+	if !slices.Equal(paths(listed.Files), paths(walked.Files)) || !slices.Equal(listed.Skipped, walked.Skipped) {
+		t.Fatal(paths(listed.Files), listed.Skipped, paths(walked.Files), walked.Skipped)
+	}
+	if listed.Files[0].FullPath != walked.Files[0].FullPath {
+		t.Fatal(listed.Files[0], walked.Files[0])
+	}
+}
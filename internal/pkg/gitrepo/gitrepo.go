@@ -0,0 +1,181 @@
+package gitrepo
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Thin wrapper around the git CLI, scoped to a directory inside a work tree.
+type Repo struct {
+	Dir string
+}
+
+type Commit struct {
+	Hash     string
+	Author   string
+	Date     time.Time
+	Subject  string
+	Trailers []Trailer
+}
+
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+// Open the work tree containing dir, fails if dir is not inside a work tree.
+func Open(dir string) (*Repo, error) {
+	r := &Repo{Dir: dir}
+	out, err := r.git("rev-parse", "--is-inside-work-tree")
+	if err != nil || strings.TrimSpace(out) != "true" {
+		return nil, fmt.Errorf("%s is not inside a git work tree: %w", dir, err)
+	}
+	return r, nil
+}
+
+// Open the work tree containing dir, or initialize a new repository in dir.
+func OpenOrInit(dir string) (*Repo, error) {
+	if r, err := Open(dir); err == nil {
+		return r, nil
+	}
+	r := &Repo{Dir: dir}
+	if _, err := r.git("init", "--quiet"); err != nil {
+		return nil, fmt.Errorf("fail to init git repository in %s: %w", dir, err)
+	}
+	return r, nil
+}
+
+// Returns the porcelain status lines of the files under Dir, empty if clean.
+// Paths in excludes (relative to Dir) are ignored.
+func (r *Repo) Status(excludes ...string) ([]string, error) {
+	args := append([]string{"status", "--porcelain", "--untracked-files=all", "--"}, pathspec(excludes)...)
+	out, err := r.git(args...)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get git status: %w", err)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// Stage every change under Dir and commit it, returns the new commit hash.
+// Paths in excludes (relative to Dir) are never staged.
+func (r *Repo) CommitAll(message string, excludes ...string) (string, error) {
+	args := append([]string{"add", "--all", "--"}, pathspec(excludes)...)
+	if _, err := r.git(args...); err != nil {
+		return "", fmt.Errorf("fail to stage changes: %w", err)
+	}
+	if _, err := r.gitWithInput(message, "commit", "--quiet", "--file", "-", "--", "."); err != nil {
+		return "", fmt.Errorf("fail to commit changes: %w", err)
+	}
+	out, err := r.git("rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("fail to read commit hash: %w", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Returns the commits touching Dir, newest first, with their trailers.
+func (r *Repo) Log() ([]Commit, error) {
+	const (
+		fieldSep  = "\x1f"
+		recordSep = "\x1e"
+	)
+	format := strings.Join([]string{"%H", "%an", "%aI", "%s", "%(trailers:only,unfold)"}, fieldSep) + recordSep
+	out, err := r.git("log", "--format="+format, "--", ".")
+	if err != nil {
+		// No commit yet
+		if strings.Contains(err.Error(), "does not have any commits") {
+			return []Commit{}, nil
+		}
+		return nil, fmt.Errorf("fail to read git log: %w", err)
+	}
+
+	commits := []Commit{}
+	for _, record := range strings.Split(out, recordSep) {
+		record = strings.TrimLeft(record, "\n")
+		if record == "" {
+			continue
+		}
+		fields := strings.SplitN(record, fieldSep, 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected git log record: %q", record)
+		}
+		date, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("fail to parse commit date %s: %w", fields[2], err)
+		}
+		commit := Commit{Hash: fields[0], Author: fields[1], Date: date, Subject: fields[3]}
+		for _, line := range strings.Split(fields[4], "\n") {
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			commit.Trailers = append(commit.Trailers, Trailer{Key: strings.TrimSpace(key), Value: strings.TrimSpace(value)})
+		}
+		commits = append(commits, commit)
+	}
+	return commits, nil
+}
+
+// Whether the commit is reachable from any remote-tracking branch.
+func (r *Repo) IsPushed(hash string) (bool, error) {
+	out, err := r.git("branch", "--remotes", "--contains", hash)
+	if err != nil {
+		return false, fmt.Errorf("fail to look up commit %s in remote branches: %w", hash, err)
+	}
+	return strings.TrimSpace(out) != "", nil
+}
+
+// Returns the content of path (relative to Dir) at the given revision.
+func (r *Repo) Show(rev string, path string) ([]byte, error) {
+	out, err := r.git("show", rev+":./"+path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read %s at %s: %w", path, rev, err)
+	}
+	return []byte(out), nil
+}
+
+// Returns the values of all trailers with the given key.
+func (c *Commit) TrailerValues(key string) []string {
+	values := []string{}
+	for _, t := range c.Trailers {
+		if strings.EqualFold(t.Key, key) {
+			values = append(values, t.Value)
+		}
+	}
+	return values
+}
+
+// Pathspec matching everything under the current directory except excludes.
+func pathspec(excludes []string) []string {
+	spec := []string{"."}
+	for _, exclude := range excludes {
+		spec = append(spec, ":(exclude)"+exclude)
+	}
+	return spec
+}
+
+func (r *Repo) git(args ...string) (string, error) {
+	return r.gitWithInput("", args...)
+}
+
+func (r *Repo) gitWithInput(input string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.Dir
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
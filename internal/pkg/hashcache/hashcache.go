@@ -0,0 +1,178 @@
+package hashcache
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"see_updater/internal/pkg/filesystem"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+const (
+	// Default filename of the cache in the workspace dir
+	Filename = "hash-cache.json"
+	// Cache hits hashed longer ago are rehashed
+	DefaultReverifyAfter = 30 * 24 * time.Hour
+	// Share of the other cache hits rehashed on each run
+	DefaultSampleRate = 0.01
+
+	format = 1
+	// Files modified that shortly before being hashed may change again
+	// without changing their mtime (its granularity is coarse on some
+	// filesystems), they are not cached
+	racyWindow = 2 * time.Second
+)
+
+// Result of Lookup.
+type Status int
+
+const (
+	Miss   Status = iota // Unknown file or stat data changed, hash it
+	Hit                  // Use the cached hashes
+	Sample               // Stat data unchanged, but rehash it to check the cached hashes
+)
+
+// Hashes of files by absolute path, valid while their size, mtime and inode
+// (on unix) are unchanged. Safe for concurrent use.
+type Cache struct {
+	ReverifyAfter time.Duration
+	SampleRate    float64
+
+	path    string
+	mu      sync.Mutex
+	entries map[string]entry
+	seen    map[string]bool // Looked up in this run, the others are dropped by Save
+	rand    *rand.Rand
+}
+
+type entry struct {
+	Size     int64             `json:"size"`
+	ModTime  int64             `json:"mtime"` // Unix nanoseconds
+	Inode    uint64            `json:"inode,omitempty"`
+	Hashes   map[string]string `json:"hashes"` // Algorithm -> hex digest
+	Verified time.Time         `json:"verified"`
+}
+
+type cacheFile struct {
+	Format  int              `json:"format"`
+	Entries map[string]entry `json:"entries"`
+}
+
+// Load the cache file at path. A missing or unreadable cache is empty: the
+// files are hashed again, a run never fails because of its cache.
+func Load(path string) *Cache {
+	c := &Cache{
+		ReverifyAfter: DefaultReverifyAfter,
+		SampleRate:    DefaultSampleRate,
+		path:          path,
+		entries:       map[string]entry{},
+		seen:          map[string]bool{},
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("fail to read hash cache, files are hashed again", slog.String("path", path), slog.Any("error", err))
+		}
+		return c
+	}
+	content := cacheFile{}
+	if err = json.Unmarshal(bytes, &content); err != nil || content.Format != format {
+		slog.Warn("invalid hash cache, files are hashed again", slog.String("path", path), slog.Any("error", err))
+		return c
+	}
+	if content.Entries != nil {
+		c.entries = content.Entries
+	}
+	return c
+}
+
+// Cached hashes of the file at path with stat data info, if there are hashes
+// for every algorithm and the stat data is unchanged.
+func (c *Cache) Lookup(path string, info os.FileInfo, algorithms []string) (metadata.Hashes, Status) {
+	key := cacheKey(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[key] = true
+
+	e, ok := c.entries[key]
+	if !ok || e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() || e.Inode != inode(info) {
+		return nil, Miss
+	}
+	hashes := metadata.Hashes{}
+	for _, algorithm := range algorithms {
+		digest, err := hex.DecodeString(e.Hashes[algorithm])
+		if err != nil || len(digest) == 0 {
+			return nil, Miss
+		}
+		hashes[algorithm] = digest
+	}
+	if time.Since(e.Verified) > c.ReverifyAfter || c.rand.Float64() < c.SampleRate {
+		return hashes, Sample
+	}
+	return hashes, Hit
+}
+
+// Record the hashes of the file at path, computed at hashedAt from a file
+// with stat data info (taken before hashing).
+func (c *Cache) Store(path string, info os.FileInfo, hashes metadata.Hashes, hashedAt time.Time) {
+	key := cacheKey(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[key] = true
+
+	if info.ModTime().After(hashedAt.Add(-racyWindow)) {
+		delete(c.entries, key)
+		return
+	}
+	e := entry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Inode: inode(info), Hashes: map[string]string{}, Verified: hashedAt.UTC()}
+	for algorithm, digest := range hashes {
+		e.Hashes[algorithm] = digest.String()
+	}
+	c.entries[key] = e
+}
+
+// Write the cache file, without the files not looked up since Load.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	content := cacheFile{Format: format, Entries: map[string]entry{}}
+	for key, e := range c.entries {
+		if c.seen[key] {
+			content.Entries[key] = e
+		}
+	}
+	bytes, err := json.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("fail to marshal hash cache: %w", err)
+	}
+	if err = filesystem.MakeNewDirAll(filepath.Dir(c.path)); err != nil {
+		return fmt.Errorf("fail to write hash cache: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err = filesystem.WriteBytesToFile(tmp, bytes); err != nil {
+		return fmt.Errorf("fail to write hash cache: %w", err)
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("fail to write hash cache: %w", err)
+	}
+	return nil
+}
+
+func cacheKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,122 @@
+package hashcache_test
+
+import (
+	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/hashcache"
+	"testing"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+var sha256 = []string{"sha256"}
+
+func writeOldFile(t *testing.T, path string, content string) os.FileInfo {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestLookupAndStore(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	info := writeOldFile(t, file, "a")
+	hashes := metadata.Hashes{"sha256": []byte{1, 2, 3}}
+
+	cache := hashcache.Load(filepath.Join(dir, "cache.json"))
+	cache.SampleRate = 0
+	if _, status := cache.Lookup(file, info, sha256); status != hashcache.Miss {
+		t.Fatal("empty cache hit", status)
+	}
+	cache.Store(file, info, hashes, time.Now())
+	if cached, status := cache.Lookup(file, info, sha256); status != hashcache.Hit || cached["sha256"].String() != "010203" {
+		t.Fatal(cached, status)
+	}
+	// Another algorithm is not cached
+	if _, status := cache.Lookup(file, info, []string{"sha256", "sha512"}); status != hashcache.Miss {
+		t.Fatal("missing algorithm hit", status)
+	}
+	// Changed stat data
+	changed := writeOldFile(t, file, "ab")
+	if _, status := cache.Lookup(file, changed, sha256); status != hashcache.Miss {
+		t.Fatal("changed file hit", status)
+	}
+
+	// Every hit sampled, or hashed too long ago
+	cache.Store(file, changed, hashes, time.Now())
+	cache.SampleRate = 1
+	if cached, status := cache.Lookup(file, changed, sha256); status != hashcache.Sample || cached == nil {
+		t.Fatal(cached, status)
+	}
+	cache.SampleRate = 0
+	cache.ReverifyAfter = 0
+	if _, status := cache.Lookup(file, changed, sha256); status != hashcache.Sample {
+		t.Fatal("old hash not sampled", status)
+	}
+}
+
+func TestStoreRacyFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Modified right before being hashed: may change again with the same mtime
+	cache := hashcache.Load(filepath.Join(dir, "cache.json"))
+	cache.Store(file, info, metadata.Hashes{"sha256": []byte{1}}, time.Now())
+	if _, status := cache.Lookup(file, info, sha256); status != hashcache.Miss {
+		t.Fatal("racy file cached", status)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "cache.json")
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	infoA, infoB := writeOldFile(t, a, "a"), writeOldFile(t, b, "b")
+
+	cache := hashcache.Load(path)
+	cache.Store(a, infoA, metadata.Hashes{"sha256": []byte{1}}, time.Now())
+	cache.Store(b, infoB, metadata.Hashes{"sha256": []byte{2}}, time.Now())
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries not looked up are dropped on save
+	cache = hashcache.Load(path)
+	cache.SampleRate = 0
+	if cached, status := cache.Lookup(a, infoA, sha256); status != hashcache.Hit || cached["sha256"].String() != "01" {
+		t.Fatal(cached, status)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	cache = hashcache.Load(path)
+	if _, status := cache.Lookup(b, infoB, sha256); status != hashcache.Miss {
+		t.Fatal("pruned entry hit", status)
+	}
+
+	// A corrupt cache is empty
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache = hashcache.Load(path)
+	if _, status := cache.Lookup(a, infoA, sha256); status != hashcache.Miss {
+		t.Fatal("corrupt cache hit", status)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package hashcache
+
+import "os"
+
+// No inode outside of unix, entries are keyed by path, size and mtime only.
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,133 @@
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// Gitignore-style rules. A pattern without a slash matches a name at any
+// depth, a pattern with a slash is relative to the root, a trailing slash
+// matches directories only, `*`, `?` and `[...]` match within a name, `**`
+// matches any number of directories and `!` re-includes what an earlier
+// pattern excluded. The last matching rule wins.
+type Rules struct {
+	rules []rule
+}
+
+type rule struct {
+	source   string // e.g. ".tufignore:3"
+	pattern  string
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+func New() *Rules {
+	return &Rules{}
+}
+
+// Add one pattern, blank lines and comments (#) are ignored. source describes
+// where the pattern comes from in Match results.
+func (r *Rules) Add(source string, pattern string) error {
+	line := strings.TrimRight(pattern, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	rl := rule{source: source, pattern: line}
+	if strings.HasPrefix(line, "!") {
+		rl.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rl.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return fmt.Errorf("invalid pattern %q (%s)", pattern, source)
+	}
+	// Without a slash (other than a trailing one) the pattern matches at any depth
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	rl.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	for _, segment := range rl.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q (%s): %w", pattern, source, err)
+		}
+	}
+	r.rules = append(r.rules, rl)
+	return nil
+}
+
+// Add the patterns of a file, one per line. A missing file adds nothing.
+func (r *Rules) AddFile(filepath string, name string) error {
+	file, err := os.Open(filepath)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("fail to open ignore file %s: %w", filepath, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for i := 1; scanner.Scan(); i++ {
+		if err = r.Add(fmt.Sprintf("%s:%d", name, i), scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("fail to read ignore file %s: %w", filepath, err)
+	}
+	return nil
+}
+
+// Whether relPath ('/'-separated, relative to the root) is ignored, and the
+// rule deciding it, e.g. `.tufignore:3: *.swp`. Empty if no rule matches.
+func (r *Rules) Match(relPath string, isDir bool) (bool, string) {
+	if r == nil {
+		return false, ""
+	}
+	names := strings.Split(strings.Trim(relPath, "/"), "/")
+	for i := len(r.rules) - 1; i >= 0; i-- {
+		rl := r.rules[i]
+		if rl.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(rl.segments, names) {
+			return !rl.negate, rl.source + ": " + rl.pattern
+		}
+	}
+	return false, ""
+}
+
+func matchSegments(segments []string, names []string) bool {
+	if len(segments) == 0 {
+		return len(names) == 0
+	}
+	if segments[0] == "**" {
+		// A trailing ** matches everything inside, not the directory itself
+		if len(segments) == 1 {
+			return len(names) > 0
+		}
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(segments[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(segments[0], names[0]); !ok {
+		return false
+	}
+	return matchSegments(segments[1:], names[1:])
+}
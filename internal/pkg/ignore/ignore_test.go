@@ -0,0 +1,81 @@
+package ignore_test
+
+import (
+	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/ignore"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	rules := ignore.New()
+	for _, pattern := range []string{
+		"# editor files",
+		"*.swp",
+		".DS_Store",
+		"build/",
+		"/docs/*.md",
+		"!docs/keep.md",
+		"assets/**/raw",
+		"logs/**",
+		`\#literal`,
+	} {
+		if err := rules.Add("test", pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.txt", false, false},
+		{".a.txt.swp", false, true},
+		{"sub/dir/.a.txt.swp", false, true},
+		{"sub/.DS_Store", false, true},
+		{"build", true, true},
+		{"sub/build", true, true},
+		{"build", false, false}, // directories only
+		{"docs/readme.md", false, true},
+		{"sub/docs/readme.md", false, false}, // anchored
+		{"docs/keep.md", false, false},       // re-included
+		{"docs/sub/readme.md", false, false}, // * does not cross directories
+		{"assets/raw", true, true},
+		{"assets/a/b/raw", false, true},
+		{"logs", true, false},
+		{"logs/a/b.log", false, true},
+		{"#literal", false, true},
+	}
+	for _, c := range cases {
+		if ignored, _ := rules.Match(c.path, c.isDir); ignored != c.ignored {
+			t.Error(c.path, c.isDir, ignored)
+		}
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".tufignore")
+	if err := os.WriteFile(path, []byte("# comment\n\n*.tmp\n!keep.tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules := ignore.New()
+	if err := rules.AddFile(path, ".tufignore"); err != nil {
+		t.Fatal(err)
+	}
+	if ignored, rule := rules.Match("a/b.tmp", false); !ignored || rule != ".tufignore:3: *.tmp" {
+		t.Fatal(ignored, rule)
+	}
+	if ignored, rule := rules.Match("keep.tmp", false); ignored || rule != ".tufignore:4: !keep.tmp" {
+		t.Fatal(ignored, rule)
+	}
+
+	// A missing file adds nothing, an invalid pattern fails
+	if err := rules.AddFile(filepath.Join(dir, "missing"), "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.Add("test", "[a"); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package journal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"see_updater/internal/pkg/filesystem"
+)
+
+// Files and directories used by the journal inside the committed directory.
+const (
+	JournalFilename = ".updater-journal"
+	StagingDirname  = ".updater-staging"
+)
+
+// Outcome of Recover.
+const (
+	RecoverNone          = "none"
+	RecoverRolledForward = "rolled-forward"
+	RecoverRolledBack    = "rolled-back"
+)
+
+// One file of a transaction, paths are relative to the committed directory.
+type Entry struct {
+	Staged string `json:"staged"`
+	Target string `json:"target"`
+	SHA256 string `json:"sha256"`
+}
+
+type record struct {
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"`
+	CreatedAt time.Time `json:"created_at"`
+	Entries   []Entry   `json:"entries"`
+}
+
+// Txn writes several files into a directory so that either all or none of them
+// end up in place, even across a crash:
+//  1. every file is written to a staging directory and fsynced,
+//  2. the journal listing the files is written and fsynced (commit point),
+//  3. the staged files are renamed into place,
+//  4. the journal and the staging directory are removed.
+//
+// An interrupted transaction is rolled back by Recover before the commit point
+// and rolled forward after it.
+type Txn struct {
+	Dir       string
+	Operation string
+	id        string
+	entries   []Entry
+}
+
+type Result struct {
+	Action string
+	Files  []string
+}
+
+// Start a transaction in dir, fails if an interrupted one needs recovery.
+func Begin(dir string, operation string) (*Txn, error) {
+	if _, err := os.Stat(filepath.Join(dir, JournalFilename)); err == nil {
+		return nil, fmt.Errorf("an interrupted operation was found in %s, recover it first", dir)
+	}
+	t := &Txn{Dir: dir, Operation: operation, id: strconv.FormatInt(time.Now().UnixNano(), 36)}
+	if err := filesystem.MakeNewDirAll(filepath.Join(dir, StagingDirname, t.id)); err != nil {
+		return nil, fmt.Errorf("fail to make staging dir: %w", err)
+	}
+	return t, nil
+}
+
+// Write target (a filename in Dir) by calling write with a staging path.
+func (t *Txn) Stage(target string, write func(path string) error) error {
+	staged := filepath.Join(StagingDirname, t.id, strconv.Itoa(len(t.entries)))
+	path := filepath.Join(t.Dir, staged)
+	if err := write(path); err != nil {
+		return fmt.Errorf("fail to stage %s: %w", target, err)
+	}
+	if err := filesystem.SyncFile(path); err != nil {
+		return fmt.Errorf("fail to sync staged %s: %w", target, err)
+	}
+	sum, err := sumFile(path)
+	if err != nil {
+		return err
+	}
+	t.entries = append(t.entries, Entry{Staged: filepath.ToSlash(staged), Target: target, SHA256: sum})
+	return nil
+}
+
+// Move every staged file into place, returns the committed targets.
+func (t *Txn) Commit() ([]string, error) {
+	if len(t.entries) == 0 {
+		return nil, t.Abort()
+	}
+	if err := filesystem.SyncDir(filepath.Join(t.Dir, StagingDirname, t.id)); err != nil {
+		return nil, fmt.Errorf("fail to sync staging dir: %w", err)
+	}
+
+	content, err := json.MarshalIndent(record{ID: t.id, Operation: t.Operation, CreatedAt: time.Now().UTC(), Entries: t.entries}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("fail to marshal journal: %w", err)
+	}
+	tmp := filepath.Join(t.Dir, JournalFilename+".tmp")
+	if err = filesystem.WriteBytesToFile(tmp, content); err != nil {
+		return nil, fmt.Errorf("fail to write journal: %w", err)
+	}
+	if err = filesystem.SyncFile(tmp); err != nil {
+		return nil, fmt.Errorf("fail to sync journal: %w", err)
+	}
+	if err = os.Rename(tmp, filepath.Join(t.Dir, JournalFilename)); err != nil {
+		return nil, fmt.Errorf("fail to write journal: %w", err)
+	}
+	if err = filesystem.SyncDir(t.Dir); err != nil {
+		return nil, fmt.Errorf("fail to sync dir %s: %w", t.Dir, err)
+	}
+
+	// Committed, from here on an error is repaired by Recover
+	result, err := rollForward(t.Dir, record{ID: t.id, Entries: t.entries})
+	if err != nil {
+		return nil, fmt.Errorf("operation committed but not completed, run recover: %w", err)
+	}
+	return result.Files, nil
+}
+
+// Discard the staged files, nothing has been moved into place yet.
+func (t *Txn) Abort() error {
+	if err := os.RemoveAll(filepath.Join(t.Dir, StagingDirname, t.id)); err != nil {
+		return fmt.Errorf("fail to remove staging dir: %w", err)
+	}
+	removeIfEmpty(filepath.Join(t.Dir, StagingDirname))
+	return nil
+}
+
+// Complete or discard a transaction interrupted in dir. The transaction is
+// rolled forward if its journal was written, otherwise it is rolled back.
+func Recover(dir string) (Result, error) {
+	content, err := os.ReadFile(filepath.Join(dir, JournalFilename))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Result{}, fmt.Errorf("fail to read journal: %w", err)
+	}
+	if err == nil {
+		r := record{}
+		if err = json.Unmarshal(content, &r); err != nil {
+			return Result{}, fmt.Errorf("fail to parse journal %s: %w", filepath.Join(dir, JournalFilename), err)
+		}
+		return rollForward(dir, r)
+	}
+
+	// Interrupted before the commit point
+	os.Remove(filepath.Join(dir, JournalFilename+".tmp"))
+	staging := filepath.Join(dir, StagingDirname)
+	entries, err := os.ReadDir(staging)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return Result{Action: RecoverNone}, nil
+	} else if err != nil {
+		return Result{}, fmt.Errorf("fail to read staging dir: %w", err)
+	}
+	if err = os.RemoveAll(staging); err != nil {
+		return Result{}, fmt.Errorf("fail to remove staging dir: %w", err)
+	}
+	if len(entries) == 0 {
+		return Result{Action: RecoverNone}, nil
+	}
+	return Result{Action: RecoverRolledBack}, nil
+}
+
+func rollForward(dir string, r record) (Result, error) {
+	result := Result{Action: RecoverRolledForward}
+	for _, entry := range r.Entries {
+		staged := filepath.Join(dir, filepath.FromSlash(entry.Staged))
+		target := filepath.Join(dir, entry.Target)
+		if _, err := os.Stat(staged); err == nil {
+			if err = os.Rename(staged, target); err != nil {
+				return result, fmt.Errorf("fail to move %s into place: %w", entry.Target, err)
+			}
+		} else if sum, err := sumFile(target); err != nil || sum != entry.SHA256 {
+			return result, fmt.Errorf("staged file of %s is missing and the target does not match the journal", entry.Target)
+		}
+		result.Files = append(result.Files, entry.Target)
+	}
+	if err := filesystem.SyncDir(dir); err != nil {
+		return result, fmt.Errorf("fail to sync dir %s: %w", dir, err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, JournalFilename)); err != nil {
+		return result, fmt.Errorf("fail to remove journal: %w", err)
+	}
+	os.RemoveAll(filepath.Join(dir, StagingDirname, r.ID))
+	removeIfEmpty(filepath.Join(dir, StagingDirname))
+	return result, nil
+}
+
+func sumFile(path string) (string, error) {
+	content, err := filesystem.ReadBytesFromFile(path)
+	if err != nil {
+		return "", fmt.Errorf("fail to read %s: %w", path, err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func removeIfEmpty(dir string) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+		os.Remove(dir)
+	}
+}
@@ -0,0 +1,136 @@
+package journal_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/journal"
+	"testing"
+)
+
+func write(content string) func(path string) error {
+	return func(path string) error {
+		return os.WriteFile(path, []byte(content), 0644)
+	}
+}
+
+func assertContent(t *testing.T, path string, want string) {
+	t.Helper()
+	have, err := os.ReadFile(path)
+	if err != nil || string(have) != want {
+		t.Fatal(path, string(have), err)
+	}
+}
+
+func assertClean(t *testing.T, dir string) {
+	t.Helper()
+	for _, name := range []string{journal.JournalFilename, journal.StagingDirname} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Fatal(name, "left behind")
+		}
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "timestamp.json"), []byte("old"), 0644)
+
+	txn, err := journal.Begin(dir, "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Stage("2.targets.json", write("targets"))
+	txn.Stage("timestamp.json", write("new"))
+	// Nothing in place before commit
+	if _, err = os.Stat(filepath.Join(dir, "2.targets.json")); err == nil {
+		t.Fatal("file moved into place before commit")
+	}
+	assertContent(t, filepath.Join(dir, "timestamp.json"), "old")
+
+	files, err := txn.Commit()
+	if err != nil || len(files) != 2 {
+		t.Fatal(files, err)
+	}
+	assertContent(t, filepath.Join(dir, "2.targets.json"), "targets")
+	assertContent(t, filepath.Join(dir, "timestamp.json"), "new")
+	assertClean(t, dir)
+}
+
+func TestAbort(t *testing.T) {
+	dir := t.TempDir()
+	txn, err := journal.Begin(dir, "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Stage("2.targets.json", write("targets"))
+	err = txn.Stage("2.snapshot.json", func(path string) error { return errors.New("disk full") })
+	if err == nil {
+		t.Fatal("stage should fail")
+	}
+	txn.Abort()
+	if _, err = os.Stat(filepath.Join(dir, "2.targets.json")); err == nil {
+		t.Fatal("aborted file moved into place")
+	}
+	assertClean(t, dir)
+}
+
+func TestRecoverRollBack(t *testing.T) {
+	dir := t.TempDir()
+	// Crash before the journal is written
+	txn, err := journal.Begin(dir, "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Stage("2.targets.json", write("targets"))
+
+	result, err := journal.Recover(dir)
+	if err != nil || result.Action != journal.RecoverRolledBack {
+		t.Fatal(result, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "2.targets.json")); err == nil {
+		t.Fatal("file moved into place on roll back")
+	}
+	assertClean(t, dir)
+
+	result, err = journal.Recover(dir)
+	if err != nil || result.Action != journal.RecoverNone {
+		t.Fatal(result, err)
+	}
+}
+
+func TestRecoverRollForward(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "timestamp.json"), []byte("old"), 0644)
+
+	// Crash after the journal is written and the first file is moved into place
+	staging := filepath.Join(dir, journal.StagingDirname, "tx")
+	os.MkdirAll(staging, 0700)
+	os.WriteFile(filepath.Join(dir, "2.targets.json"), []byte("targets"), 0644)
+	os.WriteFile(filepath.Join(staging, "1"), []byte("new"), 0644)
+	journalContent := fmt.Sprintf(`{"id":"tx","operation":"update","entries":[
+		{"staged":"%[1]s/tx/0","target":"2.targets.json","sha256":"%[2]s"},
+		{"staged":"%[1]s/tx/1","target":"timestamp.json","sha256":"%[3]s"}]}`,
+		journal.StagingDirname, sum("targets"), sum("new"))
+	os.WriteFile(filepath.Join(dir, journal.JournalFilename), []byte(journalContent), 0644)
+
+	// Interrupted operation blocks new ones
+	if _, err := journal.Begin(dir, "sign"); err == nil {
+		t.Fatal("begin should fail with a pending journal")
+	}
+
+	result, err := journal.Recover(dir)
+	if err != nil || result.Action != journal.RecoverRolledForward || len(result.Files) != 2 {
+		t.Fatal(result, err)
+	}
+	assertContent(t, filepath.Join(dir, "2.targets.json"), "targets")
+	assertContent(t, filepath.Join(dir, "timestamp.json"), "new")
+	assertClean(t, dir)
+}
+
+func sum(content string) string {
+	s := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(s[:])
+}
@@ -0,0 +1,261 @@
+package metahelper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/hashcache"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Interval of the progress reports of hashFiles.
+const progressInterval = time.Second
+
+// Hash algorithm of targets when none is given, like go-tuf.
+const DefaultHashAlgorithm = "sha256"
+
+// Hash algorithms supported for targets, see newHasher.
+var HashAlgorithms = []string{"sha256", "sha512"}
+
+// Target file info of the file at path, hashed while streaming it: memory use
+// does not depend on the file size. DefaultHashAlgorithm if no algorithm is
+// given.
+func HashFile(path string, algorithms ...string) (*metadata.TargetFiles, error) {
+	return hashFile(path, nil, algorithms...)
+}
+
+func hashFile(path string, counter *atomic.Int64, algorithms ...string) (*metadata.TargetFiles, error) {
+	return hashOpened(path, func() (io.ReadCloser, error) { return os.Open(path) }, counter, algorithms...)
+}
+
+// Target file info of the content given by open, streamed into the hashers.
+// path names the content in errors and in the target file info.
+func hashOpened(path string, open func() (io.ReadCloser, error), counter *atomic.Int64, algorithms ...string) (*metadata.TargetFiles, error) {
+	if len(algorithms) == 0 {
+		algorithms = []string{DefaultHashAlgorithm}
+	}
+	hashers := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for _, algorithm := range algorithms {
+		hasher, err := newHasher(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashers[algorithm] = hasher
+		writers = append(writers, hasher)
+	}
+	if counter != nil {
+		writers = append(writers, countingWriter{counter})
+	}
+
+	content, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	length, err := io.Copy(io.MultiWriter(writers...), content)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file %s: %w", path, err)
+	}
+
+	target := metadata.TargetFile()
+	target.Path = path
+	target.Length = length
+	for algorithm, hasher := range hashers {
+		target.Hashes[algorithm] = hasher.Sum(nil)
+	}
+	return target, nil
+}
+
+// hashFile through cache: a file whose stat data is unchanged gets its cached
+// hashes without being read, unless paranoid or sampled for re-verification.
+// A sampled file whose content changed behind unchanged stat data is logged
+// and gets its new hashes, so it shows as modified.
+func cachedHashFile(path string, counter *atomic.Int64, cache *hashcache.Cache, paranoid bool, algorithms ...string) (*metadata.TargetFiles, error) {
+	if cache == nil {
+		return hashFile(path, counter, algorithms...)
+	}
+	if len(algorithms) == 0 {
+		algorithms = []string{DefaultHashAlgorithm}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	cached, status := cache.Lookup(path, info, algorithms)
+	if status == hashcache.Hit && !paranoid {
+		slog.Debug("hash cache hit", slog.String("filepath", path))
+		target := metadata.TargetFile()
+		target.Path = path
+		target.Length = info.Size()
+		target.Hashes = cached
+		return target, nil
+	}
+
+	hashedAt := time.Now()
+	target, err := hashFile(path, counter, algorithms...)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		for algorithm, digest := range cached {
+			if !bytes.Equal(digest, target.Hashes[algorithm]) {
+				slog.Warn("file content changed without changing its size or mtime, the hash cache was stale",
+					slog.String("filepath", path), slog.String("algorithm", algorithm))
+				break
+			}
+		}
+	}
+	cache.Store(path, info, target.Hashes, hashedAt)
+	return target, nil
+}
+
+// Same algorithms as go-tuf's TargetFiles.FromBytes.
+// Size in bytes of the digests of algorithm, one of HashAlgorithms.
+func HashSize(algorithm string) (int, error) {
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	return hasher.Size(), nil
+}
+
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("hash algorithm not supported: %s", algorithm)
+}
+
+type countingWriter struct {
+	count *atomic.Int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	w.count.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Target file infos of files by hashOne, in the order of files, computed by
+// up to jobs workers (runtime.NumCPU() if < 1). Reports the progress to
+// progress if not nil. Stops at the first error.
+func hashFiles(files []filesystem.ScannedFile, jobs int, progress io.Writer,
+	hashOne func(file filesystem.ScannedFile, counter *atomic.Int64) (*metadata.TargetFiles, error)) ([]*metadata.TargetFiles, error) {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	jobs = min(jobs, len(files))
+
+	report := newHashProgress(progress, len(files))
+	defer report.stop()
+
+	results := make([]*metadata.TargetFiles, len(files))
+	errs := make([]error, len(files))
+	var next atomic.Int64
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				i := int(next.Add(1) - 1)
+				if i >= len(files) {
+					return
+				}
+				results[i], errs[i] = hashOne(files[i], &report.bytes)
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+				report.files.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Periodic report of the files and bytes hashed, e.g.
+// "Hashing targets: 120/4000 files, 1.2 GB (310.5 MB/s)". A summary is
+// printed at the end if any report was, short runs print nothing.
+type hashProgress struct {
+	w        io.Writer
+	total    int
+	start    time.Time
+	files    atomic.Int64
+	bytes    atomic.Int64
+	done     chan struct{}
+	finished sync.WaitGroup
+}
+
+func newHashProgress(w io.Writer, total int) *hashProgress {
+	p := &hashProgress{w: w, total: total, start: time.Now(), done: make(chan struct{})}
+	if w == nil {
+		return p
+	}
+	p.finished.Add(1)
+	go func() {
+		defer p.finished.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		reported := false
+		for {
+			select {
+			case <-ticker.C:
+				p.print("Hashing targets")
+				reported = true
+			case <-p.done:
+				if reported {
+					p.print("Hashed targets")
+				}
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *hashProgress) print(label string) {
+	elapsed := time.Since(p.start).Seconds()
+	bytes := p.bytes.Load()
+	fmt.Fprintf(p.w, "%s: %d/%d files, %s (%s/s)\n", label, p.files.Load(), p.total,
+		formatBytes(float64(bytes)), formatBytes(float64(bytes)/elapsed))
+}
+
+func (p *hashProgress) stop() {
+	close(p.done)
+	p.finished.Wait()
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for ; n >= 1000 && i < len(units)-1; i++ {
+		n /= 1000
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
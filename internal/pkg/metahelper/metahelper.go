@@ -1,132 +1,360 @@
 package metahelper
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"see_updater/internal/pkg/custom"
 	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/hashcache"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/theupdateframework/go-tuf/v2/metadata"
 )
 
 // Ascending order, last elem is the latest version of metadata file path.
-// Note: this function will panic if there is no version prefix
-// i.e. `1.` in `1.role.json`.
+// Only files directly inside the directory and named `<version>.<role>.json`
+// or `<role>.json` are considered, other files and subdirectories (e.g. `.git`)
+// are ignored.
 func GetRoleMetadataFilepathsFromDir(path string, roleName string) ([]string, error) {
-	localFilepaths, fullFilepaths, err := filesystem.GetAllFilepathsInDir(path)
+	entries, err := os.ReadDir(path)
 	if err != nil {
-		return nil, err
-	} else if len(fullFilepaths) == 0 {
-		return nil, fmt.Errorf("no file is found in directory")
+		return nil, fmt.Errorf("fail to read dir %s: %w", path, err)
 	}
 
-	targetFilepaths := []string{}
-	for i, fullFilepath := range fullFilepaths {
-		if strings.Contains(localFilepaths[i], roleName) {
-			targetFilepaths = append(targetFilepaths, fullFilepath)
+	type versionedFilepath struct {
+		version  int
+		filepath string
+	}
+	pattern := regexp.MustCompile(`^(?:(\d+)\.)?` + regexp.QuoteMeta(roleName) + `\.json$`)
+	found := []versionedFilepath{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := pattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
 		}
+		version := 0 // Unversioned file e.g. timestamp.json
+		if match[1] != "" {
+			version, err = strconv.Atoi(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("fail to parse version prefix number: %w", err)
+			}
+		}
+		found = append(found, versionedFilepath{version, filepath.Join(path, entry.Name())})
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no metadata file is found in directory %s for role: %s", path, roleName)
 	}
-	sort.Slice(targetFilepaths, func(i, j int) bool {
-		iList := strings.Split(targetFilepaths[i], string(os.PathSeparator))
-		jList := strings.Split(targetFilepaths[j], string(os.PathSeparator))
 
-		iLastPath := iList[len(iList)-1]
-		jLastPath := jList[len(jList)-1]
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].version < found[j].version
+	})
+	targetFilepaths := make([]string, len(found))
+	for i, f := range found {
+		targetFilepaths[i] = f.filepath
+	}
+	return targetFilepaths, nil
+}
 
-		iVer, err := strconv.Atoi(strings.Split(iLastPath, ".")[0])
-		if err != nil {
-			panic(fmt.Errorf("fail to parse version prefix number: %w", err))
+// How GenerateNewTargetsFromDir makes targets from the files of a dir.
+type TargetsOptions struct {
+	Prefix   string                 // See TargetPath
+	Scan     filesystem.ScanOptions // Files kept
+	Jobs     int                    // Files hashed in parallel, runtime.NumCPU() if < 1
+	Progress io.Writer              // Hashing progress reports, none if nil
+	Cache    *hashcache.Cache       // Hashes reused for files with unchanged stat data, none if nil
+	Paranoid bool                   // Hash every file, the cache is only updated
+	// Content of a scanned file, instead of reading its FullPath (e.g. the
+	// object of a remote dir). The cache is not used.
+	Open func(file filesystem.ScannedFile) (io.ReadCloser, error)
+	// Hashes of every target, DefaultHashAlgorithm if empty
+	HashAlgorithms []string
+}
+
+// Targets metadata of the files of dirPath kept by opts.Scan. Targets are
+// named by TargetPath with opts.Prefix, recorded symlinks are hashed from
+// their link target and carry it in `custom.symlink`. Also returns the scan
+// result. Files found in opts.Cache are not read, see cachedHashFile.
+func GenerateNewTargetsFromDir(dirPath string, expireIn time.Time, opts TargetsOptions) (*metadata.Metadata[metadata.TargetsType], filesystem.ScanResult, error) {
+	scan, err := filesystem.ScanDir(dirPath, opts.Scan)
+	if err != nil {
+		return nil, scan, err
+	}
+	targets, err := GenerateNewTargets(scan, expireIn, opts)
+	return targets, scan, err
+}
+
+// Targets metadata of the files of scan, like GenerateNewTargetsFromDir,
+// opts.Scan is not used.
+func GenerateNewTargets(scan filesystem.ScanResult, expireIn time.Time, opts TargetsOptions) (*metadata.Metadata[metadata.TargetsType], error) {
+	infos, err := hashFiles(scan.Files, opts.Jobs, opts.Progress, func(file filesystem.ScannedFile, counter *atomic.Int64) (*metadata.TargetFiles, error) {
+		slog.Debug("generating target file info for file", slog.String("filepath", file.FullPath))
+		if file.Symlink != "" {
+			return symlinkTargetFile(file.Path, file.Symlink, opts.HashAlgorithms...)
+		}
+		var targetFileInfo *metadata.TargetFiles
+		var err error
+		if opts.Open != nil {
+			targetFileInfo, err = hashOpened(file.FullPath, func() (io.ReadCloser, error) { return opts.Open(file) }, counter, opts.HashAlgorithms...)
+		} else {
+			targetFileInfo, err = cachedHashFile(file.FullPath, counter, opts.Cache, opts.Paranoid, opts.HashAlgorithms...)
 		}
-		jVer, err := strconv.Atoi(strings.Split(jLastPath, ".")[0])
 		if err != nil {
-			panic(fmt.Errorf("fail to parse version prefix number: %w", err))
+			return nil, (fmt.Errorf("fail to generate target file info for file: %s\n\terror: %w", file.FullPath, err))
 		}
-		return iVer < jVer
+		return targetFileInfo, nil
 	})
-	return targetFilepaths, nil
+	if err != nil {
+		return nil, err
+	}
+	targets := metadata.Targets(expireIn)
+	for i, file := range scan.Files {
+		name := TargetPath(opts.Prefix, file.Path)
+		infos[i].Path = name
+		targets.Signed.Targets[name] = infos[i]
+	}
+	return targets, nil
 }
 
-func GenerateNewTargetsFromDir(dirPath string, expireIn time.Time) (*metadata.Metadata[metadata.TargetsType], error) {
-	targetLocalFilepaths, targetFullFilepaths, err := filesystem.GetAllFilepathsInDir(dirPath)
+// Target file info of a recorded symlink: the hashes and length of the link
+// target string, which is kept in `custom.symlink`.
+func symlinkTargetFile(name string, link string, algorithms ...string) (*metadata.TargetFiles, error) {
+	target, err := metadata.TargetFile().FromBytes(name, []byte(link), algorithms...)
 	if err != nil {
 		return nil, err
 	}
-	targets := metadata.Targets(expireIn)
-	for i, targetFullFilepath := range targetFullFilepaths {
-		slog.Debug("generating target file info for file", slog.String("filepath", targetLocalFilepaths[i]))
-		targetFileInfo, err := metadata.TargetFile().FromFile(targetFullFilepath)
-		if err != nil {
-			return nil, (fmt.Errorf("fail to generate target file info for file: %s\n\terror: %w", targetFullFilepath, err))
+	custom, err := json.Marshal(map[string]string{"symlink": link})
+	if err != nil {
+		return nil, err
+	}
+	target.Custom = (*json.RawMessage)(&custom)
+	return target, nil
+}
+
+// Target path of a file at relPath ('/'-separated, relative to the scanned
+// dir): prefix/relPath, or relPath alone if prefix is empty.
+func TargetPath(prefix string, relPath string) string {
+	if prefix == "" {
+		return relPath
+	}
+	return path.Join(prefix, relPath)
+}
+
+// Copy of targets with every entry renamed to TargetPath(prefix, relPath) for
+// the relPath it was made from, target file infos are kept as is (no
+// rehashing). Old names are '/' or '\'-separated and end with relPath, the
+// longest relPath wins. Entries without a match in relPaths, or whose new
+// name is taken, keep their name and are returned.
+func MigrateTargetPaths(targets *metadata.Metadata[metadata.TargetsType], prefix string, relPaths []string) (*metadata.Metadata[metadata.TargetsType], []string, error) {
+	bytes, err := targets.ToBytes(false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to copy targets metadata: %w", err)
+	}
+	migrated, err := metadata.Targets().FromBytes(bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to copy targets metadata: %w", err)
+	}
+
+	// Longest first, so that the first match is the longest
+	candidates := append([]string{}, relPaths...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i]) > len(candidates[j])
+	})
+	renamed := map[string]*metadata.TargetFiles{}
+	unmatched := []string{}
+	for _, oldPath := range sortedTargetPaths(migrated.Signed.Targets) {
+		target := migrated.Signed.Targets[oldPath]
+		normalized := strings.ReplaceAll(oldPath, "\\", "/")
+		newPath := ""
+		for _, relPath := range candidates {
+			if normalized == relPath || strings.HasSuffix(normalized, "/"+relPath) {
+				newPath = TargetPath(prefix, relPath)
+				break
+			}
+		}
+		if newPath == "" || renamed[newPath] != nil {
+			unmatched = append(unmatched, oldPath)
+			newPath = oldPath
 		}
-		targetFileInfo.Path = targetLocalFilepaths[i]
-		targets.Signed.Targets[targetLocalFilepaths[i]] = targetFileInfo
+		target.Path = newPath
+		renamed[newPath] = target
 	}
-	return targets, nil
+	migrated.Signed.Targets = renamed
+	return migrated, unmatched, nil
+}
+
+// Kinds of TargetChange
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+	ChangeRenamed  = "renamed"
+	ChangeRehashed = "rehashed" // Same content, hashed with other algorithms
+	// Renamed, and its custom metadata changed
+	ChangeRenamedModified = "renamed_modified"
+)
+
+// Difference of one target file between two targets metadata. Old is the zero
+// value for an added target and New for a removed one. A renamed target has
+// the same hashes and length under a new path, Old.Path is the previous path.
+// It is renamed and modified if its custom metadata changed too.
+type TargetChange struct {
+	Kind string
+	New  metadata.TargetFiles
+	Old  metadata.TargetFiles
 }
 
+// Path of the target after the change, or before it if it was removed.
+func (c TargetChange) Path() string {
+	if c.Kind == ChangeRemoved {
+		return c.Old.Path
+	}
+	return c.New.Path
+}
+
+// Classify every difference between the old and new targets as added, removed,
+// modified, renamed or rehashed. Contents are compared on the hash algorithms
+// both targets have, see SameContent. A target whose custom metadata changed
+// is modified too. Renames are paired with a removed target of the same
+// custom metadata first.
 func CompareNewOldTargets(newTargets *metadata.Metadata[metadata.TargetsType],
 	oldTargets *metadata.Metadata[metadata.TargetsType],
-	sortByPath bool) []struct {
-	New metadata.TargetFiles
-	Old metadata.TargetFiles
-} {
-	newChanges := []struct {
-		New metadata.TargetFiles
-		Old metadata.TargetFiles
-	}{}
+	sortByPath bool) []TargetChange {
+	newChanges := []TargetChange{}
 
 	newTargetMap := newTargets.Signed.Targets
 	oldTargetMap := oldTargets.Signed.Targets
 
-	for _, newTargetInfo := range newTargetMap {
+	// Iterate in path order so that renames are paired deterministically
+	added := []string{}
+	for _, path := range sortedTargetPaths(newTargetMap) {
 		// Dereference to avoid overwriting pointer memory
-		newTargetInfoTmp := *newTargetInfo
-		oldTargetInfoTmp := *metadata.TargetFile()
-		if oldTargetMap[newTargetInfo.Path] != nil {
-			oldTargetInfoTmp = *oldTargetMap[newTargetInfo.Path]
+		newTargetInfoTmp := *newTargetMap[path]
+		if oldTargetMap[path] == nil {
+			added = append(added, path)
+			continue
 		}
+		oldTargetInfoTmp := *oldTargetMap[path]
 
-		slog.Debug("Comparing hashes", slog.String("filepath", newTargetInfo.Path),
+		slog.Debug("Comparing hashes", slog.String("filepath", path),
 			slog.Any("new_hash", newTargetInfoTmp.Hashes),
 			slog.Any("old_hash", oldTargetInfoTmp.Hashes))
-		// fmt.Printf("Comparing %s\n", newTargetInfoTmp.Path)
-		// fmt.Printf("\tnew hash: %s\n", newTargetInfoTmp.Hashes)
-		// fmt.Printf("\told hash: %s\n", oldTargetInfoTmp.Hashes)
-
-		// Compare new and old target file info
-		if oldTargetInfoTmp.Hashes.Equal(newTargetInfoTmp.Hashes) &&
-			oldTargetInfoTmp.Length == newTargetInfoTmp.Length &&
-			oldTargetInfoTmp.Path == newTargetInfoTmp.Path {
-			//fmt.Println("same target file info :D")
-			continue
+		if !SameContent(&oldTargetInfoTmp, &newTargetInfoTmp) || !custom.Equal(oldTargetInfoTmp.Custom, newTargetInfoTmp.Custom) {
+			newChanges = append(newChanges, TargetChange{Kind: ChangeModified, New: newTargetInfoTmp, Old: oldTargetInfoTmp})
+		} else if !sameAlgorithms(oldTargetInfoTmp.Hashes, newTargetInfoTmp.Hashes) {
+			newChanges = append(newChanges, TargetChange{Kind: ChangeRehashed, New: newTargetInfoTmp, Old: oldTargetInfoTmp})
 		}
+	}
 
-		newChanges = append(newChanges, struct {
-			New metadata.TargetFiles
-			Old metadata.TargetFiles
-		}{
-			New: newTargetInfoTmp,
-			Old: oldTargetInfoTmp,
+	// Targets gone from the new version, by content for rename detection
+	removed := []string{}
+	removedByLength := map[int64][]string{}
+	for _, path := range sortedTargetPaths(oldTargetMap) {
+		if newTargetMap[path] == nil {
+			removed = append(removed, path)
+			length := oldTargetMap[path].Length
+			removedByLength[length] = append(removedByLength[length], path)
+		}
+	}
+	renamed := map[string]bool{}
+	for _, path := range added {
+		newTargetInfoTmp := *newTargetMap[path]
+		candidates := removedByLength[newTargetInfoTmp.Length]
+		i := slices.IndexFunc(candidates, func(from string) bool {
+			return SameContent(oldTargetMap[from], &newTargetInfoTmp) && custom.Equal(oldTargetMap[from].Custom, newTargetInfoTmp.Custom)
 		})
-		slog.Debug("new changes found", slog.String("filepath", newTargetInfoTmp.Path),
-			slog.Int("total_changes", len(newChanges)))
+		kind := ChangeRenamed
+		if i < 0 {
+			i = slices.IndexFunc(candidates, func(from string) bool {
+				return SameContent(oldTargetMap[from], &newTargetInfoTmp)
+			})
+			kind = ChangeRenamedModified
+		}
+		if i >= 0 {
+			from := candidates[i]
+			removedByLength[newTargetInfoTmp.Length] = slices.Delete(candidates, i, i+1)
+			renamed[from] = true
+			newChanges = append(newChanges, TargetChange{Kind: kind, New: newTargetInfoTmp, Old: *oldTargetMap[from]})
+			continue
+		}
+		newChanges = append(newChanges, TargetChange{Kind: ChangeAdded, New: newTargetInfoTmp, Old: *metadata.TargetFile()})
 	}
+	for _, path := range removed {
+		if !renamed[path] {
+			newChanges = append(newChanges, TargetChange{Kind: ChangeRemoved, New: *metadata.TargetFile(), Old: *oldTargetMap[path]})
+		}
+	}
+	slog.Debug("new changes found", slog.Int("total_changes", len(newChanges)))
 
 	if sortByPath {
 		sort.Slice(newChanges, func(i, j int) bool {
-			return newChanges[i].New.Path < newChanges[j].New.Path
+			return newChanges[i].Path() < newChanges[j].Path()
 		})
 	}
 
 	return newChanges
 }
 
-// Convert forward slash to backward slash of the Path string
-func BackifyForwardSlash(targetInfo *metadata.TargetFiles) *metadata.TargetFiles {
-	targetInfo.Path = strings.Replace(targetInfo.Path, "\\", "/", -1)
-	return targetInfo
+func sortedTargetPaths(targets map[string]*metadata.TargetFiles) []string {
+	paths := make([]string, 0, len(targets))
+	for path := range targets {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Whether a and b have the same length and the same digests for the hash
+// algorithms they both have, which must be at least one.
+func SameContent(a *metadata.TargetFiles, b *metadata.TargetFiles) bool {
+	if a.Length != b.Length {
+		return false
+	}
+	common := 0
+	for algorithm, digest := range a.Hashes {
+		if other, ok := b.Hashes[algorithm]; ok {
+			if !bytes.Equal(digest, other) {
+				return false
+			}
+			common++
+		}
+	}
+	return common > 0
+}
+
+// Hash algorithms of hashes missing from target, in the order of algorithms.
+func MissingHashes(target *metadata.TargetFiles, algorithms []string) []string {
+	missing := []string{}
+	for _, algorithm := range algorithms {
+		if _, ok := target.Hashes[algorithm]; !ok {
+			missing = append(missing, algorithm)
+		}
+	}
+	return missing
+}
+
+func sameAlgorithms(a metadata.Hashes, b metadata.Hashes) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for algorithm := range a {
+		if _, ok := b[algorithm]; !ok {
+			return false
+		}
+	}
+	return true
 }
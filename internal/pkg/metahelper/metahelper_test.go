@@ -0,0 +1,294 @@
+package metahelper_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/metahelper"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+func targetsOf(t *testing.T, files map[string]string) *metadata.Metadata[metadata.TargetsType] {
+	t.Helper()
+	targets := metadata.Targets(time.Now().Add(time.Hour))
+	for path, content := range files {
+		target, err := metadata.TargetFile().FromBytes(path, []byte(content), "sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets.Signed.Targets[path] = target
+	}
+	return targets
+}
+
+func TestCompareNewOldTargets(t *testing.T) {
+	oldTargets := targetsOf(t, map[string]string{
+		"same.txt":     "same",
+		"modified.txt": "before",
+		"removed.txt":  "removed",
+		"old/name.txt": "renamed",
+	})
+	newTargets := targetsOf(t, map[string]string{
+		"same.txt":     "same",
+		"modified.txt": "after",
+		"added.txt":    "added",
+		"new/name.txt": "renamed",
+	})
+
+	changes := metahelper.CompareNewOldTargets(newTargets, oldTargets, true)
+	want := []struct {
+		kind    string
+		path    string
+		oldPath string
+	}{
+		{metahelper.ChangeAdded, "added.txt", ""},
+		{metahelper.ChangeModified, "modified.txt", "modified.txt"},
+		{metahelper.ChangeRenamed, "new/name.txt", "old/name.txt"},
+		{metahelper.ChangeRemoved, "removed.txt", "removed.txt"},
+	}
+	if len(changes) != len(want) {
+		t.Fatal(changes)
+	}
+	for i, change := range changes {
+		if change.Kind != want[i].kind || change.Path() != want[i].path || change.Old.Path != want[i].oldPath {
+			t.Fatal(i, change.Kind, change.Path(), change.Old.Path)
+		}
+	}
+	if !changes[2].Old.Hashes.Equal(changes[2].New.Hashes) || changes[1].Old.Hashes.Equal(changes[1].New.Hashes) {
+		t.Fatal("unexpected hashes", changes[1], changes[2])
+	}
+}
+
+func TestCompareNewOldTargetsRenameOnce(t *testing.T) {
+	// Two new copies of one removed file: one rename, one addition
+	oldTargets := targetsOf(t, map[string]string{"a.txt": "content"})
+	newTargets := targetsOf(t, map[string]string{"b.txt": "content", "c.txt": "content"})
+
+	changes := metahelper.CompareNewOldTargets(newTargets, oldTargets, true)
+	if len(changes) != 2 || changes[0].Kind != metahelper.ChangeRenamed || changes[0].Old.Path != "a.txt" ||
+		changes[1].Kind != metahelper.ChangeAdded {
+		t.Fatal(changes)
+	}
+}
+
+func TestCompareNewOldTargetsCustom(t *testing.T) {
+	// Same content, other custom metadata: modified
+	oldTargets := targetsOf(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	newTargets := targetsOf(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	before, after, reordered := json.RawMessage(`{"version":"1.0","x":1}`), json.RawMessage(`{"version":"1.1","x":1}`), json.RawMessage(`{ "x": 1, "version": "1.0" }`)
+	oldTargets.Signed.Targets["a.txt"].Custom = &before
+	newTargets.Signed.Targets["a.txt"].Custom = &after
+	changes := metahelper.CompareNewOldTargets(newTargets, oldTargets, true)
+	if len(changes) != 1 || changes[0].Kind != metahelper.ChangeModified || changes[0].Path() != "a.txt" {
+		t.Fatal(changes)
+	}
+
+	// Formatting and key order aside
+	newTargets.Signed.Targets["a.txt"].Custom = &reordered
+	if changes = metahelper.CompareNewOldTargets(newTargets, oldTargets, true); len(changes) != 0 {
+		t.Fatal(changes)
+	}
+}
+
+func TestCompareNewOldTargetsRenameCustom(t *testing.T) {
+	// Renames pair the same custom metadata first, then report the change
+	oldTargets := targetsOf(t, map[string]string{"a.txt": "content", "b.txt": "content"})
+	newTargets := targetsOf(t, map[string]string{"c.txt": "content", "d.txt": "content"})
+	v1, v2 := json.RawMessage(`{"version":"1"}`), json.RawMessage(`{"version":"2"}`)
+	oldTargets.Signed.Targets["a.txt"].Custom = &v1
+	oldTargets.Signed.Targets["b.txt"].Custom = &v2
+	newTargets.Signed.Targets["c.txt"].Custom = &v2
+	newTargets.Signed.Targets["d.txt"].Custom = &v2
+
+	changes := metahelper.CompareNewOldTargets(newTargets, oldTargets, true)
+	if len(changes) != 2 || changes[0].Kind != metahelper.ChangeRenamed || changes[0].Old.Path != "b.txt" ||
+		changes[1].Kind != metahelper.ChangeRenamedModified || changes[1].Old.Path != "a.txt" {
+		t.Fatal(changes)
+	}
+}
+
+func TestCompareNewOldTargetsAlgorithms(t *testing.T) {
+	// Contents are compared on the common algorithms
+	oldTargets := targetsOf(t, map[string]string{"same.txt": "same", "modified.txt": "before", "old.txt": "renamed"})
+	newTargets := metadata.Targets(time.Now().Add(time.Hour))
+	for path, content := range map[string]string{"same.txt": "same", "modified.txt": "after", "new.txt": "renamed"} {
+		target, err := metadata.TargetFile().FromBytes(path, []byte(content), "sha256", "sha512")
+		if err != nil {
+			t.Fatal(err)
+		}
+		newTargets.Signed.Targets[path] = target
+	}
+
+	changes := metahelper.CompareNewOldTargets(newTargets, oldTargets, true)
+	if len(changes) != 3 || changes[0].Kind != metahelper.ChangeModified || changes[1].Kind != metahelper.ChangeRenamed ||
+		changes[2].Kind != metahelper.ChangeRehashed || changes[2].Path() != "same.txt" {
+		t.Fatal(changes)
+	}
+	if missing := metahelper.MissingHashes(oldTargets.Signed.Targets["same.txt"], []string{"sha256", "sha512"}); len(missing) != 1 || missing[0] != "sha512" {
+		t.Fatal(missing)
+	}
+
+	// Without a common algorithm, the content is unknown
+	sha512Only, err := metadata.TargetFile().FromBytes("same.txt", []byte("same"), "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metahelper.SameContent(oldTargets.Signed.Targets["same.txt"], sha512Only) ||
+		!metahelper.SameContent(newTargets.Signed.Targets["same.txt"], sha512Only) {
+		t.Fatal("unexpected content comparison")
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	if metahelper.TargetPath("", "a/b.txt") != "a/b.txt" || metahelper.TargetPath("repo", "a/b.txt") != "repo/a/b.txt" ||
+		metahelper.TargetPath("app/v1/", "b.txt") != "app/v1/b.txt" {
+		t.Fatal("unexpected target paths")
+	}
+}
+
+func TestMigrateTargetPaths(t *testing.T) {
+	targets := targetsOf(t, map[string]string{
+		`repo\win\a.txt`:      "a", // Windows separator
+		"home/app/repo/b.txt": "b", // mangled root
+		"repo/app/c.txt":      "c", // nested dir named like the root
+		"repo/gone.txt":       "gone",
+	})
+	migrated, unmatched, err := metahelper.MigrateTargetPaths(targets, "", []string{"win/a.txt", "b.txt", "c.txt", "app/c.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unmatched) != 1 || unmatched[0] != "repo/gone.txt" {
+		t.Fatal(unmatched)
+	}
+	for oldPath, newPath := range map[string]string{
+		`repo\win\a.txt`:      "win/a.txt",
+		"home/app/repo/b.txt": "b.txt",
+		"repo/app/c.txt":      "app/c.txt",
+		"repo/gone.txt":       "repo/gone.txt",
+	} {
+		target := migrated.Signed.Targets[newPath]
+		if target == nil || target.Path != newPath || !target.Hashes.Equal(targets.Signed.Targets[oldPath].Hashes) {
+			t.Fatal(oldPath, newPath, target)
+		}
+	}
+	// The original targets are left untouched
+	if len(migrated.Signed.Targets) != 4 || targets.Signed.Targets[`repo\win\a.txt`] == nil {
+		t.Fatal(migrated.Signed.Targets)
+	}
+
+	// Two entries of one file: the first keeps the new path
+	targets = targetsOf(t, map[string]string{"repo/a.txt": "a", `repo\a.txt`: "a"})
+	migrated, unmatched, err = metahelper.MigrateTargetPaths(targets, "app", []string{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unmatched) != 1 || unmatched[0] != `repo\a.txt` || migrated.Signed.Targets["app/a.txt"] == nil {
+		t.Fatal(unmatched, migrated.Signed.Targets)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.bin")
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := metadata.TargetFile().FromFile(path, "sha256", "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := metahelper.HashFile(path, "sha256", "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Length != want.Length || !got.Hashes.Equal(want.Hashes) || len(got.Hashes) != 2 {
+		t.Fatal(got, want)
+	}
+	if _, err = metahelper.HashFile(path, "md5"); err == nil {
+		t.Fatal("unsupported algorithm accepted")
+	}
+}
+
+func TestGenerateNewTargetsFromDirJobs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "repo")
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("dir%d", i%5), fmt.Sprintf("file%d.txt", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The targets do not depend on the number of workers
+	expires := time.Now().Add(time.Hour)
+	var first []byte
+	for _, jobs := range []int{1, 4, 64} {
+		progress := new(bytes.Buffer)
+		targets, scan, err := metahelper.GenerateNewTargetsFromDir(dir, expires, metahelper.TargetsOptions{Prefix: "repo", Jobs: jobs, Progress: progress})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(scan.Files) != 50 || len(targets.Signed.Targets) != 50 || targets.Signed.Targets["repo/dir3/file8.txt"].Length != 8 {
+			t.Fatal(jobs, len(targets.Signed.Targets))
+		}
+		content, err := targets.ToBytes(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = content
+		} else if !bytes.Equal(first, content) {
+			t.Fatal("targets differ with", jobs, "jobs")
+		}
+		// Short runs do not report progress
+		if progress.Len() != 0 {
+			t.Fatal(progress.String())
+		}
+	}
+
+	// A failing file fails the whole run
+	if err := os.Chmod(filepath.Join(dir, "dir1", "file6.txt"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Open(filepath.Join(dir, "dir1", "file6.txt")); err == nil {
+		f.Close()
+		t.Skip("file permissions not enforced")
+	}
+	if _, _, err := metahelper.GenerateNewTargetsFromDir(dir, expires, metahelper.TargetsOptions{Jobs: 4}); err == nil {
+		t.Fatal("unreadable file hashed")
+	}
+}
+
+func TestGenerateNewTargetsOpen(t *testing.T) {
+	// Listed files that are not on disk, read through Open
+	contents := map[string]string{"a.txt": "a", "sub/b.txt": "bb"}
+	scan := filesystem.ScanPaths("/remote/repo", []string{"sub/b.txt", "a.txt"}, filesystem.ScanOptions{})
+	targets, err := metahelper.GenerateNewTargets(scan, time.Now().Add(time.Hour), metahelper.TargetsOptions{
+		Prefix: "repo",
+		Open: func(file filesystem.ScannedFile) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(contents[file.Path])), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := targetsOf(t, map[string]string{"repo/a.txt": "a", "repo/sub/b.txt": "bb"})
+	if len(targets.Signed.Targets) != 2 {
+		t.Fatal(targets.Signed.Targets)
+	}
+	for name, target := range want.Signed.Targets {
+		if !metahelper.SameContent(target, targets.Signed.Targets[name]) {
+			t.Fatal(name, targets.Signed.Targets[name])
+		}
+	}
+}
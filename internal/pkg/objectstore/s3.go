@@ -0,0 +1,374 @@
+package objectstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	Scheme        = "s3://"
+	defaultRegion = "us-east-1"
+)
+
+var (
+	ErrNotFound           = errors.New("object not found")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// Minimal client for S3-compatible object storage (AWS S3, MinIO, Ceph...).
+// Requests use path-style addressing and are signed with AWS Signature V4.
+type S3 struct {
+	Endpoint     string // e.g. http://localhost:9000
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Bucket       string
+	Client       *http.Client
+}
+
+type Object struct {
+	Key  string
+	ETag string
+	Size int64
+}
+
+// Condition of a write, at most one field should be set.
+// IfNoneMatch: only create the object if it does not exist yet.
+// IfMatch: only overwrite the object if its current ETag matches.
+type Condition struct {
+	IfNoneMatch bool
+	IfMatch     string
+}
+
+// Returns true if the string is an s3://bucket/prefix URI.
+func IsURI(s string) bool {
+	return strings.HasPrefix(s, Scheme)
+}
+
+// Split s3://bucket/prefix into bucket and prefix, the prefix never starts
+// with a slash and always ends with one (unless empty).
+func ParseURI(uri string) (string, string, error) {
+	if !IsURI(uri) {
+		return "", "", fmt.Errorf("not an s3 uri: %s", uri)
+	}
+	rest := strings.TrimPrefix(uri, Scheme)
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("missing bucket in s3 uri: %s", uri)
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+// Initialize client from the standard AWS environment variables:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION
+// (or AWS_DEFAULT_REGION) and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL).
+func NewFromEnv(bucket string) (*S3, error) {
+	s := &S3{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Region:       firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), defaultRegion),
+		Endpoint:     firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")),
+		Bucket:       bucket,
+		Client:       http.DefaultClient,
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.Region)
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("missing credentials, please set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+// List all objects under prefix (ListObjectsV2, follows continuation tokens).
+func (s *S3) List(prefix string) ([]Object, error) {
+	objects := []Object{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("fail to list objects with prefix %s: %w", prefix, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("fail to read list response: %w", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fail to list objects with prefix %s: %s", prefix, responseError(res, body))
+		}
+
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key  string
+				ETag string
+				Size int64
+			}
+		}
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("fail to parse list response: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, Object{Key: c.Key, ETag: c.ETag, Size: c.Size})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, nil
+}
+
+// Returns the content and ETag of the object.
+func (s *S3) Get(key string) ([]byte, string, error) {
+	res, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to get object %s: %w", key, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to read object %s: %w", key, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return body, res.Header.Get("ETag"), nil
+	case http.StatusNotFound:
+		return nil, "", fmt.Errorf("%w: %s", ErrNotFound, key)
+	default:
+		return nil, "", fmt.Errorf("fail to get object %s: %s", key, responseError(res, body))
+	}
+}
+
+// Content of the object, streamed: memory use does not depend on the object
+// size. The caller closes it.
+func (s *S3) Open(key string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get object %s: %w", key, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	default:
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("fail to get object %s: %s", key, responseError(res, body))
+	}
+}
+
+// Write the object and return its new ETag. Returns ErrPreconditionFailed if
+// the condition does not hold, i.e. somebody else wrote the object first.
+func (s *S3) Put(key string, content []byte, cond Condition) (string, error) {
+	headers := http.Header{}
+	if cond.IfNoneMatch {
+		headers.Set("If-None-Match", "*")
+	} else if cond.IfMatch != "" {
+		headers.Set("If-Match", cond.IfMatch)
+	}
+	res, err := s.do(http.MethodPut, key, nil, headers, content)
+	if err != nil {
+		return "", fmt.Errorf("fail to put object %s: %w", key, err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return "", fmt.Errorf("%w: %s", ErrPreconditionFailed, key)
+	default:
+		return "", fmt.Errorf("fail to put object %s: %s", key, responseError(res, body))
+	}
+}
+
+// Remove the object, removing a missing object is not an error. With
+// cond.IfMatch, returns ErrPreconditionFailed if the object was replaced since
+// it had that ETag.
+func (s *S3) Delete(key string, cond Condition) error {
+	headers := http.Header{}
+	if cond.IfMatch != "" {
+		headers.Set("If-Match", cond.IfMatch)
+	}
+	res, err := s.do(http.MethodDelete, key, nil, headers, nil)
+	if err != nil {
+		return fmt.Errorf("fail to delete object %s: %w", key, err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	case http.StatusPreconditionFailed:
+		return fmt.Errorf("%w: %s", ErrPreconditionFailed, key)
+	default:
+		return fmt.Errorf("fail to delete object %s: %s", key, responseError(res, body))
+	}
+}
+
+func (s *S3) do(method string, key string, query url.Values, headers http.Header, content []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %w", s.Endpoint, err)
+	}
+	path := strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	reqURL := *endpoint
+	reqURL.Path = path
+	reqURL.RawPath = uriEncode(path, false)
+	reqURL.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, reqURL.String(), bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	s.sign(req, reqURL.RawPath, reqURL.RawQuery, content, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// Sign request with AWS Signature Version 4.
+// Reference: https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (s *S3) sign(req *http.Request, canonicalURI string, canonicalQuery string, content []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(content)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	signedHeaderNames := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.SessionToken != "" {
+		signedHeaderNames = append(signedHeaderNames, "x-amz-security-token")
+	}
+	sort.Strings(signedHeaderNames)
+	canonicalHeaders := ""
+	for _, name := range signedHeaderNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, canonicalURI, canonicalQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// URI encode every byte except the unreserved characters, slash is kept as is
+// for object keys and encoded for query parameters.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func responseError(res *http.Response, body []byte) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%s: %s: %s", res.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("%s", res.Status)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
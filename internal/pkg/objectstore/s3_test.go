@@ -0,0 +1,183 @@
+package objectstore_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"see_updater/internal/pkg/objectstore"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// In-memory S3-compatible server supporting the subset used by the client.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		keys := []string{}
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><ETag>%s</ETag><Size>%d</Size></Contents>", k, etag(f.objects[k]), len(f.objects[k]))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodGet:
+		content, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(content))
+		w.Write(content)
+	case r.Method == http.MethodPut:
+		content, exists := f.objects[key]
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && (!exists || m != etag(content)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodDelete:
+		if m := r.Header.Get("If-Match"); m != "" {
+			if content, exists := f.objects[key]; exists && m != etag(content) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestParseURI(t *testing.T) {
+	cases := []struct {
+		uri    string
+		bucket string
+		prefix string
+		fail   bool
+	}{
+		{"s3://bucket/metadata", "bucket", "metadata/", false},
+		{"s3://bucket/a/b/", "bucket", "a/b/", false},
+		{"s3://bucket", "bucket", "", false},
+		{"s3:///prefix", "", "", true},
+		{"/local/path", "", "", true},
+	}
+	for _, c := range cases {
+		bucket, prefix, err := objectstore.ParseURI(c.uri)
+		if (err != nil) != c.fail || bucket != c.bucket || prefix != c.prefix {
+			t.Fatal(c.uri, bucket, prefix, err)
+		}
+	}
+}
+
+func TestS3ConditionalWrites(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	s := &objectstore.S3{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Bucket:    "bucket",
+	}
+
+	// Create only once
+	tag, err := s.Put("metadata/2.targets.json", []byte("first"), objectstore.Condition{IfNoneMatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Put("metadata/2.targets.json", []byte("second"), objectstore.Condition{IfNoneMatch: true})
+	if !errors.Is(err, objectstore.ErrPreconditionFailed) {
+		t.Fatal("second create should fail", err)
+	}
+
+	// Overwrite with matching and stale ETag
+	newTag, err := s.Put("metadata/2.targets.json", []byte("third"), objectstore.Condition{IfMatch: tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Put("metadata/2.targets.json", []byte("fourth"), objectstore.Condition{IfMatch: tag})
+	if !errors.Is(err, objectstore.ErrPreconditionFailed) {
+		t.Fatal("overwrite with stale etag should fail", err)
+	}
+
+	content, gotTag, err := s.Get("metadata/2.targets.json")
+	if err != nil || string(content) != "third" || gotTag != newTag {
+		t.Fatal(string(content), gotTag, err)
+	}
+	_, _, err = s.Get("metadata/missing.json")
+	if !errors.Is(err, objectstore.ErrNotFound) {
+		t.Fatal(err)
+	}
+	reader, err := s.Open("metadata/2.targets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err = io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(content) != "third" {
+		t.Fatal(string(content), err)
+	}
+	if _, err = s.Open("metadata/missing.json"); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Fatal(err)
+	}
+
+	objects, err := s.List("metadata/")
+	if err != nil || len(objects) != 1 || objects[0].Key != "metadata/2.targets.json" {
+		t.Fatal(objects, err)
+	}
+	// Delete only if unchanged, then twice
+	if err = s.Delete("metadata/2.targets.json", objectstore.Condition{IfMatch: `"other"`}); !errors.Is(err, objectstore.ErrPreconditionFailed) {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = s.Delete("metadata/2.targets.json", objectstore.Condition{}); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if objects, err = s.List("metadata/"); err != nil || len(objects) != 0 {
+		t.Fatal(objects, err)
+	}
+}
@@ -0,0 +1,277 @@
+// Package publish lays out the target files of a consistent snapshot
+// repository: each target is served as <dir>/<hash>.<basename> for every hash
+// algorithm of its target file info, so that a client downloading while the
+// repository is updated always gets the content its metadata describes.
+package publish
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/metahelper"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+const (
+	// Record of the generations published to a dir, see Prune
+	GenerationsFilename = ".generations.json"
+
+	// Ways of publishing a target file
+	ModeCopy     = "copy"
+	ModeHardlink = "hardlink" // Falls back to a copy across filesystems
+
+	format = 1
+)
+
+var Modes = []string{ModeCopy, ModeHardlink}
+
+// The source changed since its target file info was computed.
+var ErrChanged = errors.New("source changed since it was hashed")
+
+// Content of a target file: the local file at Path, or what Open reads (e.g.
+// a remote object), or Data if both are empty (e.g. the link target of a
+// recorded symlink).
+type Source struct {
+	Path string                        `json:"path,omitempty"`
+	Open func() (io.ReadCloser, error) `json:"-"`
+	Data []byte                        `json:"data,omitempty"`
+}
+
+// Published paths of the target name, relative to the publish dir and
+// '/'-separated, one per hash algorithm, sorted.
+func HashedPaths(name string, hashes metadata.Hashes) []string {
+	dir, base := path.Split(name)
+	paths := []string{}
+	for _, digest := range hashes {
+		paths = append(paths, dir+hex.EncodeToString(digest)+"."+base)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Write the hashed paths of targets missing from dir, from their sources in
+// mode. Every file is checked against the length and hashes of its target
+// before being renamed into place, existing files of the right length are
+// kept. Returns the paths written and the targets without a source.
+func Publish(dir string, targets map[string]*metadata.TargetFiles, sources map[string]Source, mode string) ([]string, []string, error) {
+	written, missing := []string{}, []string{}
+	names := []string{}
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		target := targets[name]
+		todo := []string{}
+		for _, rel := range HashedPaths(name, target.Hashes) {
+			if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err == nil && info.Mode().IsRegular() && info.Size() == target.Length {
+				continue
+			}
+			todo = append(todo, rel)
+		}
+		if len(todo) == 0 {
+			continue
+		}
+		source, ok := sources[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+
+		first := filepath.Join(dir, filepath.FromSlash(todo[0]))
+		if err := place(first, target, func(tmp string) error {
+			switch {
+			case source.Path != "":
+				return link(source.Path, tmp, mode)
+			case source.Open != nil:
+				return copyFrom(source.Open, tmp)
+			}
+			return filesystem.WriteBytesToFile(tmp, source.Data)
+		}); err != nil {
+			return written, missing, fmt.Errorf("fail to publish target %s: %w", name, err)
+		}
+		written = append(written, todo[0])
+		// Same content under the other hashes
+		for _, rel := range todo[1:] {
+			if err := place(filepath.Join(dir, filepath.FromSlash(rel)), target, func(tmp string) error {
+				return link(first, tmp, ModeHardlink)
+			}); err != nil {
+				return written, missing, fmt.Errorf("fail to publish target %s: %w", name, err)
+			}
+			written = append(written, rel)
+		}
+	}
+	return written, missing, nil
+}
+
+// Make the file at dest with write (given a temporary path next to it),
+// check it against target, then rename it into place.
+func place(dest string, target *metadata.TargetFiles, write func(tmp string) error) error {
+	if err := filesystem.MakeNewDirAll(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+	if err := write(tmp); err != nil {
+		return err
+	}
+	algorithms := []string{}
+	for algorithm := range target.Hashes {
+		algorithms = append(algorithms, algorithm)
+	}
+	written, err := metahelper.HashFile(tmp, algorithms...)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !metahelper.SameContent(target, written) {
+		os.Remove(tmp)
+		return ErrChanged
+	}
+	return os.Rename(tmp, dest)
+}
+
+// Hardlink or copy src to dest.
+func link(src string, dest string, mode string) error {
+	if mode == ModeHardlink {
+		err := os.Link(src, dest)
+		if err == nil {
+			return nil
+		}
+		slog.Debug("fail to hardlink, copying instead", slog.String("source", src), slog.Any("error", err))
+	}
+	return copyFrom(func() (io.ReadCloser, error) { return os.Open(src) }, dest)
+}
+
+// Write what open reads to dest.
+func copyFrom(open func() (io.ReadCloser, error), dest string) error {
+	in, err := open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Files published for one version of the targets metadata.
+type generation struct {
+	Version    int64      `json:"version"`
+	Published  time.Time  `json:"published"`
+	Superseded *time.Time `json:"superseded,omitempty"` // nil for the current generation
+	Files      []string   `json:"files"`
+}
+
+type generationsFile struct {
+	Format      int          `json:"format"`
+	Generations []generation `json:"generations"`
+}
+
+// Record the files of targets version as the current generation of dir, and
+// delete the files of the generations superseded longer than grace ago that
+// no kept generation references: clients that fetched older metadata can
+// still download their targets during grace. Returns the removed paths.
+func Prune(dir string, version int64, targets map[string]*metadata.TargetFiles, grace time.Duration, now time.Time) ([]string, error) {
+	record := filepath.Join(dir, GenerationsFilename)
+	content := generationsFile{}
+	bytes, err := os.ReadFile(record)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("fail to read %s: %w", record, err)
+	}
+	if err == nil {
+		if err = json.Unmarshal(bytes, &content); err != nil || content.Format != format {
+			return nil, fmt.Errorf("invalid %s, fix or remove it: %v", record, err)
+		}
+	}
+
+	files := []string{}
+	for name, target := range targets {
+		files = append(files, HashedPaths(name, target.Hashes)...)
+	}
+	sort.Strings(files)
+	now = now.UTC()
+	current := generation{Version: version, Published: now, Files: files}
+	if n := len(content.Generations); n > 0 && content.Generations[n-1].Version == version {
+		// Same version published again, e.g. signed later
+		current.Published = content.Generations[n-1].Published
+		content.Generations = content.Generations[:n-1]
+	} else if n > 0 {
+		content.Generations[n-1].Superseded = &now
+	}
+	content.Generations = append(content.Generations, current)
+
+	kept, dropped := []generation{}, []generation{}
+	for _, g := range content.Generations {
+		if g.Superseded == nil || now.Sub(*g.Superseded) < grace {
+			kept = append(kept, g)
+		} else {
+			dropped = append(dropped, g)
+		}
+	}
+	referenced := map[string]bool{}
+	for _, g := range kept {
+		for _, file := range g.Files {
+			referenced[file] = true
+		}
+	}
+	removed := []string{}
+	for _, g := range dropped {
+		for _, file := range g.Files {
+			if referenced[file] {
+				continue
+			}
+			referenced[file] = true // Once
+			full := filepath.Join(dir, filepath.FromSlash(file))
+			if err := os.Remove(full); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return removed, fmt.Errorf("fail to remove %s: %w", full, err)
+			}
+			removeEmptyDirs(dir, filepath.Dir(full))
+			removed = append(removed, file)
+		}
+	}
+	sort.Strings(removed)
+
+	content.Format = format
+	content.Generations = kept
+	if bytes, err = json.MarshalIndent(content, "", "  "); err != nil {
+		return removed, fmt.Errorf("fail to marshal %s: %w", record, err)
+	}
+	tmp := record + ".tmp"
+	if err = filesystem.WriteBytesToFile(tmp, bytes); err != nil {
+		return removed, fmt.Errorf("fail to write %s: %w", record, err)
+	}
+	if err = os.Rename(tmp, record); err != nil {
+		return removed, fmt.Errorf("fail to write %s: %w", record, err)
+	}
+	return removed, nil
+}
+
+// Remove dir and its parents up to root while they are empty.
+func removeEmptyDirs(root string, dir string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
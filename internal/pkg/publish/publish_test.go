@@ -0,0 +1,153 @@
+package publish_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/metahelper"
+	"see_updater/internal/pkg/publish"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+func targetOf(t *testing.T, name string, content string) *metadata.TargetFiles {
+	t.Helper()
+	target, err := metadata.TargetFile().FromBytes(name, []byte(content), "sha256", "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func TestHashedPaths(t *testing.T) {
+	hashes := metadata.Hashes{"sha256": []byte{0xab}, "sha512": []byte{0xcd}}
+	if paths := publish.HashedPaths("repo/sub/a.txt", hashes); !slices.Equal(paths, []string{"repo/sub/ab.a.txt", "repo/sub/cd.a.txt"}) {
+		t.Fatal(paths)
+	}
+	if paths := publish.HashedPaths("a.txt", metadata.Hashes{"sha256": []byte{0xab}}); !slices.Equal(paths, []string{"ab.a.txt"}) {
+		t.Fatal(paths)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(src, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	targets := map[string]*metadata.TargetFiles{
+		"repo/a.txt":     targetOf(t, "repo/a.txt", "a"),
+		"repo/link":      targetOf(t, "repo/link", "a.txt"),
+		"repo/remote":    targetOf(t, "repo/remote", "r"),
+		"repo/elsewhere": targetOf(t, "repo/elsewhere", "e"),
+	}
+	sources := map[string]publish.Source{
+		"repo/a.txt": {Path: src},
+		"repo/link":  {Data: []byte("a.txt")},
+		"repo/remote": {Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("r")), nil
+		}},
+	}
+
+	for _, mode := range publish.Modes {
+		written, missing, err := publish.Publish(filepath.Join(out, mode), targets, sources, mode)
+		if err != nil || len(written) != 6 || !slices.Equal(missing, []string{"repo/elsewhere"}) {
+			t.Fatal(mode, written, missing, err)
+		}
+		for _, name := range []string{"repo/a.txt", "repo/link", "repo/remote"} {
+			for _, rel := range publish.HashedPaths(name, targets[name].Hashes) {
+				published, err := metahelper.HashFile(filepath.Join(out, mode, filepath.FromSlash(rel)), "sha256", "sha512")
+				if err != nil || !metahelper.SameContent(targets[name], published) {
+					t.Fatal(mode, rel, err)
+				}
+			}
+		}
+		// Published files are kept
+		if written, _, err = publish.Publish(filepath.Join(out, mode), targets, sources, mode); err != nil || len(written) != 0 {
+			t.Fatal(mode, written, err)
+		}
+	}
+
+	// A source that changed since it was hashed is not published
+	if err := os.WriteFile(src, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := publish.Publish(filepath.Join(out, "changed"), targets, sources, publish.ModeCopy); !errors.Is(err, publish.ErrChanged) {
+		t.Fatal(err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	generations := []map[string]*metadata.TargetFiles{
+		{"repo/a.txt": targetOf(t, "repo/a.txt", "a"), "repo/b.txt": targetOf(t, "repo/b.txt", "b")},
+		{"repo/a.txt": targetOf(t, "repo/a.txt", "aa"), "repo/b.txt": targetOf(t, "repo/b.txt", "b")},
+		{"repo/a.txt": targetOf(t, "repo/a.txt", "aaa")},
+	}
+	sources := func(i int) map[string]publish.Source {
+		sources := map[string]publish.Source{}
+		for name, target := range generations[i] {
+			path := filepath.Join(t.TempDir(), "src")
+			content := map[int64]string{1: "a", 2: "aa", 3: "aaa"}[target.Length]
+			if name == "repo/b.txt" {
+				content = "b"
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			sources[name] = publish.Source{Path: path}
+		}
+		return sources
+	}
+	exists := func(name string, target *metadata.TargetFiles) bool {
+		for _, rel := range publish.HashedPaths(name, target.Hashes) {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	start := time.Now()
+	published := []time.Time{start, start.Add(2 * time.Hour), start.Add(2*time.Hour + 30*time.Minute)}
+	for i := range generations {
+		if _, _, err := publish.Publish(dir, generations[i], sources(i), publish.ModeCopy); err != nil {
+			t.Fatal(err)
+		}
+		removed, err := publish.Prune(dir, int64(i+1), generations[i], time.Hour, published[i])
+		if err != nil || len(removed) != 0 {
+			t.Fatal(i, removed, err)
+		}
+	}
+
+	// Generation 1 was superseded over an hour ago, generation 2 half an hour
+	// ago: only the files of generation 1 nothing else references are removed
+	removed, err := publish.Prune(dir, 3, generations[2], time.Hour, start.Add(3*time.Hour+time.Minute))
+	if err != nil || len(removed) != 2 {
+		t.Fatal(removed, err)
+	}
+	if exists("repo/a.txt", generations[0]["repo/a.txt"]) || !exists("repo/b.txt", generations[0]["repo/b.txt"]) ||
+		!exists("repo/a.txt", generations[1]["repo/a.txt"]) || !exists("repo/a.txt", generations[2]["repo/a.txt"]) {
+		t.Fatal("wrong files removed", removed)
+	}
+
+	// Once generation 2 is past the grace period too, b.txt goes
+	removed, err = publish.Prune(dir, 3, generations[2], time.Hour, start.Add(4*time.Hour))
+	if err != nil || len(removed) != 4 || exists("repo/b.txt", generations[1]["repo/b.txt"]) || !exists("repo/a.txt", generations[2]["repo/a.txt"]) {
+		t.Fatal(removed, err)
+	}
+
+	// A corrupt record is not overwritten
+	if err = os.WriteFile(filepath.Join(dir, publish.GenerationsFilename), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = publish.Prune(dir, 4, generations[2], time.Hour, start); err == nil {
+		t.Fatal("corrupt record accepted")
+	}
+}
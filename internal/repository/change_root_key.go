@@ -6,7 +6,6 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"log/slog"
-	"path/filepath"
 	"slices"
 
 	"see_updater/internal/pkg/cryptography"
@@ -265,8 +264,9 @@ func changeRootKey(config configChangeRootKey) error {
 		return fmt.Errorf("metadata directory is not writable: %w", err)
 	}
 	filename := fmt.Sprintf("%d.%s.json", roles.Root().Signed.Version, Root)
-	fmt.Println("FILENAME", filename)
-	err = roles.Root().ToFile(filepath.Join(config.metadataDir, filename), true)
+	err = writeMetadataFiles(config.metadataDir, ChangeRootKeyVerb, []metadataFile{
+		{filename, func(path string) error { return roles.Root().ToFile(path, true) }},
+	})
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to write root metadata to file", slog.Any("error", err))
 		return fmt.Errorf("fail to write root metadata to file: %w", err)
@@ -0,0 +1,637 @@
+package repository
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"see_updater/internal/pkg/cryptography"
+	"see_updater/internal/pkg/datetime"
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/logging"
+	"see_updater/internal/pkg/metahelper"
+	"see_updater/internal/pkg/publish"
+
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/repository"
+)
+
+// Release channels (e.g. stable, beta, nightly) are delegated targets roles
+// of the top-level targets, one per channel, signed with their own keys. The
+// targets of a channel are named <channel>/<target>, and clients of a channel
+// download <channel>/<target>.
+
+// Deepest target names of a channel, in path segments after the channel:
+// delegated path patterns match one segment per "*".
+const channelDepth = 8
+
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Channel as listed by `channel list`.
+type channelListing struct {
+	Name    string          `json:"name"`
+	Version int64           `json:"version"`
+	Expires time.Time       `json:"expires"`
+	KeyIDs  []string        `json:"keyids"`
+	Targets []channelTarget `json:"targets"`
+}
+
+type channelTarget struct {
+	Name   string            `json:"name"` // without the channel
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+	Custom *json.RawMessage  `json:"custom,omitempty"`
+}
+
+// Path patterns of the targets delegated to channel.
+func channelPaths(channel string) []string {
+	paths := []string{}
+	for depth := 1; depth <= channelDepth; depth++ {
+		paths = append(paths, channel+strings.Repeat("/*", depth))
+	}
+	return paths
+}
+
+func checkChannelName(name string) error {
+	if !channelNamePattern.MatchString(name) || slices.Contains(getRoles(), name) {
+		return fmt.Errorf("%w: invalid channel name %q, use lowercase letters, digits, \"-\" and \"_\", other than %s",
+			ErrUsage, name, strings.Join(getRoles(), ", "))
+	}
+	return nil
+}
+
+// Channels delegated by targets, in delegation order.
+func channelNames(targets *metadata.Metadata[metadata.TargetsType]) []string {
+	names := []string{}
+	if targets.Signed.Delegations != nil {
+		for _, role := range targets.Signed.Delegations.Roles {
+			names = append(names, role.Name)
+		}
+	}
+	return names
+}
+
+// Refuse top-level targets named <channel>/... for any channel of targets, or
+// for channel if given: the top-level targets come first for clients, they
+// would hide what the channel serves.
+func checkChannelNamespace(targets *metadata.Metadata[metadata.TargetsType], channel string) error {
+	channels := channelNames(targets)
+	if channel != "" {
+		channels = []string{channel}
+	}
+	names := []string{}
+	for name := range targets.Signed.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, channel := range channels {
+		for _, name := range names {
+			if strings.HasPrefix(name, channel+"/") {
+				return fmt.Errorf("%w: target %s is in the namespace of channel %s, rename it (see --%s) or exclude it", ErrUsage, name, channel, ScanTargetPrefix)
+			}
+		}
+	}
+	return nil
+}
+
+func delegatedRole(targets *metadata.Metadata[metadata.TargetsType], channel string) *metadata.DelegatedRole {
+	if targets.Signed.Delegations == nil {
+		return nil
+	}
+	for i := range targets.Signed.Delegations.Roles {
+		if targets.Signed.Delegations.Roles[i].Name == channel {
+			return &targets.Signed.Delegations.Roles[i]
+		}
+	}
+	return nil
+}
+
+// Load the latest metadata files of the top-level roles and of every channel
+// of metadataDir. The top-level roles are verified against root, and the
+// channels against targets unless verify is false.
+func loadChannelRoles(ctx context.Context, metadataDir string, verify bool) (roleSet, error) {
+	roles := repository.New()
+	load := func(role string, fromFile func(path string) error) error {
+		paths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, role)
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to load metadata filepaths", slog.Any("error", err), slog.String("role", role))
+			return fmt.Errorf("fail to load metadata filepaths: %w", err)
+		}
+		if err = fromFile(paths[len(paths)-1]); err != nil {
+			slog.ErrorContext(ctx, "fail to load metadata from file", slog.Any("error", err), slog.String("role", role))
+			return fmt.Errorf("fail to load %s metadata from file: %w", role, err)
+		}
+		return nil
+	}
+	err := load(Root, func(path string) error {
+		root, err := metadata.Root().FromFile(path)
+		roles.SetRoot(root)
+		return err
+	})
+	if err == nil {
+		err = load(Targets, func(path string) error {
+			targets, err := metadata.Targets().FromFile(path)
+			roles.SetTargets(Targets, targets)
+			return err
+		})
+	}
+	if err == nil {
+		err = load(Snapshot, func(path string) error {
+			snapshot, err := metadata.Snapshot().FromFile(path)
+			roles.SetSnapshot(snapshot)
+			return err
+		})
+	}
+	if err == nil {
+		err = load(Timestamp, func(path string) error {
+			timestamp, err := metadata.Timestamp().FromFile(path)
+			roles.SetTimestamp(timestamp)
+			return err
+		})
+	}
+	for _, channel := range channelNames(roles.Targets(Targets)) {
+		if err != nil {
+			break
+		}
+		err = load(channel, func(path string) error {
+			targets, err := metadata.Targets().FromFile(path)
+			roles.SetTargets(channel, targets)
+			return err
+		})
+	}
+	if err != nil || !verify {
+		return roles, err
+	}
+
+	for _, name := range []string{Root, Targets, Snapshot, Timestamp} {
+		switch name {
+		case Root:
+			err = roles.Root().VerifyDelegate(Root, roles.Root())
+		case Targets:
+			err = roles.Root().VerifyDelegate(Targets, roles.Targets(Targets))
+		case Snapshot:
+			err = roles.Root().VerifyDelegate(Snapshot, roles.Snapshot())
+		case Timestamp:
+			err = roles.Root().VerifyDelegate(Timestamp, roles.Timestamp())
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to verify metadata signature for previous version", slog.Any("error", err), slog.String("role", name))
+			return nil, fmt.Errorf("fail to verify %s metadata signature for PREVIOUS version: %w", strings.ToUpper(name), err)
+		}
+	}
+	for _, channel := range channelNames(roles.Targets(Targets)) {
+		if err = roles.Targets(Targets).VerifyDelegate(channel, roles.Targets(channel)); err != nil {
+			slog.ErrorContext(ctx, "fail to verify metadata signature for previous version", slog.Any("error", err), slog.String("role", channel))
+			return nil, fmt.Errorf("fail to verify channel %s metadata signature for PREVIOUS version: %w", channel, err)
+		}
+	}
+	return roles, nil
+}
+
+// Copy of the targets metadata, to edit the next version.
+func copyTargets(targets *metadata.Metadata[metadata.TargetsType]) (*metadata.Metadata[metadata.TargetsType], error) {
+	bytes, err := targets.ToBytes(false)
+	if err != nil {
+		return nil, fmt.Errorf("fail to copy targets metadata: %w", err)
+	}
+	copied, err := metadata.Targets().FromBytes(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("fail to copy targets metadata: %w", err)
+	}
+	return copied, nil
+}
+
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	bytes, err := filesystem.ReadBytesFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return cryptography.ParseRsaPrivateKeyFromPemStr(string(bytes))
+}
+
+// Add a channel: a delegated role of the top-level targets for the targets
+// named <channel>/..., signed by the channel key, with no target yet. Writes
+// new targets, channel, snapshot and timestamp versions.
+func addChannel(config configChannel, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("channel", config.name),
+		slog.String("channel_privkey_filepath", config.privkeyFilepath),
+		slog.Int("expire_in", int(config.expireIn)),
+	))
+
+	if err := checkChannelName(config.name); err != nil {
+		return err
+	}
+	roles, err := loadChannelRoles(ctx, config.metadataDir, true)
+	if err != nil {
+		return err
+	}
+	targets := roles.Targets(Targets)
+	if delegatedRole(targets, config.name) != nil {
+		return fmt.Errorf("%w: channel %s already exists", ErrUsage, config.name)
+	}
+	if err = checkChannelNamespace(targets, config.name); err != nil {
+		return err
+	}
+	privkey, err := loadPrivateKey(config.privkeyFilepath)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to load channel key", slog.Any("error", err))
+		return fmt.Errorf("fail to load key of channel %s: %w", config.name, err)
+	}
+	key, err := metadata.KeyFromPublicKey(privkey.Public())
+	if err != nil {
+		return fmt.Errorf("fail to load key of channel %s: %w", config.name, err)
+	}
+
+	nextTargets, err := copyTargets(targets)
+	if err != nil {
+		return err
+	}
+	if nextTargets.Signed.Delegations == nil {
+		nextTargets.Signed.Delegations = &metadata.Delegations{Keys: map[string]*metadata.Key{}}
+	}
+	nextTargets.Signed.Delegations.Keys[key.ID()] = key
+	nextTargets.Signed.Delegations.Roles = append(nextTargets.Signed.Delegations.Roles, metadata.DelegatedRole{
+		Name:        config.name,
+		KeyIDs:      []string{key.ID()},
+		Threshold:   1,
+		Terminating: true,
+		Paths:       channelPaths(config.name),
+	})
+	nextTargets.Signed.Version = targets.Signed.Version + 1
+	nextTargets.Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+	roles.SetTargets(Targets, nextTargets)
+	roles.SetTargets(config.name, metadata.Targets(datetime.ExpireIn(int(config.expireIn))))
+
+	fmt.Fprintf(out.text, "Adding channel %s for the targets named %s/...\n", config.name, config.name)
+	if config.askConfirmation {
+		if err = out.confirmer.Confirm(); err != nil {
+			return fmt.Errorf("fail to confirm operation: %w", err)
+		}
+	}
+	keys := map[string]*rsa.PrivateKey{config.name: privkey}
+	if config.targetsPrivkeyFilepath != "" {
+		if keys[Targets], err = loadPrivateKey(config.targetsPrivkeyFilepath); err != nil {
+			slog.ErrorContext(ctx, "fail to load targets key", slog.Any("error", err))
+			return err
+		}
+	}
+	return signChannelUpdate(ctx, ChannelVerb+" "+ChannelAddVerb, config, roles, []string{Targets, config.name}, keys, out)
+}
+
+// Copy the entries of the names from channel --from (or the top-level
+// targets) to channel --to, hashes and custom metadata included: the target
+// files are not read again. Writes new channel, snapshot and timestamp
+// versions, the top-level targets are untouched.
+func promoteTargets(config configChannel, names []string, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("from", config.from),
+		slog.String("to", config.to),
+		slog.Any("targets", names),
+		slog.String("channel_privkey_filepath", config.privkeyFilepath),
+		slog.Int("expire_in", int(config.expireIn)),
+	))
+
+	roles, err := loadChannelRoles(ctx, config.metadataDir, true)
+	if err != nil {
+		return err
+	}
+	channels := channelNames(roles.Targets(Targets))
+	if config.from != Targets && !slices.Contains(channels, config.from) {
+		return fmt.Errorf("%w: unknown --%s channel %q, channels: %s", ErrUsage, ChannelFrom, config.from, strings.Join(append([]string{Targets}, channels...), ", "))
+	}
+	if !slices.Contains(channels, config.to) || config.to == config.from {
+		return fmt.Errorf("%w: invalid --%s channel %q, channels: %s", ErrUsage, ChannelTo, config.to, strings.Join(channels, ", "))
+	}
+
+	source := roles.Targets(config.from)
+	next, err := copyTargets(roles.Targets(config.to))
+	if err != nil {
+		return err
+	}
+	sourceNames := map[string]string{} // promoted name -> name in --from
+	notFound := []string{}
+	for _, name := range names {
+		// Names are given without the channel, or as listed in --from
+		if config.from != Targets {
+			name = strings.TrimPrefix(name, config.from+"/")
+		}
+		sourceName := name
+		if config.from != Targets {
+			sourceName = config.from + "/" + name
+		}
+		target := source.Signed.Targets[sourceName]
+		if target == nil {
+			notFound = append(notFound, name)
+			continue
+		}
+		if err = checkTargetName(name); err != nil {
+			return err
+		}
+		if depth := len(strings.Split(name, "/")); depth > channelDepth {
+			return fmt.Errorf("%w: target %s is %d levels deep, channels hold targets up to %d levels", ErrUsage, name, depth, channelDepth)
+		}
+		bytes, err := json.Marshal(target)
+		if err != nil {
+			return fmt.Errorf("fail to copy target %s: %w", sourceName, err)
+		}
+		promoted := metadata.TargetFile()
+		if err = json.Unmarshal(bytes, promoted); err != nil {
+			return fmt.Errorf("fail to copy target %s: %w", sourceName, err)
+		}
+		promoted.Path = config.to + "/" + name
+		next.Signed.Targets[promoted.Path] = promoted
+		sourceNames[promoted.Path] = sourceName
+	}
+	if len(notFound) > 0 {
+		sort.Strings(notFound)
+		return fmt.Errorf("%w: %d targets not found in %s: %s", ErrUsage, len(notFound), config.from, strings.Join(notFound, ", "))
+	}
+	yanked, err := tombstones(roles.Targets(Targets))
+	if err != nil {
+		return err
+	}
+	if found := yankedTargets(yanked, next.Signed.Targets); len(found) > 0 {
+		return fmt.Errorf("%w: %d targets have the content of a yanked target: %s", ErrVerification, len(found), describeYanked(found))
+	}
+
+	changes := metahelper.CompareNewOldTargets(next, roles.Targets(config.to), true)
+	if len(changes) == 0 {
+		fmt.Fprintf(out.text, "Channel %s already serves the targets, no metadata file was written\n", config.to)
+		return nil
+	}
+	fmt.Fprintf(out.text, "Promoting from %s to %s\n", config.from, config.to)
+	printTargetChanges(out, targetChanges(changes))
+	if config.askConfirmation {
+		if err = out.confirmer.Confirm(); err != nil {
+			return fmt.Errorf("fail to confirm operation: %w", err)
+		}
+	}
+	privkey, err := loadPrivateKey(config.privkeyFilepath)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to load channel key", slog.Any("error", err))
+		return fmt.Errorf("fail to load key of channel %s: %w", config.to, err)
+	}
+	keys := map[string]*rsa.PrivateKey{config.to: privkey}
+	next.Signed.Version = roles.Targets(config.to).Signed.Version + 1
+	next.Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+	roles.SetTargets(config.to, next)
+
+	// Consistent snapshot clients download the promoted targets under their
+	// new names, published from the files of the source targets
+	sources := map[string]publish.Source{}
+	if config.publish.dir != "" {
+		for _, change := range changes {
+			from := source.Signed.Targets[sourceNames[change.New.Path]]
+			for _, rel := range publish.HashedPaths(from.Path, from.Hashes) {
+				path := filepath.Join(config.publish.dir, filepath.FromSlash(rel))
+				if _, err := os.Stat(path); err == nil {
+					sources[change.New.Path] = publish.Source{Path: path}
+					break
+				}
+			}
+		}
+	}
+	promoted := map[string]*metadata.TargetFiles{}
+	for _, change := range changes {
+		promoted[change.New.Path] = next.Signed.Targets[change.New.Path]
+	}
+	if err = config.publish.publishTargets(ctx, roles.Root().Signed.ConsistentSnapshot, promoted, sources, out); err != nil {
+		return err
+	}
+	return signChannelUpdate(ctx, ChannelVerb+" "+ChannelPromoteVerb, config, roles, []string{config.to}, keys, out)
+}
+
+// Sign the changed roles (the top-level targets and channels, whose next
+// versions are in roles) with keys, point a new snapshot and timestamp at
+// them and write them all. Snapshot and timestamp are signed with the keys of
+// config if given, left unsigned otherwise.
+func signChannelUpdate(ctx context.Context, verb string, config configChannel, roles roleSet, changed []string,
+	keys map[string]*rsa.PrivateKey, out *cmdOutput) error {
+	hashed, err := metaHashes(config.metaHashes)
+	if err != nil {
+		return err
+	}
+	if hashed, err = keptMetaHashes(config.metadataDir, hashed); err != nil {
+		return err
+	}
+	for name, path := range map[string]string{Snapshot: config.snapshotPrivkeyFilepath, Timestamp: config.timestampPrivkeyFilepath} {
+		if path == "" {
+			continue
+		}
+		if keys[name], err = loadPrivateKey(path); err != nil {
+			slog.ErrorContext(ctx, "fail to load key", slog.Any("error", err), slog.String("role", name))
+			return err
+		}
+	}
+
+	// Check if keys are valid for roles
+	for name, key := range keys {
+		keyMetadata, err := metadata.KeyFromPublicKey(key.Public())
+		if err != nil {
+			return err
+		}
+		keyIDs := []string{}
+		if role := delegatedRole(roles.Targets(Targets), name); role != nil {
+			keyIDs = role.KeyIDs
+		} else if role := roles.Root().Signed.Roles[name]; role != nil {
+			keyIDs = role.KeyIDs
+		}
+		if !slices.Contains(keyIDs, keyMetadata.ID()) {
+			slog.ErrorContext(ctx, "invalid key for role", slog.String("role", name))
+			return fmt.Errorf("%w: invalid key for role : %s", ErrUsage, name)
+		}
+	}
+
+	roles.Snapshot().Signed.Version += 1
+	roles.Snapshot().Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+	roles.Timestamp().Signed.Version += 1
+	roles.Timestamp().Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+	sign := func(name string, sign func(signature.Signer) error) error {
+		key := keys[name]
+		if key == nil {
+			slog.InfoContext(ctx, fmt.Sprintf("No key provided for role: %s, skipping signing operation\n", name))
+			return nil
+		}
+		signer, err := signature.LoadSigner(key, crypto.SHA256)
+		if err == nil {
+			err = sign(signer)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to sign metadata", slog.Any("error", err), slog.String("role", name))
+			return fmt.Errorf("fail to sign metadata for role: %s\n\terror: %w", name, err)
+		}
+		return nil
+	}
+
+	// Signing, in order: snapshot and timestamp may record the hashes of the
+	// signed files
+	files := []metadataFile{}
+	for _, name := range changed {
+		targets := roles.Targets(name)
+		targets.ClearSignatures()
+		if err = sign(name, func(signer signature.Signer) error {
+			_, err := targets.Sign(signer)
+			return err
+		}); err != nil {
+			return err
+		}
+		meta := metadata.MetaFile(targets.Signed.Version)
+		if slices.Contains(hashed, Snapshot) {
+			data, err := targets.ToBytes(true)
+			if err != nil {
+				return fmt.Errorf("fail to serialize %s metadata: %w", name, err)
+			}
+			digest := sha256.Sum256(data)
+			meta.Length = int64(len(data))
+			meta.Hashes = metadata.Hashes{"sha256": digest[:]}
+		}
+		roles.Snapshot().Signed.Meta[name+".json"] = meta
+		files = append(files, metadataFile{fmt.Sprintf("%d.%s.json", targets.Signed.Version, name),
+			func(path string) error { return targets.ToFile(path, true) }})
+	}
+	roles.Snapshot().ClearSignatures()
+	if err = sign(Snapshot, func(signer signature.Signer) error {
+		_, err := roles.Snapshot().Sign(signer)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err = setMetaFile(roles, Timestamp, slices.Contains(hashed, Timestamp)); err != nil {
+		slog.ErrorContext(ctx, "fail to update meta", slog.Any("error", err), slog.String("role", Timestamp))
+		return err
+	}
+	roles.Timestamp().ClearSignatures()
+	if err = sign(Timestamp, func(signer signature.Signer) error {
+		_, err := roles.Timestamp().Sign(signer)
+		return err
+	}); err != nil {
+		return err
+	}
+	files = append(files,
+		metadataFile{fmt.Sprintf("%d.%s.json", roles.Snapshot().Signed.Version, Snapshot),
+			func(path string) error { return roles.Snapshot().ToFile(path, true) }},
+		metadataFile{fmt.Sprintf("%s.json", Timestamp),
+			func(path string) error { return roles.Timestamp().ToFile(path, true) }})
+
+	// Verify newer version and prompt reminder for omitted keys
+	for _, name := range append(append([]string{}, changed...), Snapshot, Timestamp) {
+		var verErr error
+		switch name {
+		case Targets:
+			verErr = roles.Root().VerifyDelegate(Targets, roles.Targets(Targets))
+		case Snapshot:
+			verErr = roles.Root().VerifyDelegate(Snapshot, roles.Snapshot())
+		case Timestamp:
+			verErr = roles.Root().VerifyDelegate(Timestamp, roles.Timestamp())
+		default:
+			verErr = roles.Targets(Targets).VerifyDelegate(name, roles.Targets(name))
+		}
+		if verErr == nil {
+			continue
+		}
+		slog.Warn("fail to verify metadata signature for new version", slog.Any("error", verErr), slog.String("role", name))
+		fmt.Fprintln(out.text, "Please make sure that the right keys were used, otherwise please perform additional signing to meet the threshold")
+		fmt.Fprintln(out.text, "Program will now proceed to write the signature to the metadata file (irreversible)")
+		if config.askConfirmation {
+			if err = out.confirmer.Confirm(); err != nil {
+				fmt.Fprintln(out.text, "Operation aborted, no changes were made")
+				return fmt.Errorf("fail to confirm operation: %w", err)
+			}
+		}
+	}
+
+	// All or none of the files are written
+	if err = writeMetadataFiles(config.metadataDir, verb, files); err != nil {
+		slog.ErrorContext(ctx, "fail to save metadata to file", slog.Any("error", err))
+		slog.InfoContext(ctx, "no metadata file was written")
+		return fmt.Errorf("fail to save metadata to file\n\terror: %w", err)
+	}
+	return nil
+}
+
+// Show the targets each channel serves, or only the given channels.
+func listChannels(config configChannel, only []string, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+	))
+
+	// Unsigned channels are listed too, verify checks them
+	roles, err := loadChannelRoles(ctx, config.metadataDir, false)
+	if err != nil {
+		return err
+	}
+	channels := channelNames(roles.Targets(Targets))
+	for _, name := range only {
+		if !slices.Contains(channels, name) {
+			return fmt.Errorf("%w: unknown channel %q, channels: %s", ErrUsage, name, strings.Join(channels, ", "))
+		}
+	}
+
+	listings := []channelListing{}
+	for _, channel := range channels {
+		if len(only) > 0 && !slices.Contains(only, channel) {
+			continue
+		}
+		targets := roles.Targets(channel)
+		listing := channelListing{Name: channel, Version: targets.Signed.Version, Expires: targets.Signed.Expires,
+			KeyIDs: delegatedRole(roles.Targets(Targets), channel).KeyIDs, Targets: []channelTarget{}}
+		for name, target := range targets.Signed.Targets {
+			listing.Targets = append(listing.Targets, channelTarget{Name: strings.TrimPrefix(name, channel+"/"), Length: target.Length,
+				Hashes: hexHashes(target.Hashes), Custom: target.Custom})
+		}
+		sort.Slice(listing.Targets, func(i, j int) bool { return listing.Targets[i].Name < listing.Targets[j].Name })
+		listings = append(listings, listing)
+	}
+	out.result.Data = listings
+
+	if len(listings) == 0 {
+		fmt.Fprintf(out.text, "No channel, add one with `%s %s`\n", ChannelVerb, ChannelAddVerb)
+		return nil
+	}
+	w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+	fmt.Fprintln(w, "\tChannel\tVersion\tExpiration\tTarget\tLength\tRelease\tHash")
+	for _, listing := range listings {
+		fmt.Fprintf(w, "\t%s\t%d\t%s\t", listing.Name, listing.Version, listing.Expires.Format(time.RFC3339))
+		if len(listing.Targets) == 0 {
+			fmt.Fprintln(w, "-\t\t\t")
+		}
+		for i, target := range listing.Targets {
+			if i > 0 {
+				fmt.Fprint(w, "\t\t\t\t")
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", target.Name, target.Length, releaseVersion(target.Custom), hashSummary(target.Hashes))
+		}
+	}
+	return w.Flush()
+}
+
+// The "version" custom field of a target, "-" if none.
+func releaseVersion(custom *json.RawMessage) string {
+	values := map[string]any{}
+	if custom == nil || json.Unmarshal(*custom, &values) != nil {
+		return "-"
+	}
+	if version, ok := values["version"].(string); ok {
+		return version
+	}
+	return "-"
+}
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"see_updater/internal/pkg/logging"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	envPrefix         = "UPDATER"
+	configName        = "updater" // updater.yaml/updater.toml in the current dir
+	configProfilesKey = "profiles"
+	sourceAnnotation  = "updater_source" // flag annotation recording where an applied value comes from
+)
+
+// Sources of a flag value, from the highest precedence to the lowest.
+const (
+	SourceFlag      = "flag"
+	SourceEnv       = "env"
+	SourceProfile   = "profile"
+	SourceFile      = "config file"
+	SourceWorkspace = "workspace"
+	SourceDefault   = "default"
+)
+
+// Settings read from the config file and UPDATER_* environment variables. In
+// the config file, command flags live in a section named after the command
+// (e.g. `update:` or `lock: {status: ...}`), global flags at the top level and
+// profiles under `profiles: {<name>: ...}` with the same layout.
+type settings struct {
+	v       *viper.Viper
+	file    string
+	profile string
+}
+
+// Effective value of a flag and where it comes from.
+type flagSetting struct {
+	Command string `json:"command"`
+	Flag    string `json:"flag"`
+	Value   string `json:"value"`
+	Source  string `json:"source"`
+}
+
+func loadSettings(configFile string, profile string) (*settings, error) {
+	s := &settings{v: viper.New(), profile: profile}
+	if configFile == "" {
+		configFile = os.Getenv(envName(GlobalConfig))
+	}
+	if s.profile == "" {
+		s.profile = os.Getenv(envName(GlobalProfile))
+	}
+
+	if configFile != "" {
+		s.v.SetConfigFile(configFile)
+	} else {
+		s.v.SetConfigName(configName)
+		s.v.AddConfigPath(".")
+	}
+	err := s.v.ReadInConfig()
+	if err != nil && errors.As(err, &viper.ConfigFileNotFoundError{}) {
+		// No config file in the current dir
+	} else if err != nil {
+		return nil, fmt.Errorf("fail to read config file: %w", err)
+	} else {
+		s.file = s.v.ConfigFileUsed()
+	}
+
+	if s.profile != "" && !s.v.IsSet(configProfilesKey+"."+s.profile) {
+		return nil, fmt.Errorf("profile %q not found in config file %s", s.profile, s.file)
+	}
+	return s, nil
+}
+
+// Config key of a flag, e.g. `update.metadata-dir`, or `git` for global flags.
+func configKey(cmd *cobra.Command, flag *pflag.Flag) string {
+	if cmd.Root().PersistentFlags().Lookup(flag.Name) == flag {
+		return flag.Name
+	}
+	path := strings.Fields(cmd.CommandPath())[1:]
+	return strings.Join(append(path, flag.Name), ".")
+}
+
+// Environment variable of a config key, e.g. UPDATER_UPDATE_METADATA_DIR.
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// Value of a flag from the environment, the profile or the config file.
+func (s *settings) lookup(key string) (string, string, bool) {
+	if value, ok := os.LookupEnv(envName(key)); ok {
+		return value, SourceEnv, true
+	}
+	if s.profile != "" {
+		profileKey := strings.Join([]string{configProfilesKey, s.profile, key}, ".")
+		if s.v.IsSet(profileKey) {
+			return configValue(s.v.Get(profileKey)), SourceProfile + " " + s.profile, true
+		}
+	}
+	if s.v.IsSet(key) {
+		return configValue(s.v.Get(key)), SourceFile, true
+	}
+	return "", "", false
+}
+
+// Lists (e.g. several key filepaths) are joined with ";" like on the command line.
+func configValue(value any) string {
+	if list, ok := value.([]any); ok {
+		items := []string{}
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ";")
+	}
+	return fmt.Sprint(value)
+}
+
+// Flags that select the settings themselves are never read from them.
+func isSettingsFlag(name string) bool {
+	return name == GlobalConfig || name == GlobalProfile || name == "help"
+}
+
+// Set the flags of cmd that were not given on the command line.
+func applySettings(cmd *cobra.Command, s *settings) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || isSettingsFlag(flag.Name) {
+			return
+		}
+		value, source, ok := s.lookup(configKey(cmd, flag))
+		if !ok {
+			return
+		}
+		if setErr := cmd.Flags().Set(flag.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value for --%s from %s: %w", flag.Name, source, setErr)
+			return
+		}
+		cmd.Flags().SetAnnotation(flag.Name, sourceAnnotation, []string{source})
+	})
+	return err
+}
+
+// Effective flag values of cmd without changing them.
+func resolveSettings(cmd *cobra.Command, s *settings, w *workspace) []flagSetting {
+	cmd.InheritedFlags() // merge the global flags into cmd.Flags()
+	var workspaceValues map[string]string
+	if w != nil {
+		workspaceValues = w.flagDefaults(cmd)
+	}
+	result := []flagSetting{}
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if isSettingsFlag(flag.Name) {
+			return
+		}
+		setting := flagSetting{Command: strings.Join(strings.Fields(cmd.CommandPath())[1:], " "), Flag: flag.Name,
+			Value: flag.Value.String(), Source: SourceDefault}
+		if source := flag.Annotations[sourceAnnotation]; flag.Changed && len(source) > 0 {
+			setting.Source = source[0]
+		} else if flag.Changed {
+			setting.Source = SourceFlag
+		} else if value, source, ok := s.lookup(configKey(cmd, flag)); ok {
+			setting.Value, setting.Source = value, source
+		} else if value := workspaceValues[flag.Name]; value != "" {
+			setting.Value, setting.Source = value, SourceWorkspace
+		}
+		result = append(result, setting)
+	})
+	return result
+}
+
+// Print the effective settings of the given commands (all if none) and the
+// source of each value.
+func showConfig(root *cobra.Command, config configConfigShow, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("config_file", config.configFile),
+		slog.String("profile", config.profile),
+		slog.Any("commands", config.commands),
+	))
+
+	s, err := loadSettings(config.configFile, config.profile)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to load settings", slog.Any("error", err))
+		return err
+	}
+	w, err := findWorkspace(config.workspaceDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to load workspace", slog.Any("error", err))
+		return err
+	}
+
+	commands := []*cobra.Command{}
+	if len(config.commands) > 0 {
+		cmd, _, err := root.Find(config.commands)
+		if err != nil || cmd == root {
+			return fmt.Errorf("unknown command %q", strings.Join(config.commands, " "))
+		}
+		commands = append(commands, cmd)
+	} else {
+		commands = runnableCommands(root)
+	}
+
+	file := s.file
+	if file == "" {
+		file = "none"
+	}
+	fmt.Fprintf(out.text, "Config file: %s\n", file)
+	if s.profile != "" {
+		fmt.Fprintf(out.text, "Profile: %s\n", s.profile)
+	}
+	if w != nil {
+		fmt.Fprintf(out.text, "Workspace: %s\n", w.root)
+	}
+	tw := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+	fmt.Fprintln(tw, "\tCommand\tFlag\tValue\tSource")
+	settings := []flagSetting{}
+	for _, cmd := range commands {
+		for _, setting := range resolveSettings(cmd, s, w) {
+			fmt.Fprintf(tw, "\t%s\t--%s\t%s\t%s\n", setting.Command, setting.Flag, setting.Value, setting.Source)
+			settings = append(settings, setting)
+		}
+	}
+	tw.Flush()
+	out.result.Data = settings
+	return nil
+}
+
+func runnableCommands(cmd *cobra.Command) []*cobra.Command {
+	commands := []*cobra.Command{}
+	for _, child := range cmd.Commands() {
+		if slices.Contains([]string{ConfigVerb, "help", "completion"}, child.Name()) {
+			continue
+		}
+		if child.Runnable() {
+			commands = append(commands, child)
+		}
+		commands = append(commands, runnableCommands(child)...)
+	}
+	sort.SliceStable(commands, func(i, j int) bool { return commands[i].CommandPath() < commands[j].CommandPath() })
+	return commands
+}
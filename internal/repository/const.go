@@ -10,6 +10,20 @@ const (
 	Timestamp = "timestamp"
 
 	// Flags
+	// Global
+	GlobalGit  = "git"
+	GlobalWait = "wait"
+	// Flags for global workspace directory
+	GlobalWorkspaceDir = "workspace-dir"
+	GlobalConfig       = "config"
+	GlobalProfile      = "profile"
+	GlobalOutput       = "output"
+	GlobalYes          = "yes"
+	GlobalNoInput      = "no-input"
+	GlobalDryRun       = "dry-run"
+	// Values of --output
+	OutputText = "text"
+	OutputJSON = "json"
 	// KeygenVerb
 	KeygenVerb            = "keygen"
 	KeygenOutputDir       = "output-dir"
@@ -28,6 +42,8 @@ const (
 	InitSnapshotThreshold        = "snapshot-threshold"
 	InitTimestampThreshold       = "timestamp-threshold"
 	InitExpire                   = "expire"
+	InitForce                    = "force"
+	InitConsistentSnapshot       = "consistent-snapshot"
 	// UpdateVerb
 	UpdateVerb                     = "update"
 	UpdateRepositoryDir            = "repository-dir"
@@ -37,6 +53,43 @@ const (
 	UpdateTimestampPrivkeyFilepath = "timestamp-priv-filepath"
 	UpdateExpire                   = "expire"
 	UpdateAskConfirmation          = "ask-confirmation"
+	UpdatePlanVerb                 = "plan"
+	UpdateApplyVerb                = "apply"
+	UpdatePlanFilepath             = "plan-filepath"
+	UpdateFailOnRemoval            = "fail-on-removal"
+	UpdateMigratePaths             = "migrate-paths"
+	// Target
+	TargetVerb                     = "target"
+	TargetAddVerb                  = "add"
+	TargetRemoveVerb               = "remove"
+	TargetRehashVerb               = "rehash"
+	TargetYankVerb                 = "yank"
+	TargetRepositoryDir            = "repository-dir"
+	TargetMetadataDir              = "metadata-dir"
+	TargetAs                       = "as"
+	TargetHash                     = "hash"
+	TargetLength                   = "length"
+	TargetReason                   = "reason"
+	TargetChannelKey               = "channel-key"
+	TargetTargetsPrivkeyFilepath   = "targets-priv-filepath"
+	TargetSnapshotPrivkeyFilepath  = "snapshot-priv-filepath"
+	TargetTimestampPrivkeyFilepath = "timestamp-priv-filepath"
+	TargetExpire                   = "expire"
+	TargetAskConfirmation          = "ask-confirmation"
+	// Channel
+	ChannelVerb                     = "channel"
+	ChannelAddVerb                  = "add"
+	ChannelPromoteVerb              = "promote"
+	ChannelListVerb                 = "list"
+	ChannelMetadataDir              = "metadata-dir"
+	ChannelFrom                     = "from"
+	ChannelTo                       = "to"
+	ChannelPrivkeyFilepath          = "priv-filepath"
+	ChannelTargetsPrivkeyFilepath   = "targets-priv-filepath"
+	ChannelSnapshotPrivkeyFilepath  = "snapshot-priv-filepath"
+	ChannelTimestampPrivkeyFilepath = "timestamp-priv-filepath"
+	ChannelExpire                   = "expire"
+	ChannelAskConfirmation          = "ask-confirmation"
 	// SignVerb
 	SignVerb            = "sign"
 	SignMetadataDir     = "metadata-dir"
@@ -56,6 +109,7 @@ const (
 	VerifyVerb          = "verify"
 	VerifyRepositoryDir = "repository-dir"
 	VerifyMetadataDir   = "metadata-dir"
+	VerifyFailOnRemoval = "fail-on-removal"
 	// Change root key
 	ChangeRootKeyVerb                       = "change-root-key"
 	ChangeRootKeyMetadataDir                = "metadata-dir"
@@ -68,6 +122,50 @@ const (
 	ChangeRootKeyReplacementPrivkeyFilepath = "repl-priv-filepath"
 	ChangeRootKeyExpire                     = "expire"
 	ChangeRootKeyThreshold                  = "threshold"
+	// History
+	HistoryVerb        = "history"
+	HistoryMetadataDir = "metadata-dir"
+	// Lock
+	LockVerb        = "lock"
+	LockStatusVerb  = "status"
+	LockBreakVerb   = "break"
+	LockMetadataDir = "metadata-dir"
+	LockBreakForce  = "force"
+	// Recover
+	RecoverVerb        = "recover"
+	RecoverMetadataDir = "metadata-dir"
+	// Undo
+	UndoVerb        = "undo"
+	UndoMetadataDir = "metadata-dir"
+	// Config
+	ConfigVerb     = "config"
+	ConfigShowVerb = "show"
+	// Scan of the repository dir (init, update, update plan, verify)
+	ScanExclude        = "exclude"
+	ScanInclude        = "include"
+	ScanTargetPrefix   = "target-prefix"
+	ScanStripRoot      = "strip-root"
+	ScanSymlinks       = "symlinks"
+	ScanJobs           = "jobs"
+	ScanHashCache      = "hash-cache"
+	ScanParanoid       = "paranoid"
+	ScanHashAlgorithms = "hash-algorithms"
+	ScanCustomSidecars = "custom-sidecars"
+	ScanCustomManifest = "custom-manifest"
+	ScanCustomSchema   = "custom-schema"
+
+	// Length and hashes of the files referenced by snapshot and timestamp
+	// (init, update, update apply, target)
+	MetaHashes = "meta-hashes"
+
+	// Target files of a consistent snapshot repository (init, update, update
+	// apply, target)
+	PublishDir   = "publish-dir"
+	PublishMode  = "publish-mode"
+	PublishGrace = "publish-grace"
+
+	// Ignore rules at the root of the repository dir
+	IgnoreFilename = ".tufignore"
 
 	// Operation result messages
 	KeygenFailed             = "----------KEYGEN FAILED----------"
@@ -76,6 +174,14 @@ const (
 	InitSucceeded            = "----------INIT SUCCEEDED----------"
 	UpdateFailed             = "----------UPDATE FAILED----------"
 	UpdateSucceeded          = "----------UPDATE SUCCEEDED----------"
+	UpdatePlanFailed         = "----------UPDATE PLAN FAILED----------"
+	UpdatePlanSucceeded      = "----------UPDATE PLAN SUCCEEDED----------"
+	UpdateApplyFailed        = "----------UPDATE APPLY FAILED----------"
+	UpdateApplySucceeded     = "----------UPDATE APPLY SUCCEEDED----------"
+	TargetFailed             = "----------TARGET FAILED----------"
+	TargetSucceeded          = "----------TARGET SUCCEEDED----------"
+	ChannelFailed            = "----------CHANNEL FAILED----------"
+	ChannelSucceeded         = "----------CHANNEL SUCCEEDED----------"
 	SignFailed               = "----------SIGN FAILED----------"
 	SignSucceeded            = "----------SIGN SUCCEEDED----------"
 	ChangeThresholdFailed    = "----------CHANGE THRESHOLD FAILED----------"
@@ -84,6 +190,16 @@ const (
 	VerifySucceeded          = "----------VERIFY SUCCEEDED----------"
 	ChangeRootKeyFailed      = "----------CHANGE ROOT KEY FAILED----------"
 	ChangeRootKeySucceeded   = "----------CHANGE ROOT KEY SUCCEEDED----------"
+	HistoryFailed            = "----------HISTORY FAILED----------"
+	HistorySucceeded         = "----------HISTORY SUCCEEDED----------"
+	LockFailed               = "----------LOCK FAILED----------"
+	LockSucceeded            = "----------LOCK SUCCEEDED----------"
+	RecoverFailed            = "----------RECOVER FAILED----------"
+	RecoverSucceeded         = "----------RECOVER SUCCEEDED----------"
+	UndoFailed               = "----------UNDO FAILED----------"
+	UndoSucceeded            = "----------UNDO SUCCEEDED----------"
+	ConfigFailed             = "----------CONFIG FAILED----------"
+	ConfigSucceeded          = "----------CONFIG SUCCEEDED----------"
 
 	// Testing constants, paths are relative to the resository_test.go file
 	TestDir                         = "../../test/"
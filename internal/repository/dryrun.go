@@ -0,0 +1,267 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/metahelper"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Commands supporting --dry-run.
+var dryRunCommands = []string{InitVerb, UpdateVerb, UpdateVerb + " " + UpdateApplyVerb,
+	TargetVerb + " " + TargetAddVerb, TargetVerb + " " + TargetRemoveVerb, TargetVerb + " " + TargetYankVerb,
+	TargetVerb + " " + TargetRehashVerb,
+	ChannelVerb + " " + ChannelAddVerb, ChannelVerb + " " + ChannelPromoteVerb, SignVerb, ChangeThresholdVerb, ChangeRootKeyVerb}
+
+// Mutating commands without --dry-run support, they refuse it rather than run
+// for real.
+var noDryRunCommands = []string{KeygenVerb, RecoverVerb, UndoVerb, LockBreakVerb}
+
+// Scratch copy of a metadata dir that a dry-run operation writes to instead of
+// the real one.
+type dryRunDir struct {
+	original string
+	local    string
+}
+
+// Signature status of a metadata file written by a dry-run operation.
+type roleThreshold struct {
+	Role       string `json:"role"`
+	File       string `json:"file"`
+	Signatures int    `json:"signatures"`
+	Threshold  int    `json:"threshold"`
+	Met        bool   `json:"met"`
+	Error      string `json:"error,omitempty"`
+}
+
+// With --dry-run, replace *dir with a scratch copy of it, returns nil otherwise.
+// The tool state (lock, journal, operation log) and the git repository are
+// not copied.
+func stageDryRun(global *configGlobal, dir *string) (*dryRunDir, error) {
+	if !global.dryRun {
+		return nil, nil
+	}
+	tmp, err := os.MkdirTemp("", "updater-dry-run-")
+	if err != nil {
+		return nil, fmt.Errorf("fail to make temporary dir: %w", err)
+	}
+	d := &dryRunDir{original: *dir, local: filepath.Join(tmp, filepath.Base(filepath.Clean(*dir)))}
+
+	err = filepath.WalkDir(d.original, func(p string, di fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != d.original && (di.Name() == ".git" || slices.Contains(stateFilenames(), di.Name())) {
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(d.original, p)
+		if err != nil {
+			return err
+		}
+		if di.IsDir() {
+			return filesystem.MakeNewDirAll(filepath.Join(d.local, rel))
+		}
+		content, err := filesystem.ReadBytesFromFile(p)
+		if err != nil {
+			return err
+		}
+		return filesystem.WriteBytesToFile(filepath.Join(d.local, rel), content)
+	})
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		err = nil // e.g. init of a new output dir
+	}
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("fail to copy metadata dir %s for dry run: %w", d.original, err)
+	}
+	slog.Info("dry run, writing to a copy of the metadata dir", slog.String("metadata_dir", d.original), slog.String("copy", d.local))
+	*dir = d.local
+	return d, nil
+}
+
+func (d *dryRunDir) Close() {
+	if d == nil {
+		return
+	}
+	if err := os.RemoveAll(filepath.Dir(d.local)); err != nil {
+		slog.Warn("fail to remove dry run dir", slog.Any("error", err), slog.String("dir", d.local))
+	}
+}
+
+// Print what op would have written: files, versions, signatures, threshold
+// status of every written file and the diff against the current files.
+func (d *dryRunDir) report(op operation, out *cmdOutput) error {
+	out.result.DryRun = true
+	fmt.Fprintln(out.text, "Dry run, no file was written")
+	if len(op.files)+len(op.removed) == 0 {
+		fmt.Fprintln(out.text, "No metadata file would change")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+	fmt.Fprintln(w, "\tNo.\tFile\tVersion\tSignatures\tThreshold\tThreshold met")
+	for i, filename := range op.files {
+		status := d.thresholdStatus(filename)
+		out.result.Thresholds = append(out.result.Thresholds, status)
+		met := strconv.FormatBool(status.Met)
+		if status.Error != "" {
+			met += " (" + status.Error + ")"
+		}
+		fmt.Fprintf(w, "\t%d.\t%s\t%d\t%d\t%d\t%s\n", i+1, filename, op.versions[status.Role], status.Signatures, status.Threshold, met)
+	}
+	w.Flush()
+	for _, filename := range op.removed {
+		fmt.Fprintf(out.text, "Removed: %s\n", filename)
+	}
+	if len(op.keyIDs) > 0 {
+		fmt.Fprintf(out.text, "Signatures added by key(s): %s\n", strings.Join(op.keyIDs, ", "))
+	}
+
+	diff, err := d.diff(op)
+	if err != nil {
+		return err
+	}
+	out.result.Diff = diff
+	fmt.Fprint(out.text, diff)
+	return nil
+}
+
+// Whether the signatures of filename in the copy meet the threshold of the
+// latest root in the copy, or of the latest targets for a channel.
+func (d *dryRunDir) thresholdStatus(filename string) roleThreshold {
+	role := metadataFilenamePattern.FindStringSubmatch(filename)[2]
+	status := roleThreshold{Role: role, File: filename}
+	path := filepath.Join(d.local, filename)
+	status.Signatures = len(parseMetadataSummary(readFileOrEmpty(path)).Signatures)
+
+	rootFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(d.local, Root)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	root, err := metadata.Root().FromFile(rootFilepaths[len(rootFilepaths)-1])
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if r, ok := root.Signed.Roles[role]; ok {
+		status.Threshold = r.Threshold
+	}
+
+	switch role {
+	case Root:
+		var md *metadata.Metadata[metadata.RootType]
+		if md, err = metadata.Root().FromFile(path); err == nil {
+			err = root.VerifyDelegate(Root, md)
+		}
+	case Targets:
+		var md *metadata.Metadata[metadata.TargetsType]
+		if md, err = metadata.Targets().FromFile(path); err == nil {
+			err = root.VerifyDelegate(Targets, md)
+		}
+	case Snapshot:
+		var md *metadata.Metadata[metadata.SnapshotType]
+		if md, err = metadata.Snapshot().FromFile(path); err == nil {
+			err = root.VerifyDelegate(Snapshot, md)
+		}
+	case Timestamp:
+		var md *metadata.Metadata[metadata.TimestampType]
+		if md, err = metadata.Timestamp().FromFile(path); err == nil {
+			err = root.VerifyDelegate(Timestamp, md)
+		}
+	default:
+		// Channels are delegated by the latest targets in the copy
+		var delegator, md *metadata.Metadata[metadata.TargetsType]
+		var targetsFilepaths []string
+		if targetsFilepaths, err = metahelper.GetRoleMetadataFilepathsFromDir(d.local, Targets); err == nil {
+			delegator, err = metadata.Targets().FromFile(targetsFilepaths[len(targetsFilepaths)-1])
+		}
+		if err == nil {
+			if r := delegatedRole(delegator, role); r != nil {
+				status.Threshold = r.Threshold
+			}
+			if md, err = metadata.Targets().FromFile(path); err == nil {
+				err = delegator.VerifyDelegate(role, md)
+			}
+		}
+	}
+	status.Met = err == nil
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Unified diff of the files written or removed by op. A new version of a role
+// is compared with the previous version.
+func (d *dryRunDir) diff(op operation) (string, error) {
+	var b strings.Builder
+	for _, filename := range append(slices.Clone(op.files), op.removed...) {
+		from := filename
+		if _, err := os.Stat(filepath.Join(d.original, filename)); err != nil {
+			from = d.previousVersion(filename)
+		}
+		fromContent := ""
+		if from != "" {
+			fromContent = string(readFileOrEmpty(filepath.Join(d.original, from)))
+		}
+		toContent := string(readFileOrEmpty(filepath.Join(d.local, filename)))
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(fromContent),
+			B:        difflib.SplitLines(toContent),
+			FromFile: diffName("a", from),
+			ToFile:   diffName("b", filename),
+			Context:  3,
+		})
+		if err != nil {
+			return "", fmt.Errorf("fail to diff %s: %w", filename, err)
+		}
+		b.WriteString(diff)
+	}
+	return b.String(), nil
+}
+
+// Filename of the version before filename (e.g. 1.root.json for 2.root.json)
+// in the original dir, empty if there is none.
+func (d *dryRunDir) previousVersion(filename string) string {
+	match := metadataFilenamePattern.FindStringSubmatch(filename)
+	version, err := strconv.Atoi(match[1])
+	if err != nil || version < 2 {
+		return ""
+	}
+	previous := fmt.Sprintf("%d.%s.json", version-1, match[2])
+	if _, err = os.Stat(filepath.Join(d.original, previous)); err != nil {
+		return ""
+	}
+	return previous
+}
+
+func diffName(prefix string, filename string) string {
+	if filename == "" {
+		return "/dev/null"
+	}
+	return prefix + "/" + filename
+}
+
+func readFileOrEmpty(path string) []byte {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return content
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"errors"
+	"io/fs"
+
+	"see_updater/internal/pkg/cli"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Errors of the commands, test with errors.Is. ExitCode maps them to the
+// process exit code.
+var (
+	ErrUsage           = errors.New("invalid usage")
+	ErrVerification    = errors.New("verification failed")
+	ErrThresholdNotMet = errors.New("signature threshold not met")
+	ErrExpired         = errors.New("metadata expired")
+	ErrLockHeld        = errors.New("metadata dir is locked")
+	ErrIO              = errors.New("i/o error")
+	ErrPlanOutdated    = errors.New("metadata dir changed since the plan was made")
+	ErrTargetsRemoved  = errors.New("target files removed")
+)
+
+// Process exit codes.
+const (
+	ExitOK              = 0
+	ExitFailure         = 1 // any other error
+	ExitUsage           = 2
+	ExitVerification    = 3
+	ExitThresholdNotMet = 4
+	ExitExpired         = 5
+	ExitLockHeld        = 6
+	ExitIO              = 7
+	ExitPlanOutdated    = 8
+	ExitTargetsRemoved  = 9
+)
+
+// Exit code of the error returned by a command. The most specific cause wins,
+// e.g. an expired and under-signed metadata file exits with ExitThresholdNotMet.
+func ExitCode(err error) int {
+	var pathErr *fs.PathError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrUsage), errors.Is(err, cli.ErrNoInput):
+		return ExitUsage
+	case errors.Is(err, ErrLockHeld):
+		return ExitLockHeld
+	case errors.Is(err, ErrPlanOutdated):
+		return ExitPlanOutdated
+	case errors.Is(err, ErrThresholdNotMet), errors.Is(err, &metadata.ErrUnsignedMetadata{}):
+		return ExitThresholdNotMet
+	case errors.Is(err, ErrExpired), errors.Is(err, &metadata.ErrExpiredMetadata{}):
+		return ExitExpired
+	case errors.Is(err, ErrVerification), errors.Is(err, &metadata.ErrRepository{}):
+		return ExitVerification
+	case errors.Is(err, ErrTargetsRemoved):
+		return ExitTargetsRemoved
+	case errors.Is(err, ErrIO), errors.As(err, &pathErr):
+		return ExitIO
+	}
+	return ExitFailure
+}
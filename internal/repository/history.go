@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"see_updater/internal/pkg/gitrepo"
+	"see_updater/internal/pkg/logging"
+)
+
+type historyEntry struct {
+	Commit    string    `json:"commit"`
+	Date      time.Time `json:"date"`
+	Author    string    `json:"author"`
+	Subject   string    `json:"subject"`
+	Operation []string  `json:"operation,omitempty"`
+	Versions  []string  `json:"versions,omitempty"`
+	KeyIDs    []string  `json:"key_ids,omitempty"`
+}
+
+// Print the operations recorded in the git history of the metadata directory,
+// newest first.
+func showHistory(config configHistory, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+	))
+
+	repo, err := gitrepo.Open(config.metadataDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to open git repository", slog.Any("error", err))
+		return err
+	}
+	commits, err := repo.Log()
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to read git history", slog.Any("error", err))
+		return err
+	}
+
+	entries := []historyEntry{}
+	fmt.Fprintf(out.text, "A total of %d commits found:\n", len(commits))
+	w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+	fmt.Fprintln(w, "\tNo.\tCommit\tDate\tAuthor\tOperation\tVersions\tKey ID(s)")
+	for i, commit := range commits {
+		operation := strings.Join(commit.TrailerValues(TrailerOperation), ",")
+		if operation == "" {
+			operation = "- (" + commit.Subject + ")"
+		}
+		keyIDs := []string{}
+		for _, keyID := range commit.TrailerValues(TrailerKeyID) {
+			keyIDs = append(keyIDs, shortID(keyID))
+		}
+		fmt.Fprintf(w, "\t%d.\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, shortID(commit.Hash), commit.Date.Format("2006-01-02 15:04:05"),
+			commit.Author, operation, strings.Join(commit.TrailerValues(TrailerVersion), ","), strings.Join(keyIDs, ","))
+		entries = append(entries, historyEntry{
+			Commit:    commit.Hash,
+			Date:      commit.Date,
+			Author:    commit.Author,
+			Subject:   commit.Subject,
+			Operation: commit.TrailerValues(TrailerOperation),
+			Versions:  commit.TrailerValues(TrailerVersion),
+			KeyIDs:    commit.TrailerValues(TrailerKeyID),
+		})
+	}
+	w.Flush()
+	out.result.Data = entries
+
+	return nil
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
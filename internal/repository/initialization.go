@@ -6,7 +6,7 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"log/slog"
-	"path/filepath"
+	"slices"
 
 	"see_updater/internal/pkg/cryptography"
 	"see_updater/internal/pkg/datetime"
@@ -20,7 +20,7 @@ import (
 )
 
 // Reference: https://github.com/theupdateframework/go-tuf/blob/master/examples/repository/basic_repository.go
-func initRepo(config configInit) error {
+func initRepo(config configInit, out *cmdOutput) error {
 	// Append context to logger
 	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
 		slog.String("repository_dir", config.repositoryDir),
@@ -34,6 +34,8 @@ func initRepo(config configInit) error {
 		slog.Int("snapshot_threshold", int(config.snapshotThreshold)),
 		slog.Int("timestamp_threshold", int(config.timestampThreshold)),
 		slog.Int("expire_in", int(config.expireIn)),
+		slog.Bool("consistent_snapshot", config.consistentSnapshot),
+		slog.String("publish_dir", config.publish.dir),
 	))
 
 	_, err := filesystem.IsDirWritable(config.outputDir)
@@ -55,24 +57,24 @@ func initRepo(config configInit) error {
 	timestamp := metadata.Timestamp(datetime.ExpireIn(int(config.expireIn)))
 	roles.SetTimestamp(timestamp)
 	root := metadata.Root(datetime.ExpireIn(int(config.expireIn)))
+	// Only advertised with --consistent-snapshot: clients then download the
+	// target files published as <hash>.<name>
+	root.Signed.ConsistentSnapshot = config.consistentSnapshot
 	roles.SetRoot(root)
 
 	// Set Targets
 	// Full filepath: C:/Users/User/Project/file.txt
 	// Local filepath:  Project/file.txt
-	targetLocalFilepaths, targetFullFilepaths, err := filesystem.GetAllFilepathsInDir(config.repositoryDir)
+	newTargets, scan, err := config.scan.targets(config.repositoryDir, datetime.ExpireIn(int(config.expireIn)))
 	if err != nil {
-		slog.ErrorContext(ctx, err.Error())
+		slog.ErrorContext(ctx, "fail to generate targets from repository dir", slog.Any("error", err))
 		return err
 	}
-	for i, targetFullFilepath := range targetFullFilepaths {
-		slog.DebugContext(ctx, "generating target file info for file", slog.String("filepath", targetLocalFilepaths[i]))
-		targetFileInfo, err := metadata.TargetFile().FromFile(targetFullFilepath)
-		if err != nil {
-			slog.ErrorContext(ctx, "fail to generate target file info for file", slog.Any("error", err), slog.String("filepath", targetFullFilepath))
-			return fmt.Errorf("fail to generate target file info for file: %s\n\terror: %w", targetFullFilepath, err)
-		}
-		roles.Targets(Targets).Signed.Targets[targetLocalFilepaths[i]] = targetFileInfo
+	roles.Targets(Targets).Signed.Targets = newTargets.Signed.Targets
+	printScanReport(out, scan.Skipped, scan.Hardlinks)
+	sources, err := config.scan.sources(config.repositoryDir, scan)
+	if err != nil {
+		return err
 	}
 
 	// Read root private RSA rolesKeys (public key can be derived from private key)
@@ -114,8 +116,17 @@ func initRepo(config configInit) error {
 		roles.Root().Signed.Roles[name].Threshold = int(threshold)
 	}
 
-	// Sign metadata files for each respective role
+	// Sign metadata files for each respective role, in order: snapshot and
+	// timestamp may record the hashes of the signed targets and snapshot
+	hashed, err := metaHashes(config.metaHashes)
+	if err != nil {
+		return err
+	}
 	for _, name := range getRoles() {
+		if err = setMetaFile(roles, name, slices.Contains(hashed, name)); err != nil {
+			slog.ErrorContext(ctx, "fail to update meta", slog.Any("error", err), slog.String("role", name))
+			return err
+		}
 		for _, key := range rolesKeys[name] {
 			signer, err := signature.LoadSigner(key, crypto.SHA256)
 			if err != nil {
@@ -161,39 +172,38 @@ func initRepo(config configInit) error {
 		}
 	}
 
+	// Clients must find the target files once the metadata is written
+	if err = config.publish.publish(ctx, roles, sources, out); err != nil {
+		return err
+	}
+
 	// Attempt write
 	outputDir := config.outputDir
-	// Write metadata files
-	// TODO This write operation will overwrite the first versions of metadata files if they exist,
-	// prompt warning if the output metadata directory is not empty??
-	succeededWrites := []string{} // To remove written files in case of error
+	// Write metadata files, all or none of them. Existing files are only
+	// overwritten with --force, see checkNoRepository
+	files := []metadataFile{}
 	for _, name := range []string{Targets, Snapshot, Timestamp, Root} {
-		filename := ""
 		switch name {
 		case Targets:
-			// roles.Targets(Targets).Sign()
-			filename := fmt.Sprintf("%d.%s.json", roles.Targets(Targets).Signed.Version, name)
-			err = roles.Targets(Targets).ToFile(filepath.Join(outputDir, filename), true)
+			files = append(files, metadataFile{fmt.Sprintf("%d.%s.json", roles.Targets(Targets).Signed.Version, name),
+				func(path string) error { return roles.Targets(Targets).ToFile(path, true) }})
 		case Snapshot:
-			filename := fmt.Sprintf("%d.%s.json", roles.Snapshot().Signed.Version, name)
-			err = roles.Snapshot().ToFile(filepath.Join(outputDir, filename), true)
+			files = append(files, metadataFile{fmt.Sprintf("%d.%s.json", roles.Snapshot().Signed.Version, name),
+				func(path string) error { return roles.Snapshot().ToFile(path, true) }})
 		case Timestamp:
-			filename := fmt.Sprintf("%s.json", name)
-			err = roles.Timestamp().ToFile(filepath.Join(outputDir, filename), true)
+			files = append(files, metadataFile{fmt.Sprintf("%s.json", name),
+				func(path string) error { return roles.Timestamp().ToFile(path, true) }})
 		case Root:
-			filename := fmt.Sprintf("%d.%s.json", roles.Root().Signed.Version, name)
-			err = roles.Root().ToFile(filepath.Join(outputDir, filename), true)
+			files = append(files, metadataFile{fmt.Sprintf("%d.%s.json", roles.Root().Signed.Version, name),
+				func(path string) error { return roles.Root().ToFile(path, true) }})
 		}
-		if err != nil {
-			for _, path := range succeededWrites {
-				filesystem.Remove(path)
-			}
-			slog.ErrorContext(ctx, "fail to save metadata to file", slog.Any("error", err), slog.String("role", name))
-			slog.InfoContext(ctx, "all generated metadata files removed")
-			return fmt.Errorf("fail to save metadata to file\n\terror: %w", err)
-		}
-		succeededWrites = append(succeededWrites, filepath.Join(outputDir, filename))
 	}
+	if err = writeMetadataFiles(outputDir, InitVerb, files); err != nil {
+		slog.ErrorContext(ctx, "fail to save metadata to file", slog.Any("error", err))
+		slog.InfoContext(ctx, "no metadata file was written")
+		return fmt.Errorf("fail to save metadata to file\n\terror: %w", err)
+	}
+	config.publish.prune(ctx, roles, out)
 
 	return nil
 }
@@ -8,7 +8,7 @@ import (
 	"see_updater/internal/pkg/filesystem"
 )
 
-func generateRsaKeypairPEM(config configKeygen) error {
+func generateRsaKeypairPEM(config configKeygen, out *cmdOutput) error {
 	privKey, pubKey := cryptography.GenerateRsaKeyPair(config.bitLength)
 	privKeyPemStr := cryptography.ExportRsaPrivateKeyAsPemStr(privKey)
 	pubKeyPemStr, _ := cryptography.ExportRsaPublicKeyAsPemStr(pubKey)
@@ -23,14 +23,16 @@ func generateRsaKeypairPEM(config configKeygen) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Private key written to: %s", privKeypath)
+	fmt.Fprintf(out.text, "Private key written to: %s\n", privKeypath)
+	out.result.Files = append(out.result.Files, privKeypath)
 
 	pubKeypath := filepath.Join(config.outputDir, config.pubkeyFilename)
 	err = filesystem.WriteStringToFile(pubKeypath, pubKeyPemStr)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Public key written to: %s", pubKeypath)
+	fmt.Fprintf(out.text, "Public key written to: %s\n", pubKeypath)
+	out.result.Files = append(out.result.Files, pubKeypath)
 
 	return nil
 }
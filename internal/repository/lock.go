@@ -0,0 +1,374 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"see_updater/internal/pkg/filesemaphore"
+	"see_updater/internal/pkg/logging"
+	"see_updater/internal/pkg/objectstore"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+const (
+	lockFilename  = ".updater.lock"
+	lockSemaphore = filesemaphore.SemaphoreName("repository")
+	lockPollEvery = 200 * time.Millisecond
+)
+
+// Owner of the repository lock, stored as JSON in the lock file.
+type lockOwner struct {
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	PID       int32     `json:"pid"`
+	Command   string    `json:"command"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type lockStatus struct {
+	Locked bool       `json:"locked"`
+	Owner  *lockOwner `json:"owner,omitempty"`
+	Stale  bool       `json:"stale"`
+}
+
+// Exclusive lock on a metadata directory held by the current process.
+type repoLock struct {
+	semaphore *filesemaphore.Semaphore
+	owner     lockOwner
+}
+
+func newLockOwner(command string) lockOwner {
+	owner := lockOwner{PID: int32(os.Getpid()), Command: command, StartedAt: time.Now().UTC()}
+	if u, err := user.Current(); err == nil {
+		owner.User = u.Username
+	}
+	owner.Host, _ = os.Hostname()
+	return owner
+}
+
+func (o lockOwner) String() string {
+	return fmt.Sprintf("%s@%s (pid %d, command %q) since %s", o.User, o.Host, o.PID, o.Command,
+		o.StartedAt.Local().Format("2006-01-02 15:04:05"))
+}
+
+// A lock is stale when it was taken on this host by a process that no longer
+// runs. Locks taken on another host are never considered stale.
+func (o lockOwner) isStale() bool {
+	host, _ := os.Hostname()
+	if o.Host != host || o.PID <= 0 {
+		return false
+	}
+	exists, err := process.PidExists(o.PID)
+	return err == nil && !exists
+}
+
+// Take the lock of metadataDir for command. A stale lock is removed, a live
+// one is waited on for at most wait before giving up.
+func acquireLock(metadataDir string, command string, wait time.Duration) (*repoLock, error) {
+	semaphore, err := filesemaphore.New(metadataDir, filesemaphore.SemaphoreMap{})
+	if err != nil {
+		return nil, err
+	}
+	owner := newLockOwner(command)
+	content, err := json.Marshal(owner)
+	if err != nil {
+		return nil, fmt.Errorf("fail to marshal lock owner: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err = semaphore.WriteNew(lockSemaphore, lockFilename, string(content))
+		if err == nil {
+			return &repoLock{semaphore: semaphore, owner: owner}, nil
+		} else if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		held, err := os.ReadFile(filepath.Join(metadataDir, lockFilename))
+		if err != nil && errors.Is(err, fs.ErrNotExist) {
+			continue // released in between
+		} else if err != nil {
+			return nil, fmt.Errorf("fail to read lock file: %w", err)
+		}
+		// The lock file is created before its content is written: an empty or
+		// partial one is held by an owner not known yet
+		holder := "an unknown owner"
+		if owner, err := parseLockOwner(held); err == nil {
+			if owner.isStale() {
+				slog.Warn("removing stale repository lock", slog.String("metadata_dir", metadataDir), slog.String("owner", owner.String()))
+				if err = removeStaleLock(metadataDir, held); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			holder = owner.String()
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w by %s (%s), retry later or use --%s", ErrLockHeld, holder, metadataDir, GlobalWait)
+		}
+		time.Sleep(min(lockPollEvery, time.Until(deadline)))
+	}
+}
+
+// Remove the lock file of metadataDir if it still holds stale. The file is
+// first renamed aside, atomically, so that a lock taken by another process
+// since stale was read is put back instead of removed.
+func removeStaleLock(metadataDir string, stale []byte) error {
+	lockPath := filepath.Join(metadataDir, lockFilename)
+	aside := filepath.Join(metadataDir, fmt.Sprintf("%s.%d.stale", lockFilename, os.Getpid()))
+	if err := os.Rename(lockPath, aside); err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil // removed by another process
+	} else if err != nil {
+		return fmt.Errorf("fail to remove stale lock: %w", err)
+	}
+	defer os.Remove(aside)
+
+	content, err := os.ReadFile(aside)
+	if err != nil {
+		return fmt.Errorf("fail to remove stale lock: %w", err)
+	}
+	if bytes.Equal(content, stale) {
+		return nil
+	}
+	// Link fails instead of replacing a lock taken meanwhile
+	if err = os.Link(aside, lockPath); err != nil {
+		return fmt.Errorf("fail to put back lock taken while removing a stale one: %w", err)
+	}
+	return nil
+}
+
+// Lock of a metadata dir in object storage: the lock file as an object created
+// with `If-None-Match: *`, so that only one writer at a time can create it.
+type remoteLock struct {
+	store *objectstore.S3
+	key   string
+	etag  string // of the object written, only this one is released
+}
+
+// Take the lock of the metadata dir at prefix of store for command, waiting
+// at most wait for a live one. Remote locks are never considered stale: the
+// store cannot remove the object only if it is still the stale one, so they
+// have to be removed by hand.
+func acquireRemoteLock(store *objectstore.S3, prefix string, command string, wait time.Duration) (*remoteLock, error) {
+	key := prefix + lockFilename
+	content, err := json.Marshal(newLockOwner(command))
+	if err != nil {
+		return nil, fmt.Errorf("fail to marshal lock owner: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		etag, err := store.Put(key, content, objectstore.Condition{IfNoneMatch: true})
+		if err == nil {
+			return &remoteLock{store: store, key: key, etag: etag}, nil
+		} else if !errors.Is(err, objectstore.ErrPreconditionFailed) {
+			return nil, fmt.Errorf("%w: %w", ErrIO, err)
+		}
+
+		holder := "an unknown owner"
+		bytes, _, err := store.Get(key)
+		if err != nil && errors.Is(err, objectstore.ErrNotFound) {
+			continue // released in between
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrIO, err)
+		}
+		owner := lockOwner{}
+		if json.Unmarshal(bytes, &owner) == nil {
+			holder = owner.String()
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w by %s (%s), retry later or use --%s, run `%s %s --%s` if its owner is gone",
+				ErrLockHeld, holder, key, GlobalWait, LockVerb, LockBreakVerb, LockBreakForce)
+		}
+		time.Sleep(min(lockPollEvery, time.Until(deadline)))
+	}
+}
+
+// Remove the lock object unless it was replaced since it was taken, e.g.
+// broken and taken by another writer: that lock is not ours to release.
+func (l *remoteLock) Release() error {
+	err := l.store.Delete(l.key, objectstore.Condition{IfMatch: l.etag})
+	if errors.Is(err, objectstore.ErrPreconditionFailed) {
+		slog.Warn("repository lock was replaced since it was taken, left in place", slog.String("key", l.key))
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("fail to release repository lock: %w", err)
+	}
+	return nil
+}
+
+// Store and key of the lock object of a metadata dir in object storage.
+func remoteLockObject(uri string) (*objectstore.S3, string, error) {
+	bucket, prefix, err := objectstore.ParseURI(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	store, err := objectstore.NewFromEnv(bucket)
+	if err != nil {
+		return nil, "", err
+	}
+	return store, prefix + lockFilename, nil
+}
+
+// Content and ETag of the lock object of a metadata dir in object storage,
+// nil if it is not locked.
+func readRemoteLock(store *objectstore.S3, key string) ([]byte, string, error) {
+	content, etag, err := store.Get(key)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	return content, etag, nil
+}
+
+func (l *repoLock) Release() error {
+	if err := l.semaphore.Release(lockSemaphore); err != nil {
+		return fmt.Errorf("fail to release repository lock: %w", err)
+	}
+	return nil
+}
+
+func readLockOwner(metadataDir string) (lockOwner, error) {
+	owner := lockOwner{}
+	bytes, err := os.ReadFile(filepath.Join(metadataDir, lockFilename))
+	if err != nil {
+		return owner, fmt.Errorf("fail to read lock file: %w", err)
+	}
+	if owner, err = parseLockOwner(bytes); err != nil {
+		return owner, fmt.Errorf("fail to parse lock file %s: %w", filepath.Join(metadataDir, lockFilename), err)
+	}
+	return owner, nil
+}
+
+func parseLockOwner(content []byte) (lockOwner, error) {
+	owner := lockOwner{}
+	err := json.Unmarshal(content, &owner)
+	return owner, err
+}
+
+// Print the current holder of the lock, if any.
+func showLockStatus(config configLock, out *cmdOutput) error {
+	if objectstore.IsURI(config.metadataDir) {
+		return showRemoteLockStatus(config, out)
+	}
+	owner, err := readLockOwner(config.metadataDir)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(out.text, "Metadata dir %s is not locked\n", config.metadataDir)
+		out.result.Data = lockStatus{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	stale := owner.isStale()
+	out.result.Data = lockStatus{Locked: true, Owner: &owner, Stale: stale}
+	state := "held"
+	if stale {
+		state = "stale, owner process is no longer running"
+	}
+	fmt.Fprintf(out.text, "Metadata dir %s is locked by %s (%s)\n", config.metadataDir, owner, state)
+	return nil
+}
+
+// Remove the lock, a lock held by a live or unknown process requires force.
+func breakLock(config configLock, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+		slog.Bool("force", config.force),
+	))
+	if objectstore.IsURI(config.metadataDir) {
+		return breakRemoteLock(ctx, config, out)
+	}
+
+	owner, err := readLockOwner(config.metadataDir)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(out.text, "Metadata dir %s is not locked\n", config.metadataDir)
+		return nil
+	} else if err != nil && !config.force {
+		slog.ErrorContext(ctx, "fail to read lock owner", slog.Any("error", err))
+		return fmt.Errorf("%w, use --%s to remove it anyway", err, LockBreakForce)
+	}
+	if err == nil && !owner.isStale() && !config.force {
+		return fmt.Errorf("%w by %s which may still be running, use --%s to remove it anyway", ErrLockHeld, owner, LockBreakForce)
+	}
+
+	if err = os.Remove(filepath.Join(config.metadataDir, lockFilename)); err != nil {
+		slog.ErrorContext(ctx, "fail to remove lock file", slog.Any("error", err))
+		return fmt.Errorf("fail to remove lock file: %w", err)
+	}
+	slog.WarnContext(ctx, "repository lock broken", slog.String("owner", strings.TrimSpace(owner.String())))
+	fmt.Fprintf(out.text, "Removed lock of metadata dir %s\n", config.metadataDir)
+	return nil
+}
+
+// Print the holder of the lock object, remote locks are never stale (see
+// acquireRemoteLock).
+func showRemoteLockStatus(config configLock, out *cmdOutput) error {
+	store, key, err := remoteLockObject(config.metadataDir)
+	if err != nil {
+		return err
+	}
+	content, _, err := readRemoteLock(store, key)
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		fmt.Fprintf(out.text, "Metadata dir %s is not locked\n", config.metadataDir)
+		out.result.Data = lockStatus{}
+		return nil
+	}
+	status, holder := lockStatus{Locked: true}, "an unknown owner"
+	if owner, err := parseLockOwner(content); err == nil {
+		status.Owner, holder = &owner, owner.String()
+	}
+	out.result.Data = status
+	fmt.Fprintf(out.text, "Metadata dir %s is locked by %s (held, lock object %s)\n", config.metadataDir, holder, key)
+	return nil
+}
+
+// Remove the lock object if it is still the one read: its owner may be
+// running anywhere, so force is always required.
+func breakRemoteLock(ctx context.Context, config configLock, out *cmdOutput) error {
+	store, key, err := remoteLockObject(config.metadataDir)
+	if err != nil {
+		return err
+	}
+	content, etag, err := readRemoteLock(store, key)
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		fmt.Fprintf(out.text, "Metadata dir %s is not locked\n", config.metadataDir)
+		return nil
+	}
+	holder := "an unknown owner"
+	if owner, err := parseLockOwner(content); err == nil {
+		holder = owner.String()
+	}
+	if !config.force {
+		return fmt.Errorf("%w by %s which may still be running, use --%s to remove it anyway", ErrLockHeld, holder, LockBreakForce)
+	}
+
+	err = store.Delete(key, objectstore.Condition{IfMatch: etag})
+	if errors.Is(err, objectstore.ErrPreconditionFailed) {
+		return fmt.Errorf("%w: lock object %s was replaced since it was read, check its owner again", ErrLockHeld, key)
+	} else if err != nil {
+		slog.ErrorContext(ctx, "fail to remove lock object", slog.Any("error", err))
+		return fmt.Errorf("%w: fail to remove lock object: %w", ErrIO, err)
+	}
+	slog.WarnContext(ctx, "repository lock broken", slog.String("owner", holder))
+	fmt.Fprintf(out.text, "Removed lock of metadata dir %s\n", config.metadataDir)
+	return nil
+}
@@ -0,0 +1,208 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/metahelper"
+
+	"github.com/spf13/cobra"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Roles that can record the length and hashes of the file they reference, in
+// addition to its version: snapshot for targets.json, timestamp for
+// snapshot.json. Clients then refuse a referenced file of another length or
+// content (endless data and substitution attacks).
+var metaHashRoles = []string{Snapshot, Timestamp}
+
+func addMetaHashesFlag(cmd *cobra.Command, raw *string) {
+	cmd.Flags().StringVar(raw, MetaHashes, "", fmt.Sprintf("Roles recording the length and hashes of the file they reference, \",\" separated: %q (of %s.json), %q (of %s.json) (optional)",
+		Snapshot, Targets, Timestamp, Snapshot))
+}
+
+// Roles of --meta-hashes, without duplicates.
+func metaHashes(raw string) ([]string, error) {
+	roles := []string{}
+	for _, role := range strings.Split(raw, ",") {
+		if role = strings.ToLower(strings.TrimSpace(role)); role == "" {
+			continue
+		}
+		if !slices.Contains(metaHashRoles, role) {
+			return nil, fmt.Errorf("%w: invalid --%s %q, accepted: %s", ErrUsage, MetaHashes, raw, strings.Join(metaHashRoles, ", "))
+		}
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
+
+// Roles of --meta-hashes, plus the roles whose latest version in metadataDir
+// already records the length and hashes of the file it references: a run
+// without --meta-hashes must not silently drop the protection.
+func keptMetaHashes(metadataDir string, hashed []string) ([]string, error) {
+	kept := slices.Clone(hashed)
+	for _, role := range metaHashRoles {
+		if slices.Contains(kept, role) {
+			continue
+		}
+		paths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, role)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load metadata filepaths: %w", err)
+		}
+		var meta *metadata.MetaFiles
+		switch role {
+		case Snapshot:
+			snapshot, err := metadata.Snapshot().FromFile(paths[len(paths)-1])
+			if err != nil {
+				return nil, fmt.Errorf("fail to load metadata from file: %w", err)
+			}
+			meta = snapshot.Signed.Meta[Targets+".json"]
+		case Timestamp:
+			timestamp, err := metadata.Timestamp().FromFile(paths[len(paths)-1])
+			if err != nil {
+				return nil, fmt.Errorf("fail to load metadata from file: %w", err)
+			}
+			meta = timestamp.Signed.Meta[Snapshot+".json"]
+		}
+		if isHashedMeta(meta) {
+			kept = append(kept, role)
+		}
+	}
+	return kept, nil
+}
+
+// Role whose file is referenced by role in its meta, "" if none.
+func referencedRole(role string) string {
+	switch role {
+	case Snapshot:
+		return Targets
+	case Timestamp:
+		return Snapshot
+	}
+	return ""
+}
+
+// Point the meta of role (snapshot or timestamp) at the current version of
+// the file it references, with its length and hashes if hashed. They are
+// computed from the bytes the file is written with, so the referenced role
+// must not change afterwards, signatures included.
+func setMetaFile(roles roleSet, role string, hashed bool) error {
+	var meta *metadata.MetaFiles
+	var data []byte
+	var err error
+	switch role {
+	case Snapshot:
+		meta = metadata.MetaFile(roles.Targets(Targets).Signed.Version)
+		if hashed {
+			data, err = roles.Targets(Targets).ToBytes(true)
+		}
+	case Timestamp:
+		meta = metadata.MetaFile(roles.Snapshot().Signed.Version)
+		if hashed {
+			data, err = roles.Snapshot().ToBytes(true)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fail to serialize %s metadata: %w", referencedRole(role), err)
+	}
+	if hashed {
+		digest := sha256.Sum256(data)
+		meta.Length = int64(len(data))
+		meta.Hashes = metadata.Hashes{"sha256": digest[:]}
+	}
+
+	filename := referencedRole(role) + ".json"
+	switch role {
+	case Snapshot:
+		roles.Snapshot().Signed.Meta[filename] = meta
+	case Timestamp:
+		roles.Timestamp().Signed.Meta[filename] = meta
+	}
+	return nil
+}
+
+// Whether meta records the length or hashes of the file it references.
+func isHashedMeta(meta *metadata.MetaFiles) bool {
+	return meta != nil && (meta.Length != 0 || len(meta.Hashes) > 0)
+}
+
+// Check data, the bytes of the file referenced by meta, against the length
+// and hashes meta records.
+func checkMetaFile(filename string, meta *metadata.MetaFiles, data []byte) error {
+	if meta == nil {
+		return fmt.Errorf("%s is not referenced", filename)
+	}
+	if err := meta.VerifyLengthHashes(data); err != nil {
+		return fmt.Errorf("%s does not match the length and hashes recorded for it: %w", filename, err)
+	}
+	return nil
+}
+
+// Files of the roles recording the length and hashes of version of the file
+// of role, whose bytes changed to data (e.g. signed again): their meta is
+// updated and their signatures cleared, they must be signed again. Cascades
+// from targets to snapshot to timestamp. Also returns the cleared roles.
+func refreshHashedMeta(metadataDir string, role string, version int64, data []byte) ([]metadataFile, []string, error) {
+	files, cleared := []metadataFile{}, []string{}
+	for role != Timestamp && role != Root {
+		referencing := Snapshot
+		if role == Snapshot {
+			referencing = Timestamp
+		}
+		paths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, referencing)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fail to load metadata filepaths: %w", err)
+		}
+		path := paths[len(paths)-1]
+
+		var meta *metadata.MetaFiles
+		var referencingVersion int64
+		var toBytes func() ([]byte, error)
+		switch referencing {
+		case Snapshot:
+			snapshot, err := metadata.Snapshot().FromFile(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("fail to load metadata from file: %w", err)
+			}
+			meta, referencingVersion = snapshot.Signed.Meta[role+".json"], snapshot.Signed.Version
+			toBytes = func() ([]byte, error) {
+				snapshot.ClearSignatures()
+				return snapshot.ToBytes(true)
+			}
+		case Timestamp:
+			timestamp, err := metadata.Timestamp().FromFile(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("fail to load metadata from file: %w", err)
+			}
+			meta, referencingVersion = timestamp.Signed.Meta[role+".json"], timestamp.Signed.Version
+			toBytes = func() ([]byte, error) {
+				timestamp.ClearSignatures()
+				return timestamp.ToBytes(true)
+			}
+		}
+		if !isHashedMeta(meta) || meta.Version != version || meta.VerifyLengthHashes(data) == nil {
+			break
+		}
+		digest := sha256.Sum256(data)
+		meta.Length = int64(len(data))
+		meta.Hashes = metadata.Hashes{"sha256": digest[:]}
+		if data, err = toBytes(); err != nil {
+			return nil, nil, fmt.Errorf("fail to serialize %s metadata: %w", referencing, err)
+		}
+		content := data
+		files = append(files, metadataFile{filepath.Base(path), func(path string) error {
+			return filesystem.WriteBytesToFile(path, content)
+		}})
+		cleared = append(cleared, referencing)
+		role, version = referencing, referencingVersion
+	}
+	return files, cleared, nil
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/gitrepo"
+	"see_updater/internal/pkg/journal"
+)
+
+// Git commit trailer keys
+const (
+	TrailerOperation = "Updater-Operation"
+	TrailerRole      = "Updater-Role"
+	TrailerVersion   = "Updater-Version"
+	TrailerKeyID     = "Updater-Key-ID"
+	TrailerFile      = "Updater-File"
+	TrailerRemoved   = "Updater-Removed-File"
+)
+
+var metadataFilenamePattern = regexp.MustCompile(`^(?:(\d+)\.)?([^.]+)\.json$`)
+
+// Summary of the metadata files written by a repository mutation.
+type operation struct {
+	verb     string
+	files    []string         // filenames relative to the metadata dir
+	removed  []string         // filenames removed from the metadata dir
+	roles    []string         // roles of the written files
+	versions map[string]int64 // role -> version written
+	keyIDs   []string         // keys that added a signature
+}
+
+// Top-level metadata files of a directory, filename -> content.
+type dirContents map[string][]byte
+
+// Run fn as a mutation of the metadata directory and describe the files it
+// wrote. The directory is locked for the duration of the operation and the
+// written files are recorded in the operation log, so that it can be undone. In
+// git mode the directory must be a clean work tree beforehand and the changes
+// are recorded as one commit afterwards. A dry run (on a scratch copy of the
+// directory, see stageDryRun) is neither committed nor logged. The lock of a
+// remote metadata dir is taken by stageLockedMetadataDir instead.
+func runOperation(global *configGlobal, verb string, metadataDir string, fn func() error) (op operation, err error) {
+	if verb != InitVerb {
+		if _, err = os.Stat(metadataDir); err != nil {
+			return operation{}, fmt.Errorf("fail to access metadata dir %s: %w", metadataDir, err)
+		}
+	}
+	lock, err := acquireLock(metadataDir, verb, global.wait)
+	if err != nil {
+		return operation{}, err
+	}
+	defer func() {
+		if releaseErr := lock.Release(); releaseErr != nil {
+			slog.Error("fail to release repository lock", slog.Any("error", releaseErr), slog.String("metadata_dir", metadataDir))
+			err = errors.Join(err, releaseErr)
+		}
+	}()
+	if _, err = recoverMetadataDir(metadataDir); err != nil {
+		return operation{}, err
+	}
+
+	var repo *gitrepo.Repo
+	if global.git && !global.dryRun {
+		var err error
+		if verb == InitVerb {
+			if err = filesystem.MakeNewDirAll(metadataDir); err != nil {
+				return operation{}, fmt.Errorf("fail to make metadata dir %s: %w", metadataDir, err)
+			}
+			repo, err = gitrepo.OpenOrInit(metadataDir)
+		} else {
+			repo, err = gitrepo.Open(metadataDir)
+		}
+		if err != nil {
+			return operation{}, err
+		}
+		status, err := repo.Status(stateFilenames()...)
+		if err != nil {
+			return operation{}, err
+		}
+		if len(status) > 0 {
+			return operation{}, fmt.Errorf("metadata dir %s has uncommitted changes, commit or discard them first:\n\t%s",
+				metadataDir, strings.Join(status, "\n\t"))
+		}
+	}
+
+	before, err := readMetadataDir(metadataDir)
+	if err != nil {
+		return operation{}, err
+	}
+	if err = fn(); err != nil {
+		return operation{}, err
+	}
+	after, err := readMetadataDir(metadataDir)
+	if err != nil {
+		return operation{}, err
+	}
+	op = describeOperation(verb, before, after)
+
+	hash := ""
+	if repo != nil && len(op.files)+len(op.removed) > 0 {
+		hash, err = repo.CommitAll(op.commitMessage(), stateFilenames()...)
+		if err != nil {
+			slog.Error("fail to record operation in git history", slog.Any("error", err), slog.String("operation", verb))
+			return op, fmt.Errorf("metadata files were written but not committed: %w", err)
+		}
+		slog.Info("recorded operation in git history", slog.String("operation", verb), slog.String("commit", hash))
+	}
+	// Undo removes its own entry from the log instead
+	if verb != UndoVerb && !global.dryRun && len(op.files) > 0 {
+		if err = recordOperation(metadataDir, op, before, after, hash); err != nil {
+			slog.Error("fail to record operation in operation log", slog.Any("error", err), slog.String("operation", verb))
+			return op, fmt.Errorf("metadata files were written but the operation cannot be undone: %w", err)
+		}
+	}
+	return op, nil
+}
+
+// Files the tool keeps in the metadata dir besides the metadata files.
+func stateFilenames() []string {
+	return []string{lockFilename, journal.JournalFilename, journal.JournalFilename + ".tmp", journal.StagingDirname,
+		oplogFilename, oplogFilename + ".tmp", oplogBackupDirname}
+}
+
+func readMetadataDir(dir string) (dirContents, error) {
+	contents := dirContents{}
+	entries, err := os.ReadDir(dir)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return contents, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("fail to read dir %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !metadataFilenamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		bytes, err := filesystem.ReadBytesFromFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		contents[entry.Name()] = bytes
+	}
+	return contents, nil
+}
+
+func describeOperation(verb string, before, after dirContents) operation {
+	op := operation{verb: verb, versions: map[string]int64{}}
+	for filename, content := range after {
+		if old, ok := before[filename]; ok && string(old) == string(content) {
+			continue
+		}
+		op.files = append(op.files, filename)
+
+		role := metadataFilenamePattern.FindStringSubmatch(filename)[2]
+		if !slices.Contains(op.roles, role) {
+			op.roles = append(op.roles, role)
+		}
+		newFile := parseMetadataSummary(content)
+		op.versions[role] = newFile.Signed.Version
+		// Signatures of a previous version do not count as already present
+		oldFile := parseMetadataSummary(before[filename])
+		if oldFile.Signed.Version != newFile.Signed.Version {
+			oldFile.Signatures = nil
+		}
+		for _, sig := range newFile.Signatures {
+			if !slices.ContainsFunc(oldFile.Signatures, func(s metadataSignature) bool { return s.KeyID == sig.KeyID }) &&
+				!slices.Contains(op.keyIDs, sig.KeyID) {
+				op.keyIDs = append(op.keyIDs, sig.KeyID)
+			}
+		}
+	}
+	for filename := range before {
+		if _, ok := after[filename]; !ok {
+			op.removed = append(op.removed, filename)
+		}
+	}
+	sort.Strings(op.files)
+	sort.Strings(op.removed)
+	sort.Strings(op.keyIDs)
+	slices.SortFunc(op.roles, func(a, b string) int { return roleOrder(a) - roleOrder(b) })
+	return op
+}
+
+// Subject line summarizing the versions, followed by the trailers.
+func (op operation) commitMessage() string {
+	versions := []string{}
+	for _, role := range op.roles {
+		versions = append(versions, fmt.Sprintf("%s v%d", role, op.versions[role]))
+	}
+	summary := strings.Join(versions, ", ")
+	if len(versions) == 0 {
+		summary = fmt.Sprintf("removed %d file(s)", len(op.removed))
+	}
+	lines := []string{
+		fmt.Sprintf("%s: %s", op.verb, summary),
+		"",
+		fmt.Sprintf("%s: %s", TrailerOperation, op.verb),
+	}
+	for _, role := range op.roles {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerRole, role))
+	}
+	for _, role := range op.roles {
+		lines = append(lines, fmt.Sprintf("%s: %s=%d", TrailerVersion, role, op.versions[role]))
+	}
+	for _, keyID := range op.keyIDs {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerKeyID, keyID))
+	}
+	for _, file := range op.files {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerFile, file))
+	}
+	for _, file := range op.removed {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerRemoved, file))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+type metadataSignature struct {
+	KeyID string `json:"keyid"`
+}
+
+type metadataSummary struct {
+	Signed struct {
+		Type    string `json:"_type"`
+		Version int64  `json:"version"`
+	} `json:"signed"`
+	Signatures []metadataSignature `json:"signatures"`
+}
+
+// Best effort, returns an empty summary for missing or malformed content.
+func parseMetadataSummary(content []byte) metadataSummary {
+	summary := metadataSummary{}
+	if len(content) > 0 {
+		json.Unmarshal(content, &summary)
+	}
+	return summary
+}
+
+// Root first, then the top-level roles in delegation order, then the others.
+func roleOrder(role string) int {
+	if idx := slices.Index([]string{Root, Targets, Snapshot, Timestamp}, role); idx >= 0 {
+		return idx
+	}
+	return 4
+}
@@ -0,0 +1,271 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/gitrepo"
+	"see_updater/internal/pkg/logging"
+)
+
+const (
+	oplogFilename      = ".updater-oplog"
+	oplogBackupDirname = ".updater-backups" // replaced files, named by their sha256
+	oplogLimit         = 20                 // entries kept, oldest are dropped first
+)
+
+// Operation log of the metadata dir, oldest entry first.
+type oplog struct {
+	Entries []oplogEntry `json:"entries"`
+}
+
+// What a repository operation created or replaced, enough to undo it.
+type oplogEntry struct {
+	Operation string      `json:"operation"`
+	User      string      `json:"user"`
+	Time      time.Time   `json:"time"`
+	Commit    string      `json:"commit,omitempty"` // git mode only
+	Files     []oplogFile `json:"files"`
+}
+
+type oplogFile struct {
+	Filename       string `json:"filename"`
+	SHA256         string `json:"sha256"`                    // content written by the operation
+	Created        bool   `json:"created"`                   // false if an existing file was replaced
+	PreviousSHA256 string `json:"previous_sha256,omitempty"` // content replaced by the operation
+	// Copy of the replaced content relative to the metadata dir, none in git
+	// mode where the parent of the commit has it
+	Backup string `json:"backup,omitempty"`
+}
+
+func readOplog(metadataDir string) (oplog, error) {
+	log := oplog{}
+	bytes, err := os.ReadFile(filepath.Join(metadataDir, oplogFilename))
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return log, nil
+	} else if err != nil {
+		return log, fmt.Errorf("fail to read operation log: %w", err)
+	}
+	if err = json.Unmarshal(bytes, &log); err != nil {
+		return log, fmt.Errorf("fail to parse operation log %s: %w", filepath.Join(metadataDir, oplogFilename), err)
+	}
+	return log, nil
+}
+
+func writeOplog(metadataDir string, log oplog) error {
+	if len(log.Entries) > oplogLimit {
+		log.Entries = log.Entries[len(log.Entries)-oplogLimit:]
+	}
+	bytes, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		return fmt.Errorf("fail to marshal operation log: %w", err)
+	}
+	tmp := filepath.Join(metadataDir, oplogFilename+".tmp")
+	if err = filesystem.WriteBytesToFile(tmp, bytes); err != nil {
+		return fmt.Errorf("fail to write operation log: %w", err)
+	}
+	if err = os.Rename(tmp, filepath.Join(metadataDir, oplogFilename)); err != nil {
+		return fmt.Errorf("fail to write operation log: %w", err)
+	}
+	pruneBackups(metadataDir, log)
+	return nil
+}
+
+// Remove the backups no entry of log refers to anymore. Failures only leave
+// unused files behind.
+func pruneBackups(metadataDir string, log oplog) {
+	used := map[string]bool{}
+	for _, entry := range log.Entries {
+		for _, file := range entry.Files {
+			used[file.Backup] = true
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(metadataDir, oplogBackupDirname))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		backup := oplogBackupDirname + "/" + e.Name()
+		if used[backup] {
+			continue
+		}
+		if err = os.Remove(filepath.Join(metadataDir, filepath.FromSlash(backup))); err != nil {
+			slog.Warn("fail to remove unused backup", slog.Any("error", err), slog.String("backup", backup))
+		}
+	}
+}
+
+// Append the files written by op to the operation log. Outside of git mode
+// the replaced files are kept as backups, written before the log refers to
+// them.
+func recordOperation(metadataDir string, op operation, before, after dirContents, commit string) error {
+	entry := oplogEntry{Operation: op.verb, Time: time.Now().UTC(), Commit: commit}
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	}
+	for _, filename := range op.files {
+		file := oplogFile{Filename: filename, SHA256: sha256Hex(after[filename])}
+		previous, replaced := before[filename]
+		file.Created = !replaced
+		if replaced {
+			file.PreviousSHA256 = sha256Hex(previous)
+		}
+		if replaced && commit == "" {
+			file.Backup = oplogBackupDirname + "/" + file.PreviousSHA256
+			backupPath := filepath.Join(metadataDir, filepath.FromSlash(file.Backup))
+			if err := filesystem.MakeNewDirAll(filepath.Dir(backupPath)); err != nil {
+				return fmt.Errorf("fail to make backup dir: %w", err)
+			}
+			if err := filesystem.WriteBytesToFile(backupPath, previous); err != nil {
+				return fmt.Errorf("fail to back up %s: %w", filename, err)
+			}
+		}
+		entry.Files = append(entry.Files, file)
+	}
+
+	log, err := readOplog(metadataDir)
+	if err != nil {
+		return err
+	}
+	log.Entries = append(log.Entries, entry)
+	return writeOplog(metadataDir, log)
+}
+
+// Restore the metadata files to their state before the last logged operation.
+// Refuses if the operation has been published, or if its files were changed
+// since.
+func undoLastOperation(config configUndo, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+	))
+
+	log, err := readOplog(config.metadataDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to read operation log", slog.Any("error", err))
+		return err
+	}
+	if len(log.Entries) == 0 {
+		return fmt.Errorf("no operation to undo in %s", config.metadataDir)
+	}
+	entry := log.Entries[len(log.Entries)-1]
+
+	if entry.Commit != "" {
+		pushed, err := isCommitPushed(config.metadataDir, entry.Commit)
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to check whether operation is published", slog.Any("error", err))
+			return err
+		}
+		if pushed {
+			return fmt.Errorf("last operation %q (commit %s) has been pushed to a git remote and cannot be undone", entry.Operation, shortID(entry.Commit))
+		}
+	}
+
+	// Refuse to discard changes made after the operation
+	for _, file := range entry.Files {
+		content, err := filesystem.ReadBytesFromFile(filepath.Join(config.metadataDir, file.Filename))
+		if err != nil || sha256Hex(content) != file.SHA256 {
+			slog.ErrorContext(ctx, "metadata file changed since operation", slog.String("file", file.Filename), slog.String("operation", entry.Operation))
+			return fmt.Errorf("%s was changed after operation %q, refusing to undo it", file.Filename, entry.Operation)
+		}
+	}
+
+	// Restore the replaced files first, so that the timestamp never points to
+	// a removed snapshot
+	restored := []metadataFile{}
+	removed := []string{}
+	for _, file := range entry.Files {
+		if file.Created {
+			removed = append(removed, file.Filename)
+			continue
+		}
+		previous, err := readPrevious(config.metadataDir, entry, file)
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to read replaced metadata file", slog.Any("error", err), slog.String("file", file.Filename))
+			return err
+		}
+		restored = append(restored, metadataFile{file.Filename, func(path string) error {
+			return filesystem.WriteBytesToFile(path, previous)
+		}})
+	}
+	if len(restored) > 0 {
+		if err = writeMetadataFiles(config.metadataDir, UndoVerb, restored); err != nil {
+			slog.ErrorContext(ctx, "fail to restore metadata files", slog.Any("error", err))
+			return err
+		}
+	}
+	for _, filename := range removed {
+		if err = os.Remove(filepath.Join(config.metadataDir, filename)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.ErrorContext(ctx, "fail to remove metadata file", slog.Any("error", err), slog.String("file", filename))
+			return fmt.Errorf("fail to remove %s: %w", filename, err)
+		}
+	}
+	if err = filesystem.SyncDir(config.metadataDir); err != nil {
+		return fmt.Errorf("fail to sync dir %s: %w", config.metadataDir, err)
+	}
+
+	log.Entries = log.Entries[:len(log.Entries)-1]
+	if err = writeOplog(config.metadataDir, log); err != nil {
+		slog.ErrorContext(ctx, "fail to update operation log", slog.Any("error", err))
+		return err
+	}
+
+	slog.InfoContext(ctx, "operation undone", slog.String("operation", entry.Operation), slog.Any("removed", removed))
+	fmt.Fprintf(out.text, "Undone operation %q by %s at %s\n", entry.Operation, entry.User, entry.Time.Local().Format("2006-01-02 15:04:05"))
+	if len(removed) > 0 {
+		fmt.Fprintf(out.text, "Removed: %s\n", strings.Join(removed, ", "))
+	}
+	for _, file := range restored {
+		fmt.Fprintf(out.text, "Restored: %s\n", file.filename)
+	}
+	return nil
+}
+
+// Content of file before entry replaced it, from its backup or, in git mode,
+// from the parent of the operation commit.
+func readPrevious(metadataDir string, entry oplogEntry, file oplogFile) ([]byte, error) {
+	var previous []byte
+	var err error
+	if file.Backup != "" {
+		previous, err = filesystem.ReadBytesFromFile(filepath.Join(metadataDir, filepath.FromSlash(file.Backup)))
+	} else if entry.Commit != "" {
+		var repo *gitrepo.Repo
+		if repo, err = gitrepo.Open(metadataDir); err == nil {
+			previous, err = repo.Show(entry.Commit+"^", file.Filename)
+		}
+	} else {
+		err = errors.New("no backup recorded")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to read %s as replaced by operation %q: %w", file.Filename, entry.Operation, err)
+	}
+	if sha256Hex(previous) != file.PreviousSHA256 {
+		return nil, fmt.Errorf("backup of %s replaced by operation %q is corrupt, refusing to undo it", file.Filename, entry.Operation)
+	}
+	return previous, nil
+}
+
+func isCommitPushed(metadataDir string, commit string) (bool, error) {
+	repo, err := gitrepo.Open(metadataDir)
+	if err != nil {
+		return false, err
+	}
+	return repo.IsPushed(commit)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"see_updater/internal/pkg/cli"
+	"see_updater/internal/pkg/custom"
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/metahelper"
+
+	"github.com/spf13/cobra"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Result document of a command, printed on stdout with --output json.
+type commandResult struct {
+	Command      string                   `json:"command"`
+	Success      bool                     `json:"success"`
+	Error        string                   `json:"error,omitempty"`
+	MetadataDir  string                   `json:"metadata_dir,omitempty"`
+	Files        []string                 `json:"files,omitempty"`   // written by the command
+	Removed      []string                 `json:"removed,omitempty"` // removed by the command
+	Versions     map[string]int64         `json:"versions,omitempty"`
+	KeyIDs       []string                 `json:"signatures_added,omitempty"`
+	Changes      []targetChange           `json:"changes,omitempty"`
+	Skipped      []filesystem.SkippedFile `json:"skipped,omitempty"`   // left out of the scan
+	Hardlinks    [][]string               `json:"hardlinks,omitempty"` // groups of scanned files hardlinked together
+	Verification []roleVerification       `json:"verification,omitempty"`
+	Unhashed     map[string][]string      `json:"unhashed,omitempty"`    // verify: target -> missing hash algorithms
+	Published    []string                 `json:"published,omitempty"`   // target files written to the publish dir
+	Unpublished  []string                 `json:"unpublished,omitempty"` // targets without a file to publish
+	Pruned       []string                 `json:"pruned,omitempty"`      // target files of old generations removed
+	Yanked       []yankedTarget           `json:"yanked,omitempty"`      // verify: targets with yanked content
+	Data         any                      `json:"data,omitempty"`        // command specific
+	DryRun       bool                     `json:"dry_run,omitempty"`
+	Thresholds   []roleThreshold          `json:"thresholds,omitempty"` // dry run only
+	Diff         string                   `json:"diff,omitempty"`       // dry run only
+}
+
+// Target file that differs between the targets metadata and the repository
+// dir, see metahelper.CompareNewOldTargets for the kinds.
+type targetChange struct {
+	Kind      string            `json:"kind"`
+	Path      string            `json:"path"`
+	OldPath   string            `json:"old_path,omitempty"` // renamed only
+	OldLength int64             `json:"old_length"`
+	NewLength int64             `json:"new_length"`
+	OldHashes map[string]string `json:"old_hashes,omitempty"`
+	NewHashes map[string]string `json:"new_hashes,omitempty"`
+	// Custom metadata, when it changed
+	OldCustom *json.RawMessage `json:"old_custom,omitempty"`
+	NewCustom *json.RawMessage `json:"new_custom,omitempty"`
+}
+
+func targetChanges(changes []metahelper.TargetChange) []targetChange {
+	result := []targetChange{}
+	for _, change := range changes {
+		c := targetChange{Kind: change.Kind, Path: change.Path(), OldLength: change.Old.Length, NewLength: change.New.Length,
+			OldHashes: hexHashes(change.Old.Hashes), NewHashes: hexHashes(change.New.Hashes)}
+		if change.Kind == metahelper.ChangeRenamed || change.Kind == metahelper.ChangeRenamedModified {
+			c.OldPath = change.Old.Path
+		}
+		if !custom.Equal(change.Old.Custom, change.New.Custom) {
+			c.OldCustom, c.NewCustom = change.Old.Custom, change.New.Custom
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// Print the target changes and record them in the result document.
+func printTargetChanges(out *cmdOutput, changes []targetChange) {
+	out.result.Changes = changes
+	counts := map[string]int{}
+	for _, change := range changes {
+		counts[change.Kind]++
+	}
+	fmt.Fprintf(out.text, "A total of %d new changes detected: %d added, %d removed, %d modified, %d renamed", len(changes),
+		counts[metahelper.ChangeAdded], counts[metahelper.ChangeRemoved], counts[metahelper.ChangeModified], counts[metahelper.ChangeRenamed])
+	if counts[metahelper.ChangeRenamedModified] > 0 {
+		fmt.Fprintf(out.text, ", %d renamed and modified", counts[metahelper.ChangeRenamedModified])
+	}
+	if counts[metahelper.ChangeRehashed] > 0 {
+		fmt.Fprintf(out.text, ", %d rehashed", counts[metahelper.ChangeRehashed])
+	}
+	fmt.Fprintln(out.text)
+	w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+	fmt.Fprintln(w, "\tNo.\tChange\tFilepath\tLength (old -> new)\tHash (old -> new)")
+	for i, change := range changes {
+		path := change.Path
+		if change.OldPath != "" {
+			path = change.OldPath + " -> " + change.Path
+		}
+		fmt.Fprintf(w, "\t%d.\t%s\t%s\t%d\t->\t%d\t%s\t->\t%s\n", i+1, change.Kind, path,
+			change.OldLength, change.NewLength, hashSummary(change.OldHashes), hashSummary(change.NewHashes))
+	}
+	w.Flush()
+}
+
+// With --fail-on-removal, refuse changes removing target files. Renamed
+// targets are not removed.
+func checkRemovals(changes []targetChange, failOnRemoval bool) error {
+	if !failOnRemoval {
+		return nil
+	}
+	removed := []string{}
+	for _, change := range changes {
+		if change.Kind == metahelper.ChangeRemoved {
+			removed = append(removed, change.Path)
+		}
+	}
+	count := len(removed)
+	if count == 0 {
+		return nil
+	}
+	if count > 5 {
+		removed = append(removed[:5], "...")
+	}
+	return fmt.Errorf("%w: %d target file(s) (%s), run without --%s if intended",
+		ErrTargetsRemoved, count, strings.Join(removed, ", "), UpdateFailOnRemoval)
+}
+
+// e.g. "sha256:<hex>", "-" if there is no hash.
+func hashSummary(hashes map[string]string) string {
+	if len(hashes) == 0 {
+		return "-"
+	}
+	result := []string{}
+	for algorithm, digest := range hashes {
+		result = append(result, algorithm+":"+digest)
+	}
+	slices.Sort(result)
+	return strings.Join(result, ",")
+}
+
+func hexHashes(hashes metadata.Hashes) map[string]string {
+	if len(hashes) == 0 {
+		return nil
+	}
+	result := map[string]string{}
+	for algorithm, digest := range hashes {
+		result[algorithm] = digest.String()
+	}
+	return result
+}
+
+type roleVerification struct {
+	Role      string    `json:"role"`
+	Filepath  string    `json:"filepath"`
+	Threshold uint8     `json:"threshold"`
+	Expires   time.Time `json:"expires"`
+	Valid     bool      `json:"valid"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+// Output of a command: human readable text, and the result document collected
+// along the way. With --output json the text goes to stderr and only the
+// document is printed on stdout.
+type cmdOutput struct {
+	cmd    *cobra.Command
+	format string
+	text   io.Writer
+	doc    io.Writer
+	result commandResult
+	// Confirmation prompts, on stderr
+	confirmer *cli.Confirmer
+}
+
+// Set up the output of cmd, must run before cmd prints anything.
+func (o *cmdOutput) init(cmd *cobra.Command, format string, policy cli.Policy) error {
+	if !slices.Contains([]string{OutputText, OutputJSON}, format) {
+		return fmt.Errorf("%w: invalid --%s %q, accepted: %q, %q", ErrUsage, GlobalOutput, format, OutputText, OutputJSON)
+	}
+	o.cmd = cmd
+	o.format = format
+	o.doc = cmd.OutOrStdout()
+	if format == OutputJSON {
+		// Cobra prints usage errors through the root command
+		cmd.Root().SetOut(cmd.ErrOrStderr())
+		cmd.SetOut(cmd.ErrOrStderr())
+	}
+	o.text = cmd.OutOrStdout()
+	o.confirmer = cli.NewConfirmer(cmd.InOrStdin(), cmd.ErrOrStderr(), policy)
+	o.result = commandResult{Command: strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" "), Success: true}
+	return nil
+}
+
+// Report err and the failure banner, returns err for RunE. The banner
+// replaces cobra's error message and usage.
+func (o *cmdOutput) fail(err error, banner string) error {
+	fmt.Fprintf(o.text, "Encountered some issue: %v\n", err)
+	fmt.Fprintln(o.text, banner)
+	o.silence()
+	return o.abort(err)
+}
+
+// Report a failed input validation, msg is printed as is. Returns an ErrUsage.
+func (o *cmdOutput) reject(msg string, banner string) error {
+	fmt.Fprintln(o.text, msg)
+	fmt.Fprintln(o.text, banner)
+	o.silence()
+	return o.abort(fmt.Errorf("%w: %s", ErrUsage, msg))
+}
+
+func (o *cmdOutput) silence() {
+	o.cmd.SilenceErrors = true
+	o.cmd.SilenceUsage = true
+}
+
+// Record err and print the result document, cobra still prints err and the
+// usage unless silenced. Post-run hooks do not run once a command fails.
+func (o *cmdOutput) abort(err error) error {
+	o.result.Success = false
+	o.result.Error = err.Error()
+	if flushErr := o.flush(); flushErr != nil {
+		slog.Error("fail to print result document", slog.Any("error", flushErr))
+	}
+	return err
+}
+
+func (o *cmdOutput) succeed(banner string) {
+	fmt.Fprintln(o.text, banner)
+}
+
+// Record the files written by a repository operation.
+func (o *cmdOutput) recordOperation(op operation, metadataDir string) {
+	o.result.MetadataDir = metadataDir
+	o.result.Files = op.files
+	o.result.Removed = op.removed
+	if len(op.versions) > 0 {
+		o.result.Versions = op.versions
+	}
+	o.result.KeyIDs = op.keyIDs
+}
+
+// Print the result document in JSON mode.
+func (o *cmdOutput) flush() error {
+	if o.format != OutputJSON {
+		return nil
+	}
+	enc := json.NewEncoder(o.doc)
+	enc.SetIndent("", "  ")
+	return enc.Encode(o.result)
+}
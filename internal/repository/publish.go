@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"see_updater/internal/pkg/objectstore"
+	"see_updater/internal/pkg/publish"
+
+	"github.com/spf13/cobra"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Target files of older targets versions stay published that long after
+// being superseded, for clients still downloading with older metadata.
+const defaultPublishGrace = 24 * time.Hour
+
+// Where and how the target files of a consistent snapshot repository are
+// published, shared by init, update, update apply and target.
+type configPublish struct {
+	dir    string // local dir, nothing is published if empty
+	mode   string // see publish.Modes
+	grace  time.Duration
+	dryRun bool // nothing is published
+}
+
+func addPublishFlags(cmd *cobra.Command, config *configPublish) {
+	cmd.Flags().StringVar(&config.dir, PublishDir, "", "Local directory the target files are published to as <hash>.<name>, for roots with consistent snapshots (optional)")
+	cmd.Flags().StringVar(&config.mode, PublishMode, publish.ModeCopy, fmt.Sprintf("How target files are published: %q or %q, hardlinked files must not be edited in place (optional)",
+		publish.ModeCopy, publish.ModeHardlink))
+	cmd.Flags().DurationVar(&config.grace, PublishGrace, defaultPublishGrace, "How long the target files of older targets versions stay published (optional)")
+}
+
+// Publish the target files of roles missing from the publish dir, from
+// sources (target name -> content), before the metadata referencing them is
+// written. Refuses a publish dir if the root has no consistent snapshots.
+func (c configPublish) publish(ctx context.Context, roles roleSet, sources map[string]publish.Source, out *cmdOutput) error {
+	return c.publishTargets(ctx, roles.Root().Signed.ConsistentSnapshot, roles.Targets(Targets).Signed.Targets, sources, out)
+}
+
+// Publish targets like publish, for a root with or without consistent
+// snapshots.
+func (c configPublish) publishTargets(ctx context.Context, consistent bool, targets map[string]*metadata.TargetFiles, sources map[string]publish.Source, out *cmdOutput) error {
+	if c.dir == "" {
+		if consistent {
+			slog.WarnContext(ctx, fmt.Sprintf("root has consistent snapshots but no --%s was given, clients only download target files published as <hash>.<name>", PublishDir))
+		}
+		return nil
+	}
+	if !consistent {
+		return fmt.Errorf("%w: --%s requires a root with consistent snapshots, see `%s --%s`", ErrUsage, PublishDir, InitVerb, InitConsistentSnapshot)
+	}
+	if objectstore.IsURI(c.dir) {
+		return fmt.Errorf("%w: invalid --%s %q, use a local dir", ErrUsage, PublishDir, c.dir)
+	}
+	if !slices.Contains(publish.Modes, c.mode) {
+		return fmt.Errorf("%w: invalid --%s %q, accepted: %s", ErrUsage, PublishMode, c.mode, strings.Join(publish.Modes, ", "))
+	}
+	if c.grace < 0 {
+		return fmt.Errorf("%w: invalid --%s %s, use a positive duration", ErrUsage, PublishGrace, c.grace)
+	}
+	if c.dryRun {
+		fmt.Fprintf(out.text, "Dry run, no target file was published to: %s\n", c.dir)
+		return nil
+	}
+
+	written, missing, err := publish.Publish(c.dir, targets, sources, c.mode)
+	out.result.Published = written
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to publish target files", slog.Any("error", err), slog.String("publish_dir", c.dir))
+		if errors.Is(err, publish.ErrChanged) {
+			return fmt.Errorf("%w: %w, run `%s` again", ErrVerification, err, UpdateVerb)
+		}
+		return fmt.Errorf("fail to publish target files to %s: %w", c.dir, err)
+	}
+	if len(written) > 0 {
+		fmt.Fprintf(out.text, "Published %d target files to: %s\n", len(written), c.dir)
+	}
+	if len(missing) > 0 {
+		out.result.Unpublished = missing
+		slog.WarnContext(ctx, "targets without a file to publish", slog.Any("targets", missing))
+		fmt.Fprintf(out.text, "A total of %d targets have no file to publish, copy them to the publish dir as <hash>.<name>: %s\n",
+			len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Record the targets of roles, once written, as the current generation of the
+// publish dir and remove the files of the generations superseded longer than
+// the grace period. Failures are only logged, the metadata is written.
+func (c configPublish) prune(ctx context.Context, roles roleSet, out *cmdOutput) {
+	if c.dir == "" || c.dryRun || !roles.Root().Signed.ConsistentSnapshot {
+		return
+	}
+	targets := roles.Targets(Targets)
+	removed, err := publish.Prune(c.dir, targets.Signed.Version, targets.Signed.Targets, c.grace, time.Now())
+	out.result.Pruned = removed
+	if err != nil {
+		slog.WarnContext(ctx, "fail to prune publish dir, older target files are kept", slog.Any("error", err), slog.String("publish_dir", c.dir))
+	}
+	if len(removed) > 0 {
+		fmt.Fprintf(out.text, "Removed %d target files of older generations from: %s\n", len(removed), c.dir)
+	}
+}
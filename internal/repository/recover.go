@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"see_updater/internal/pkg/journal"
+	"see_updater/internal/pkg/logging"
+)
+
+// Metadata file to be written by a command, toFile writes it to the given path.
+type metadataFile struct {
+	filename string
+	toFile   func(path string) error
+}
+
+// Write the metadata files of an operation into dir all at once, so that an
+// interruption never leaves e.g. a new targets version without its snapshot.
+func writeMetadataFiles(dir string, verb string, files []metadataFile) error {
+	txn, err := journal.Begin(dir, verb)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = txn.Stage(file.filename, file.toFile); err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+	written, err := txn.Commit()
+	if err != nil {
+		return err
+	}
+	slog.Info("metadata files written", slog.String("operation", verb), slog.Any("files", written))
+	return nil
+}
+
+// Complete or discard an operation that was interrupted in the metadata dir.
+func recoverMetadataDir(metadataDir string) (journal.Result, error) {
+	result, err := journal.Recover(metadataDir)
+	if err != nil {
+		return result, fmt.Errorf("fail to recover interrupted operation: %w", err)
+	}
+	switch result.Action {
+	case journal.RecoverRolledForward:
+		slog.Warn("completed interrupted operation", slog.String("metadata_dir", metadataDir), slog.Any("files", result.Files))
+	case journal.RecoverRolledBack:
+		slog.Warn("discarded interrupted operation", slog.String("metadata_dir", metadataDir))
+	}
+	return result, nil
+}
+
+func recoverRepo(config configRecover, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+	))
+
+	result, err := recoverMetadataDir(config.metadataDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to recover metadata dir", slog.Any("error", err))
+		return err
+	}
+	out.result.Data = map[string]string{"action": result.Action}
+	out.result.Files = result.Files
+	switch result.Action {
+	case journal.RecoverRolledForward:
+		fmt.Fprintf(out.text, "Interrupted operation completed, files moved into place: %s\n", strings.Join(result.Files, ", "))
+	case journal.RecoverRolledBack:
+		fmt.Fprintln(out.text, "Interrupted operation discarded, no metadata file was changed")
+	default:
+		fmt.Fprintln(out.text, "No interrupted operation found")
+	}
+	return nil
+}
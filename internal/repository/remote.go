@@ -0,0 +1,357 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"see_updater/internal/pkg/custom"
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/objectstore"
+)
+
+// stagedDir mirrors the files of an s3://bucket/prefix directory that are read
+// from disk into a local temporary directory, so that the filesystem based
+// operations can run unchanged against object storage. Local directories are
+// passed through untouched.
+type stagedDir struct {
+	uri     string
+	local   string
+	tmpRoot string
+	store   *objectstore.S3
+	prefix  string
+	objects []string            // relative keys of the objects under the prefix, staged or not
+	etags   map[string]string   // relative key -> ETag at download time
+	sums    map[string][32]byte // relative key -> sha256 at download time
+	lock    *remoteLock         // held until Close, see stageLockedMetadataDir
+}
+
+// Replace *dir with the local copy of a metadata dir. Only the metadata files
+// the commands read are downloaded: every root (verify walks the chain), the
+// latest version of the other roles and the unversioned files. Older versions
+// and other objects stay in the bucket, untouched by Publish.
+func stageMetadataDir(dir *string) (*stagedDir, error) {
+	return stageDir(dir, metadataObjects)
+}
+
+// Like stageMetadataDir for a command that publishes the metadata dir: the
+// lock of the remote dir is taken before downloading and held until Close, i.e.
+// after Publish. runOperation only locks the local copy. A dry run publishes
+// nothing and takes no remote lock.
+func stageLockedMetadataDir(global *configGlobal, verb string, dir *string) (*stagedDir, error) {
+	if !objectstore.IsURI(*dir) || global.dryRun {
+		return stageMetadataDir(dir)
+	}
+	bucket, prefix, err := objectstore.ParseURI(*dir)
+	if err != nil {
+		return nil, err
+	}
+	store, err := objectstore.NewFromEnv(bucket)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := acquireRemoteLock(store, prefix, verb, global.wait)
+	if err != nil {
+		return nil, err
+	}
+	d, err := stageMetadataDir(dir)
+	if err != nil {
+		if releaseErr := lock.Release(); releaseErr != nil {
+			err = errors.Join(err, releaseErr)
+		}
+		return nil, err
+	}
+	d.lock = lock
+	return d, nil
+}
+
+// Replace *dir with the local copy of a repository dir. Only the files read
+// from disk are downloaded: the ignore file and the custom sidecars. The
+// target files are listed by scan and streamed by open.
+func stageRepositoryDir(dir *string) (*stagedDir, error) {
+	return stageDir(dir, func(rels []string) []string {
+		selected := []string{}
+		for _, rel := range rels {
+			if rel == IgnoreFilename || strings.HasSuffix(rel, custom.SidecarSuffix) {
+				selected = append(selected, rel)
+			}
+		}
+		return selected
+	})
+}
+
+// Replace *dir with the local path of the staged directory, made of the
+// objects chosen by selectObjects among the relative keys under the prefix.
+func stageDir(dir *string, selectObjects func(rels []string) []string) (*stagedDir, error) {
+	d := &stagedDir{uri: *dir, local: *dir}
+	if !objectstore.IsURI(*dir) {
+		return d, nil
+	}
+
+	bucket, prefix, err := objectstore.ParseURI(*dir)
+	if err != nil {
+		return nil, err
+	}
+	store, err := objectstore.NewFromEnv(bucket)
+	if err != nil {
+		return nil, err
+	}
+	d.store = store
+	d.prefix = prefix
+	d.etags = map[string]string{}
+	d.sums = map[string][32]byte{}
+
+	// Keep the last path element so that target paths are the same as if the
+	// directory had been read from disk
+	d.tmpRoot, err = os.MkdirTemp("", "updater-s3-")
+	if err != nil {
+		return nil, fmt.Errorf("fail to make temporary dir: %w", err)
+	}
+	name := path.Base(strings.TrimSuffix(prefix, "/"))
+	if prefix == "" {
+		name = bucket
+	}
+	d.local = filepath.Join(d.tmpRoot, name)
+	if err = filesystem.MakeNewDirAll(d.local); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("fail to make temporary dir: %w", err)
+	}
+
+	objects, err := store.List(prefix)
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	for _, object := range objects {
+		rel := strings.TrimPrefix(object.Key, prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			continue // directory placeholder
+		}
+		// e.g. `prefix/../../.bashrc` would be written outside of the copy
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			d.Close()
+			return nil, fmt.Errorf("%w: object %s is outside of %s, refusing to stage it", ErrVerification, object.Key, d.uri)
+		}
+		d.objects = append(d.objects, rel)
+	}
+	for _, rel := range selectObjects(d.objects) {
+		content, etag, err := store.Get(prefix + rel)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("%w: %w", ErrIO, err)
+		}
+		localPath := filepath.Join(d.local, filepath.FromSlash(rel))
+		if err = filesystem.MakeNewDirAll(filepath.Dir(localPath)); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("fail to make dir for object %s: %w", prefix+rel, err)
+		}
+		if err = filesystem.WriteBytesToFile(localPath, content); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("fail to write object %s to file: %w", prefix+rel, err)
+		}
+		// Kept to roll back a failed publish, the command edits localPath
+		if err = filesystem.MakeNewDirAll(filepath.Dir(d.originalPath(rel))); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("fail to make dir for object %s: %w", prefix+rel, err)
+		}
+		if err = filesystem.WriteBytesToFile(d.originalPath(rel), content); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("fail to write object %s to file: %w", prefix+rel, err)
+		}
+		d.etags[rel] = etag
+		d.sums[rel] = sha256.Sum256(content)
+	}
+	slog.Info("staged remote directory", slog.String("uri", d.uri), slog.String("local", d.local),
+		slog.Int("objects", len(d.objects)), slog.Int("downloaded", len(d.etags)))
+
+	*dir = d.local
+	return d, nil
+}
+
+// Metadata files of rels needed by the commands, see stageMetadataDir.
+func metadataObjects(rels []string) []string {
+	selected := []string{}
+	latest := map[string]string{} // role -> file of its highest version
+	versions := map[string]int{}
+	for _, rel := range rels {
+		match := metadataFilenamePattern.FindStringSubmatch(rel)
+		if match == nil || strings.Contains(rel, "/") {
+			continue
+		}
+		if match[1] == "" || match[2] == Root {
+			selected = append(selected, rel)
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		if _, ok := latest[match[2]]; !ok || version > versions[match[2]] {
+			latest[match[2]] = rel
+			versions[match[2]] = version
+		}
+	}
+	for _, rel := range latest {
+		selected = append(selected, rel)
+	}
+	sort.Strings(selected)
+	return selected
+}
+
+func (d *stagedDir) IsRemote() bool {
+	return d.store != nil
+}
+
+// Upload new and changed files back to object storage. New files are created
+// with `If-None-Match: *` and replaced files with `If-Match: <etag>`, so that a
+// concurrent writer makes the upload fail instead of silently overwriting.
+// Versioned files are uploaded before the unversioned ones (i.e. timestamp.json)
+// so that clients never see a timestamp pointing to a missing snapshot. If an
+// upload fails, the objects already uploaded are rolled back, see rollback.
+func (d *stagedDir) Publish() ([]string, error) {
+	if !d.IsRemote() {
+		return nil, nil
+	}
+
+	changed := []string{}
+	err := filepath.WalkDir(d.local, func(p string, di fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if slices.Contains(stateFilenames(), di.Name()) {
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil // local state of the tool
+		}
+		if di.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.local, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		content, err := filesystem.ReadBytesFromFile(p)
+		if err != nil {
+			return err
+		}
+		if sum, ok := d.sums[rel]; ok && bytes.Equal(sum[:], sumOf(content)) {
+			return nil
+		}
+		changed = append(changed, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to scan staged dir %s: %w", d.local, err)
+	}
+	slices.SortStableFunc(changed, func(a, b string) int {
+		return publishOrder(a) - publishOrder(b)
+	})
+
+	published := []string{}
+	for _, rel := range changed {
+		content, err := filesystem.ReadBytesFromFile(filepath.Join(d.local, filepath.FromSlash(rel)))
+		etag := ""
+		if err == nil {
+			cond := objectstore.Condition{IfNoneMatch: true}
+			if etag, ok := d.etags[rel]; ok {
+				cond = objectstore.Condition{IfMatch: etag}
+			}
+			etag, err = d.store.Put(d.prefix+rel, content, cond)
+		}
+		if err != nil {
+			slog.Error("fail to publish file", slog.Any("error", err), slog.String("key", d.prefix+rel))
+			if left := d.rollback(published); len(left) > 0 {
+				return nil, fmt.Errorf("%w: fail to publish %s: %w, fail to roll back the objects already published, left behind: %s",
+					ErrIO, rel, err, strings.Join(left, ", "))
+			}
+			return nil, fmt.Errorf("%w: fail to publish %s: %w, the %d objects already published were rolled back", ErrIO, rel, err, len(published))
+		}
+		d.etags[rel] = etag
+		d.sums[rel] = sha256.Sum256(content)
+		published = append(published, rel)
+		slog.Info("published file", slog.String("key", d.prefix+rel))
+	}
+	return published, nil
+}
+
+// Undo the upload of published (relative keys, in upload order) after a failed
+// publish: created objects are deleted and replaced ones get their staged
+// content back, unless somebody else replaced them since. Returns the keys that could
+// not be rolled back.
+func (d *stagedDir) rollback(published []string) []string {
+	left := []string{}
+	for i := len(published) - 1; i >= 0; i-- {
+		rel := published[i]
+		original, err := filesystem.ReadBytesFromFile(d.originalPath(rel))
+		if errors.Is(err, fs.ErrNotExist) {
+			err = d.store.Delete(d.prefix+rel, objectstore.Condition{IfMatch: d.etags[rel]})
+		} else if err == nil {
+			_, err = d.store.Put(d.prefix+rel, original, objectstore.Condition{IfMatch: d.etags[rel]})
+		}
+		if err != nil {
+			slog.Error("fail to roll back published file", slog.Any("error", err), slog.String("key", d.prefix+rel))
+			left = append(left, d.prefix+rel)
+			continue
+		}
+		slog.Info("rolled back published file", slog.String("key", d.prefix+rel))
+	}
+	return left
+}
+
+// Copy of the object at rel as it was staged.
+func (d *stagedDir) originalPath(rel string) string {
+	return filepath.Join(d.tmpRoot, "original", filepath.FromSlash(rel))
+}
+
+// Files of a remote dir kept by opts, from the object listing. Their full
+// path is in the local copy, where only the staged files exist.
+func (d *stagedDir) scan(opts filesystem.ScanOptions) filesystem.ScanResult {
+	return filesystem.ScanPaths(d.local, d.objects, opts)
+}
+
+// Content of the object at rel, streamed from object storage.
+func (d *stagedDir) open(rel string) (io.ReadCloser, error) {
+	content, err := d.store.Open(d.prefix + rel)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	return content, nil
+}
+
+// Remove the local copy of a remote directory and release its lock.
+func (d *stagedDir) Close() {
+	if d.tmpRoot != "" {
+		os.RemoveAll(d.tmpRoot)
+	}
+	if d.lock != nil {
+		if err := d.lock.Release(); err != nil {
+			slog.Error("fail to release repository lock", slog.Any("error", err), slog.String("uri", d.uri))
+		}
+		d.lock = nil
+	}
+}
+
+func publishOrder(rel string) int {
+	if path.Base(rel) == Timestamp+".json" {
+		return 1
+	}
+	return 0
+}
+
+func sumOf(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
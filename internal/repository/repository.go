@@ -4,15 +4,31 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"see_updater/internal/pkg/cli"
+	"see_updater/internal/pkg/hashcache"
 	"see_updater/internal/pkg/logging"
+	"see_updater/internal/pkg/objectstore"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	// "github.com/spf13/cobra/doc"
 )
 
 /* command configuration */
+type configGlobal struct {
+	git          bool
+	wait         time.Duration
+	workspaceDir string
+	configFile   string
+	profile      string
+	output       string
+	yes          bool
+	noInput      bool
+	dryRun       bool
+}
 type configKeygen struct {
 	outputDir       string
 	privkeyFilename string
@@ -36,6 +52,11 @@ type configInit struct {
 	snapshotThreshold     uint8
 	timestampThreshold    uint8
 	expireIn              uint16
+	force                 bool
+	consistentSnapshot    bool
+	metaHashes            string // "," separated roles
+	scan                  configScan
+	publish               configPublish
 }
 type configUpdate struct {
 	repositoryDir            string
@@ -45,6 +66,65 @@ type configUpdate struct {
 	timestampPrivkeyFilepath string
 	expireIn                 uint16
 	askConfirmation          bool
+	failOnRemoval            bool
+	migratePaths             bool   // rename the current targets instead of rehashing
+	metaHashes               string // "," separated roles
+	scan                     configScan
+	publish                  configPublish
+}
+type configUpdatePlan struct {
+	repositoryDir string
+	metadataDir   string
+	planFilepath  string
+	expireIn      uint16
+	failOnRemoval bool
+	migratePaths  bool
+	scan          configScan
+}
+type configUpdateApply struct {
+	planFilepath             string
+	repositoryDir            string     // publish: where the planned target files are
+	remote                   *stagedDir // repositoryDir in object storage
+	metadataDir              string
+	targetsPrivkeyFilepath   string
+	snapshotPrivkeyFilepath  string
+	timestampPrivkeyFilepath string
+	askConfirmation          bool
+	failOnRemoval            bool
+	metaHashes               string
+	publish                  configPublish
+}
+type configTarget struct {
+	repositoryDir            string // rehash
+	metadataDir              string
+	localFilepath            string            // add: file to hash
+	name                     string            // add: --as, remove, yank: target to remove
+	reason                   string            // yank
+	channelKeys              map[string]string // yank: channel -> key filepath
+	hash                     string            // add: <algorithm>:<hex digest> instead of a file
+	length                   int64
+	targetsPrivkeyFilepath   string
+	snapshotPrivkeyFilepath  string
+	timestampPrivkeyFilepath string
+	expireIn                 uint16
+	askConfirmation          bool
+	metaHashes               string
+	scan                     configScan // add: hash algorithms, rehash
+	publish                  configPublish
+}
+type configChannel struct {
+	metadataDir              string
+	name                     string // add: channel to add
+	from                     string // promote: source channel, or the top-level targets
+	to                       string // promote: destination channel
+	privkeyFilepath          string // add, promote: key of the channel
+	targetsPrivkeyFilepath   string // add
+	snapshotPrivkeyFilepath  string
+	timestampPrivkeyFilepath string
+	expireIn                 uint16
+	askConfirmation          bool
+	metaHashes               string
+	publish                  configPublish // promote
 }
 type configSign struct {
 	metadataDir     string
@@ -62,6 +142,8 @@ type configChangeThreshold struct {
 type configVerify struct {
 	repositoryDir string
 	metadataDir   string
+	failOnRemoval bool
+	scan          configScan
 }
 type configChangeRootKey struct {
 	metadataDir                string
@@ -72,18 +154,67 @@ type configChangeRootKey struct {
 	expireIn                   uint16
 	threshold                  uint16
 }
+type configHistory struct {
+	metadataDir string
+}
+type configLock struct {
+	metadataDir string
+	force       bool
+}
+type configRecover struct {
+	metadataDir string
+}
+type configUndo struct {
+	metadataDir string
+}
+type configConfigShow struct {
+	configFile   string
+	profile      string
+	workspaceDir string
+	commands     []string
+}
 
 /* command configuration */
 
+// Allowed subsets of private keys for updating targets, returns the
+// violation or an empty string
+// 1. (targets)
+// 2. (targets, snapshot)
+// 3. (targets, snapshot, timestamp)
+func checkUpdateKeys(targets string, snapshot string, timestamp string) string {
+	if len(timestamp) > 0 {
+		if len(snapshot) == 0 || len(targets) == 0 {
+			return "Snapshot and targets private keys must be provided"
+		}
+	} else if len(snapshot) > 0 && len(targets) == 0 {
+		return "Targets private key must be provided"
+	}
+	return ""
+}
+
+func (c *configGlobal) confirmPolicy() cli.Policy {
+	if c.yes {
+		return cli.PolicyYes
+	} else if c.noInput {
+		return cli.PolicyNoInput
+	}
+	return cli.PolicyAsk
+}
+
 // type repositoryMetadataGenerator struct {
 // }
 
 func NewCommand() *cobra.Command {
 	// Init logger
-	h := &logging.ContextHandler{Handler: slog.NewJSONHandler(os.Stdout, nil)}
+	h := &logging.ContextHandler{Handler: slog.NewJSONHandler(os.Stderr, nil)}
 	logger := slog.New(h)
 	slog.SetDefault(logger)
 
+	// Options shared by all commands
+	configGlobal := configGlobal{}
+	// Output of the running command
+	output := &cmdOutput{}
+
 	// Command to generate a RSA pem file
 	configKeygen := configKeygen{
 		bitLength: 4096,
@@ -92,22 +223,19 @@ func NewCommand() *cobra.Command {
 		Use:   KeygenVerb,
 		Short: "Generate RSA keypair pem file (4096 bit)",
 		Long:  "Generate RSA keypair pem file (4096 bit)",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("%s\n", "Running keygen command...")
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintln(output.text, "Running keygen command...")
 
 			if configKeygen.privkeyFilename == configKeygen.pubkeyFilename {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: private and public filenames cannot be the same\n")
-				fmt.Fprintln(cmd.OutOrStdout(), KeygenFailed)
-				return
+				return output.fail(fmt.Errorf("%w: private and public filenames cannot be the same", ErrUsage), KeygenFailed)
 			}
 
-			err := generateRsaKeypairPEM(configKeygen)
+			err := generateRsaKeypairPEM(configKeygen, output)
 			if err != nil {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: %v\n", err)
-				fmt.Fprintln(cmd.OutOrStdout(), KeygenFailed)
-			} else {
-				fmt.Fprintln(cmd.OutOrStdout(), KeygenSucceeded)
+				return output.fail(err, KeygenFailed)
 			}
+			output.succeed(KeygenSucceeded)
+			return nil
 		},
 	}
 	// Bit-length of key is fixed at 4096-bit
@@ -123,8 +251,8 @@ func NewCommand() *cobra.Command {
 		Use:   InitVerb,
 		Short: "Initialize repository with metadata files",
 		Long:  "Initialize repository with metadata files",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("%s\n", "Running init command...")
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintln(output.text, "Running init command...")
 
 			// Check if signature threshold for each role > 1,
 			// if so then check if supplied paths are enough (path delimiter is ;)
@@ -145,29 +273,85 @@ func NewCommand() *cobra.Command {
 			for _, name := range roles {
 				configInit.rolesPrivkeyFilepaths[name] = strings.Split(keyFilepaths[name], ";")
 				if int(thresholds[name]) == 0 {
-					fmt.Fprintf(cmd.OutOrStdout(), "Threshold must be greater than 0 for role: %s\n", name)
-					return
+					return output.reject(fmt.Sprintf("Threshold must be greater than 0 for role: %s", name), InitFailed)
 				} else if int(thresholds[name]) != len(configInit.rolesPrivkeyFilepaths[name]) {
-					fmt.Fprintf(cmd.OutOrStdout(), "Too few/many private key(s) provided for role: %s\n\twant: %d, have: %d\n",
-						name, thresholds[name], len(configInit.rolesPrivkeyFilepaths[name]))
-					fmt.Fprintln(cmd.OutOrStdout(), InitFailed)
-					return
+					return output.reject(fmt.Sprintf("Too few/many private key(s) provided for role: %s\n\twant: %d, have: %d",
+						name, thresholds[name], len(configInit.rolesPrivkeyFilepaths[name])), InitFailed)
+				}
+			}
+
+			// Directories can be local paths or s3://bucket/prefix URIs
+			configInit.publish.dryRun = configGlobal.dryRun
+			repositoryDir, err := stageRepositoryDir(&configInit.repositoryDir)
+			if err != nil {
+				return output.fail(err, InitFailed)
+			}
+			defer repositoryDir.Close()
+			configInit.scan.setup(cmd, repositoryDir, configGlobal.dryRun)
+			outputDir, err := stageLockedMetadataDir(&configGlobal, InitVerb, &configInit.outputDir)
+			if err != nil {
+				return output.fail(err, InitFailed)
+			}
+			defer outputDir.Close()
+
+			// Refuse to clobber an existing repository
+			workspaceDir := configGlobal.workspaceDir
+			if workspaceDir == "" {
+				workspaceDir = defaultWorkspaceRoot(outputDir.uri)
+			}
+			if configInit.scan.hashCache == "" && !cmd.Flags().Changed(ScanHashCache) && !objectstore.IsURI(repositoryDir.uri) {
+				configInit.scan.hashCache = filepath.Join(workspaceDir, workspaceDirname, hashcache.Filename)
+			}
+			if !configInit.force {
+				if err = checkNoRepository(configInit.outputDir, outputDir.uri, workspaceDir); err != nil {
+					return output.fail(err, InitFailed)
 				}
 			}
 
-			err := initRepo(configInit)
+			dryRun, err := stageDryRun(&configGlobal, &configInit.outputDir)
 			if err != nil {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: %v\n", err)
-				fmt.Fprintln(cmd.OutOrStdout(), InitFailed)
-			} else {
-				fmt.Fprintf(cmd.OutOrStdout(), "Metadata files written to: %s\n", configInit.outputDir)
-				fmt.Fprintln(cmd.OutOrStdout(), InitSucceeded)
+				return output.fail(err, InitFailed)
+			}
+			defer dryRun.Close()
 
+			op, err := runOperation(&configGlobal, InitVerb, configInit.outputDir, func() error {
+				return initRepo(configInit, output)
+			})
+			output.recordOperation(op, outputDir.uri)
+			if err == nil && dryRun != nil {
+				err = dryRun.report(op, output)
+			} else if err == nil {
+				_, err = outputDir.Publish()
 			}
+			if err == nil && dryRun == nil {
+				// Checked by initRepo
+				algorithms, _ := hashAlgorithms(configInit.scan.algorithms)
+				hashed, _ := metaHashes(configInit.metaHashes)
+				err = writeWorkspace(workspaceDir, workspaceConfig{
+					MetadataDir:    outputDir.uri,
+					RepositoryDir:  repositoryDir.uri,
+					Keys:           configInit.rolesPrivkeyFilepaths,
+					Expire:         configInit.expireIn,
+					HashAlgorithms: algorithms,
+					MetaHashes:     hashed,
+					PublishDir:     configInit.publish.dir,
+					CustomSidecars: configInit.scan.sidecars,
+					CustomManifest: configInit.scan.manifest,
+					CustomSchema:   configInit.scan.schema,
+				})
+			}
+			if err != nil {
+				return output.fail(err, InitFailed)
+			}
+			if dryRun == nil {
+				fmt.Fprintf(output.text, "Metadata files written to: %s\n", outputDir.uri)
+			}
+			output.succeed(InitSucceeded)
+			return nil
 		},
 	}
-	cmdInit.Flags().StringVarP(&configInit.repositoryDir, InitRepositoryDir, "d", "", "Directory containing target files (required)")
-	cmdInit.Flags().StringVarP(&configInit.outputDir, InitOutputDir, "o", "", "Directory for output metadata files (required)")
+	cmdInit.Flags().StringVarP(&configInit.repositoryDir, InitRepositoryDir, "d", "", "Directory containing target files, local path or s3://bucket/prefix (required)")
+	cmdInit.Flags().StringVarP(&configInit.outputDir, InitOutputDir, "o", "", "Directory for output metadata files, local path or s3://bucket/prefix (required)")
 	// Keypairs
 	cmdInit.Flags().StringVarP(&configInit.rootPrivkeyFilepathsRaw, InitRootPrivkeyFilepath, "v", "", "Root private key filepath(s) (required)")
 	cmdInit.Flags().StringVarP(&configInit.targetsPrivkeyFilepathsRaw, InitTargetsPrivkeyFilepath, "x", "", "Targets private key filepath(s) (required)")
@@ -179,6 +363,11 @@ func NewCommand() *cobra.Command {
 	cmdInit.Flags().Uint8VarP(&configInit.snapshotThreshold, InitSnapshotThreshold, "n", 1, "Snapshot key threshold (required)")
 	cmdInit.Flags().Uint8VarP(&configInit.timestampThreshold, InitTimestampThreshold, "s", 1, "Timestamp key threshold (required)")
 	cmdInit.Flags().Uint16VarP(&configInit.expireIn, InitExpire, "e", 365, "Metadata file expiration in days (required)")
+	cmdInit.Flags().BoolVarP(&configInit.force, InitForce, "f", false, "Initialize even if the output dir or the workspace already contains a repository (optional)")
+	addScanFlags(cmdInit, &configInit.scan)
+	cmdInit.Flags().BoolVar(&configInit.consistentSnapshot, InitConsistentSnapshot, false, "Advertise consistent snapshots in root, clients download the target files published as <hash>.<name> (optional)")
+	addMetaHashesFlag(cmdInit, &configInit.metaHashes)
+	addPublishFlags(cmdInit, &configInit.publish)
 	cmdInit.MarkFlagRequired(InitRepositoryDir)
 	cmdInit.MarkFlagsRequiredTogether(InitRepositoryDir, InitOutputDir,
 		InitRootPrivkeyFilepath, InitTargetsPrivkeyFilepath, InitSnapshotPrivkeyFilepath, InitTimestampPrivkeyFilepath,
@@ -190,74 +379,541 @@ func NewCommand() *cobra.Command {
 		Use:   UpdateVerb,
 		Short: "Update repository with new metadata files",
 		Long:  "Update repository with new metadata files, provide optional keys for targets/snapshot/timestamp roles to sign",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("%s\n", "Running update command...")
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintln(output.text, "Running update command...")
 
 			// Allowed subsets of private keys
-			// 1. (targets)
-			// 2. (targets, snapshot)
-			// 3. (targets, snapshot, timestamp)
-			if len(configUpdate.timestampPrivkeyFilepath) > 0 {
-				if len(configUpdate.snapshotPrivkeyFilepath) == 0 || len(configUpdate.targetsPrivkeyFilepath) == 0 {
-					fmt.Fprintln(cmd.OutOrStdout(), "Snapshot and targets private keys must be provided")
-					fmt.Fprintln(cmd.OutOrStdout(), UpdateFailed)
-					return
-				}
-			} else if len(configUpdate.snapshotPrivkeyFilepath) > 0 && len(configUpdate.targetsPrivkeyFilepath) == 0 {
-				fmt.Fprintln(cmd.OutOrStdout(), "Targets private key must be provided")
-				fmt.Fprintln(cmd.OutOrStdout(), UpdateFailed)
-				return
+			if msg := checkUpdateKeys(configUpdate.targetsPrivkeyFilepath, configUpdate.snapshotPrivkeyFilepath, configUpdate.timestampPrivkeyFilepath); msg != "" {
+				return output.reject(msg, UpdateFailed)
 			}
 
-			err := updateMetadata(configUpdate)
+			// Directories can be local paths or s3://bucket/prefix URIs
+			configUpdate.publish.dryRun = configGlobal.dryRun
+			repositoryDir, err := stageRepositoryDir(&configUpdate.repositoryDir)
 			if err != nil {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: %v\n", err)
-				fmt.Fprintln(cmd.OutOrStdout(), UpdateFailed)
-				return
-			} else {
-				fmt.Fprintf(cmd.OutOrStdout(), "Metadata files updated in dir: %s\n", configUpdate.metadataDir)
-				fmt.Fprintln(cmd.OutOrStdout(), UpdateSucceeded)
+				return output.fail(err, UpdateFailed)
 			}
+			defer repositoryDir.Close()
+			configUpdate.scan.setup(cmd, repositoryDir, configGlobal.dryRun)
+			metadataDir, err := stageLockedMetadataDir(&configGlobal, UpdateVerb, &configUpdate.metadataDir)
+			if err != nil {
+				return output.fail(err, UpdateFailed)
+			}
+			defer metadataDir.Close()
+			dryRun, err := stageDryRun(&configGlobal, &configUpdate.metadataDir)
+			if err != nil {
+				return output.fail(err, UpdateFailed)
+			}
+			defer dryRun.Close()
+
+			op, err := runOperation(&configGlobal, UpdateVerb, configUpdate.metadataDir, func() error {
+				return updateMetadata(configUpdate, output)
+			})
+			output.recordOperation(op, metadataDir.uri)
+			if err == nil && dryRun != nil {
+				err = dryRun.report(op, output)
+			} else if err == nil {
+				_, err = metadataDir.Publish()
+			}
+			if err == nil && dryRun == nil {
+				// Checked by the update
+				algorithms, _ := hashAlgorithms(configUpdate.scan.algorithms)
+				hashed, _ := metaHashes(configUpdate.metaHashes)
+				err = editWorkspace(configGlobal.workspaceDir, func(w *workspaceConfig) {
+					if cmd.Flags().Changed(ScanHashAlgorithms) && !configUpdate.migratePaths {
+						w.HashAlgorithms = algorithms
+					}
+					if cmd.Flags().Changed(MetaHashes) {
+						w.MetaHashes = hashed
+					}
+					if cmd.Flags().Changed(PublishDir) {
+						w.PublishDir, _ = filepath.Abs(configUpdate.publish.dir)
+					}
+					if cmd.Flags().Changed(ScanCustomSidecars) {
+						w.CustomSidecars = configUpdate.scan.sidecars
+					}
+					if cmd.Flags().Changed(ScanCustomManifest) {
+						w.CustomManifest = ""
+						if configUpdate.scan.manifest != "" {
+							w.CustomManifest, _ = filepath.Abs(configUpdate.scan.manifest)
+						}
+					}
+					if cmd.Flags().Changed(ScanCustomSchema) {
+						w.CustomSchema = ""
+						if configUpdate.scan.schema != "" {
+							w.CustomSchema, _ = filepath.Abs(configUpdate.scan.schema)
+						}
+					}
+				})
+			}
+			if err != nil {
+				return output.fail(err, UpdateFailed)
+			}
+			if dryRun == nil {
+				fmt.Fprintf(output.text, "Metadata files updated in dir: %s\n", metadataDir.uri)
+			}
+			output.succeed(UpdateSucceeded)
+			return nil
 		},
 	}
-	cmdUpdate.Flags().StringVarP(&configUpdate.repositoryDir, UpdateRepositoryDir, "d", "", "Directory containing target files (required)")
-	cmdUpdate.Flags().StringVarP(&configUpdate.metadataDir, UpdateMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdUpdate.Flags().StringVarP(&configUpdate.repositoryDir, UpdateRepositoryDir, "d", "", "Directory containing target files, local path or s3://bucket/prefix (required)")
+	cmdUpdate.Flags().StringVarP(&configUpdate.metadataDir, UpdateMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
 	cmdUpdate.Flags().StringVarP(&configUpdate.targetsPrivkeyFilepath, UpdateTargetsPrivkeyFilepath, "r", "", "Filepath of the private key for targets role (required)")
 	cmdUpdate.Flags().StringVarP(&configUpdate.snapshotPrivkeyFilepath, UpdateSnapshotPrivkeyFilepath, "s", "", "Filepath of the private key for snapshot role (optional, but requires targets key)")
 	cmdUpdate.Flags().StringVarP(&configUpdate.timestampPrivkeyFilepath, UpdateTimestampPrivkeyFilepath, "t", "", "Filepath of the private key for timestamp role (optional, but requires snapshot and targets keys)")
 	cmdUpdate.Flags().Uint16VarP(&configUpdate.expireIn, UpdateExpire, "e", 365, "Metadata file expiration in days (required)")
 	cmdUpdate.Flags().BoolVarP(&configUpdate.askConfirmation, UpdateAskConfirmation, "c", true, "Ask for confirmation before proceeding (optional)")
+	cmdUpdate.Flags().BoolVar(&configUpdate.failOnRemoval, UpdateFailOnRemoval, false, "Fail if target files were removed from the repository dir, renames excepted (optional)")
+	cmdUpdate.Flags().BoolVar(&configUpdate.migratePaths, UpdateMigratePaths, false, "Rename the current targets to the target paths of the repository dir without rehashing, e.g. after changing --target-prefix (optional)")
+	addScanFlags(cmdUpdate, &configUpdate.scan)
+	addMetaHashesFlag(cmdUpdate, &configUpdate.metaHashes)
+	addPublishFlags(cmdUpdate, &configUpdate.publish)
 	cmdUpdate.MarkFlagRequired(UpdateRepositoryDir)
 	cmdUpdate.MarkFlagsRequiredTogether(UpdateRepositoryDir, UpdateMetadataDir, UpdateTargetsPrivkeyFilepath, UpdateExpire)
 
+	// Commands to review the changes of an update and sign them separately
+	configUpdatePlan := configUpdatePlan{}
+	cmdUpdatePlan := &cobra.Command{
+		Use:   UpdatePlanVerb,
+		Short: "Write the plan of an update for review, without signing",
+		Long:  fmt.Sprintf("Write the new unsigned targets/snapshot/timestamp metadata and the target changes to a plan file, to be signed with `%s %s`", UpdateVerb, UpdateApplyVerb),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Directories can be local paths or s3://bucket/prefix URIs, nothing is published
+			repositoryDir, err := stageRepositoryDir(&configUpdatePlan.repositoryDir)
+			if err != nil {
+				return output.fail(err, UpdatePlanFailed)
+			}
+			defer repositoryDir.Close()
+			configUpdatePlan.scan.setup(cmd, repositoryDir, configGlobal.dryRun)
+			metadataDir, err := stageMetadataDir(&configUpdatePlan.metadataDir)
+			if err != nil {
+				return output.fail(err, UpdatePlanFailed)
+			}
+			defer metadataDir.Close()
+
+			output.result.MetadataDir = metadataDir.uri
+			if err = planUpdate(configUpdatePlan, output); err != nil {
+				return output.fail(err, UpdatePlanFailed)
+			}
+			output.succeed(UpdatePlanSucceeded)
+			return nil
+		},
+	}
+	cmdUpdatePlan.Flags().StringVarP(&configUpdatePlan.repositoryDir, UpdateRepositoryDir, "d", "", "Directory containing target files, local path or s3://bucket/prefix (required)")
+	cmdUpdatePlan.Flags().StringVarP(&configUpdatePlan.metadataDir, UpdateMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
+	cmdUpdatePlan.Flags().StringVarP(&configUpdatePlan.planFilepath, UpdatePlanFilepath, "p", "", "Filepath of the plan to write (required)")
+	cmdUpdatePlan.Flags().Uint16VarP(&configUpdatePlan.expireIn, UpdateExpire, "e", 365, "Metadata file expiration in days (required)")
+	cmdUpdatePlan.Flags().BoolVar(&configUpdatePlan.failOnRemoval, UpdateFailOnRemoval, false, "Fail if target files were removed from the repository dir, renames excepted (optional)")
+	cmdUpdatePlan.Flags().BoolVar(&configUpdatePlan.migratePaths, UpdateMigratePaths, false, "Rename the current targets to the target paths of the repository dir without rehashing, e.g. after changing --target-prefix (optional)")
+	addScanFlags(cmdUpdatePlan, &configUpdatePlan.scan)
+	cmdUpdatePlan.MarkFlagRequired(UpdatePlanFilepath)
+	cmdUpdatePlan.MarkFlagsRequiredTogether(UpdateRepositoryDir, UpdateMetadataDir, UpdatePlanFilepath, UpdateExpire)
+
+	configUpdateApply := configUpdateApply{}
+	cmdUpdateApply := &cobra.Command{
+		Use:   UpdateApplyVerb + " <plan>",
+		Short: "Sign and write an update plan",
+		Long:  fmt.Sprintf("Sign the metadata of a plan made by `%s %s` and write it, refuse if the metadata files changed since the plan was made", UpdateVerb, UpdatePlanVerb),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+				return fmt.Errorf("%w: %w", ErrUsage, err)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configUpdateApply.planFilepath = args[0]
+			configUpdateApply.publish.dryRun = configGlobal.dryRun
+
+			// Allowed subsets of private keys
+			if msg := checkUpdateKeys(configUpdateApply.targetsPrivkeyFilepath, configUpdateApply.snapshotPrivkeyFilepath, configUpdateApply.timestampPrivkeyFilepath); msg != "" {
+				return output.reject(msg, UpdateApplyFailed)
+			}
+
+			repositoryDir, err := stageRepositoryDir(&configUpdateApply.repositoryDir)
+			if err != nil {
+				return output.fail(err, UpdateApplyFailed)
+			}
+			defer repositoryDir.Close()
+			if repositoryDir.IsRemote() {
+				configUpdateApply.remote = repositoryDir
+			}
+			metadataDir, err := stageLockedMetadataDir(&configGlobal, UpdateVerb, &configUpdateApply.metadataDir)
+			if err != nil {
+				return output.fail(err, UpdateApplyFailed)
+			}
+			defer metadataDir.Close()
+			dryRun, err := stageDryRun(&configGlobal, &configUpdateApply.metadataDir)
+			if err != nil {
+				return output.fail(err, UpdateApplyFailed)
+			}
+			defer dryRun.Close()
+
+			op, err := runOperation(&configGlobal, UpdateVerb, configUpdateApply.metadataDir, func() error {
+				return applyUpdate(configUpdateApply, output)
+			})
+			output.recordOperation(op, metadataDir.uri)
+			if err == nil && dryRun != nil {
+				err = dryRun.report(op, output)
+			} else if err == nil {
+				_, err = metadataDir.Publish()
+			}
+			if err != nil {
+				return output.fail(err, UpdateApplyFailed)
+			}
+			if dryRun == nil {
+				fmt.Fprintf(output.text, "Metadata files updated in dir: %s\n", metadataDir.uri)
+			}
+			output.succeed(UpdateApplySucceeded)
+			return nil
+		},
+	}
+	cmdUpdateApply.Flags().StringVarP(&configUpdateApply.repositoryDir, UpdateRepositoryDir, "d", "", "Directory containing the planned target files to publish, local path or s3://bucket/prefix (required with --publish-dir)")
+	cmdUpdateApply.Flags().StringVarP(&configUpdateApply.metadataDir, UpdateMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
+	cmdUpdateApply.Flags().StringVarP(&configUpdateApply.targetsPrivkeyFilepath, UpdateTargetsPrivkeyFilepath, "r", "", "Filepath of the private key for targets role (required)")
+	cmdUpdateApply.Flags().StringVarP(&configUpdateApply.snapshotPrivkeyFilepath, UpdateSnapshotPrivkeyFilepath, "s", "", "Filepath of the private key for snapshot role (optional, but requires targets key)")
+	cmdUpdateApply.Flags().StringVarP(&configUpdateApply.timestampPrivkeyFilepath, UpdateTimestampPrivkeyFilepath, "t", "", "Filepath of the private key for timestamp role (optional, but requires snapshot and targets keys)")
+	cmdUpdateApply.Flags().BoolVarP(&configUpdateApply.askConfirmation, UpdateAskConfirmation, "c", true, "Ask for confirmation before proceeding (optional)")
+	cmdUpdateApply.Flags().BoolVar(&configUpdateApply.failOnRemoval, UpdateFailOnRemoval, false, "Fail if the plan removes target files, renames excepted (optional)")
+	addMetaHashesFlag(cmdUpdateApply, &configUpdateApply.metaHashes)
+	addPublishFlags(cmdUpdateApply, &configUpdateApply.publish)
+	cmdUpdateApply.MarkFlagRequired(UpdateMetadataDir)
+	cmdUpdateApply.MarkFlagsRequiredTogether(UpdateMetadataDir, UpdateTargetsPrivkeyFilepath)
+	cmdUpdate.AddCommand(cmdUpdatePlan)
+	cmdUpdate.AddCommand(cmdUpdateApply)
+
+	// Commands to add or remove one target without scanning the repository dir,
+	// and to add hashes of other algorithms to the targets
+	configTarget := configTarget{}
+	cmdTarget := &cobra.Command{
+		Use:   TargetVerb,
+		Short: "Add, remove, yank or rehash targets",
+		Long:  "Add, remove or yank one target, or add hashes to the targets, in the latest targets metadata and write new targets/snapshot/timestamp versions",
+	}
+	// Sign and write the targets edited by fn like update, then run written
+	// (if any, not on dry runs) once the metadata is published
+	runTargetEdit := func(verb string, fn func() error, written func() error) error {
+		if msg := checkUpdateKeys(configTarget.targetsPrivkeyFilepath, configTarget.snapshotPrivkeyFilepath, configTarget.timestampPrivkeyFilepath); msg != "" {
+			return output.reject(msg, TargetFailed)
+		}
+		configTarget.publish.dryRun = configGlobal.dryRun
+		metadataDir, err := stageLockedMetadataDir(&configGlobal, verb, &configTarget.metadataDir)
+		if err != nil {
+			return output.fail(err, TargetFailed)
+		}
+		defer metadataDir.Close()
+		dryRun, err := stageDryRun(&configGlobal, &configTarget.metadataDir)
+		if err != nil {
+			return output.fail(err, TargetFailed)
+		}
+		defer dryRun.Close()
+
+		op, err := runOperation(&configGlobal, verb, configTarget.metadataDir, fn)
+		output.recordOperation(op, metadataDir.uri)
+		if err == nil && dryRun != nil {
+			err = dryRun.report(op, output)
+		} else if err == nil {
+			_, err = metadataDir.Publish()
+		}
+		if err == nil && dryRun == nil && written != nil {
+			err = written()
+		}
+		if err != nil {
+			return output.fail(err, TargetFailed)
+		}
+		if dryRun == nil && len(op.files) > 0 {
+			fmt.Fprintf(output.text, "Metadata files updated in dir: %s\n", metadataDir.uri)
+		}
+		output.succeed(TargetSucceeded)
+		return nil
+	}
+	cmdTargetAdd := &cobra.Command{
+		Use:   TargetAddVerb + " [file]",
+		Short: "Add or replace one target",
+		Long:  fmt.Sprintf("Add or replace one target, hashed from a local file or given by --%s and --%s for artifacts stored elsewhere", TargetHash, TargetLength),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
+				return fmt.Errorf("%w: %w", ErrUsage, err)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				configTarget.localFilepath = args[0]
+			}
+			if (configTarget.localFilepath == "") == (configTarget.hash == "") {
+				return output.reject(fmt.Sprintf("Provide either a file or --%s", TargetHash), TargetFailed)
+			}
+			if configTarget.hash != "" && (configTarget.name == "" || configTarget.length <= 0) {
+				return output.reject(fmt.Sprintf("--%s requires --%s and a positive --%s", TargetHash, TargetAs, TargetLength), TargetFailed)
+			}
+			return runTargetEdit(TargetVerb+" "+TargetAddVerb, func() error {
+				return addTarget(configTarget, output)
+			}, nil)
+		},
+	}
+	cmdTargetAdd.Flags().StringVarP(&configTarget.name, TargetAs, "a", "", fmt.Sprintf("Target name, a relative path inside the repository (default: the file path in --%s, named like update names it) (optional)", TargetRepositoryDir))
+	cmdTargetAdd.Flags().StringVarP(&configTarget.repositoryDir, TargetRepositoryDir, "d", "", fmt.Sprintf("Directory containing target files, names the file without --%s (optional)", TargetAs))
+	cmdTargetAdd.Flags().StringVar(&configTarget.scan.targetPrefix, ScanTargetPrefix, "", "Prefix of the target name instead of the repository dirname (optional)")
+	cmdTargetAdd.Flags().BoolVar(&configTarget.scan.stripRoot, ScanStripRoot, false, "Target name relative to the repository dir, without prefix (optional)")
+	cmdTargetAdd.MarkFlagsMutuallyExclusive(ScanTargetPrefix, ScanStripRoot)
+	cmdTargetAdd.Flags().StringVar(&configTarget.hash, TargetHash, "", "Hash of an artifact stored elsewhere, <algorithm>:<hex digest> e.g. sha256:... (optional, instead of a file)")
+	cmdTargetAdd.Flags().Int64Var(&configTarget.length, TargetLength, 0, fmt.Sprintf("Length in bytes of the artifact (required with --%s)", TargetHash))
+	addHashAlgorithmsFlag(cmdTargetAdd, &configTarget.scan.algorithms)
+	cmdTargetAdd.MarkFlagsRequiredTogether(TargetHash, TargetLength)
+	cmdTargetRemove := &cobra.Command{
+		Use:   TargetRemoveVerb + " <name>",
+		Short: "Remove one target",
+		Long:  "Remove one target from the targets metadata, the target file itself is left untouched",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+				return fmt.Errorf("%w: %w", ErrUsage, err)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configTarget.name = args[0]
+			return runTargetEdit(TargetVerb+" "+TargetRemoveVerb, func() error {
+				return removeTarget(configTarget, output)
+			}, nil)
+		},
+	}
+	cmdTargetYank := &cobra.Command{
+		Use:   TargetYankVerb + " <name>",
+		Short: "Remove one target and record why",
+		Long:  fmt.Sprintf("Remove one target and record a signed tombstone (path, hashes, --%s, time) in the targets metadata, its content may not be a target again", TargetReason),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+				return fmt.Errorf("%w: %w", ErrUsage, err)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configTarget.name = args[0]
+			return runTargetEdit(TargetVerb+" "+TargetYankVerb, func() error {
+				return yankTarget(configTarget, output)
+			}, nil)
+		},
+	}
+	cmdTargetYank.Flags().StringVar(&configTarget.reason, TargetReason, "", "Why the target is yanked, recorded in its tombstone (required)")
+	cmdTargetYank.MarkFlagRequired(TargetReason)
+	cmdTargetYank.Flags().StringToStringVar(&configTarget.channelKeys, TargetChannelKey, nil, "Key of a channel serving the content, as <channel>=<filepath>, to remove it from the channel")
+	cmdTargetRehash := &cobra.Command{
+		Use:   TargetRehashVerb,
+		Short: "Add hashes of other algorithms to the targets",
+		Long:  fmt.Sprintf("Add the hashes of --%s missing from the targets, computed from the files of the repository dir, which must still match their targets", ScanHashAlgorithms),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repositoryDir, err := stageRepositoryDir(&configTarget.repositoryDir)
+			if err != nil {
+				return output.fail(err, TargetFailed)
+			}
+			defer repositoryDir.Close()
+			configTarget.scan.setup(cmd, repositoryDir, configGlobal.dryRun)
+			return runTargetEdit(TargetVerb+" "+TargetRehashVerb, func() error {
+				return rehashTargets(configTarget, output)
+			}, func() error {
+				algorithms, _ := hashAlgorithms(configTarget.scan.algorithms) // checked by rehashTargets
+				return editWorkspace(configGlobal.workspaceDir, func(w *workspaceConfig) {
+					w.HashAlgorithms = algorithms
+				})
+			})
+		},
+	}
+	cmdTargetRehash.Flags().StringVarP(&configTarget.repositoryDir, TargetRepositoryDir, "d", "", "Directory containing target files, local path or s3://bucket/prefix (required)")
+	addScanFlags(cmdTargetRehash, &configTarget.scan)
+	cmdTargetRehash.MarkFlagRequired(TargetRepositoryDir)
+	for _, cmd := range []*cobra.Command{cmdTargetAdd, cmdTargetRemove, cmdTargetYank, cmdTargetRehash} {
+		cmd.Flags().StringVarP(&configTarget.metadataDir, TargetMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
+		cmd.Flags().StringVarP(&configTarget.targetsPrivkeyFilepath, TargetTargetsPrivkeyFilepath, "r", "", "Filepath of the private key for targets role (required)")
+		cmd.Flags().StringVarP(&configTarget.snapshotPrivkeyFilepath, TargetSnapshotPrivkeyFilepath, "s", "", "Filepath of the private key for snapshot role (optional, but requires targets key)")
+		cmd.Flags().StringVarP(&configTarget.timestampPrivkeyFilepath, TargetTimestampPrivkeyFilepath, "t", "", "Filepath of the private key for timestamp role (optional, but requires snapshot and targets keys)")
+		cmd.Flags().Uint16VarP(&configTarget.expireIn, TargetExpire, "e", 365, "Metadata file expiration in days (required)")
+		cmd.Flags().BoolVarP(&configTarget.askConfirmation, TargetAskConfirmation, "c", true, "Ask for confirmation before proceeding (optional)")
+		addMetaHashesFlag(cmd, &configTarget.metaHashes)
+		addPublishFlags(cmd, &configTarget.publish)
+		cmd.MarkFlagRequired(TargetMetadataDir)
+		cmd.MarkFlagsRequiredTogether(TargetMetadataDir, TargetTargetsPrivkeyFilepath)
+		cmdTarget.AddCommand(cmd)
+	}
+
+	// Commands to manage release channels, delegated roles serving the
+	// targets named <channel>/...
+	configChannel := configChannel{}
+	cmdChannel := &cobra.Command{
+		Use:   ChannelVerb,
+		Short: "Add, promote to and list release channels",
+		Long:  "Add release channels (delegated targets roles signed with their own keys), promote targets between them and list what they serve",
+	}
+	// Sign and write the channel metadata edited by fn, then run written (if
+	// any, not on dry runs) once the metadata is published
+	runChannelEdit := func(verb string, fn func() error, written func() error) error {
+		configChannel.publish.dryRun = configGlobal.dryRun
+		metadataDir, err := stageLockedMetadataDir(&configGlobal, verb, &configChannel.metadataDir)
+		if err != nil {
+			return output.fail(err, ChannelFailed)
+		}
+		defer metadataDir.Close()
+		dryRun, err := stageDryRun(&configGlobal, &configChannel.metadataDir)
+		if err != nil {
+			return output.fail(err, ChannelFailed)
+		}
+		defer dryRun.Close()
+
+		op, err := runOperation(&configGlobal, verb, configChannel.metadataDir, fn)
+		output.recordOperation(op, metadataDir.uri)
+		if err == nil && dryRun != nil {
+			err = dryRun.report(op, output)
+		} else if err == nil {
+			_, err = metadataDir.Publish()
+		}
+		if err == nil && dryRun == nil && written != nil {
+			err = written()
+		}
+		if err != nil {
+			return output.fail(err, ChannelFailed)
+		}
+		if dryRun == nil && len(op.files) > 0 {
+			fmt.Fprintf(output.text, "Metadata files updated in dir: %s\n", metadataDir.uri)
+		}
+		output.succeed(ChannelSucceeded)
+		return nil
+	}
+	cmdChannelAdd := &cobra.Command{
+		Use:   ChannelAddVerb + " <channel>",
+		Short: "Add a release channel",
+		Long:  "Add a release channel: a delegated role of the targets role for the targets named <channel>/..., signed with the channel key",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+				return fmt.Errorf("%w: %w", ErrUsage, err)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configChannel.name = args[0]
+			if msg := checkUpdateKeys(configChannel.targetsPrivkeyFilepath, configChannel.snapshotPrivkeyFilepath, configChannel.timestampPrivkeyFilepath); msg != "" {
+				return output.reject(msg, ChannelFailed)
+			}
+			return runChannelEdit(ChannelVerb+" "+ChannelAddVerb, func() error {
+				return addChannel(configChannel, output)
+			}, func() error {
+				// Later promotions sign with the channel key of the workspace
+				path, _ := filepath.Abs(configChannel.privkeyFilepath)
+				return editWorkspace(configGlobal.workspaceDir, func(w *workspaceConfig) {
+					keys := map[string][]string{}
+					for role, paths := range w.Keys {
+						keys[role] = paths
+					}
+					keys[configChannel.name] = []string{path}
+					w.Keys = keys
+				})
+			})
+		},
+	}
+	cmdChannelAdd.Flags().StringVarP(&configChannel.targetsPrivkeyFilepath, ChannelTargetsPrivkeyFilepath, "r", "", "Filepath of the private key for targets role (required)")
+	cmdChannelAdd.MarkFlagRequired(ChannelTargetsPrivkeyFilepath)
+	cmdChannelPromote := &cobra.Command{
+		Use:   ChannelPromoteVerb + " <target>...",
+		Short: "Promote targets to a release channel",
+		Long: fmt.Sprintf("Copy targets from channel --%s (or %q, the targets of the repository dir) to channel --%s, hashes and custom metadata included, signed with the key of --%s",
+			ChannelFrom, Targets, ChannelTo, ChannelTo),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.MinimumNArgs(1)(cmd, args); err != nil {
+				return fmt.Errorf("%w: %w", ErrUsage, err)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if msg := checkUpdateKeys(configChannel.privkeyFilepath, configChannel.snapshotPrivkeyFilepath, configChannel.timestampPrivkeyFilepath); msg != "" {
+				return output.reject(strings.Replace(msg, "Targets", "Channel", 1), ChannelFailed)
+			}
+			return runChannelEdit(ChannelVerb+" "+ChannelPromoteVerb, func() error {
+				return promoteTargets(configChannel, args, output)
+			}, nil)
+		},
+	}
+	cmdChannelPromote.Flags().StringVar(&configChannel.from, ChannelFrom, "", fmt.Sprintf("Channel the targets are promoted from, or %q (required)", Targets))
+	cmdChannelPromote.Flags().StringVar(&configChannel.to, ChannelTo, "", "Channel the targets are promoted to (required)")
+	addPublishFlags(cmdChannelPromote, &configChannel.publish)
+	cmdChannelPromote.MarkFlagRequired(ChannelFrom)
+	cmdChannelPromote.MarkFlagRequired(ChannelTo)
+	for _, cmd := range []*cobra.Command{cmdChannelAdd, cmdChannelPromote} {
+		cmd.Flags().StringVarP(&configChannel.metadataDir, ChannelMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
+		cmd.Flags().StringVarP(&configChannel.privkeyFilepath, ChannelPrivkeyFilepath, "k", "", "Filepath of the private key of the channel (required)")
+		cmd.Flags().StringVarP(&configChannel.snapshotPrivkeyFilepath, ChannelSnapshotPrivkeyFilepath, "s", "", "Filepath of the private key for snapshot role (optional)")
+		cmd.Flags().StringVarP(&configChannel.timestampPrivkeyFilepath, ChannelTimestampPrivkeyFilepath, "t", "", "Filepath of the private key for timestamp role (optional, but requires snapshot key)")
+		cmd.Flags().Uint16VarP(&configChannel.expireIn, ChannelExpire, "e", 365, "Metadata file expiration in days (required)")
+		cmd.Flags().BoolVarP(&configChannel.askConfirmation, ChannelAskConfirmation, "c", true, "Ask for confirmation before proceeding (optional)")
+		addMetaHashesFlag(cmd, &configChannel.metaHashes)
+		cmd.MarkFlagRequired(ChannelMetadataDir)
+		cmd.MarkFlagRequired(ChannelPrivkeyFilepath)
+		cmdChannel.AddCommand(cmd)
+	}
+	cmdChannelList := &cobra.Command{
+		Use:   ChannelListVerb + " [channel]...",
+		Short: "Show what each release channel serves",
+		Long:  "Show the targets each release channel serves, with their length, release version and hashes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			metadataDir, err := stageMetadataDir(&configChannel.metadataDir)
+			if err != nil {
+				return output.fail(err, ChannelFailed)
+			}
+			defer metadataDir.Close()
+			output.result.MetadataDir = metadataDir.uri
+			if err = listChannels(configChannel, args, output); err != nil {
+				return output.fail(err, ChannelFailed)
+			}
+			output.succeed(ChannelSucceeded)
+			return nil
+		},
+	}
+	cmdChannelList.Flags().StringVarP(&configChannel.metadataDir, ChannelMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
+	cmdChannelList.MarkFlagRequired(ChannelMetadataDir)
+	cmdChannel.AddCommand(cmdChannelList)
+
 	// Command to sign metadata file by role
 	configSign := configSign{}
 	cmdSign := &cobra.Command{
 		Use:   SignVerb,
 		Short: "Sign the metadata file by role",
 		Long:  "Sign the metadata file by role",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println("Running sign command...")
-			fmt.Printf("Signing metadata file as role: %s...\n", configSign.role)
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintln(output.text, "Running sign command...")
+			fmt.Fprintf(output.text, "Signing metadata file as role: %s...\n", configSign.role)
 
 			if !slices.Contains([]string{Targets, Snapshot, Timestamp, Root}, configSign.role) {
-				fmt.Println("Invalid role provided, accepted: \"targets\", \"snapshot\", \"timestamp\", \"root\"")
-				fmt.Fprintln(cmd.OutOrStdout(), SignFailed)
-				return
+				return output.reject("Invalid role provided, accepted: \"targets\", \"snapshot\", \"timestamp\", \"root\"", SignFailed)
 			}
 
-			err := signMetadata(configSign)
+			metadataDir, err := stageLockedMetadataDir(&configGlobal, SignVerb, &configSign.metadataDir)
 			if err != nil {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: %v\n", err)
-				fmt.Fprintln(cmd.OutOrStdout(), SignFailed)
-				return
-			} else {
-				fmt.Fprintf(cmd.OutOrStdout(), "Metadata file for role %s updated in dir: %s\n", configSign.role, configSign.metadataDir)
-				fmt.Fprintln(cmd.OutOrStdout(), SignSucceeded)
+				return output.fail(err, SignFailed)
+			}
+			defer metadataDir.Close()
+			dryRun, err := stageDryRun(&configGlobal, &configSign.metadataDir)
+			if err != nil {
+				return output.fail(err, SignFailed)
+			}
+			defer dryRun.Close()
+
+			op, err := runOperation(&configGlobal, SignVerb, configSign.metadataDir, func() error {
+				return signMetadata(configSign, output)
+			})
+			output.recordOperation(op, metadataDir.uri)
+			if err == nil && dryRun != nil {
+				err = dryRun.report(op, output)
+			} else if err == nil {
+				_, err = metadataDir.Publish()
+			}
+			if err != nil {
+				return output.fail(err, SignFailed)
+			}
+			if dryRun == nil {
+				fmt.Fprintf(output.text, "Metadata file for role %s updated in dir: %s\n", configSign.role, metadataDir.uri)
 			}
+			output.succeed(SignSucceeded)
+			return nil
 		},
 	}
-	cmdSign.Flags().StringVarP(&configSign.metadataDir, SignMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdSign.Flags().StringVarP(&configSign.metadataDir, SignMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
 	cmdSign.Flags().StringVarP(&configSign.role, SignRole, "r", "", "Signing role targets/snapshot/timestamp/root (required)")
 	cmdSign.Flags().StringVarP(&configSign.privkeyFilepath, SignPrivkeyFilepath, "v", "", "Filepath of the private key for given role (required)")
 	cmdSign.Flags().BoolVarP(&configSign.forced, SignForced, "f", false, "Forced sign with unrecognized key (optional)")
@@ -270,32 +926,45 @@ func NewCommand() *cobra.Command {
 		Use:   ChangeThresholdVerb,
 		Short: "Change signature threshold by role, except root",
 		Long:  fmt.Sprintf("Change signature threshold by role, except for root role (use change-root-key), supports `%s`/`%s`", ChangeThresholdActionAdd, ChangeThresholdActionReduce),
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Fprintln(cmd.OutOrStdout(), "Running change-threshold command...")
-			fmt.Fprintf(cmd.OutOrStdout(), "Changing signature threshold of role: %s...\n", configSign.role)
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintln(output.text, "Running change-threshold command...")
+			fmt.Fprintf(output.text, "Changing signature threshold of role: %s...\n", configSign.role)
 
 			action := configChangeThreshold.action
 			if action != ChangeThresholdActionAdd && action != ChangeThresholdActionReduce {
-				fmt.Fprintf(cmd.OutOrStdout(), "Tips: only \"%s\" or \"%s\" is accepted for action", ChangeThresholdActionAdd, ChangeThresholdActionReduce)
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeThresholdFailed)
-				return
+				return output.reject(fmt.Sprintf("Tips: only \"%s\" or \"%s\" is accepted for action", ChangeThresholdActionAdd, ChangeThresholdActionReduce), ChangeThresholdFailed)
 			} else if configChangeThreshold.role == Root {
-				fmt.Fprintf(cmd.OutOrStdout(), "Please use change-root-key command")
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeThresholdFailed)
-				return
+				return output.reject("Please use change-root-key command", ChangeThresholdFailed)
 			}
 
-			err := changeThreshold(configChangeThreshold)
+			metadataDir, err := stageLockedMetadataDir(&configGlobal, ChangeThresholdVerb, &configChangeThreshold.metadataDir)
 			if err != nil {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: %v\n", err)
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeThresholdFailed)
-				return
-			} else {
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeThresholdSucceeded)
+				return output.fail(err, ChangeThresholdFailed)
 			}
+			defer metadataDir.Close()
+			dryRun, err := stageDryRun(&configGlobal, &configChangeThreshold.metadataDir)
+			if err != nil {
+				return output.fail(err, ChangeThresholdFailed)
+			}
+			defer dryRun.Close()
+
+			op, err := runOperation(&configGlobal, ChangeThresholdVerb, configChangeThreshold.metadataDir, func() error {
+				return changeThreshold(configChangeThreshold)
+			})
+			output.recordOperation(op, metadataDir.uri)
+			if err == nil && dryRun != nil {
+				err = dryRun.report(op, output)
+			} else if err == nil {
+				_, err = metadataDir.Publish()
+			}
+			if err != nil {
+				return output.fail(err, ChangeThresholdFailed)
+			}
+			output.succeed(ChangeThresholdSucceeded)
+			return nil
 		},
 	}
-	cmdChangeThreshold.Flags().StringVarP(&configChangeThreshold.metadataDir, ChangeThresholdMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdChangeThreshold.Flags().StringVarP(&configChangeThreshold.metadataDir, ChangeThresholdMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
 	cmdChangeThreshold.Flags().StringVarP(&configChangeThreshold.action, ChangeThresholdAction, "a", "", fmt.Sprintf("Threshold action: \"%s\" or \"%s\" (required)", ChangeThresholdActionAdd, ChangeThresholdActionReduce))
 	cmdChangeThreshold.Flags().StringVarP(&configChangeThreshold.role, ChangeThresholdRole, "r", "", "Role to change threshold targets/snapshot/timestamp (required)")
 	cmdChangeThreshold.Flags().StringVarP(&configChangeThreshold.rootPrivkeyFilepath, ChangeThresholdRootPrivkeyFilepath, "v", "", "Filepath of the root private key (required, at least 1)")
@@ -310,21 +979,34 @@ func NewCommand() *cobra.Command {
 		Use:   VerifyVerb,
 		Short: "Verify repository metadata files and targets",
 		Long:  "Verify repository metadata files and targets, output the current state of the repository",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Fprintf(cmd.OutOrStdout(), "%s\n", "Running verify command...")
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintf(output.text, "%s\n", "Running verify command...")
 
-			err := verifyMetadata(configVerify)
+			repositoryDir, err := stageRepositoryDir(&configVerify.repositoryDir)
 			if err != nil {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: %v\n", err)
-				fmt.Fprintln(cmd.OutOrStdout(), VerifyFailed)
-				return
-			} else {
-				fmt.Fprintln(cmd.OutOrStdout(), VerifySucceeded)
+				return output.fail(err, VerifyFailed)
 			}
+			defer repositoryDir.Close()
+			configVerify.scan.setup(cmd, repositoryDir, configGlobal.dryRun)
+			metadataDir, err := stageMetadataDir(&configVerify.metadataDir)
+			if err != nil {
+				return output.fail(err, VerifyFailed)
+			}
+			defer metadataDir.Close()
+
+			output.result.MetadataDir = metadataDir.uri
+			err = verifyMetadata(configVerify, output)
+			if err != nil {
+				return output.fail(err, VerifyFailed)
+			}
+			output.succeed(VerifySucceeded)
+			return nil
 		},
 	}
-	cmdVerify.Flags().StringVarP(&configVerify.repositoryDir, VerifyRepositoryDir, "d", "", "Directory containing target files (required)")
-	cmdVerify.Flags().StringVarP(&configVerify.metadataDir, VerifyMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdVerify.Flags().StringVarP(&configVerify.repositoryDir, VerifyRepositoryDir, "d", "", "Directory containing target files, local path or s3://bucket/prefix (required)")
+	cmdVerify.Flags().StringVarP(&configVerify.metadataDir, VerifyMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
+	cmdVerify.Flags().BoolVar(&configVerify.failOnRemoval, VerifyFailOnRemoval, false, "Fail if target files listed in the targets metadata were removed from the repository dir, renames excepted (optional)")
+	addScanFlags(cmdVerify, &configVerify.scan)
 	cmdVerify.MarkFlagRequired(VerifyRepositoryDir)
 	cmdVerify.MarkFlagsRequiredTogether(VerifyRepositoryDir, VerifyMetadataDir)
 
@@ -335,16 +1017,14 @@ func NewCommand() *cobra.Command {
 		Use:   ChangeRootKeyVerb,
 		Short: "Change root key",
 		Long:  fmt.Sprintf("Change root key, supports `%s`/`%s`", ChangeRootKeyActionAdd, ChangeRootKeyActionRemove),
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println("Running change-root-key command...")
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintln(output.text, "Running change-root-key command...")
 
 			// Check action
 			action := configChangeRootKey.action
 			if action != ChangeRootKeyActionAdd && action != ChangeRootKeyActionRemove {
-				fmt.Fprintf(cmd.OutOrStdout(), "Tips: only \"%s\" or \"%s\" is accepted for action",
-					ChangeRootKeyActionAdd, ChangeRootKeyActionRemove)
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeRootKeyFailed)
-				return
+				return output.reject(fmt.Sprintf("Tips: only \"%s\" or \"%s\" is accepted for action",
+					ChangeRootKeyActionAdd, ChangeRootKeyActionRemove), ChangeRootKeyFailed)
 			}
 
 			cfg := &configChangeRootKey
@@ -363,23 +1043,37 @@ func NewCommand() *cobra.Command {
 			// }
 
 			if cfg.threshold < 1 {
-				fmt.Fprintln(cmd.OutOrStdout(), "Threshold must be greater than 0")
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeRootKeyFailed)
-				return
+				return output.reject("Threshold must be greater than 0", ChangeRootKeyFailed)
 			}
 
-			err := changeRootKey(configChangeRootKey)
+			metadataDir, err := stageLockedMetadataDir(&configGlobal, ChangeRootKeyVerb, &configChangeRootKey.metadataDir)
+			if err != nil {
+				return output.fail(err, ChangeRootKeyFailed)
+			}
+			defer metadataDir.Close()
+			dryRun, err := stageDryRun(&configGlobal, &configChangeRootKey.metadataDir)
 			if err != nil {
-				fmt.Fprintf(cmd.OutOrStdout(), "Encountered some issue: %v\n", err)
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeRootKeyFailed)
-				return
-			} else {
-				fmt.Fprintln(cmd.OutOrStdout(), ChangeRootKeySucceeded)
+				return output.fail(err, ChangeRootKeyFailed)
 			}
+			defer dryRun.Close()
 
+			op, err := runOperation(&configGlobal, ChangeRootKeyVerb, configChangeRootKey.metadataDir, func() error {
+				return changeRootKey(configChangeRootKey)
+			})
+			output.recordOperation(op, metadataDir.uri)
+			if err == nil && dryRun != nil {
+				err = dryRun.report(op, output)
+			} else if err == nil {
+				_, err = metadataDir.Publish()
+			}
+			if err != nil {
+				return output.fail(err, ChangeRootKeyFailed)
+			}
+			output.succeed(ChangeRootKeySucceeded)
+			return nil
 		},
 	}
-	cmdChangeRootKey.Flags().StringVarP(&configChangeRootKey.metadataDir, ChangeRootKeyMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdChangeRootKey.Flags().StringVarP(&configChangeRootKey.metadataDir, ChangeRootKeyMetadataDir, "m", "", "Directory containing metadata files, local path or s3://bucket/prefix (required)")
 	cmdChangeRootKey.Flags().StringVarP(&configChangeRootKey.action, ChangeRootKeyAction, "a", "", fmt.Sprintf("Action: \"%s\" or \"%s\" (required)", ChangeRootKeyActionAdd, ChangeRootKeyActionRemove))
 	cmdChangeRootKey.Flags().StringVarP(&configChangeRootKey.privkeyFilepath, ChangeRootKeyPrivkeyFilepath, "v", "", "Filepath of the root private key for signing (required)")
 	cmdChangeRootKey.Flags().StringVarP(&configChangeRootKey.inputPrivkeyFilepath, ChangeRootKeyInputPrivkeyFilepath, "i", "", "Filepath of another root key to be added(private)/removed(public or private) (required)")
@@ -390,15 +1084,213 @@ func NewCommand() *cobra.Command {
 	cmdChangeRootKey.MarkFlagsRequiredTogether(ChangeRootKeyMetadataDir, ChangeRootKeyAction,
 		ChangeRootKeyPrivkeyFilepath, ChangeRootKeyInputPrivkeyFilepath, ChangeRootKeyExpire, ChangeRootKeyThreshold)
 
+	// Command to show the operations recorded in the git history
+	configHistory := configHistory{}
+	cmdHistory := &cobra.Command{
+		Use:   HistoryVerb,
+		Short: "Show the operations recorded in the git history",
+		Long:  fmt.Sprintf("Show the operations recorded in the git history of the metadata directory (see --%s)", GlobalGit),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := showHistory(configHistory, output)
+			if err != nil {
+				return output.fail(err, HistoryFailed)
+			}
+			output.succeed(HistorySucceeded)
+			return nil
+		},
+	}
+	cmdHistory.Flags().StringVarP(&configHistory.metadataDir, HistoryMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdHistory.MarkFlagRequired(HistoryMetadataDir)
+
+	// Commands to inspect and break the lock taken by mutating commands
+	configLock := configLock{}
+	cmdLock := &cobra.Command{
+		Use:   LockVerb,
+		Short: "Inspect or break the metadata directory lock",
+		Long:  fmt.Sprintf("Inspect or break the lock that mutating commands take in the metadata directory (see --%s)", GlobalWait),
+	}
+	cmdLockStatus := &cobra.Command{
+		Use:   LockStatusVerb,
+		Short: "Show the holder of the metadata directory lock",
+		Long:  "Show the holder of the metadata directory lock and whether it is stale",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := showLockStatus(configLock, output)
+			if err != nil {
+				return output.fail(err, LockFailed)
+			}
+			output.succeed(LockSucceeded)
+			return nil
+		},
+	}
+	cmdLockStatus.Flags().StringVarP(&configLock.metadataDir, LockMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdLockStatus.MarkFlagRequired(LockMetadataDir)
+	cmdLockBreak := &cobra.Command{
+		Use:   LockBreakVerb,
+		Short: "Remove the metadata directory lock",
+		Long:  fmt.Sprintf("Remove the metadata directory lock, a lock whose owner may still be running requires --%s", LockBreakForce),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := breakLock(configLock, output)
+			if err != nil {
+				return output.fail(err, LockFailed)
+			}
+			output.succeed(LockSucceeded)
+			return nil
+		},
+	}
+	cmdLockBreak.Flags().StringVarP(&configLock.metadataDir, LockMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdLockBreak.Flags().BoolVarP(&configLock.force, LockBreakForce, "f", false, "Remove the lock even if its owner may still be running (optional)")
+	cmdLockBreak.MarkFlagRequired(LockMetadataDir)
+	cmdLock.AddCommand(cmdLockStatus)
+	cmdLock.AddCommand(cmdLockBreak)
+
+	// Command to complete or discard an interrupted operation
+	configRecover := configRecover{}
+	cmdRecover := &cobra.Command{
+		Use:   RecoverVerb,
+		Short: "Recover an interrupted operation",
+		Long:  "Recover an operation interrupted while writing metadata files, roll it forward if all its files were staged, otherwise roll it back. Mutating commands do this automatically",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lock, err := acquireLock(configRecover.metadataDir, RecoverVerb, configGlobal.wait)
+			if err == nil {
+				err = recoverRepo(configRecover, output)
+				if releaseErr := lock.Release(); err == nil {
+					err = releaseErr
+				}
+			}
+			if err != nil {
+				return output.fail(err, RecoverFailed)
+			}
+			output.succeed(RecoverSucceeded)
+			return nil
+		},
+	}
+	cmdRecover.Flags().StringVarP(&configRecover.metadataDir, RecoverMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdRecover.MarkFlagRequired(RecoverMetadataDir)
+
+	// Command to undo the last repository operation
+	configUndo := configUndo{}
+	cmdUndo := &cobra.Command{
+		Use:   UndoVerb,
+		Short: "Undo the last repository operation",
+		Long:  "Restore the metadata files to their state before the last operation, as long as it has not been published",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Object storage is the publication target, whatever was written there is published
+			if objectstore.IsURI(configUndo.metadataDir) {
+				return output.fail(fmt.Errorf("%w: operations on object storage are published immediately and cannot be undone", ErrUsage), UndoFailed)
+			}
+
+			op, err := runOperation(&configGlobal, UndoVerb, configUndo.metadataDir, func() error {
+				return undoLastOperation(configUndo, output)
+			})
+			output.recordOperation(op, configUndo.metadataDir)
+			if err != nil {
+				return output.fail(err, UndoFailed)
+			}
+			output.succeed(UndoSucceeded)
+			return nil
+		},
+	}
+	cmdUndo.Flags().StringVarP(&configUndo.metadataDir, UndoMetadataDir, "m", "", "Directory containing metadata files (required)")
+	cmdUndo.MarkFlagRequired(UndoMetadataDir)
+
+	// Command to show the effective settings and where they come from
+	cmdConfig := &cobra.Command{
+		Use:   ConfigVerb,
+		Short: "Inspect the configuration",
+		Long:  "Inspect the configuration read from flags, UPDATER_* environment variables, the config file and the workspace",
+	}
+	cmdConfigShow := &cobra.Command{
+		Use:   ConfigShowVerb + " [command]",
+		Short: "Show the effective settings with their source",
+		Long: fmt.Sprintf("Show the effective flag values of the given command (all commands if none) and their source, by precedence: "+
+			"%s > %s > %s > %s > %s > %s", SourceFlag, SourceEnv, SourceProfile, SourceFile, SourceWorkspace, SourceDefault),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := showConfig(cmd.Root(), configConfigShow{
+				configFile:   configGlobal.configFile,
+				profile:      configGlobal.profile,
+				workspaceDir: configGlobal.workspaceDir,
+				commands:     args,
+			}, output)
+			if err != nil {
+				return output.fail(err, ConfigFailed)
+			}
+			output.succeed(ConfigSucceeded)
+			return nil
+		},
+	}
+	cmdConfig.AddCommand(cmdConfigShow)
+
 	// Init cobra root command and add commands to it
-	var rootCmd = &cobra.Command{Use: "App"}
+	var rootCmd = &cobra.Command{
+		Use: "App",
+		// Flags not given on the command line are taken from the environment,
+		// the config file and the workspace, in this order
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := output.init(cmd, configGlobal.output, configGlobal.confirmPolicy()); err != nil {
+				return err
+			}
+			s, err := loadSettings(configGlobal.configFile, configGlobal.profile)
+			if err != nil {
+				return output.abort(fmt.Errorf("%w: %w", ErrUsage, err))
+			}
+			if err = applySettings(cmd, s); err != nil {
+				return output.abort(fmt.Errorf("%w: %w", ErrUsage, err))
+			}
+			if err = applyWorkspace(cmd, configGlobal.workspaceDir); err != nil {
+				return output.abort(err)
+			}
+			// Cobra checks the flags again after the pre-run, without a typed error
+			if err = cmd.ValidateRequiredFlags(); err == nil {
+				err = cmd.ValidateFlagGroups()
+			}
+			if err != nil {
+				return output.abort(fmt.Errorf("%w: %w", ErrUsage, err))
+			}
+			if configGlobal.dryRun && slices.Contains(noDryRunCommands, cmd.Name()) {
+				return output.abort(fmt.Errorf("%w: --%s is not supported by %s", ErrUsage, GlobalDryRun, cmd.Name()))
+			}
+			return nil
+		},
+		// Print the result document with --output json
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			return output.flush()
+		},
+	}
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return fmt.Errorf("%w: %w", ErrUsage, err)
+	})
+	rootCmd.PersistentFlags().StringVar(&configGlobal.workspaceDir, GlobalWorkspaceDir, "",
+		"Workspace created by init (default: search the current dir and its parents), init creates it in the parent of the output dir by default (optional)")
+	rootCmd.PersistentFlags().BoolVar(&configGlobal.git, GlobalGit, false,
+		"Record every mutation as a git commit in the metadata directory, refuse to run on a dirty tree (optional)")
+	rootCmd.PersistentFlags().DurationVar(&configGlobal.wait, GlobalWait, 0,
+		"How long to wait for the metadata directory lock held by another operation, e.g. 30s (optional)")
+	rootCmd.PersistentFlags().StringVar(&configGlobal.configFile, GlobalConfig, "",
+		fmt.Sprintf("Config file in YAML or TOML (default: %s.yaml/%s.toml in the current dir, or $%s) (optional)", configName, configName, envName(GlobalConfig)))
+	rootCmd.PersistentFlags().StringVar(&configGlobal.profile, GlobalProfile, "",
+		fmt.Sprintf("Profile of the config file to apply on top of its defaults, or $%s (optional)", envName(GlobalProfile)))
+	rootCmd.PersistentFlags().StringVar(&configGlobal.output, GlobalOutput, OutputText,
+		fmt.Sprintf("Output format: \"%s\" or \"%s\", json prints one result document on stdout and everything else on stderr (optional)", OutputText, OutputJSON))
+	rootCmd.PersistentFlags().BoolVar(&configGlobal.yes, GlobalYes, false,
+		"Answer yes to every confirmation without prompting (optional)")
+	rootCmd.PersistentFlags().BoolVar(&configGlobal.noInput, GlobalNoInput, false,
+		fmt.Sprintf("Never prompt, fail when a confirmation is required unless --%s is given (optional)", GlobalYes))
+	rootCmd.PersistentFlags().BoolVar(&configGlobal.dryRun, GlobalDryRun, false,
+		fmt.Sprintf("Run %s on a copy of the metadata dir and show what would be written, nothing is written (optional)", strings.Join(dryRunCommands, ", ")))
 	rootCmd.AddCommand(cmdKeygen)
 	rootCmd.AddCommand(cmdInit)
 	rootCmd.AddCommand(cmdUpdate)
+	rootCmd.AddCommand(cmdTarget)
+	rootCmd.AddCommand(cmdChannel)
 	rootCmd.AddCommand(cmdSign)
 	rootCmd.AddCommand(cmdChangeThreshold)
 	rootCmd.AddCommand(cmdVerify)
 	rootCmd.AddCommand(cmdChangeRootKey)
+	rootCmd.AddCommand(cmdHistory)
+	rootCmd.AddCommand(cmdLock)
+	rootCmd.AddCommand(cmdRecover)
+	rootCmd.AddCommand(cmdUndo)
+	rootCmd.AddCommand(cmdConfig)
 
 	// Generate documentation
 	// err := doc.GenMarkdownTree(rootCmd, "../../test/output/")
@@ -3,18 +3,31 @@ package repository
 import (
 	"bytes"
 	"crypto"
+	"crypto/md5"
 	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"see_updater/internal/pkg/cryptography"
+	"see_updater/internal/pkg/custom"
 	"see_updater/internal/pkg/datetime"
 	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/hashcache"
+	"see_updater/internal/pkg/journal"
 	"see_updater/internal/pkg/metahelper"
+	"see_updater/internal/pkg/objectstore"
+	"see_updater/internal/pkg/publish"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -1603,12 +1616,2232 @@ func TestChangeRootKeyDoubleKeyShouldPass(t *testing.T) {
 	}
 }
 
+// Git history tests
+func TestGitHistoryShouldPass(t *testing.T) {
+	t.Setenv("GIT_AUTHOR_NAME", "tester")
+	t.Setenv("GIT_AUTHOR_EMAIL", "tester@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "tester")
+	t.Setenv("GIT_COMMITTER_EMAIL", "tester@example.com")
+	// Outside of the source tree, so that a new git repository is initialized
+	metadataDir := filepath.Join(t.TempDir(), "metadata")
+
+	// 1. Init a new repo in git mode
+	lines, _ := runCommand(testInitArgs(TestRepoDir, metadataDir, fmt.Sprintf("--%s", GlobalGit))...)
+	if lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 2. Update in git mode
+	updateArgs := []string{
+		UpdateVerb,
+		fmt.Sprintf("--%s", GlobalGit),
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+		fmt.Sprintf("--%s=%s", UpdateAskConfirmation, "FALSE"),
+	}
+	lines, _ = runCommand(updateArgs...)
+	if lines[len(lines)-1] != UpdateSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 3. Update should refuse to run on a dirty tree
+	err := filesystem.WriteStringToFile(filepath.Join(metadataDir, "untracked"), "dirty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, _ = runCommand(updateArgs...)
+	if lines[len(lines)-1] == UpdateSucceeded {
+		t.Fatal(lines)
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, "3.targets.json")); err == nil {
+		t.Fatal("metadata files written on a dirty tree")
+	}
+	os.Remove(filepath.Join(metadataDir, "untracked"))
+
+	// 4. History lists both operations, newest first
+	lines, _ = runCommand(
+		HistoryVerb,
+		fmt.Sprintf("--%s=%s", HistoryMetadataDir, metadataDir),
+	)
+	if lines[len(lines)-1] != HistorySucceeded {
+		t.Fatal(lines)
+	}
+	history := strings.Join(lines, "\n")
+	if !strings.Contains(history, "A total of 2 commits found") ||
+		strings.Index(history, UpdateVerb) > strings.Index(history, InitVerb) ||
+		!strings.Contains(history, "targets=2,snapshot=2,timestamp=2") {
+		t.Fatal(lines)
+	}
+	fmt.Println(lines)
+}
+
+// Lock tests
+func TestLockShouldPass(t *testing.T) {
+	metadataDir := filepath.Join(t.TempDir(), "metadata")
+
+	// 1. Init a new repo, the lock is released afterwards
+	lines, _ := runCommand(testInitArgs(TestRepoDir, metadataDir)...)
+	if lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, lockFilename)); err == nil {
+		t.Fatal("lock file not released")
+	}
+
+	// 2. Update waits for a lock held by a live process, then gives up
+	live := newLockOwner(SignVerb)
+	content, _ := json.Marshal(live)
+	if err := filesystem.WriteBytesToFile(filepath.Join(metadataDir, lockFilename), content); err != nil {
+		t.Fatal(err)
+	}
+	updateArgs := []string{
+		UpdateVerb,
+		fmt.Sprintf("--%s=%s", GlobalWait, "300ms"),
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+		fmt.Sprintf("--%s=%s", UpdateAskConfirmation, "FALSE"),
+	}
+	start := time.Now()
+	lines, _ = runCommand(updateArgs...)
+	if lines[len(lines)-1] != UpdateFailed || !strings.Contains(strings.Join(lines, "\n"), "is locked by") {
+		t.Fatal(lines)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("update did not wait for the lock")
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, "2.targets.json")); err == nil {
+		t.Fatal("metadata files written while locked")
+	}
+
+	// 3. Status shows the owner, break refuses a live owner without force
+	lines, _ = runCommand(LockVerb, LockStatusVerb, fmt.Sprintf("--%s=%s", LockMetadataDir, metadataDir))
+	if lines[len(lines)-1] != LockSucceeded || !strings.Contains(lines[len(lines)-2], fmt.Sprintf("pid %d", live.PID)) {
+		t.Fatal(lines)
+	}
+	lines, _ = runCommand(LockVerb, LockBreakVerb, fmt.Sprintf("--%s=%s", LockMetadataDir, metadataDir))
+	if lines[len(lines)-1] != LockFailed {
+		t.Fatal(lines)
+	}
+	lines, _ = runCommand(LockVerb, LockBreakVerb, fmt.Sprintf("--%s=%s", LockMetadataDir, metadataDir), fmt.Sprintf("--%s", LockBreakForce))
+	if lines[len(lines)-1] != LockSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 4. A lock left by a dead process is removed automatically
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stale := newLockOwner(SignVerb)
+	stale.PID = int32(exited.ProcessState.Pid())
+	content, _ = json.Marshal(stale)
+	if err := filesystem.WriteBytesToFile(filepath.Join(metadataDir, lockFilename), content); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ = runCommand(updateArgs...)
+	if lines[len(lines)-1] != UpdateSucceeded {
+		t.Fatal(lines)
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, lockFilename)); err == nil {
+		t.Fatal("lock file not released")
+	}
+
+	// 5. An empty lock file is being written by its owner, it is held
+	if err := filesystem.WriteBytesToFile(filepath.Join(metadataDir, lockFilename), nil); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	lines, code := runCommand(updateArgs...)
+	if code != ExitLockHeld || !strings.Contains(strings.Join(lines, "\n"), "locked by an unknown owner") {
+		t.Fatal(code, lines)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("update did not wait for the lock")
+	}
+
+	// 6. A lock taken since the stale one was read is kept
+	content, _ = json.Marshal(live)
+	if err := filesystem.WriteBytesToFile(filepath.Join(metadataDir, lockFilename), content); err != nil {
+		t.Fatal(err)
+	}
+	staleContent, _ := json.Marshal(stale)
+	if err := removeStaleLock(metadataDir, staleContent); err != nil {
+		t.Fatal(err)
+	}
+	if kept, err := os.ReadFile(filepath.Join(metadataDir, lockFilename)); err != nil || !bytes.Equal(kept, content) {
+		t.Fatal(string(kept), err)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(metadataDir, "*.stale")); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+	fmt.Println(lines)
+}
+
+// Recover tests
+func TestRecoverShouldPass(t *testing.T) {
+	metadataDir := t.TempDir()
+
+	// 1. Operation interrupted before all files were staged is discarded
+	staging := filepath.Join(metadataDir, journal.StagingDirname, "interrupted")
+	if err := filesystem.MakeNewDirAll(staging); err != nil {
+		t.Fatal(err)
+	}
+	filesystem.WriteStringToFile(filepath.Join(staging, "0"), "{}")
+
+	out := new(bytes.Buffer)
+	cmd := NewCommand()
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs([]string{RecoverVerb, fmt.Sprintf("--%s=%s", RecoverMetadataDir, metadataDir)})
+	cmd.Execute()
+	lines := convBufferToStrings(out)
+	if lines[len(lines)-1] != RecoverSucceeded || !strings.Contains(lines[len(lines)-2], "discarded") {
+		t.Fatal(lines)
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, journal.StagingDirname)); err == nil {
+		t.Fatal("staging dir left behind")
+	}
+
+	// 2. Nothing left to recover
+	out.Reset()
+	cmd = NewCommand()
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs([]string{RecoverVerb, fmt.Sprintf("--%s=%s", RecoverMetadataDir, metadataDir)})
+	cmd.Execute()
+	lines = convBufferToStrings(out)
+	if lines[len(lines)-1] != RecoverSucceeded || !strings.Contains(lines[len(lines)-2], "No interrupted operation") {
+		t.Fatal(lines)
+	}
+	fmt.Println(lines)
+}
+
+// Undo tests
+func TestUndoShouldPass(t *testing.T) {
+	t.Setenv("GIT_AUTHOR_NAME", "tester")
+	t.Setenv("GIT_AUTHOR_EMAIL", "tester@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "tester")
+	t.Setenv("GIT_COMMITTER_EMAIL", "tester@example.com")
+	metadataDir := filepath.Join(t.TempDir(), "metadata")
+
+	initArgs := testInitArgs(TestRepoDir, metadataDir, fmt.Sprintf("--%s", GlobalGit))
+	updateArgs := []string{
+		UpdateVerb,
+		fmt.Sprintf("--%s", GlobalGit),
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+		fmt.Sprintf("--%s=%s", UpdateAskConfirmation, "FALSE"),
+	}
+	undoArgs := []string{UndoVerb, fmt.Sprintf("--%s", GlobalGit), fmt.Sprintf("--%s=%s", UndoMetadataDir, metadataDir)}
+
+	// 1. Init and update
+	if lines, _ := runCommand(initArgs...); lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+	initTimestamp, _ := filesystem.ReadBytesFromFile(filepath.Join(metadataDir, "timestamp.json"))
+	if lines, _ := runCommand(updateArgs...); lines[len(lines)-1] != UpdateSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 2. Undo the update, the new versions are removed and the timestamp restored
+	lines, _ := runCommand(undoArgs...)
+	if lines[len(lines)-1] != UndoSucceeded {
+		t.Fatal(lines)
+	}
+	for _, filename := range []string{"2.targets.json", "2.snapshot.json"} {
+		if _, err := os.Stat(filepath.Join(metadataDir, filename)); err == nil {
+			t.Fatal(filename, "not removed")
+		}
+	}
+	timestamp, _ := filesystem.ReadBytesFromFile(filepath.Join(metadataDir, "timestamp.json"))
+	if !bytes.Equal(timestamp, initTimestamp) {
+		t.Fatal("timestamp not restored")
+	}
+
+	// 3. Undo refuses to discard changes made after the operation
+	filesystem.WriteStringToFile(filepath.Join(metadataDir, "timestamp.json"), "{}")
+	if lines, _ := runCommand(UndoVerb, fmt.Sprintf("--%s=%s", UndoMetadataDir, metadataDir)); lines[len(lines)-1] != UndoFailed {
+		t.Fatal(lines)
+	}
+	filesystem.WriteBytesToFile(filepath.Join(metadataDir, "timestamp.json"), initTimestamp)
+
+	// 4. Undo refuses once the operation is pushed
+	if lines, _ := runCommand(updateArgs...); lines[len(lines)-1] != UpdateSucceeded {
+		t.Fatal(lines)
+	}
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	for _, args := range [][]string{
+		{"init", "--quiet", "--bare", remote},
+		{"-C", metadataDir, "remote", "add", "origin", remote},
+		{"-C", metadataDir, "push", "--quiet", "origin", "HEAD:refs/heads/main"},
+		{"-C", metadataDir, "fetch", "--quiet", "origin"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatal(string(output), err)
+		}
+	}
+	lines, _ = runCommand(undoArgs...)
+	if lines[len(lines)-1] != UndoFailed || !strings.Contains(strings.Join(lines, "\n"), "pushed") {
+		t.Fatal(lines)
+	}
+	if _, err := os.Stat(filepath.Join(metadataDir, "2.targets.json")); err != nil {
+		t.Fatal("pushed operation undone")
+	}
+
+	// 5. Outside of git mode the replaced files are kept as backups, only
+	// referred to by the log, and removed once undone
+	r := newTestRepo(t, map[string]string{"a.txt": "a"}).withWorkspace()
+	r.init()
+	initTimestamp, _ = filesystem.ReadBytesFromFile(filepath.Join(r.metadataDir, "timestamp.json"))
+	r.write("a.txt", "aa")
+	if result, code := r.run(UpdateVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	log, err := readOplog(r.metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(r.metadataDir, oplogBackupDirname, sha256Hex(initTimestamp))
+	if content, err := os.ReadFile(backup); err != nil || !bytes.Equal(content, initTimestamp) {
+		t.Fatal(log, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(r.metadataDir, oplogFilename)); bytes.Contains(content, []byte(`"signed"`)) {
+		t.Fatal("replaced content kept in the log")
+	}
+	if result, code := r.run(UndoVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	timestamp, _ = filesystem.ReadBytesFromFile(filepath.Join(r.metadataDir, "timestamp.json"))
+	if !bytes.Equal(timestamp, initTimestamp) {
+		t.Fatal("timestamp not restored")
+	}
+	if _, err := os.Stat(backup); err == nil {
+		t.Fatal("backup of undone operation kept")
+	}
+	fmt.Println(lines)
+}
+
+// Workspace tests
+func TestWorkspaceShouldPass(t *testing.T) {
+	workspaceDir := t.TempDir()
+	metadataDir := filepath.Join(workspaceDir, "metadata")
+
+	initArgs := testInitArgs(TestRepoDir, metadataDir, fmt.Sprintf("--%s=%s", InitExpire, "30"))
+
+	// 1. Init creates the workspace in the parent of the output dir
+	if lines, _ := runCommand(initArgs...); lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+	w, err := findWorkspace(workspaceDir)
+	if err != nil || w.config.MetadataDir != "metadata" || w.config.Expire != 30 || len(w.config.Keys[Root]) != 1 {
+		t.Fatal(w, err)
+	}
+
+	// 2. Init refuses to run over the existing repository unless forced
+	lines, _ := runCommand(initArgs...)
+	if lines[len(lines)-1] != InitFailed || !strings.Contains(strings.Join(lines, "\n"), "already contains a repository") {
+		t.Fatal(lines)
+	}
+	if lines, _ := runCommand(append(initArgs, fmt.Sprintf("--%s", InitForce))...); lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 3. Commands inside the workspace take their flags from it
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err = os.Chdir(metadataDir); err != nil {
+		t.Fatal(err)
+	}
+	if lines, _ := runCommand(UpdateVerb, fmt.Sprintf("--%s=%s", UpdateAskConfirmation, "FALSE")); lines[len(lines)-1] != UpdateSucceeded {
+		t.Fatal(lines)
+	}
+	if _, err = os.Stat(filepath.Join(metadataDir, "2.snapshot.json")); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ = runCommand(VerifyVerb)
+	if lines[len(lines)-1] != VerifySucceeded {
+		t.Fatal(lines)
+	}
+	fmt.Println(lines)
+}
+
+// Config tests
+func TestConfigShouldPass(t *testing.T) {
+	dir := t.TempDir()
+	metadataDir := filepath.Join(dir, "metadata")
+	repositoryDir, _ := filepath.Abs(TestRepoDir)
+	configFile := filepath.Join(dir, "updater.yaml")
+	err := filesystem.WriteStringToFile(configFile, fmt.Sprintf(`
+wait: 5s
+verify:
+  repository-dir: %s
+  metadata-dir: /nonexistent
+update:
+  expire: 30
+profiles:
+  test:
+    verify:
+      metadata-dir: %s
+`, repositoryDir, metadataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("UPDATER_UPDATE_EXPIRE", "7")
+
+	// 1. Init with flags only
+	lines, _ := runCommand(testInitArgs(TestRepoDir, metadataDir)...)
+	if lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 2. Verify takes its flags from the config file, the profile wins over the defaults
+	if lines, _ = runCommand(fmt.Sprintf("--%s=%s", GlobalConfig, configFile), VerifyVerb); lines[len(lines)-1] != VerifyFailed {
+		t.Fatal(lines)
+	}
+	if lines, _ = runCommand(fmt.Sprintf("--%s=%s", GlobalConfig, configFile), fmt.Sprintf("--%s=%s", GlobalProfile, "test"), VerifyVerb); lines[len(lines)-1] != VerifySucceeded {
+		t.Fatal(lines)
+	}
+
+	// 3. Show the effective settings with their source
+	lines, _ = runCommand(fmt.Sprintf("--%s=%s", GlobalConfig, configFile), ConfigVerb, ConfigShowVerb, UpdateVerb)
+	if lines[len(lines)-1] != ConfigSucceeded {
+		t.Fatal(lines)
+	}
+	expected := map[string][]string{
+		UpdateExpire:        {"7", SourceEnv},
+		GlobalWait:          {"5s", SourceFile},
+		UpdateMetadataDir:   {"", SourceDefault},
+		UpdateRepositoryDir: {"", SourceDefault},
+	}
+	for flag, want := range expected {
+		found := false
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[1] == "--"+flag {
+				found = strings.HasSuffix(line, want[1]) && (want[0] == "" || fields[2] == want[0])
+			}
+		}
+		if !found {
+			t.Fatal(flag, want, lines)
+		}
+	}
+	fmt.Println(lines)
+}
+
+func TestJSONOutputShouldPass(t *testing.T) {
+	metadataDir := filepath.Join(t.TempDir(), "metadata")
+
+	// 1. Init prints the files and versions written, the banner goes to stderr
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	execCommand(nil, stdout, stderr, append([]string{fmt.Sprintf("--%s=%s", GlobalOutput, OutputJSON)}, testInitArgs(TestRepoDir, metadataDir)...)...)
+	result, lines := parseResult(t, stdout), convBufferToStrings(stderr)
+	if !result.Success || result.Command != InitVerb || len(result.Files) != 4 || result.Versions[Root] != 1 {
+		t.Fatal(result)
+	}
+	if lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 2. Update reports the new versions and the signatures added
+	result, _ = runCommandJSON(t, UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+		fmt.Sprintf("--%s=%s", UpdateAskConfirmation, "false"),
+	)
+	if !result.Success || result.Versions[Targets] != 2 || len(result.KeyIDs) == 0 {
+		t.Fatal(result)
+	}
+
+	// 3. Verify prints the verification table
+	result, _ = runCommandJSON(t, VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+	)
+	if !result.Success || len(result.Verification) != 4 {
+		t.Fatal(result)
+	}
+	for _, role := range result.Verification {
+		if !role.Valid {
+			t.Fatal(role)
+		}
+	}
+
+	// 4. Errors are reported in the document
+	result, _ = runCommandJSON(t, UndoVerb, fmt.Sprintf("--%s=%s", UndoMetadataDir, "s3://bucket/metadata"))
+	if result.Success || result.Error == "" {
+		t.Fatal(result)
+	}
+}
+
+func TestExitCodeShouldPass(t *testing.T) {
+	dir := t.TempDir()
+	verifyArgs := func(metadataDir string) []string {
+		return []string{VerifyVerb,
+			fmt.Sprintf("--%s=%s", VerifyRepositoryDir, TestRepoDir),
+			fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+		}
+	}
+
+	// 1. Usage errors, the banner is still the last line when the command runs
+	if _, code := runCommand(UpdateVerb, fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir)); code != ExitUsage {
+		t.Fatal(code)
+	}
+	if _, code := runCommand(VerifyVerb, "--unknown"); code != ExitUsage {
+		t.Fatal(code)
+	}
+	lines, code := runCommand(SignVerb,
+		fmt.Sprintf("--%s=%s", SignMetadataDir, dir),
+		fmt.Sprintf("--%s=%s", SignRole, "unknown"),
+		fmt.Sprintf("--%s=%s", SignPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+	)
+	if code != ExitUsage || lines[len(lines)-1] != SignFailed {
+		t.Fatal(code, lines)
+	}
+
+	// 2. Success
+	metadataDir := filepath.Join(dir, "metadata")
+	if lines, code = runCommand(testInitArgs(TestRepoDir, metadataDir)...); code != ExitOK || lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(code, lines)
+	}
+	if _, code = runCommand(verifyArgs(metadataDir)...); code != ExitOK {
+		t.Fatal(code)
+	}
+
+	// 3. Lock held by a live process
+	content, _ := json.Marshal(newLockOwner(SignVerb))
+	if err := filesystem.WriteBytesToFile(filepath.Join(metadataDir, lockFilename), content); err != nil {
+		t.Fatal(err)
+	}
+	lines, code = runCommand(UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+		fmt.Sprintf("--%s=%s", UpdateAskConfirmation, "FALSE"),
+	)
+	if code != ExitLockHeld || lines[len(lines)-1] != UpdateFailed {
+		t.Fatal(code, lines)
+	}
+
+	// 4. Expired metadata
+	expiredDir := filepath.Join(dir, "expired", "metadata")
+	if lines, code = runCommand(testInitArgs(TestRepoDir, expiredDir, fmt.Sprintf("--%s=%s", InitExpire, "0"))...); code != ExitOK {
+		t.Fatal(code, lines)
+	}
+	if lines, code = runCommand(verifyArgs(expiredDir)...); code != ExitExpired || lines[len(lines)-1] != VerifyFailed {
+		t.Fatal(code, lines)
+	}
+
+	// 5. Threshold not met, targets signed by 1 of 2 keys
+	unsignedDir := filepath.Join(dir, "unsigned")
+	err := initRepoMetadataTestHelper(configInit{
+		repositoryDir: TestRepoDir,
+		outputDir:     unsignedDir,
+		rolesPrivkeyFilepaths: map[string][]string{
+			Root:      {TestRootPrivKeyFilepath},
+			Targets:   {TestTargetsPrivKeyFilepath, TestTargetsPrivKeyTwoFilepath},
+			Snapshot:  {TestSnapshotPrivKeyFilepath},
+			Timestamp: {TestTimestampPrivKeyFilepath},
+		},
+		rootThreshhold:     1,
+		targetsThreshold:   2,
+		snapshotThreshold:  1,
+		timestampThreshold: 1,
+		expireIn:           365,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, code = runCommand(UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, unsignedDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+		fmt.Sprintf("--%s=%s", UpdateAskConfirmation, "FALSE"),
+	)
+	if code != ExitOK {
+		t.Fatal(code, lines)
+	}
+	if lines, code = runCommand(verifyArgs(unsignedDir)...); code != ExitThresholdNotMet {
+		t.Fatal(code, lines)
+	}
+}
+
+func TestConfirmationShouldPass(t *testing.T) {
+	metadataDir := filepath.Join(t.TempDir(), "metadata")
+	lines, _ := runCommand(testInitArgs(TestRepoDir, metadataDir)...)
+	if lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+	updateArgs := []string{UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+	}
+
+	casesConfirmation := []struct {
+		in              string
+		globalFlags     []string
+		banner          string
+		code            int
+		caseDescription string
+	}{
+		{"n\n", nil, UpdateFailed, ExitFailure, "declined"},
+		{"maybe\nyes\n", nil, UpdateSucceeded, ExitOK, "confirmed after a retry"},
+		{"", nil, UpdateFailed, ExitFailure, "end of input"},
+		{"y\n", []string{"--" + GlobalNoInput}, UpdateFailed, ExitUsage, "input disabled"},
+		{"", []string{"--" + GlobalYes}, UpdateSucceeded, ExitOK, "assume yes"},
+		{"", []string{"--" + GlobalYes, "--" + GlobalNoInput}, UpdateSucceeded, ExitOK, "assume yes without input"},
+	}
+	for _, c := range casesConfirmation {
+		lines, code := runCommandWithInput(c.in, append(c.globalFlags, updateArgs...)...)
+		if lines[len(lines)-1] != c.banner || code != c.code {
+			t.Fatal(c.caseDescription, code, lines)
+		}
+	}
+}
+
+func TestDryRunShouldPass(t *testing.T) {
+	dir := t.TempDir()
+	metadataDir := filepath.Join(dir, "metadata")
+	initArgs := testInitArgs(TestRepoDir, metadataDir)
+
+	// 1. Init writes neither the metadata dir nor the workspace
+	stdout := new(bytes.Buffer)
+	code := execCommand(nil, stdout, new(bytes.Buffer), append([]string{"--" + GlobalDryRun}, initArgs...)...)
+	lines := convBufferToStrings(stdout)
+	if code != ExitOK || lines[len(lines)-1] != InitSucceeded || !slices.Contains(lines, "Dry run, no file was written") {
+		t.Fatal(code, lines)
+	}
+	if !strings.Contains(stdout.String(), "+++ b/1.root.json") {
+		t.Fatal(lines)
+	}
+	if _, err := os.Stat(metadataDir); !os.IsNotExist(err) {
+		t.Fatal("metadata dir written by a dry run", err)
+	}
+
+	// 2. Update signs the copy and reports the thresholds, the files are unchanged
+	if _, code = runCommand(initArgs...); code != ExitOK {
+		t.Fatal(code)
+	}
+	before, err := os.ReadDir(metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, code := runCommandJSON(t, "--"+GlobalDryRun, "--"+GlobalYes, UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+	)
+	if code != ExitOK || !result.Success || !result.DryRun || result.Versions[Targets] != 2 || result.Diff == "" || len(result.Thresholds) != 3 {
+		t.Fatal(code, result)
+	}
+	for _, status := range result.Thresholds {
+		if !status.Met || status.Signatures != 1 || status.Threshold != 1 {
+			t.Fatal(status)
+		}
+	}
+	after, err := os.ReadDir(metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != len(after) {
+		t.Fatal("metadata dir changed by a dry run", before, after)
+	}
+
+	// 3. Commands without dry run support refuse it
+	if _, code = runCommand("--"+GlobalDryRun, UndoVerb, fmt.Sprintf("--%s=%s", UndoMetadataDir, metadataDir)); code != ExitUsage {
+		t.Fatal(code)
+	}
+}
+
+func TestUpdatePlanApplyShouldPass(t *testing.T) {
+	dir := t.TempDir()
+	metadataDir := filepath.Join(dir, "metadata")
+	planFilepath := filepath.Join(dir, "plan.json")
+	lines, _ := runCommand(testInitArgs(TestRepoDir, metadataDir)...)
+	if lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+
+	// 1. Plan writes the unsigned metadata without touching the metadata dir
+	before, err := metadataDigests(metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, code := runCommand(UpdateVerb, UpdatePlanVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdatePlanFilepath, planFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+	)
+	if code != ExitOK || lines[len(lines)-1] != UpdatePlanSucceeded {
+		t.Fatal(code, lines)
+	}
+	after, err := metadataDigests(metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := changedFilenames(before, after); len(changed) > 0 {
+		t.Fatal("metadata dir changed by plan", changed)
+	}
+	content, err := os.ReadFile(planFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := updatePlan{}
+	if err = json.Unmarshal(content, &plan); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := metadata.Targets().FromBytes(plan.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets.Signed.Version != 2 || len(targets.Signatures) != 0 || len(plan.Base) != 4 {
+		t.Fatal(targets.Signed.Version, targets.Signatures, plan.Base)
+	}
+
+	// 2. Apply signs and writes the planned metadata
+	applyArgs := []string{"--" + GlobalYes, UpdateVerb, UpdateApplyVerb, planFilepath,
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+	}
+	lines, code = runCommand(applyArgs...)
+	if code != ExitOK || lines[len(lines)-1] != UpdateApplySucceeded {
+		t.Fatal(code, lines)
+	}
+	if err = verifyAllRolesTestHelper(metadataDir); err != nil {
+		t.Fatal(err)
+	}
+	written, err := metadata.Targets().FromFile(filepath.Join(metadataDir, "2.targets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !written.Signed.Expires.Equal(targets.Signed.Expires) || len(written.Signed.Targets) != len(targets.Signed.Targets) {
+		t.Fatal("written metadata differs from the plan")
+	}
+
+	// 3. Apply refuses a plan made from older metadata files
+	lines, code = runCommand(applyArgs...)
+	if code != ExitPlanOutdated || lines[len(lines)-1] != UpdateApplyFailed {
+		t.Fatal(code, lines)
+	}
+
+	// 4. The plan is required
+	if _, code = runCommand(UpdateVerb, UpdateApplyVerb, fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir)); code != ExitUsage {
+		t.Fatal(code)
+	}
+
+	// 5. Apply shows the changes of the targets it signs, not the recorded ones
+	if _, code = runCommand(UpdateVerb, UpdatePlanVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdatePlanFilepath, planFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+	); code != ExitOK {
+		t.Fatal(code)
+	}
+	editPlan := func(edit func(plan *updatePlan)) {
+		t.Helper()
+		content, err := os.ReadFile(planFilepath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := updatePlan{}
+		if err = json.Unmarshal(content, &plan); err != nil {
+			t.Fatal(err)
+		}
+		edit(&plan)
+		if content, err = json.Marshal(plan); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(planFilepath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	editPlan(func(plan *updatePlan) {
+		targets, _ := metadata.Targets().FromBytes(plan.Targets)
+		for name := range targets.Signed.Targets {
+			delete(targets.Signed.Targets, name)
+			break
+		}
+		plan.Targets, _ = targets.ToBytes(false)
+		plan.Changes = nil
+	})
+	result, code := runCommandJSON(t, append(applyArgs, "--"+UpdateFailOnRemoval)...)
+	if code != ExitTargetsRemoved || len(result.Changes) != 1 || result.Changes[0].Kind != metahelper.ChangeRemoved {
+		t.Fatal(code, result)
+	}
+
+	// 6. Apply refuses a plan whose snapshot does not reference its targets
+	editPlan(func(plan *updatePlan) {
+		snapshot, _ := metadata.Snapshot().FromBytes(plan.Snapshot)
+		snapshot.Signed.Meta[Targets+".json"].Version = 1
+		plan.Snapshot, _ = snapshot.ToBytes(false)
+	})
+	if result, code = runCommandJSON(t, applyArgs...); code != ExitVerification || !strings.Contains(result.Error, "snapshot does not reference") {
+		t.Fatal(code, result)
+	}
+}
+
+func TestTargetChangesShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"})
+	repoDir, metadataDir := r.repoDir, r.metadataDir
+	r.init()
+
+	// Modify a, rename b to d, remove c, add e
+	os.WriteFile(filepath.Join(repoDir, "a.txt"), []byte("a2"), 0644)
+	os.Rename(filepath.Join(repoDir, "b.txt"), filepath.Join(repoDir, "d.txt"))
+	os.Remove(filepath.Join(repoDir, "c.txt"))
+	os.WriteFile(filepath.Join(repoDir, "e.txt"), []byte("e"), 0644)
+
+	// 1. Verify classifies every change
+	verifyArgs := []string{VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+	}
+	result, code := r.run(verifyArgs...)
+	if code != ExitOK {
+		t.Fatal(code, result)
+	}
+	// Target paths start with the name of the repository dir
+	kinds := map[string]string{}
+	for _, change := range result.Changes {
+		kinds[strings.TrimPrefix(change.Path, "repo/")] = change.Kind
+	}
+	if len(result.Changes) != 4 || kinds["a.txt"] != metahelper.ChangeModified || kinds["d.txt"] != metahelper.ChangeRenamed ||
+		kinds["c.txt"] != metahelper.ChangeRemoved || kinds["e.txt"] != metahelper.ChangeAdded {
+		t.Fatal(result.Changes)
+	}
+	for _, change := range result.Changes {
+		if change.Kind == metahelper.ChangeRenamed && (change.OldPath != "repo/b.txt" || change.OldHashes["sha256"] != change.NewHashes["sha256"]) {
+			t.Fatal(change)
+		}
+		if change.Kind == metahelper.ChangeModified && change.OldHashes["sha256"] == change.NewHashes["sha256"] {
+			t.Fatal(change)
+		}
+	}
+
+	// 2. Removals fail verify and update with --fail-on-removal
+	if _, code = r.run(append(verifyArgs, "--"+VerifyFailOnRemoval)...); code != ExitTargetsRemoved {
+		t.Fatal(code)
+	}
+	before, err := metadataDigests(metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateArgs := []string{UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+	}
+	if _, code = r.run(append(updateArgs, "--"+UpdateFailOnRemoval)...); code != ExitTargetsRemoved {
+		t.Fatal(code)
+	}
+	after, err := metadataDigests(metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := changedFilenames(before, after); len(changed) > 0 {
+		t.Fatal("metadata written despite --fail-on-removal", changed)
+	}
+
+	// 3. A rename is not a removal
+	os.WriteFile(filepath.Join(repoDir, "c.txt"), []byte("c"), 0644)
+	if result, code = r.run(append(updateArgs, "--"+UpdateFailOnRemoval)...); code != ExitOK {
+		t.Fatal(code, result)
+	}
+}
+
+func TestTargetAddRemoveShouldPass(t *testing.T) {
+	dir := t.TempDir()
+	metadataDir := filepath.Join(dir, "metadata")
+	artifact := filepath.Join(dir, "artifact.bin")
+	if err := os.WriteFile(artifact, []byte("artifact"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines, _ := runCommand(testInitArgs(TestRepoDir, metadataDir)...)
+	if lines[len(lines)-1] != InitSucceeded {
+		t.Fatal(lines)
+	}
+	keys := []string{
+		fmt.Sprintf("--%s=%s", TargetMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", TargetTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", TargetSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", TargetTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+	}
+	initialCount := len(latestTargets(t, metadataDir, Targets).Signed.Targets)
+
+	casesTarget := []struct {
+		args            []string
+		code            int
+		version         int64
+		count           int
+		caseDescription string
+	}{
+		{[]string{TargetAddVerb, artifact, "--" + TargetAs + "=bin/artifact.bin"}, ExitOK, 2, initialCount + 1, "add a local file"},
+		{[]string{TargetAddVerb, artifact, "--" + TargetAs + "=bin/artifact.bin"}, ExitOK, 2, initialCount + 1, "add the same file again"},
+		{[]string{TargetAddVerb, "--" + TargetHash + "=sha256:" + strings.Repeat("ab", 32), "--" + TargetLength + "=10", "--" + TargetAs + "=remote/artifact"}, ExitOK, 3, initialCount + 2, "add by hash"},
+		{[]string{TargetAddVerb, "--" + TargetHash + "=sha256:xyz", "--" + TargetLength + "=10", "--" + TargetAs + "=remote/other"}, ExitUsage, 3, initialCount + 2, "invalid hash"},
+		{[]string{TargetAddVerb, "--" + TargetHash + "=md5:" + strings.Repeat("ab", 16), "--" + TargetLength + "=10", "--" + TargetAs + "=remote/other"}, ExitUsage, 3, initialCount + 2, "unsupported hash algorithm"},
+		{[]string{TargetAddVerb, "--" + TargetHash + "=sha256:ab", "--" + TargetLength + "=10", "--" + TargetAs + "=remote/other"}, ExitUsage, 3, initialCount + 2, "digest too short"},
+		{[]string{TargetAddVerb, "--" + TargetHash + "=sha512:" + strings.Repeat("ab", 32), "--" + TargetLength + "=10", "--" + TargetAs + "=remote/other"}, ExitUsage, 3, initialCount + 2, "digest of another algorithm"},
+		{[]string{TargetAddVerb, artifact, "--" + TargetAs + "=../outside"}, ExitUsage, 3, initialCount + 2, "name outside the repository"},
+		{[]string{TargetAddVerb, "--" + TargetHash + "=sha256:" + strings.Repeat("ab", 32), "--" + TargetLength + "=10"}, ExitUsage, 3, initialCount + 2, "hash without name"},
+		{[]string{TargetRemoveVerb, "bin/artifact.bin"}, ExitOK, 4, initialCount + 1, "remove"},
+		{[]string{TargetRemoveVerb, "bin/artifact.bin"}, ExitUsage, 4, initialCount + 1, "remove a missing target"},
+	}
+	for _, c := range casesTarget {
+		lines, code := runCommand(append(append([]string{"--" + GlobalYes, TargetVerb}, c.args...), keys...)...)
+		targets := latestTargets(t, metadataDir, Targets)
+		if code != c.code || targets.Signed.Version != c.version || len(targets.Signed.Targets) != c.count {
+			t.Fatal(c.caseDescription, code, targets.Signed.Version, len(targets.Signed.Targets), lines)
+		}
+		if err := verifyAllRolesTestHelper(metadataDir); err != nil {
+			t.Fatal(c.caseDescription, err)
+		}
+	}
+	if targets := latestTargets(t, metadataDir, Targets); targets.Signed.Targets["remote/artifact"] == nil || targets.Signed.Targets["remote/artifact"].Length != 10 {
+		t.Fatal(targets.Signed.Targets)
+	}
+
+	// Without --as, a file of the repository dir is named as update names it
+	r := newTestRepo(t, map[string]string{"a.txt": "a"})
+	r.init()
+	r.write("bin/new.bin", "new")
+	repoKeys := []string{
+		fmt.Sprintf("--%s=%s", TargetMetadataDir, r.metadataDir),
+		fmt.Sprintf("--%s=%s", TargetTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", TargetSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", TargetTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+	}
+	addArgs := []string{TargetVerb, TargetAddVerb, filepath.Join(r.repoDir, "bin", "new.bin"), fmt.Sprintf("--%s=%s", TargetRepositoryDir, r.repoDir)}
+	if result, code := r.run(append(addArgs, repoKeys...)...); code != ExitOK || r.latest(Targets).Signed.Targets["repo/bin/new.bin"] == nil {
+		t.Fatal(code, result)
+	}
+	updateArgs := []string{UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, r.repoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, r.metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%d", UpdateExpire, 365),
+	}
+	if result, code := r.run(updateArgs...); code != ExitOK || len(result.Changes) != 0 {
+		t.Fatal(code, result.Changes)
+	}
+	// The prefix of the scan applies, files outside the repository dir need --as
+	if result, code := r.run(append(append(addArgs, "--"+ScanStripRoot), repoKeys...)...); code != ExitOK || r.latest(Targets).Signed.Targets["bin/new.bin"] == nil {
+		t.Fatal(code, result)
+	}
+	if result, code := r.run(append([]string{TargetVerb, TargetRemoveVerb, "bin/new.bin"}, repoKeys...)...); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if _, code := r.run(append([]string{TargetVerb, TargetAddVerb, artifact, fmt.Sprintf("--%s=%s", TargetRepositoryDir, r.repoDir)}, repoKeys...)...); code != ExitUsage {
+		t.Fatal(code)
+	}
+	if _, code := r.run(append([]string{TargetVerb, TargetAddVerb, filepath.Join(r.repoDir, "a.txt")}, repoKeys...)...); code != ExitUsage {
+		t.Fatal(code)
+	}
+
+	// Targets added from elsewhere are kept by update, until a file of the
+	// repository dir replaces them or they are removed
+	for _, args := range [][]string{
+		{"--" + TargetHash + "=sha256:" + strings.Repeat("ab", 32), "--" + TargetLength + "=10", "--" + TargetAs + "=remote/artifact"},
+		{artifact, "--" + TargetAs + "=repo/b.txt"},
+	} {
+		if result, code := r.run(append(append([]string{TargetVerb, TargetAddVerb}, args...), repoKeys...)...); code != ExitOK {
+			t.Fatal(code, result)
+		}
+	}
+	external := func() []string {
+		names, err := externalTargets(r.latest(Targets))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	if names := external(); !slices.Equal(names, []string{"remote/artifact", "repo/b.txt"}) {
+		t.Fatal(names)
+	}
+	if result, code := r.run(updateArgs...); code != ExitOK || len(result.Changes) != 0 {
+		t.Fatal(code, result.Changes)
+	}
+	if targets := r.latest(Targets).Signed.Targets; targets["remote/artifact"] == nil || targets["repo/b.txt"] == nil || targets["repo/b.txt"].Length != int64(len("artifact")) {
+		t.Fatal(targets)
+	}
+	r.write("b.txt", "b")
+	if result, code := r.run(updateArgs...); code != ExitOK || len(result.Changes) != 1 || result.Changes[0].Path != "repo/b.txt" ||
+		r.latest(Targets).Signed.Targets["repo/b.txt"].Length != 1 {
+		t.Fatal(code, result.Changes)
+	}
+	if names := external(); !slices.Equal(names, []string{"remote/artifact"}) {
+		t.Fatal(names)
+	}
+	verifyArgs := []string{VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, r.repoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, r.metadataDir),
+		"--" + VerifyFailOnRemoval,
+	}
+	if result, code := r.run(verifyArgs...); code != ExitOK || len(result.Changes) != 0 {
+		t.Fatal(code, result.Changes)
+	}
+	if result, code := r.run(append([]string{TargetVerb, TargetRemoveVerb, "remote/artifact"}, repoKeys...)...); code != ExitOK || len(external()) != 0 {
+		t.Fatal(code, result)
+	}
+}
+
+func TestIgnoreRulesShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{
+		"a.txt":                     "a",
+		".a.txt.swp":                "swap",
+		".git/HEAD":                 "ref",
+		"build/out.bin":             "out",
+		"docs/notes.md":             "notes",
+		"docs/keep.md":              "keep",
+		IgnoreFilename:              "# build output\nbuild/\n",
+		"tmpfile_check_writable123": "",
+	})
+	repoDir, metadataDir := r.repoDir, r.metadataDir
+	scanFlags := []string{
+		fmt.Sprintf("--%s=%s", ScanExclude, "*.md"),
+		fmt.Sprintf("--%s=%s", ScanInclude, "docs/keep.md"),
+	}
+	result := r.init(scanFlags...)
+
+	// 1. Ignored files and dirs are reported once with their rule
+	skipped := map[string]string{}
+	for _, file := range result.Skipped {
+		skipped[file.Path] = file.Reason
+	}
+	want := map[string]string{
+		".git":                      "default: .git/",
+		".a.txt.swp":                "default: *.swp",
+		IgnoreFilename:              "default: " + IgnoreFilename,
+		"tmpfile_check_writable123": "default: tmpfile_check_writable*",
+		"build":                     IgnoreFilename + ":2: build/",
+		"docs/notes.md":             "--" + ScanExclude + ": *.md",
+	}
+	if len(skipped) != len(want) {
+		t.Fatal(result.Skipped)
+	}
+	for path, reason := range want {
+		if skipped[path] != reason {
+			t.Fatal(path, skipped[path])
+		}
+	}
+
+	// 2. Only the kept files are targets
+	targets := r.latest(Targets)
+	names := []string{}
+	for name := range targets.Signed.Targets {
+		names = append(names, filepath.ToSlash(name))
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"repo/a.txt", "repo/docs/keep.md"}) {
+		t.Fatal(names)
+	}
+
+	// 3. Verify applies the same rules: no change, the skipped files are reported
+	verifyArgs := []string{VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+	}
+	result, code := r.run(append(verifyArgs, scanFlags...)...)
+	if code != ExitOK || len(result.Changes) != 0 || len(result.Skipped) != len(want) {
+		t.Fatal(code, result)
+	}
+	// Without the flags, the excluded doc is a new target
+	result, code = r.run(verifyArgs...)
+	if code != ExitOK || len(result.Changes) != 1 || result.Changes[0].Kind != metahelper.ChangeAdded ||
+		filepath.ToSlash(result.Changes[0].Path) != "repo/docs/notes.md" {
+		t.Fatal(code, result)
+	}
+
+	// 4. An invalid pattern is a usage error
+	if _, code = r.run(append(verifyArgs, fmt.Sprintf("--%s=%s", ScanExclude, "[a"))...); code != ExitUsage {
+		t.Fatal(code)
+	}
+}
+
+func TestTargetPathsShouldPass(t *testing.T) {
+	// A nested dir named like the root must not mangle the target paths
+	r := newTestRepo(t, map[string]string{"a.txt": "a", "sub/repo/b.txt": "b"})
+	repoDir, metadataDir := r.repoDir, r.metadataDir
+	targetNames := func() []string {
+		names := []string{}
+		for name := range r.latest(Targets).Signed.Targets {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	r.init()
+
+	// 1. By default target paths are '/'-separated and prefixed by the dirname
+	if names := targetNames(); !slices.Equal(names, []string{"repo/a.txt", "repo/sub/repo/b.txt"}) {
+		t.Fatal(names)
+	}
+
+	// 2. Another prefix changes every path, verify reports renames
+	verifyArgs := []string{VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+	}
+	result, code := r.run(append(verifyArgs, "--"+ScanStripRoot)...)
+	if code != ExitOK || len(result.Changes) != 2 || result.Changes[0].Kind != metahelper.ChangeRenamed ||
+		result.Changes[0].OldPath != "repo/a.txt" || result.Changes[0].Path != "a.txt" {
+		t.Fatal(code, result.Changes)
+	}
+
+	// 3. Migrate to the new paths without rehashing, then nothing changes
+	updateArgs := []string{UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+	}
+	// The file content changed: a rehash would report a modification, not a migration
+	if err := filesystem.WriteBytesToFile(filepath.Join(repoDir, "a.txt"), []byte("a2")); err != nil {
+		t.Fatal(err)
+	}
+	result, code = r.run(append(updateArgs, fmt.Sprintf("--%s=%s", ScanTargetPrefix, "app/v1"), "--"+UpdateMigratePaths)...)
+	if code != ExitOK || len(result.Changes) != 2 {
+		t.Fatal(code, result)
+	}
+	for _, change := range result.Changes {
+		if change.Kind != metahelper.ChangeRenamed || !strings.HasPrefix(change.Path, "app/v1/") {
+			t.Fatal(change)
+		}
+	}
+	if names := targetNames(); !slices.Equal(names, []string{"app/v1/a.txt", "app/v1/sub/repo/b.txt"}) {
+		t.Fatal(names)
+	}
+	result, code = r.run(append(verifyArgs, fmt.Sprintf("--%s=%s", ScanTargetPrefix, "app/v1"))...)
+	if code != ExitOK || len(result.Changes) != 1 || result.Changes[0].Kind != metahelper.ChangeModified || result.Changes[0].Path != "app/v1/a.txt" {
+		t.Fatal(code, result.Changes)
+	}
+
+	// 4. Invalid or conflicting prefixes are usage errors
+	for _, args := range [][]string{
+		{fmt.Sprintf("--%s=%s", ScanTargetPrefix, "../app")},
+		{fmt.Sprintf("--%s=%s", ScanTargetPrefix, "/app")},
+		{fmt.Sprintf("--%s=%s", ScanTargetPrefix, "app"), "--" + ScanStripRoot},
+	} {
+		if _, code = r.run(append(verifyArgs, args...)...); code != ExitUsage {
+			t.Fatal(args, code)
+		}
+	}
+}
+
+func TestSymlinksShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{"a.txt": "a"})
+	repoDir, metadataDir := r.repoDir, r.metadataDir
+	if err := os.Symlink("a.txt", filepath.Join(repoDir, "latest.txt")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	initArgs := testInitArgs(repoDir, metadataDir)
+
+	// 1. Invalid policies are usage errors, refused links fail before anything is written
+	if _, code := r.run(append(initArgs, fmt.Sprintf("--%s=%s", ScanSymlinks, "copy"))...); code != ExitUsage {
+		t.Fatal(code)
+	}
+	if _, code := r.run(append(initArgs, fmt.Sprintf("--%s=%s", ScanSymlinks, filesystem.SymlinksError))...); code != ExitFailure {
+		t.Fatal(code)
+	}
+	if available, _ := filesystem.IsFileAvailable(metadataDir, "1.root.json"); available {
+		t.Fatal("metadata written")
+	}
+
+	// 2. Recorded links are targets hashed from their link target
+	if result, code := r.run(append(initArgs, fmt.Sprintf("--%s=%s", ScanSymlinks, filesystem.SymlinksRecord))...); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	targets := r.latest(Targets)
+	link := targets.Signed.Targets["repo/latest.txt"]
+	custom := map[string]string{}
+	if link == nil || link.Custom == nil || json.Unmarshal(*link.Custom, &custom) != nil || custom["symlink"] != "a.txt" ||
+		link.Length != int64(len("a.txt")) {
+		t.Fatal(link)
+	}
+
+	// 3. Followed, the link is the content of a.txt
+	result, code := r.run(VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", ScanSymlinks, filesystem.SymlinksFollow),
+	)
+	if code != ExitOK || len(result.Changes) != 1 || result.Changes[0].Kind != metahelper.ChangeModified || result.Changes[0].Path != "repo/latest.txt" {
+		t.Fatal(code, result.Changes)
+	}
+}
+
+func TestJobsShouldPass(t *testing.T) {
+	metadataDir := filepath.Join(t.TempDir(), "metadata")
+	if _, code := runCommand(testInitArgs(TestRepoDir, metadataDir, fmt.Sprintf("--%s=%s", ScanJobs, "3"))...); code != ExitOK {
+		t.Fatal(code)
+	}
+
+	// Hashing with any number of jobs finds no change
+	verifyArgs := []string{VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, TestRepoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+	}
+	for _, jobs := range []string{"1", "16"} {
+		if _, code := runCommand(append(verifyArgs, fmt.Sprintf("--%s=%s", ScanJobs, jobs), "--"+VerifyFailOnRemoval)...); code != ExitOK {
+			t.Fatal(jobs, code)
+		}
+	}
+	if _, code := runCommand(append(verifyArgs, fmt.Sprintf("--%s=%s", ScanJobs, "0"))...); code != ExitUsage {
+		t.Fatal(code)
+	}
+}
+
+func TestHashCacheShouldPass(t *testing.T) {
+	r := newTestRepo(t, nil)
+	repoDir, metadataDir := r.repoDir, r.metadataDir
+	cachePath := filepath.Join(r.dir, workspaceDirname, hashcache.Filename)
+	old := time.Now().Add(-time.Hour)
+	writeOld := func(name string, content string) {
+		r.write(name, content)
+		if err := os.Chtimes(filepath.Join(repoDir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeOld("a.txt", "a")
+	writeOld("b.txt", "b")
+	r.init()
+
+	// 1. Init fills the cache in the workspace
+	content, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if !strings.Contains(string(content), name) {
+			t.Fatal(name, string(content))
+		}
+	}
+
+	// 2. A file changed with its stat data is rehashed
+	verifyArgs := []string{VerifyVerb,
+		fmt.Sprintf("--%s=%s", VerifyRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", VerifyMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", ScanHashCache, cachePath),
+	}
+	r.write("b.txt", "bb")
+	if result, code := r.run(verifyArgs...); code != ExitOK || len(result.Changes) != 1 || result.Changes[0].Path != "repo/b.txt" {
+		t.Fatal(code, result.Changes)
+	}
+
+	// 3. A change behind unchanged size and mtime is only caught by --paranoid
+	// (or by a sampled re-verification)
+	writeOld("a.txt", "x")
+	result, code := r.run(append(verifyArgs, "--"+ScanParanoid)...)
+	if code != ExitOK || len(result.Changes) != 2 {
+		t.Fatal(code, result.Changes)
+	}
+	for _, change := range result.Changes {
+		if change.Kind != metahelper.ChangeModified {
+			t.Fatal(result.Changes)
+		}
+	}
+}
+
+func TestHashAlgorithmsShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{"a.txt": "a", "b.txt": "b"}).withWorkspace()
+	targetHashes := func() map[string]metadata.Hashes {
+		hashes := map[string]metadata.Hashes{}
+		for name, target := range r.latest(Targets).Signed.Targets {
+			hashes[name] = target.Hashes
+		}
+		return hashes
+	}
+	r.init()
+	for name, hashes := range targetHashes() {
+		if len(hashes) != 1 || hashes["sha256"] == nil {
+			t.Fatal(name, hashes)
+		}
+	}
+
+	// 1. Verify checks every listed algorithm
+	both := fmt.Sprintf("--%s=%s", ScanHashAlgorithms, "sha256,sha512")
+	if result, code := r.run(VerifyVerb, both); code != ExitVerification || len(result.Unhashed) != 2 ||
+		!slices.Equal(result.Unhashed["repo/a.txt"], []string{"sha512"}) || len(result.Changes) != 0 {
+		t.Fatal(code, result.Unhashed, result.Changes)
+	}
+	if _, code := r.run(VerifyVerb, fmt.Sprintf("--%s=%s", ScanHashAlgorithms, "md5")); code != ExitUsage {
+		t.Fatal(code)
+	}
+
+	// 2. Rehash refuses changed files
+	r.write("b.txt", "c")
+	if result, code := r.run(TargetVerb, TargetRehashVerb, both); code != ExitVerification {
+		t.Fatal(code, result)
+	}
+	if content, _ := os.ReadFile(workspaceConfigPath(r.dir)); strings.Contains(string(content), "sha512") {
+		t.Fatal("workspace edited by a failed rehash")
+	}
+	r.write("b.txt", "b")
+
+	// 3. Rehash adds the new algorithm and records it in the workspace
+	if result, code := r.run(TargetVerb, TargetRehashVerb, both); code != ExitOK || len(result.Changes) != 2 ||
+		result.Changes[0].Kind != metahelper.ChangeRehashed {
+		t.Fatal(code, result)
+	}
+	for name, hashes := range targetHashes() {
+		if len(hashes) != 2 || hashes["sha512"] == nil {
+			t.Fatal(name, hashes)
+		}
+	}
+	content, err := os.ReadFile(workspaceConfigPath(r.dir))
+	if err != nil || !strings.Contains(string(content), "sha512") {
+		t.Fatal(err, string(content))
+	}
+	if result, code := r.run(VerifyVerb, "--"+VerifyFailOnRemoval); code != ExitOK || len(result.Changes) != 0 {
+		t.Fatal(code, result)
+	}
+
+	// 4. Update keeps both algorithms from the workspace
+	r.write("c.txt", "c")
+	if result, code := r.run(UpdateVerb); code != ExitOK || len(result.Changes) != 1 {
+		t.Fatal(code, result)
+	}
+	if hashes := targetHashes()["repo/c.txt"]; len(hashes) != 2 {
+		t.Fatal(hashes)
+	}
+}
+
+func TestMetaHashesShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{"a.txt": "a"}).withWorkspace()
+	repoDir, metadataDir := r.repoDir, r.metadataDir
+	latest := func(role string) string {
+		return latestMetadataFilepath(t, metadataDir, role)
+	}
+	// Two targets keys, an update signs with the first one only
+	r.init(fmt.Sprintf("--%s=%s;%s", InitTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath, TestTargetsPrivKeyTwoFilepath),
+		fmt.Sprintf("--%s=%s", InitTargetsThreshold, "2"),
+		fmt.Sprintf("--%s=%s", MetaHashes, "snapshot,timestamp"))
+
+	// 1. Snapshot and timestamp record the length and hashes of the files
+	checkMeta := func() {
+		t.Helper()
+		snapshot, err := metadata.Snapshot().FromFile(latest(Snapshot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamp, err := metadata.Timestamp().FromFile(latest(Timestamp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, meta := range map[string]*metadata.MetaFiles{
+			latest(Targets):  snapshot.Signed.Meta[Targets+".json"],
+			latest(Snapshot): timestamp.Signed.Meta[Snapshot+".json"],
+		} {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Length != int64(len(content)) || meta.VerifyLengthHashes(content) != nil {
+				t.Fatal(path, meta)
+			}
+		}
+	}
+	checkMeta()
+	if result, code := r.run(VerifyVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+
+	// 2. A targets file with other bytes, even with the same signed content,
+	// fails the verification
+	path := latest(Targets)
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, append(original, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result, code := r.run(VerifyVerb); code != ExitVerification {
+		t.Fatal(code, result)
+	}
+	if err = os.WriteFile(path, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 3. Update keeps recording them, from the workspace
+	if err = filesystem.WriteBytesToFile(filepath.Join(repoDir, "b.txt"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if result, code := r.run(UpdateVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	checkMeta()
+
+	// 4. Signing targets again updates the snapshot and timestamp meta, which
+	// must be signed again
+	if result, code := r.run(SignVerb, fmt.Sprintf("--%s=%s", SignRole, Targets),
+		fmt.Sprintf("--%s=%s", SignPrivkeyFilepath, TestTargetsPrivKeyTwoFilepath)); code != ExitOK || len(result.Files) != 3 {
+		t.Fatal(code, result)
+	}
+	checkMeta()
+	if result, code := r.run(VerifyVerb); code == ExitOK {
+		t.Fatal(code, result)
+	}
+	for _, role := range []string{Snapshot, Timestamp} {
+		if result, code := r.run(SignVerb, fmt.Sprintf("--%s=%s", SignRole, role)); code != ExitOK {
+			t.Fatal(role, code, result)
+		}
+	}
+	checkMeta()
+	if result, code := r.run(VerifyVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+
+	// 5. A later update without --meta-hashes nor the workspace keeps
+	// recording them
+	r.write("c.txt", "c")
+	if result, code := runCommandJSON(t, "--"+GlobalYes, UpdateVerb,
+		fmt.Sprintf("--%s=%s", UpdateRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", UpdateMetadataDir, metadataDir),
+		fmt.Sprintf("--%s=%s", UpdateTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", UpdateExpire, "365"),
+	); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	checkMeta()
+}
+
+func TestConsistentSnapshotShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{"sub/a.txt": "a"}).withWorkspace()
+	repoDir, metadataDir := r.repoDir, r.metadataDir
+	publishDir := filepath.Join(r.dir, "publish")
+	// Published paths of the latest targets
+	published := func() []string {
+		t.Helper()
+		files := []string{}
+		for name, target := range r.latest(Targets).Signed.Targets {
+			files = append(files, publish.HashedPaths(name, target.Hashes)...)
+		}
+		sort.Strings(files)
+		return files
+	}
+	exists := func(files []string) bool {
+		for _, file := range files {
+			if _, err := os.Stat(filepath.Join(publishDir, filepath.FromSlash(file))); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	// 1. Root advertises consistent snapshots, every target is published
+	// under each of its hashes
+	result := r.init("--"+InitConsistentSnapshot,
+		fmt.Sprintf("--%s=%s", PublishDir, publishDir),
+		fmt.Sprintf("--%s=%s", ScanHashAlgorithms, "sha256,sha512"))
+	root, err := metadata.Root().FromFile(filepath.Join(metadataDir, "1.root.json"))
+	if err != nil || !root.Signed.ConsistentSnapshot {
+		t.Fatal(err, "root without consistent snapshots")
+	}
+	first := published()
+	if len(first) != 2 || !slices.Equal(result.Published, first) || !exists(first) || !strings.HasPrefix(first[0], "repo/sub/") {
+		t.Fatal(first, result.Published)
+	}
+	content, err := os.ReadFile(filepath.Join(publishDir, filepath.FromSlash(first[0])))
+	if err != nil || string(content) != "a" {
+		t.Fatal(err, string(content))
+	}
+
+	// 2. Update publishes the new content from the workspace publish dir, the
+	// previous generation is kept during the grace period
+	r.write("sub/a.txt", "aa")
+	result, code := r.run(UpdateVerb)
+	if code != ExitOK {
+		t.Fatal(code, result)
+	}
+	second := published()
+	if !slices.Equal(result.Published, second) || !exists(second) || !exists(first) || len(result.Pruned) != 0 {
+		t.Fatal(result.Published, result.Pruned)
+	}
+
+	// 3. Without grace, the superseded generations are removed
+	r.write("sub/a.txt", "aaa")
+	if result, code = r.run(UpdateVerb, fmt.Sprintf("--%s=%s", PublishGrace, "0s")); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	third := published()
+	removed := append(append([]string{}, first...), second...)
+	sort.Strings(removed)
+	if !exists(third) || !slices.Equal(result.Pruned, removed) {
+		t.Fatal(result.Pruned, removed)
+	}
+	for _, file := range removed {
+		if exists([]string{file}) {
+			t.Fatal("not removed", file)
+		}
+	}
+
+	// 4. A dry run publishes nothing
+	r.write("sub/b.txt", "b")
+	if result, code = r.run("--"+GlobalDryRun, UpdateVerb); code != ExitOK || len(result.Published) != 0 {
+		t.Fatal(code, result)
+	}
+
+	// 5. A plan finds the target files relative to the repository dir, apply
+	// publishes them from its own --repository-dir
+	planFilepath := filepath.Join(r.dir, "plan.json")
+	if result, code = r.run(UpdateVerb, UpdatePlanVerb, fmt.Sprintf("--%s=%s", UpdatePlanFilepath, planFilepath)); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	content, err = os.ReadFile(planFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := updatePlan{}
+	if err = json.Unmarshal(content, &plan); err != nil || plan.Sources["repo/sub/b.txt"].Path != "sub/b.txt" {
+		t.Fatal(err, plan.Sources)
+	}
+	if result, code = r.run(UpdateVerb, UpdateApplyVerb, planFilepath, fmt.Sprintf("--%s=", UpdateRepositoryDir)); code != ExitUsage {
+		t.Fatal(code, result)
+	}
+	if result, code = r.run(UpdateVerb, UpdateApplyVerb, planFilepath); code != ExitOK || !exists(published()) || len(result.Published) == 0 {
+		t.Fatal(code, result)
+	}
+
+	// 6. Roots are made without consistent snapshots by default, there is
+	// nothing to publish to
+	otherDir := t.TempDir()
+	result, code = r.run(append(testInitArgs(repoDir, filepath.Join(otherDir, "metadata")),
+		fmt.Sprintf("--%s=%s", GlobalWorkspaceDir, otherDir))...)
+	if code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if root, err = metadata.Root().FromFile(filepath.Join(otherDir, "metadata", "1.root.json")); err != nil || root.Signed.ConsistentSnapshot {
+		t.Fatal(err, "root with consistent snapshots")
+	}
+	if result, code = r.run(UpdateVerb, fmt.Sprintf("--%s=%s", GlobalWorkspaceDir, otherDir),
+		fmt.Sprintf("--%s=%s", PublishDir, publishDir)); code != ExitUsage || !strings.Contains(result.Error, InitConsistentSnapshot) {
+		t.Fatal(code, result)
+	}
+}
+
+func TestCustomMetadataShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{
+		"fw/a.bin":                        "a",
+		"fw/b.bin":                        "b",
+		"fw/a.bin" + custom.SidecarSuffix: `{"version": "1.0", "hardware": ["rev-a"]}`,
+	}).withWorkspace()
+	write := func(path string, content string) {
+		t.Helper()
+		if err := filesystem.WriteBytesToFile(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := filepath.Join(r.dir, "manifest.csv")
+	write(manifest, "path,version,hardware\nfw/a.bin,0.9,\nfw/b.bin,2.0,rev-a;rev-b\n")
+	// Custom metadata of the latest targets
+	customOf := func() map[string]string {
+		t.Helper()
+		values := map[string]string{}
+		for name, target := range r.latest(Targets).Signed.Targets {
+			values[name] = ""
+			if target.Custom != nil {
+				compact := new(bytes.Buffer)
+				if err := json.Compact(compact, *target.Custom); err != nil {
+					t.Fatal(err)
+				}
+				values[name] = compact.String()
+			}
+		}
+		return values
+	}
+
+	// 1. Sidecars override the manifest, sidecars are not targets
+	r.init("--"+ScanCustomSidecars, fmt.Sprintf("--%s=%s", ScanCustomManifest, manifest))
+	values := customOf()
+	if len(values) != 2 || values["repo/fw/a.bin"] != `{"hardware":["rev-a"],"version":"1.0"}` ||
+		values["repo/fw/b.bin"] != `{"hardware":["rev-a","rev-b"],"version":"2.0"}` {
+		t.Fatal(values)
+	}
+
+	// 2. A custom change is a modification, from the workspace settings
+	r.write("fw/a.bin"+custom.SidecarSuffix, `{"version": "1.1", "hardware": ["rev-a"]}`)
+	result, code := r.run(UpdateVerb)
+	if code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Kind != metahelper.ChangeModified || result.Changes[0].Path != "repo/fw/a.bin" ||
+		result.Changes[0].NewCustom == nil || !strings.Contains(string(*result.Changes[0].NewCustom), "1.1") {
+		t.Fatal(result.Changes)
+	}
+	if values = customOf(); values["repo/fw/a.bin"] != `{"hardware":["rev-a"],"version":"1.1"}` {
+		t.Fatal(values)
+	}
+
+	// 3. Values the schema refuses fail the update
+	r.write("fw/b.bin"+custom.SidecarSuffix, `{"release_notes_url": "notes.txt"}`)
+	if result, code = r.run(UpdateVerb); code != ExitUsage || !strings.Contains(result.Error, "fw/b.bin") {
+		t.Fatal(code, result)
+	}
+	schema := filepath.Join(r.dir, "schema.yaml")
+	write(schema, "fields:\n  version: {type: string, required: true}\n  hardware: {type: array}\n")
+	r.write("fw/b.bin"+custom.SidecarSuffix, `{"hardware": ["rev-c"]}`)
+	if result, code = r.run(UpdateVerb, fmt.Sprintf("--%s=%s", ScanCustomSchema, schema)); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if values = customOf(); values["repo/fw/b.bin"] != `{"hardware":["rev-c"],"version":"2.0"}` {
+		t.Fatal(values)
+	}
+}
+
+func TestChannelsShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{"fw/a.bin": "a", "fw/a.bin" + custom.SidecarSuffix: `{"version": "1.0"}`}).withWorkspace()
+	r.init("--" + ScanCustomSidecars)
+
+	// 1. Channels are delegated roles with their own keys, the workspace
+	// provides the other keys
+	if result, code := r.run(ChannelVerb, ChannelAddVerb, "beta", fmt.Sprintf("--%s=%s", ChannelPrivkeyFilepath, TestTargetsPrivKeyTwoFilepath)); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if result, code := r.run(ChannelVerb, ChannelAddVerb, "stable", fmt.Sprintf("--%s=%s", ChannelPrivkeyFilepath, TestSnapshotPrivKeyTwoFilepath)); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	delegations := r.latest(Targets).Signed.Delegations
+	if delegations == nil || len(delegations.Roles) != 2 || delegations.Roles[1].Name != "stable" {
+		t.Fatal(delegations)
+	}
+	if ok, _ := delegations.Roles[1].IsDelegatedPath("stable/repo/fw/a.bin"); !ok {
+		t.Fatal("stable does not serve its namespace", delegations.Roles[1].Paths)
+	}
+	for _, args := range [][]string{
+		{ChannelVerb, ChannelAddVerb, "stable"},  // exists
+		{ChannelVerb, ChannelAddVerb, "Stable"},  // invalid name
+		{ChannelVerb, ChannelAddVerb, "targets"}, // top-level role
+	} {
+		if result, code := r.run(append(args, fmt.Sprintf("--%s=%s", ChannelPrivkeyFilepath, TestTargetsPrivKeyTwoFilepath))...); code != ExitUsage {
+			t.Fatal(args, code, result)
+		}
+	}
+	// A dry run adds nothing and records no key
+	result, code := r.run("--"+GlobalDryRun, ChannelVerb, ChannelAddVerb, "gamma", fmt.Sprintf("--%s=%s", ChannelPrivkeyFilepath, TestTargetsPrivKeyTwoFilepath))
+	if code != ExitOK || !result.DryRun || len(result.Thresholds) != 4 {
+		t.Fatal(code, result)
+	}
+	// The channel is verified through the new targets
+	for _, status := range result.Thresholds {
+		if !status.Met || status.Threshold != 1 {
+			t.Fatal(status)
+		}
+	}
+	if delegatedRole(r.latest(Targets), "gamma") != nil {
+		t.Fatal("channel added by a dry run")
+	}
+	if content, _ := os.ReadFile(workspaceConfigPath(r.dir)); strings.Contains(string(content), "gamma") {
+		t.Fatal("channel key recorded by a dry run")
+	}
+	// Top-level targets cannot enter the namespace of a channel afterwards
+	for _, args := range [][]string{
+		{TargetVerb, TargetAddVerb, filepath.Join(r.repoDir, "fw", "a.bin"), "--" + TargetAs + "=beta/a.bin"},
+		{UpdateVerb, "--" + ScanTargetPrefix + "=stable"},
+	} {
+		if result, code := r.run(args...); code != ExitUsage || !strings.Contains(result.Error, "namespace of channel") {
+			t.Fatal(args, code, result)
+		}
+	}
+
+	// 2. Targets of the repository dir are promoted to beta as they are
+	if result, code := r.run(ChannelVerb, ChannelPromoteVerb, "--"+ChannelFrom, Targets, "--"+ChannelTo, "beta", "repo/fw/a.bin"); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	original := r.latest(Targets).Signed.Targets["repo/fw/a.bin"]
+	promoted := r.latest("beta").Signed.Targets["beta/repo/fw/a.bin"]
+	if promoted == nil || !promoted.Hashes.Equal(original.Hashes) || promoted.Length != original.Length || !custom.Equal(promoted.Custom, original.Custom) {
+		t.Fatal(promoted, original)
+	}
+
+	// 3. The repository dir moves on, beta to stable promotes what beta
+	// serves, without reading the files
+	r.write("fw/a.bin", "aa")
+	r.write("fw/a.bin"+custom.SidecarSuffix, `{"version": "1.1"}`)
+	if result, code := r.run(UpdateVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	result, code = r.run(ChannelVerb, ChannelPromoteVerb, "--"+ChannelFrom, "beta", "--"+ChannelTo, "stable", "beta/repo/fw/a.bin")
+	if code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Kind != metahelper.ChangeAdded || result.Changes[0].Path != "stable/repo/fw/a.bin" {
+		t.Fatal(result.Changes)
+	}
+	if stable := r.latest("stable").Signed.Targets["stable/repo/fw/a.bin"]; stable == nil || !stable.Hashes.Equal(promoted.Hashes) {
+		t.Fatal(stable)
+	}
+	// Nothing to promote
+	if result, code = r.run(ChannelVerb, ChannelPromoteVerb, "--"+ChannelFrom, "beta", "--"+ChannelTo, "stable", "repo/fw/a.bin"); code != ExitOK || len(result.Files) != 0 {
+		t.Fatal(code, result)
+	}
+
+	// 4. Only the destination channel key signs
+	for _, args := range [][]string{
+		{"--" + ChannelFrom, Targets, "--" + ChannelTo, "stable", "repo/fw/a.bin", fmt.Sprintf("--%s=%s", ChannelPrivkeyFilepath, TestTargetsPrivKeyTwoFilepath)},
+		{"--" + ChannelFrom, "beta", "--" + ChannelTo, "stable", "repo/fw/missing.bin"},
+		{"--" + ChannelFrom, "alpha", "--" + ChannelTo, "stable", "repo/fw/a.bin"},
+	} {
+		if result, code = r.run(append([]string{ChannelVerb, ChannelPromoteVerb}, args...)...); code != ExitUsage {
+			t.Fatal(args, code, result)
+		}
+	}
+
+	// 5. List shows what each channel serves
+	if result, code = r.run(ChannelVerb, ChannelListVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	listings := []channelListing{}
+	data, _ := json.Marshal(result.Data)
+	if err := json.Unmarshal(data, &listings); err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 2 || listings[1].Name != "stable" || len(listings[1].Targets) != 1 || listings[1].Targets[0].Name != "repo/fw/a.bin" ||
+		releaseVersion(listings[1].Targets[0].Custom) != "1.0" {
+		t.Fatal(listings)
+	}
+
+	// 6. Clients verify the channels through targets and snapshot
+	if result, code = r.run(VerifyVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+}
+
+func TestTargetYankShouldPass(t *testing.T) {
+	r := newTestRepo(t, map[string]string{"fw/a.bin": "a", "fw/b.bin": "b"}).withWorkspace()
+	r.init()
+	yanked := r.latest(Targets).Signed.Targets["repo/fw/a.bin"]
+
+	// 1. A yank needs a reason and an existing target
+	for _, args := range [][]string{
+		{"repo/fw/a.bin"},
+		{"repo/fw/missing.bin", "--" + TargetReason, "bad build"},
+	} {
+		if result, code := r.run(append([]string{TargetVerb, TargetYankVerb}, args...)...); code != ExitUsage {
+			t.Fatal(args, code, result)
+		}
+	}
+
+	// 2. The target is removed and its tombstone signed with targets
+	if result, code := r.run(TargetVerb, TargetYankVerb, "repo/fw/a.bin", "--"+TargetReason, "bad build"); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	targets := r.latest(Targets)
+	if _, ok := targets.Signed.Targets["repo/fw/a.bin"]; ok {
+		t.Fatal("yanked target still served")
+	}
+	list, err := tombstones(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Path != "repo/fw/a.bin" || list[0].Reason != "bad build" || list[0].Length != yanked.Length ||
+		!list[0].Hashes.Equal(yanked.Hashes) || list[0].Time.IsZero() {
+		t.Fatal(list)
+	}
+
+	// 3. The yanked content may not come back, under any path
+	if result, code := r.run(UpdateVerb); code != ExitVerification {
+		t.Fatal(code, result)
+	}
+	result, code := r.run(VerifyVerb)
+	if code != ExitVerification || len(result.Yanked) != 1 {
+		t.Fatal(code, result)
+	}
+	r.remove("fw/a.bin")
+	r.write("fw/c.bin", "a")
+	if result, code = r.run(UpdateVerb); code != ExitVerification {
+		t.Fatal(code, result)
+	}
+	r.remove("fw/c.bin")
+
+	// 4. Tombstones are kept by later updates
+	r.write("fw/b.bin", "bb")
+	if result, code = r.run(UpdateVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if list, err = tombstones(r.latest(Targets)); err != nil || len(list) != 1 {
+		t.Fatal(list, err)
+	}
+	if result, code = r.run(VerifyVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+
+	// 5. Promoted content is yanked from the channels too, signed with the
+	// channel keys of the workspace, and a channel entry may be named
+	if result, code = r.run(ChannelVerb, ChannelAddVerb, "stable", fmt.Sprintf("--%s=%s", ChannelPrivkeyFilepath, TestTargetsPrivKeyTwoFilepath)); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if result, code = r.run(ChannelVerb, ChannelPromoteVerb, "--"+ChannelFrom, Targets, "--"+ChannelTo, "stable", "repo/fw/b.bin"); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	stable := r.latest("stable").Signed.Version
+	for expected, args := range map[int][]string{
+		ExitOK:    {"--" + GlobalDryRun, TargetVerb, TargetYankVerb, "stable/repo/fw/b.bin", "--" + TargetReason, "bad build"},
+		ExitUsage: {TargetVerb, TargetYankVerb, "stable/repo/fw/b.bin", "--" + TargetReason, "bad build", fmt.Sprintf("--%s=stable=%s", TargetChannelKey, TestSnapshotPrivKeyTwoFilepath)},
+	} {
+		if result, code = r.run(args...); code != expected {
+			t.Fatal(args, code, result)
+		}
+		if r.latest("stable").Signed.Targets["stable/repo/fw/b.bin"] == nil || r.latest(Targets).Signed.Targets["repo/fw/b.bin"] == nil {
+			t.Fatal(args, "target yanked")
+		}
+	}
+	if result, code = r.run(TargetVerb, TargetYankVerb, "stable/repo/fw/b.bin", "--"+TargetReason, "bad build"); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if channel := r.latest("stable"); len(channel.Signed.Targets) != 0 || channel.Signed.Version != stable+1 {
+		t.Fatal(channel.Signed.Targets, channel.Signed.Version)
+	}
+	if _, ok := r.latest(Targets).Signed.Targets["repo/fw/b.bin"]; ok {
+		t.Fatal("source of the yanked channel entry still served")
+	}
+	if list, err = tombstones(r.latest(Targets)); err != nil || len(list) != 2 || list[1].Path != "stable/repo/fw/b.bin" {
+		t.Fatal(list, err)
+	}
+	r.remove("fw/b.bin")
+	if result, code = r.run(VerifyVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+}
+
+// Remote tests
+func TestRemoteShouldPass(t *testing.T) {
+	store := newFakeS3(t, map[string]string{"repo/a.txt": "a", "repo/sub/b.txt": "b"})
+	dir := t.TempDir()
+	run := func(args ...string) (commandResult, int) {
+		return runCommandJSON(t, append([]string{"--" + GlobalYes, fmt.Sprintf("--%s=%s", GlobalWorkspaceDir, dir)}, args...)...)
+	}
+
+	// 1. Init reads the targets from and writes the metadata to the bucket
+	if result, code := run(testInitArgs("s3://bucket/repo", "s3://bucket/metadata")...); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if keys := store.keys("metadata/"); !slices.Contains(keys, "metadata/1.root.json") || !slices.Contains(keys, "metadata/timestamp.json") {
+		t.Fatal(keys)
+	}
+	if result, code := run(VerifyVerb, "--"+VerifyFailOnRemoval); code != ExitOK || len(result.Changes) != 0 {
+		t.Fatal(code, result)
+	}
+
+	// 2. The ignore file of the bucket applies, target files are hashed from
+	// the objects
+	store.objects["repo/a.txt"] = []byte("aa")
+	store.objects["repo/"+IgnoreFilename] = []byte("sub/\n")
+	result, code := run(UpdateVerb)
+	if code != ExitOK || len(result.Changes) != 2 || len(result.Skipped) != 2 {
+		t.Fatal(code, result)
+	}
+	if targets := store.targets(t, "metadata/2.targets.json"); len(targets) != 1 || targets["repo/a.txt"].Length != 2 {
+		t.Fatal(targets)
+	}
+
+	// 3. Only the metadata files read are downloaded: every root, the latest
+	// version of the other roles
+	store.objects["metadata/artifacts/fw.bin"] = []byte("fw")
+	clear(store.requests)
+	if result, code = run(VerifyVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	for key, count := range map[string]int{"metadata/1.root.json": 1, "metadata/2.targets.json": 1, "metadata/1.targets.json": 0,
+		"metadata/artifacts/fw.bin": 0, "repo/a.txt": 1, "repo/sub/b.txt": 0} {
+		if store.requests[http.MethodGet+" "+key] != count {
+			t.Fatal(key, store.requests)
+		}
+	}
+
+	// 4. Keys escaping the prefix are refused before anything is written
+	store.objects["repo/../../escaped.txt"] = []byte("x")
+	if result, code = run(VerifyVerb); code != ExitVerification || !strings.Contains(result.Error, "outside") {
+		t.Fatal(code, result)
+	}
+	if _, err := os.Stat(filepath.Join(os.TempDir(), "escaped.txt")); err == nil {
+		t.Fatal("object written outside of the staged dir")
+	}
+	delete(store.objects, "repo/../../escaped.txt")
+
+	// 5. A failed upload rolls back the objects already published
+	keys := store.keys("metadata/")
+	store.objects["repo/a.txt"] = []byte("aaa")
+	store.failPut = "metadata/timestamp.json"
+	if result, code = run(UpdateVerb); code != ExitIO || !strings.Contains(result.Error, "rolled back") {
+		t.Fatal(code, result)
+	}
+	if after := store.keys("metadata/"); !slices.Equal(after, keys) || store.requests[http.MethodDelete+" metadata/3.targets.json"] != 1 {
+		t.Fatal(after, keys, store.requests)
+	}
+	store.failPut = ""
+	store.objects["repo/a.txt"] = []byte("aa")
+	if result, code = run(VerifyVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+
+	// 6. The lock is taken on the bucket and released once published
+	store.objects["metadata/"+lockFilename] = []byte(`{"user":"other","host":"elsewhere","pid":1,"command":"update"}`)
+	store.objects["repo/a.txt"] = []byte("aaa")
+	if result, code = run(UpdateVerb); code != ExitLockHeld || !strings.Contains(result.Error, "other@elsewhere") {
+		t.Fatal(code, result)
+	}
+	delete(store.objects, "metadata/"+lockFilename)
+	clear(store.requests)
+	if result, code = run(UpdateVerb); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if _, ok := store.objects["metadata/"+lockFilename]; ok || store.requests[http.MethodPut+" metadata/"+lockFilename] != 1 ||
+		store.requests[http.MethodDelete+" metadata/"+lockFilename] != 1 {
+		t.Fatal(store.requests)
+	}
+
+	// 7. A lock replaced since it was taken is not released, lock status and
+	// break work on the bucket
+	s3, err := objectstore.NewFromEnv("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := acquireRemoteLock(s3, "metadata/", UpdateVerb, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.objects["metadata/"+lockFilename] = []byte(`{"user":"other","host":"elsewhere","pid":1,"command":"update"}`)
+	if err = lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	lockArgs := []string{fmt.Sprintf("--%s=%s", LockMetadataDir, "s3://bucket/metadata")}
+	result, code = run(append([]string{LockVerb, LockStatusVerb}, lockArgs...)...)
+	if status, _ := result.Data.(map[string]any); code != ExitOK || status["locked"] != true {
+		t.Fatal(code, result)
+	}
+	if result, code = run(append([]string{LockVerb, LockBreakVerb}, lockArgs...)...); code != ExitLockHeld || !strings.Contains(result.Error, "other@elsewhere") {
+		t.Fatal(code, result)
+	}
+	if result, code = run(append([]string{LockVerb, LockBreakVerb, "--" + LockBreakForce}, lockArgs...)...); code != ExitOK {
+		t.Fatal(code, result)
+	}
+	if _, ok := store.objects["metadata/"+lockFilename]; ok {
+		t.Fatal("lock object not removed")
+	}
+	result, code = run(append([]string{LockVerb, LockStatusVerb}, lockArgs...)...)
+	if status, _ := result.Data.(map[string]any); code != ExitOK || status["locked"] != false {
+		t.Fatal(code, result)
+	}
+}
+
 // Helper functions
 func convBufferToStrings(bf *bytes.Buffer) []string {
 	lines := strings.Split(bf.String(), "\n")
 	return lines[:len(lines)-1]
 }
 
+// Exit code of the command run with args, reading stdin from in (none if
+// nil) and writing to stdout and stderr.
+func execCommand(in io.Reader, stdout io.Writer, stderr io.Writer, args ...string) int {
+	cmd := NewCommand()
+	if in != nil {
+		cmd.SetIn(in)
+	}
+	cmd.SetOut(stdout)
+	cmd.SetErr(stderr)
+	cmd.SetArgs(args)
+	return ExitCode(cmd.Execute())
+}
+
+// Lines of the combined output and exit code of the command run with args.
+func runCommand(args ...string) ([]string, int) {
+	return runCommandWithInput("", args...)
+}
+
+// Like runCommand, answering the prompts with in.
+func runCommandWithInput(in string, args ...string) ([]string, int) {
+	out := new(bytes.Buffer)
+	code := execCommand(strings.NewReader(in), out, out, args...)
+	return convBufferToStrings(out), code
+}
+
+// Result document and exit code of the command run with --output json and
+// args, stderr is discarded.
+func runCommandJSON(t *testing.T, args ...string) (commandResult, int) {
+	t.Helper()
+	stdout := new(bytes.Buffer)
+	code := execCommand(nil, stdout, new(bytes.Buffer), append([]string{fmt.Sprintf("--%s=%s", GlobalOutput, OutputJSON)}, args...)...)
+	return parseResult(t, stdout), code
+}
+
+// Result document of a command run with --output json.
+func parseResult(t *testing.T, stdout *bytes.Buffer) commandResult {
+	t.Helper()
+	result := commandResult{}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		t.Fatal(err, stdout.String())
+	}
+	return result
+}
+
+// Arguments of an init of repoDir into metadataDir signed by the test keys,
+// with thresholds of 1 and expiring in 365 days, followed by extra: a flag
+// repeated in extra wins.
+func testInitArgs(repoDir string, metadataDir string, extra ...string) []string {
+	return append([]string{InitVerb,
+		fmt.Sprintf("--%s=%s", InitRepositoryDir, repoDir),
+		fmt.Sprintf("--%s=%s", InitOutputDir, metadataDir),
+		fmt.Sprintf("--%s=%s", InitRootPrivkeyFilepath, TestRootPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", InitTargetsPrivkeyFilepath, TestTargetsPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", InitSnapshotPrivkeyFilepath, TestSnapshotPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", InitTimestampPrivkeyFilepath, TestTimestampPrivKeyFilepath),
+		fmt.Sprintf("--%s=%s", InitRootThreshold, "1"),
+		fmt.Sprintf("--%s=%s", InitTargetsThreshold, "1"),
+		fmt.Sprintf("--%s=%s", InitSnapshotThreshold, "1"),
+		fmt.Sprintf("--%s=%s", InitTimestampThreshold, "1"),
+		fmt.Sprintf("--%s=%s", InitExpire, "365"),
+	}, extra...)
+}
+
+// Filepath of the latest metadata file of role in metadataDir.
+func latestMetadataFilepath(t *testing.T, metadataDir string, role string) string {
+	t.Helper()
+	paths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths[len(paths)-1]
+}
+
+// Latest metadata of the targets role, or of a channel, in metadataDir.
+func latestTargets(t *testing.T, metadataDir string, role string) *metadata.Metadata[metadata.TargetsType] {
+	t.Helper()
+	targets, err := metadata.Targets().FromFile(latestMetadataFilepath(t, metadataDir, role))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return targets
+}
+
+// Repository of a test in a temp dir: the target files in repoDir
+// (<dir>/repo) and the metadata in metadataDir (<dir>/metadata), the
+// workspace is made in dir by init. Commands run with --output json and --yes.
+type testRepo struct {
+	t           *testing.T
+	dir         string
+	repoDir     string
+	metadataDir string
+	globals     []string // global flags of every command
+}
+
+// New test repository with the given target files, by path relative to the
+// repository dir.
+func newTestRepo(t *testing.T, files map[string]string) *testRepo {
+	t.Helper()
+	dir := t.TempDir()
+	r := &testRepo{t: t, dir: dir, repoDir: filepath.Join(dir, "repo"), metadataDir: filepath.Join(dir, "metadata"),
+		globals: []string{"--" + GlobalYes}}
+	if err := filesystem.MakeNewDirAll(r.repoDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		r.write(name, content)
+	}
+	return r
+}
+
+// Also take the flags of the commands from the workspace in dir.
+func (r *testRepo) withWorkspace() *testRepo {
+	r.globals = append(r.globals, fmt.Sprintf("--%s=%s", GlobalWorkspaceDir, r.dir))
+	return r
+}
+
+// Init the repository with testInitArgs, fails the test if init fails.
+func (r *testRepo) init(extra ...string) commandResult {
+	r.t.Helper()
+	result, code := r.run(testInitArgs(r.repoDir, r.metadataDir, extra...)...)
+	if code != ExitOK {
+		r.t.Fatal(code, result)
+	}
+	return result
+}
+
+func (r *testRepo) run(args ...string) (commandResult, int) {
+	r.t.Helper()
+	return runCommandJSON(r.t, append(append([]string{}, r.globals...), args...)...)
+}
+
+// Write the file at name, relative to the repository dir, with its dirs.
+func (r *testRepo) write(name string, content string) {
+	r.t.Helper()
+	path := filepath.Join(r.repoDir, filepath.FromSlash(name))
+	if err := filesystem.MakeNewDirAll(filepath.Dir(path)); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := filesystem.WriteBytesToFile(path, []byte(content)); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// Remove the file at name, relative to the repository dir.
+func (r *testRepo) remove(name string) {
+	r.t.Helper()
+	if err := os.Remove(filepath.Join(r.repoDir, filepath.FromSlash(name))); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) latest(role string) *metadata.Metadata[metadata.TargetsType] {
+	r.t.Helper()
+	return latestTargets(r.t, r.metadataDir, role)
+}
+
+// In-memory S3-compatible server for the s3:// dirs, see
+// objectstore_test.fakeS3. Requests are counted by method and key.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests map[string]int // "<method> <key>" -> count
+	failPut  string         // key whose uploads fail with 500
+}
+
+// Start a fake S3 server with objects (key -> content) in bucket "bucket",
+// and point the AWS environment variables at it.
+func newFakeS3(t *testing.T, objects map[string]string) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{objects: map[string][]byte{}, requests: map[string]int{}}
+	for key, content := range objects {
+		f.objects[key] = []byte(content)
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+	return f
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.requests[r.Method+" "+key]++
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		keys := []string{}
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><ETag>%s</ETag><Size>%d</Size></Contents>", k, fakeETag(f.objects[k]), len(f.objects[k]))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodGet:
+		content, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", fakeETag(content))
+		w.Write(content)
+	case r.Method == http.MethodPut && key == f.failPut:
+		w.WriteHeader(http.StatusInternalServerError)
+	case r.Method == http.MethodPut:
+		content, exists := f.objects[key]
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && (!exists || m != fakeETag(content)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		w.Header().Set("ETag", fakeETag(body))
+	case r.Method == http.MethodDelete:
+		if m := r.Header.Get("If-Match"); m != "" {
+			if content, exists := f.objects[key]; exists && m != fakeETag(content) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Targets of the targets metadata object at key.
+func (f *fakeS3) targets(t *testing.T, key string) map[string]*metadata.TargetFiles {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	targets, err := metadata.Targets().FromBytes(f.objects[key])
+	if err != nil {
+		t.Fatal(key, err)
+	}
+	return targets.Signed.Targets
+}
+
+// Keys of the objects under prefix, sorted.
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fakeETag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
 func verifyAllRolesTestHelper(metaDir string) error {
 	roles := repository.New()
 	// Load root
@@ -1996,7 +4229,7 @@ func updateRepoMetadataTestHelper(config configUpdate) error {
 	}
 
 	// Generate new target metadata files from files in directory
-	newTargets, err := metahelper.GenerateNewTargetsFromDir(config.repositoryDir, datetime.ExpireIn(7))
+	newTargets, _, err := metahelper.GenerateNewTargetsFromDir(config.repositoryDir, datetime.ExpireIn(7), metahelper.TargetsOptions{Prefix: filepath.Base(config.repositoryDir)})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,388 @@
+package repository
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"see_updater/internal/pkg/custom"
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/hashcache"
+	"see_updater/internal/pkg/ignore"
+	"see_updater/internal/pkg/metahelper"
+	"see_updater/internal/pkg/publish"
+
+	"github.com/spf13/cobra"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Files that are never meant to be targets: VCS data, OS and editor litter,
+// and the probe files of filesystem.IsDirWritable. The .tufignore file or
+// --include can bring them back with a `!pattern`.
+var defaultIgnorePatterns = []string{
+	".git/",
+	IgnoreFilename,
+	".DS_Store",
+	"Thumbs.db",
+	"*.swp",
+	"*.swo",
+	"*~",
+	"tmpfile_check_writable*",
+}
+
+// Which files of the repository dir a scan keeps, shared by init, update,
+// update plan and verify.
+type configScan struct {
+	excludeRaw   string // ";" separated patterns
+	includeRaw   string // ";" separated patterns
+	targetPrefix string // default: the repository dirname
+	stripRoot    bool
+	symlinks     string // see filesystem.SymlinksPolicies
+	jobs         int
+	hashCache    string // cache file path, none if empty
+	paranoid     bool
+	algorithms   string     // "," separated hash algorithms
+	sidecars     bool       // custom metadata from <file>.meta.json
+	manifest     string     // custom metadata file, none if empty
+	schema       string     // schema of the custom metadata, custom.DefaultSchema if empty
+	saveCache    bool       // false on dry runs
+	progress     io.Writer  // hashing progress, stderr
+	remote       *stagedDir // the repository dir if it is remote, its files are listed and streamed
+}
+
+func addScanFlags(cmd *cobra.Command, config *configScan) {
+	cmd.Flags().StringVar(&config.excludeRaw, ScanExclude, "", fmt.Sprintf("Patterns of files to leave out of the targets, \";\" separated, in %s syntax (optional)", IgnoreFilename))
+	cmd.Flags().StringVar(&config.includeRaw, ScanInclude, "", "Patterns of files to keep even if excluded, \";\" separated (optional)")
+	cmd.Flags().StringVar(&config.targetPrefix, ScanTargetPrefix, "", "Prefix of the target paths instead of the repository dirname (optional)")
+	cmd.Flags().BoolVar(&config.stripRoot, ScanStripRoot, false, "Target paths relative to the repository dir, without prefix (optional)")
+	cmd.Flags().StringVar(&config.symlinks, ScanSymlinks, filesystem.SymlinksFollow, fmt.Sprintf("Symlinks policy: %q, %q, %q or %q, links must point inside the repository dir (optional)",
+		filesystem.SymlinksFollow, filesystem.SymlinksSkip, filesystem.SymlinksError, filesystem.SymlinksRecord))
+	cmd.Flags().IntVar(&config.jobs, ScanJobs, runtime.NumCPU(), "Number of files hashed in parallel (optional)")
+	cmd.Flags().StringVar(&config.hashCache, ScanHashCache, "", "Hash cache file, files with unchanged size, mtime and inode are not rehashed (optional, default: in the workspace)")
+	cmd.Flags().BoolVar(&config.paranoid, ScanParanoid, false, "Rehash every file, ignoring the hash cache (optional)")
+	addHashAlgorithmsFlag(cmd, &config.algorithms)
+	cmd.Flags().BoolVar(&config.sidecars, ScanCustomSidecars, false, fmt.Sprintf("Read the custom metadata of each file from <file>%s, sidecars are not targets (optional)", custom.SidecarSuffix))
+	cmd.Flags().StringVar(&config.manifest, ScanCustomManifest, "", "YAML, JSON or CSV file of the custom metadata of the files, by path relative to the repository dir (optional)")
+	cmd.Flags().StringVar(&config.schema, ScanCustomSchema, "", "YAML schema of the custom metadata (optional, default: version, hardware, release_notes_url and min_from_version)")
+	cmd.MarkFlagsMutuallyExclusive(ScanTargetPrefix, ScanStripRoot)
+}
+
+// Set up the scan of cmd for the staged repositoryDir: the files of a remote
+// dir are listed and streamed from object storage, without hash cache (there
+// is no stat data to check). The cache is not written on dry runs.
+func (c *configScan) setup(cmd *cobra.Command, repositoryDir *stagedDir, dryRun bool) {
+	c.progress = cmd.ErrOrStderr()
+	c.saveCache = !dryRun
+	if repositoryDir.IsRemote() {
+		c.hashCache = ""
+		c.remote = repositoryDir
+	}
+}
+
+// Targets metadata of the files of repositoryDir kept by the scan options,
+// and the scan result.
+func (c configScan) targets(repositoryDir string, expireIn time.Time) (*metadata.Metadata[metadata.TargetsType], filesystem.ScanResult, error) {
+	opts, err := c.options(repositoryDir)
+	if err != nil {
+		return nil, filesystem.ScanResult{}, err
+	}
+	prefix, err := c.prefix(repositoryDir)
+	if err != nil {
+		return nil, filesystem.ScanResult{}, err
+	}
+	algorithms, err := hashAlgorithms(c.algorithms)
+	if err != nil {
+		return nil, filesystem.ScanResult{}, err
+	}
+	scan, err := c.scanFiles(repositoryDir, opts)
+	if err != nil {
+		return nil, scan, err
+	}
+	var cache *hashcache.Cache
+	if c.hashCache != "" {
+		cache = hashcache.Load(c.hashCache)
+	}
+	targetsOpts := metahelper.TargetsOptions{
+		Prefix:         prefix,
+		Jobs:           c.jobs,
+		Progress:       c.progress,
+		Cache:          cache,
+		Paranoid:       c.paranoid,
+		HashAlgorithms: algorithms,
+	}
+	if c.remote != nil {
+		targetsOpts.Open = func(file filesystem.ScannedFile) (io.ReadCloser, error) {
+			return c.remote.open(file.Path)
+		}
+	}
+	targets, err := metahelper.GenerateNewTargets(scan, expireIn, targetsOpts)
+	if err == nil && cache != nil && c.saveCache {
+		// The targets are right without the cache, losing it only costs time
+		if err := cache.Save(); err != nil {
+			slog.Warn("fail to save hash cache", slog.String("path", c.hashCache), slog.Any("error", err))
+		}
+	}
+	if err == nil {
+		err = c.applyCustom(targets, scan, prefix)
+	}
+	return targets, scan, err
+}
+
+// Set the custom field of the targets of scan (named with prefix) from the
+// manifest and the sidecars, checked against the schema. Sidecar values
+// override the manifest ones.
+func (c configScan) applyCustom(targets *metadata.Metadata[metadata.TargetsType], scan filesystem.ScanResult, prefix string) error {
+	if !c.sidecars && c.manifest == "" {
+		return nil
+	}
+	schema := custom.DefaultSchema()
+	var err error
+	if c.schema != "" {
+		if schema, err = custom.LoadSchema(c.schema); err != nil {
+			return fmt.Errorf("%w: %w", ErrUsage, err)
+		}
+	}
+	manifest := map[string]map[string]any{}
+	if c.manifest != "" {
+		if manifest, err = custom.LoadManifest(c.manifest, schema); err != nil {
+			return fmt.Errorf("%w: %w", ErrUsage, err)
+		}
+	}
+
+	invalid := []string{}
+	for _, file := range scan.Files {
+		values := map[string]any{}
+		for name, value := range manifest[file.Path] {
+			values[name] = value
+		}
+		delete(manifest, file.Path)
+		if c.sidecars {
+			sidecar, ok, err := custom.ReadSidecar(file.FullPath + custom.SidecarSuffix)
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("%s: %v", file.Path, err))
+				continue
+			}
+			for name, value := range sidecar {
+				values[name] = value
+			}
+			if ok && len(sidecar) == 0 {
+				slog.Warn("empty sidecar", slog.String("filepath", file.FullPath+custom.SidecarSuffix))
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if err = schema.Validate(values); err == nil {
+			err = custom.Apply(targets.Signed.Targets[metahelper.TargetPath(prefix, file.Path)], values)
+		}
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", file.Path, err))
+		}
+	}
+	if len(manifest) > 0 {
+		unmatched := []string{}
+		for path := range manifest {
+			unmatched = append(unmatched, path)
+		}
+		sort.Strings(unmatched)
+		slog.Warn("custom metadata of files not found in the repository dir", slog.String("manifest", c.manifest), slog.Any("paths", unmatched))
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%w: invalid custom metadata of %d files:\n\t%s", ErrUsage, len(invalid), strings.Join(invalid, "\n\t"))
+	}
+	return nil
+}
+
+// The targets renamed to the paths they would get from a scan of
+// repositoryDir, their file infos are kept (no rehashing), see
+// metahelper.MigrateTargetPaths. Also returns the scan result and the
+// targets that kept their path.
+func (c configScan) migrate(repositoryDir string, targets *metadata.Metadata[metadata.TargetsType]) (*metadata.Metadata[metadata.TargetsType], filesystem.ScanResult, []string, error) {
+	opts, err := c.options(repositoryDir)
+	if err != nil {
+		return nil, filesystem.ScanResult{}, nil, err
+	}
+	prefix, err := c.prefix(repositoryDir)
+	if err != nil {
+		return nil, filesystem.ScanResult{}, nil, err
+	}
+	scan, err := c.scanFiles(repositoryDir, opts)
+	if err != nil {
+		return nil, scan, nil, err
+	}
+	relPaths := []string{}
+	for _, file := range scan.Files {
+		relPaths = append(relPaths, file.Path)
+	}
+	migrated, unmatched, err := metahelper.MigrateTargetPaths(targets, prefix, relPaths)
+	if err != nil {
+		return nil, scan, nil, err
+	}
+	return migrated, scan, unmatched, nil
+}
+
+// Contents of the targets of a scan of repositoryDir by target name, to
+// publish them: the scanned files, or the link target of recorded symlinks.
+func (c configScan) sources(repositoryDir string, scan filesystem.ScanResult) (map[string]publish.Source, error) {
+	prefix, err := c.prefix(repositoryDir)
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]publish.Source{}
+	for _, file := range scan.Files {
+		name := metahelper.TargetPath(prefix, file.Path)
+		switch {
+		case file.Symlink != "":
+			sources[name] = publish.Source{Data: []byte(file.Symlink)}
+		case c.remote != nil:
+			rel := file.Path
+			sources[name] = publish.Source{Open: func() (io.ReadCloser, error) { return c.remote.open(rel) }}
+		default:
+			sources[name] = publish.Source{Path: file.FullPath}
+		}
+	}
+	return sources, nil
+}
+
+// Files of repositoryDir kept by opts, listed from object storage if the dir
+// is remote.
+func (c configScan) scanFiles(repositoryDir string, opts filesystem.ScanOptions) (filesystem.ScanResult, error) {
+	if c.remote != nil {
+		return c.remote.scan(opts), nil
+	}
+	return filesystem.ScanDir(repositoryDir, opts)
+}
+
+func (c configScan) options(repositoryDir string) (filesystem.ScanOptions, error) {
+	if c.jobs < 1 {
+		return filesystem.ScanOptions{}, fmt.Errorf("%w: invalid --%s %d, at least 1 file is hashed at a time", ErrUsage, ScanJobs, c.jobs)
+	}
+	if !slices.Contains(filesystem.SymlinksPolicies, c.symlinks) {
+		return filesystem.ScanOptions{}, fmt.Errorf("%w: invalid --%s %q, accepted: %s", ErrUsage, ScanSymlinks, c.symlinks, strings.Join(filesystem.SymlinksPolicies, ", "))
+	}
+	rules, err := c.rules(repositoryDir)
+	if err != nil {
+		return filesystem.ScanOptions{}, err
+	}
+	return filesystem.ScanOptions{Ignore: rules, Symlinks: c.symlinks}, nil
+}
+
+// Prefix of the target paths: --target-prefix, nothing with --strip-root, by
+// default the last element of the repository dir (e.g. "repo/a.txt").
+func (c configScan) prefix(repositoryDir string) (string, error) {
+	switch {
+	case c.stripRoot:
+		return "", nil
+	case c.targetPrefix != "":
+		prefix := strings.TrimRight(filepath.ToSlash(c.targetPrefix), "/")
+		if err := checkTargetName(prefix); err != nil || prefix == "." {
+			return "", fmt.Errorf("%w: invalid --%s %q, use a relative path", ErrUsage, ScanTargetPrefix, c.targetPrefix)
+		}
+		return path.Clean(prefix), nil
+	default:
+		name := filepath.Base(filepath.Clean(repositoryDir))
+		if name == "." || name == string(filepath.Separator) {
+			return "", nil
+		}
+		return name, nil
+	}
+}
+
+// Ignore rules of a scan of repositoryDir, the last matching rule wins: the
+// defaults, then the .tufignore file at the root of the repository dir, then
+// --exclude, then --include.
+func (c configScan) rules(repositoryDir string) (*ignore.Rules, error) {
+	rules := ignore.New()
+	for _, pattern := range defaultIgnorePatterns {
+		if err := rules.Add("default", pattern); err != nil {
+			return nil, err
+		}
+	}
+	if err := rules.AddFile(filepath.Join(repositoryDir, IgnoreFilename), IgnoreFilename); err != nil {
+		return nil, err
+	}
+	if c.sidecars {
+		if err := rules.Add("--"+ScanCustomSidecars, "*"+custom.SidecarSuffix); err != nil {
+			return nil, err
+		}
+	}
+	// The manifest describes the targets, it is not one
+	if rel, err := filepath.Rel(repositoryDir, c.manifest); c.manifest != "" && err == nil && filepath.IsLocal(rel) {
+		if err = rules.Add("--"+ScanCustomManifest, "/"+filepath.ToSlash(rel)); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range splitPatterns(c.excludeRaw) {
+		if err := rules.Add("--"+ScanExclude, pattern); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUsage, err)
+		}
+	}
+	for _, pattern := range splitPatterns(c.includeRaw) {
+		if err := rules.Add("--"+ScanInclude, "!"+strings.TrimPrefix(pattern, "!")); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUsage, err)
+		}
+	}
+	return rules, nil
+}
+
+func addHashAlgorithmsFlag(cmd *cobra.Command, algorithms *string) {
+	cmd.Flags().StringVar(algorithms, ScanHashAlgorithms, metahelper.DefaultHashAlgorithm, fmt.Sprintf("Hash algorithms of the targets, \",\" separated, among: %s (optional)", strings.Join(metahelper.HashAlgorithms, ", ")))
+}
+
+// Hash algorithms of --hash-algorithms, without duplicates.
+func hashAlgorithms(raw string) ([]string, error) {
+	algorithms := []string{}
+	for _, algorithm := range strings.Split(raw, ",") {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if !slices.Contains(metahelper.HashAlgorithms, algorithm) {
+			return nil, fmt.Errorf("%w: invalid --%s %q, accepted: %s", ErrUsage, ScanHashAlgorithms, raw, strings.Join(metahelper.HashAlgorithms, ", "))
+		}
+		if !slices.Contains(algorithms, algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return algorithms, nil
+}
+
+func splitPatterns(raw string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(raw, ";") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Print the files left out of the scan and the hardlinked files, and record
+// them in the result document. Prints nothing if there are none.
+func printScanReport(out *cmdOutput, skipped []filesystem.SkippedFile, hardlinks [][]string) {
+	out.result.Skipped = skipped
+	out.result.Hardlinks = hardlinks
+	if len(skipped) > 0 {
+		fmt.Fprintf(out.text, "A total of %d files skipped\n", len(skipped))
+		w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+		fmt.Fprintln(w, "\tNo.\tFilepath\tReason")
+		for i, file := range skipped {
+			fmt.Fprintf(w, "\t%d.\t%s\t%s\n", i+1, file.Path, file.Reason)
+		}
+		w.Flush()
+	}
+	if len(hardlinks) > 0 {
+		fmt.Fprintf(out.text, "A total of %d groups of hardlinked files, each file is a target with the same content\n", len(hardlinks))
+		w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+		fmt.Fprintln(w, "\tNo.\tFilepaths")
+		for i, paths := range hardlinks {
+			fmt.Fprintf(w, "\t%d.\t%s\n", i+1, strings.Join(paths, ", "))
+		}
+		w.Flush()
+	}
+}
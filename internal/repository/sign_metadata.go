@@ -3,10 +3,12 @@ package repository
 import (
 	"context"
 	"crypto"
+	"errors"
 	"fmt"
 	"log/slog"
 	"path/filepath"
 	"slices"
+	"strings"
 
 	"see_updater/internal/pkg/cli"
 	"see_updater/internal/pkg/cryptography"
@@ -20,7 +22,7 @@ import (
 	"github.com/theupdateframework/go-tuf/v2/metadata/repository"
 )
 
-func signMetadata(config configSign) error {
+func signMetadata(config configSign, out *cmdOutput) error {
 	// Append context to logger
 	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
 		slog.String("metadata_dir", config.metadataDir),
@@ -179,34 +181,66 @@ func signMetadata(config configSign) error {
 	}
 	if verErr != nil {
 		slog.Warn("fail to verify targets metadata signature", slog.Any("error", verErr), slog.String("role", config.role))
-		fmt.Printf("fail to verify targets metadata signature for given role: %s\n\terror: %v\n", config.role, verErr)
+		fmt.Fprintf(out.text, "fail to verify targets metadata signature for given role: %s\n\terror: %v\n", config.role, verErr)
 		// Two scenarios:
 		// 1. User used the RIGHT key to sign, but total RIGHT signature < threshold
 		// 2. User used the WRONG key to sign, total RIGHT signature < threshold
-		fmt.Println("Please perform additional signing to meet the threshold, program will now proceed to write the signature to the metadata file (irreversible)")
-		if !cli.AskConfirmation(3) {
-			fmt.Println("Operation aborted, no changes were made")
+		fmt.Fprintln(out.text, "Please perform additional signing to meet the threshold, program will now proceed to write the signature to the metadata file (irreversible)")
+		if err = out.confirmer.Confirm(); errors.Is(err, cli.ErrDeclined) {
+			fmt.Fprintln(out.text, "Operation aborted, no changes were made")
 			return nil
+		} else if err != nil {
+			return fmt.Errorf("fail to confirm operation: %w, use --%s to sign anyway", err, GlobalYes)
 		}
 	}
 
 	// Write
-	var writeErr error
-	var filename string
+	var file metadataFile
 	switch config.role {
 	case Targets:
-		filename = fmt.Sprintf("%d.%s.json", roles.Targets(Targets).Signed.Version, config.role)
-		writeErr = roles.Targets(Targets).ToFile(filepath.Join(config.metadataDir, filename), true)
+		file = metadataFile{fmt.Sprintf("%d.%s.json", roles.Targets(Targets).Signed.Version, config.role),
+			func(path string) error { return roles.Targets(Targets).ToFile(path, true) }}
 	case Snapshot:
-		filename = fmt.Sprintf("%d.%s.json", roles.Snapshot().Signed.Version, config.role)
-		writeErr = roles.Snapshot().ToFile(filepath.Join(config.metadataDir, filename), true)
+		file = metadataFile{fmt.Sprintf("%d.%s.json", roles.Snapshot().Signed.Version, config.role),
+			func(path string) error { return roles.Snapshot().ToFile(path, true) }}
 	case Timestamp:
-		filename = fmt.Sprintf("%s.json", config.role)
-		writeErr = roles.Timestamp().ToFile(filepath.Join(config.metadataDir, filename), true)
+		file = metadataFile{fmt.Sprintf("%s.json", config.role),
+			func(path string) error { return roles.Timestamp().ToFile(path, true) }}
 	case Root:
-		filename = fmt.Sprintf("%d.%s.json", roles.Root().Signed.Version, config.role)
-		writeErr = roles.Root().ToFile(filepath.Join(config.metadataDir, filename), true)
+		file = metadataFile{fmt.Sprintf("%d.%s.json", roles.Root().Signed.Version, config.role),
+			func(path string) error { return roles.Root().ToFile(path, true) }}
 	}
+	filename := file.filename
+	files := []metadataFile{file}
+
+	// Snapshot and timestamp recording the length and hashes of the signed
+	// file must point at its new bytes
+	var data []byte
+	var version int64
+	switch config.role {
+	case Targets:
+		data, err = roles.Targets(Targets).ToBytes(true)
+		version = roles.Targets(Targets).Signed.Version
+	case Snapshot:
+		data, err = roles.Snapshot().ToBytes(true)
+		version = roles.Snapshot().Signed.Version
+	}
+	if err != nil {
+		return fmt.Errorf("fail to serialize %s metadata: %w", config.role, err)
+	}
+	if data != nil {
+		refreshed, cleared, err := refreshHashedMeta(config.metadataDir, config.role, version, data)
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to update the meta of the signed file", slog.Any("error", err), slog.String("role", config.role))
+			return err
+		}
+		files = append(files, refreshed...)
+		if len(cleared) > 0 {
+			fmt.Fprintf(out.text, "Recorded the new length and hashes of %s.json, the signatures of %s were cleared: sign them again\n",
+				config.role, strings.Join(cleared, ", "))
+		}
+	}
+	writeErr := writeMetadataFiles(config.metadataDir, SignVerb, files)
 	if writeErr != nil {
 		slog.ErrorContext(ctx, "fail to write signed target metadata to file", slog.Any("error", writeErr),
 			slog.String("role", config.role),
@@ -0,0 +1,456 @@
+package repository
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"see_updater/internal/pkg/datetime"
+	"see_updater/internal/pkg/logging"
+	"see_updater/internal/pkg/metahelper"
+	"see_updater/internal/pkg/objectstore"
+	"see_updater/internal/pkg/publish"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Key of the targets custom metadata (signed.custom) listing the targets added
+// from elsewhere than the repository dir, see keepExternalTargets.
+const externalKey = "external"
+
+// Add or replace one target in the latest targets metadata, from a local file
+// or from a hash and length given on the command line, and write new targets,
+// snapshot and timestamp versions. The repository dir is not scanned. A
+// target named with --as is recorded as external: update keeps it.
+func addTarget(config configTarget, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("repository_dir", config.repositoryDir),
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("local_filepath", config.localFilepath),
+		slog.String("name", config.name),
+		slog.String("hash", config.hash),
+		slog.Int64("length", config.length),
+		slog.Int("expire_in", int(config.expireIn)),
+	))
+
+	target, err := newTargetFile(config)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to make target file info", slog.Any("error", err))
+		return err
+	}
+	sources := map[string]publish.Source{}
+	if config.localFilepath != "" {
+		sources[target.Path] = publish.Source{Path: config.localFilepath}
+	}
+	return editTargets(ctx, TargetVerb+" "+TargetAddVerb, config, sources, out, func(targets *metadata.Metadata[metadata.TargetsType]) error {
+		targets.Signed.Targets[target.Path] = target
+		external, err := externalTargets(targets)
+		if err != nil {
+			return err
+		}
+		external = slices.DeleteFunc(external, func(name string) bool { return name == target.Path })
+		if config.name != "" {
+			external = append(external, target.Path)
+		}
+		return setExternalTargets(targets, external)
+	})
+}
+
+// Remove one target from the latest targets metadata and write new targets,
+// snapshot and timestamp versions.
+func removeTarget(config configTarget, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("name", config.name),
+		slog.Int("expire_in", int(config.expireIn)),
+	))
+
+	return editTargets(ctx, TargetVerb+" "+TargetRemoveVerb, config, nil, out, func(targets *metadata.Metadata[metadata.TargetsType]) error {
+		if targets.Signed.Targets[config.name] == nil {
+			return fmt.Errorf("%w: target %s not found in the targets metadata", ErrUsage, config.name)
+		}
+		delete(targets.Signed.Targets, config.name)
+		return nil
+	})
+}
+
+// Remove one target from the latest targets metadata and record its
+// tombstone, then write new targets, snapshot and timestamp versions. Its
+// content may not be a target again, see nextTargetsRoles: the targets and
+// channel entries with the same content are removed too, the channels are
+// signed with their --channel-key. A channel entry (<channel>/<name>) may be
+// yanked by its name.
+func yankTarget(config configTarget, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("name", config.name),
+		slog.String("reason", config.reason),
+		slog.Any("channel_keys", config.channelKeys),
+		slog.Int("expire_in", int(config.expireIn)),
+	))
+
+	if strings.TrimSpace(config.reason) == "" {
+		return fmt.Errorf("%w: --%s must not be empty", ErrUsage, TargetReason)
+	}
+	roles, err := loadChannelRoles(ctx, config.metadataDir, true)
+	if err != nil {
+		return err
+	}
+	channels := channelNames(roles.Targets(Targets))
+	target := roles.Targets(Targets).Signed.Targets[config.name]
+	if channel, _, ok := strings.Cut(config.name, "/"); ok && target == nil && slices.Contains(channels, channel) {
+		target = roles.Targets(channel).Signed.Targets[config.name]
+	}
+	if target == nil {
+		return fmt.Errorf("%w: target %s not found in the targets metadata or its channels", ErrUsage, config.name)
+	}
+	t := tombstone{Path: config.name, Length: target.Length, Hashes: target.Hashes, Reason: strings.TrimSpace(config.reason),
+		Time: time.Now().UTC().Truncate(time.Second)}
+	yank := func(targets *metadata.Metadata[metadata.TargetsType]) {
+		for name, target := range targets.Signed.Targets {
+			if t.matches(target) {
+				delete(targets.Signed.Targets, name)
+			}
+		}
+	}
+	edit := func(targets *metadata.Metadata[metadata.TargetsType]) error {
+		list, err := tombstones(targets)
+		if err != nil {
+			return err
+		}
+		if err = setTombstones(targets, append(list, t)); err != nil {
+			return err
+		}
+		yank(targets)
+		out.result.Data = t
+		return nil
+	}
+
+	served := []string{} // channels serving the content
+	for _, channel := range channels {
+		if len(yankedTargets([]tombstone{t}, roles.Targets(channel).Signed.Targets)) > 0 {
+			served = append(served, channel)
+		}
+	}
+	if len(served) == 0 {
+		return editTargets(ctx, TargetVerb+" "+TargetYankVerb, config, nil, out, edit)
+	}
+
+	keys := map[string]*rsa.PrivateKey{}
+	for _, channel := range served {
+		path := config.channelKeys[channel]
+		if path == "" {
+			return fmt.Errorf("%w: channel %s serves the content of %s, give its key with --%s %s=<path>", ErrUsage, channel, config.name, TargetChannelKey, channel)
+		}
+		if keys[channel], err = loadPrivateKey(path); err != nil {
+			slog.ErrorContext(ctx, "fail to load channel key", slog.Any("error", err))
+			return fmt.Errorf("fail to load key of channel %s: %w", channel, err)
+		}
+	}
+	if config.targetsPrivkeyFilepath != "" {
+		if keys[Targets], err = loadPrivateKey(config.targetsPrivkeyFilepath); err != nil {
+			slog.ErrorContext(ctx, "fail to load targets key", slog.Any("error", err))
+			return err
+		}
+	}
+	changed := append([]string{Targets}, served...)
+	changes := []metahelper.TargetChange{}
+	for _, name := range changed {
+		next, err := copyTargets(roles.Targets(name))
+		if err != nil {
+			return err
+		}
+		if name == Targets {
+			err = edit(next)
+		} else {
+			yank(next)
+		}
+		if err != nil {
+			return err
+		}
+		changes = append(changes, metahelper.CompareNewOldTargets(next, roles.Targets(name), true)...)
+		next.Signed.Version = roles.Targets(name).Signed.Version + 1
+		next.Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+		roles.SetTargets(name, next)
+	}
+
+	fmt.Fprintf(out.text, "Yanking %s from the targets and channels %s\n", config.name, strings.Join(served, ", "))
+	printTargetChanges(out, targetChanges(changes))
+	if config.askConfirmation {
+		if err = out.confirmer.Confirm(); err != nil {
+			return fmt.Errorf("fail to confirm operation: %w", err)
+		}
+	}
+	return signChannelUpdate(ctx, TargetVerb+" "+TargetYankVerb, configChannel{
+		metadataDir:              config.metadataDir,
+		snapshotPrivkeyFilepath:  config.snapshotPrivkeyFilepath,
+		timestampPrivkeyFilepath: config.timestampPrivkeyFilepath,
+		expireIn:                 config.expireIn,
+		askConfirmation:          config.askConfirmation,
+		metaHashes:               config.metaHashes,
+	}, roles, changed, keys, out)
+}
+
+// Add the hashes of --hash-algorithms missing from the latest targets,
+// computed from the files of the repository dir, and write new targets,
+// snapshot and timestamp versions. Files must still have the content of their
+// target (changed files are for update), targets without a file keep their
+// hashes.
+func rehashTargets(config configTarget, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("repository_dir", config.repositoryDir),
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("hash_algorithms", config.scan.algorithms),
+		slog.Int("expire_in", int(config.expireIn)),
+	))
+
+	algorithms, err := hashAlgorithms(config.scan.algorithms)
+	if err != nil {
+		return err
+	}
+	files, scan, err := config.scan.targets(config.repositoryDir, datetime.ExpireIn(placeholderExpireIn))
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to generate targets from repository dir", slog.Any("error", err))
+		return err
+	}
+	sources, err := config.scan.sources(config.repositoryDir, scan)
+	if err != nil {
+		return err
+	}
+	return editTargets(ctx, TargetVerb+" "+TargetRehashVerb, config, sources, out, func(targets *metadata.Metadata[metadata.TargetsType]) error {
+		changed, notFound := []string{}, []string{}
+		for name, target := range targets.Signed.Targets {
+			if len(metahelper.MissingHashes(target, algorithms)) == 0 {
+				continue
+			}
+			file := files.Signed.Targets[name]
+			if file == nil {
+				notFound = append(notFound, name)
+				continue
+			}
+			if !metahelper.SameContent(target, file) {
+				changed = append(changed, name)
+				continue
+			}
+			for algorithm, digest := range file.Hashes {
+				if _, ok := target.Hashes[algorithm]; !ok {
+					target.Hashes[algorithm] = digest
+				}
+			}
+		}
+		if len(notFound) > 0 {
+			sort.Strings(notFound)
+			slog.WarnContext(ctx, "targets not found in the repository dir kept their hashes", slog.Any("targets", notFound))
+		}
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			return fmt.Errorf("%w: %d target files changed, run `%s` first: %s", ErrVerification, len(changed), UpdateVerb, strings.Join(changed, ", "))
+		}
+		return nil
+	})
+}
+
+// Apply edit to a copy of the latest targets, then show the change, ask for
+// confirmation, sign and write like update, publishing from sources. Nothing
+// is written if the edit changes nothing.
+func editTargets(ctx context.Context, verb string, config configTarget, sources map[string]publish.Source, out *cmdOutput,
+	edit func(*metadata.Metadata[metadata.TargetsType]) error) error {
+	roles, newChanges, err := nextTargetsRoles(ctx, config.metadataDir, config.expireIn,
+		func(oldTargets *metadata.Metadata[metadata.TargetsType]) (*metadata.Metadata[metadata.TargetsType], error) {
+			bytes, err := oldTargets.ToBytes(false)
+			if err != nil {
+				return nil, fmt.Errorf("fail to copy targets metadata: %w", err)
+			}
+			targets, err := metadata.Targets().FromBytes(bytes)
+			if err != nil {
+				return nil, fmt.Errorf("fail to copy targets metadata: %w", err)
+			}
+			if err = edit(targets); err != nil {
+				return nil, err
+			}
+			return targets, nil
+		})
+	if err != nil {
+		return err
+	}
+
+	if len(newChanges) == 0 {
+		fmt.Fprintln(out.text, "Target already up to date, no metadata file was written")
+		return nil
+	}
+	printTargetChanges(out, targetChanges(newChanges))
+	if config.askConfirmation {
+		if err = out.confirmer.Confirm(); err != nil {
+			return fmt.Errorf("fail to confirm operation: %w", err)
+		}
+	}
+	return signUpdate(ctx, verb, configUpdate{
+		metadataDir:              config.metadataDir,
+		targetsPrivkeyFilepath:   config.targetsPrivkeyFilepath,
+		snapshotPrivkeyFilepath:  config.snapshotPrivkeyFilepath,
+		timestampPrivkeyFilepath: config.timestampPrivkeyFilepath,
+		expireIn:                 config.expireIn,
+		askConfirmation:          config.askConfirmation,
+		metaHashes:               config.metaHashes,
+		publish:                  config.publish,
+	}, roles, sources, out)
+}
+
+// Target file info of `target add`, hashed from the local file or built from
+// --hash and --length.
+func newTargetFile(config configTarget) (*metadata.TargetFiles, error) {
+	name := config.name
+	if name == "" {
+		var err error
+		if name, err = defaultTargetName(config); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkTargetName(name); err != nil {
+		return nil, err
+	}
+
+	if config.localFilepath != "" {
+		algorithms, err := hashAlgorithms(config.scan.algorithms)
+		if err != nil {
+			return nil, err
+		}
+		target, err := metahelper.HashFile(config.localFilepath, algorithms...)
+		if err != nil {
+			return nil, fmt.Errorf("fail to generate target file info for file: %s\n\terror: %w", config.localFilepath, err)
+		}
+		target.Path = name
+		return target, nil
+	}
+
+	algorithm, digest, ok := strings.Cut(config.hash, ":")
+	if !ok || algorithm == "" {
+		return nil, fmt.Errorf("%w: invalid --%s %q, expected <algorithm>:<hex digest>", ErrUsage, TargetHash, config.hash)
+	}
+	algorithm = strings.ToLower(algorithm)
+	size, err := metahelper.HashSize(algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid --%s %q, accepted algorithms: %s", ErrUsage, TargetHash, config.hash, strings.Join(metahelper.HashAlgorithms, ", "))
+	}
+	bytes, err := hex.DecodeString(digest)
+	if err != nil || len(bytes) == 0 {
+		return nil, fmt.Errorf("%w: invalid --%s %q, the digest must be hexadecimal", ErrUsage, TargetHash, config.hash)
+	}
+	if len(bytes) != size {
+		return nil, fmt.Errorf("%w: invalid --%s %q, a %s digest has %d hexadecimal digits", ErrUsage, TargetHash, config.hash, algorithm, 2*size)
+	}
+	target := metadata.TargetFile()
+	target.Path = name
+	target.Length = config.length
+	target.Hashes = metadata.Hashes{algorithm: bytes}
+	return target, nil
+}
+
+// Name of the local file of `target add` without --as: its path relative to
+// the repository dir with the prefix of the scan, as update names it.
+func defaultTargetName(config configTarget) (string, error) {
+	if config.repositoryDir == "" || objectstore.IsURI(config.repositoryDir) {
+		return "", fmt.Errorf("%w: name the target with --%s, or give the local --%s holding %s", ErrUsage, TargetAs, TargetRepositoryDir, config.localFilepath)
+	}
+	dir, err := filepath.Abs(config.repositoryDir)
+	if err != nil {
+		return "", fmt.Errorf("fail to resolve repository dir %s: %w", config.repositoryDir, err)
+	}
+	file, err := filepath.Abs(config.localFilepath)
+	if err != nil {
+		return "", fmt.Errorf("fail to resolve file %s: %w", config.localFilepath, err)
+	}
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is not inside --%s %s, name the target with --%s", ErrUsage, config.localFilepath, TargetRepositoryDir, config.repositoryDir, TargetAs)
+	}
+	prefix, err := config.scan.prefix(config.repositoryDir)
+	if err != nil {
+		return "", err
+	}
+	return metahelper.TargetPath(prefix, filepath.ToSlash(rel)), nil
+}
+
+// Target names are relative paths inside the repository.
+func checkTargetName(name string) error {
+	clean := path.Clean(filepath.ToSlash(name))
+	if name == "" || path.IsAbs(clean) || filepath.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("%w: invalid target name %q, use a relative path inside the repository (see --%s)", ErrUsage, name, TargetAs)
+	}
+	return nil
+}
+
+// Names of the targets added from elsewhere than the repository dir, recorded
+// in the targets metadata.
+func externalTargets(targets *metadata.Metadata[metadata.TargetsType]) ([]string, error) {
+	names := []string{}
+	raw, ok := targetsCustom(targets)[externalKey]
+	if !ok {
+		return names, nil
+	}
+	bytes, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(bytes, &names)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid external targets in targets metadata: %w", err)
+	}
+	return names, nil
+}
+
+// Record the names of the targets added from elsewhere, sorted. Nothing is
+// recorded for none unless a list was.
+func setExternalTargets(targets *metadata.Metadata[metadata.TargetsType], names []string) error {
+	if _, ok := targetsCustom(targets)[externalKey]; !ok && len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	if err := setTargetsCustom(targets, externalKey, names); err != nil {
+		return fmt.Errorf("fail to marshal external targets: %w", err)
+	}
+	return nil
+}
+
+// Put back in newTargets, made from the files of the repository dir, the
+// external targets of oldTargets. A file of the dir with the same name
+// replaces an external target, which is no longer recorded as such. Returns
+// the names of the targets put back.
+func keepExternalTargets(oldTargets *metadata.Metadata[metadata.TargetsType], newTargets *metadata.Metadata[metadata.TargetsType]) ([]string, error) {
+	external, err := externalTargets(oldTargets)
+	if err != nil || len(external) == 0 {
+		return nil, err
+	}
+	kept := []string{}
+	for _, name := range external {
+		target := oldTargets.Signed.Targets[name]
+		if target == nil || newTargets.Signed.Targets[name] != nil {
+			continue
+		}
+		newTargets.Signed.Targets[name] = target
+		kept = append(kept, name)
+	}
+	if targetsCustom(newTargets) == nil {
+		for name, field := range targetsCustom(oldTargets) {
+			if err = setTargetsCustom(newTargets, name, field); err != nil {
+				return nil, fmt.Errorf("fail to copy targets custom metadata: %w", err)
+			}
+		}
+	}
+	if err = setExternalTargets(newTargets, slices.Clone(kept)); err != nil {
+		return nil, err
+	}
+	return kept, nil
+}
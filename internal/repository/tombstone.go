@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Key of the targets custom metadata (signed.custom) holding the tombstones.
+const yankedKey = "yanked"
+
+// Record of a yanked target, signed with the targets metadata: clients that
+// cached it can tell a yank from a removal, and its content may never be a
+// target again.
+type tombstone struct {
+	Path   string          `json:"path"`
+	Length int64           `json:"length"`
+	Hashes metadata.Hashes `json:"hashes"`
+	Reason string          `json:"reason"`
+	Time   time.Time       `json:"time"`
+}
+
+// Target whose content was yanked.
+type yankedTarget struct {
+	Path   string `json:"path"`
+	Yanked string `json:"yanked"` // path of the tombstone
+	Reason string `json:"reason"`
+}
+
+// Custom metadata of the targets role, kept apart from the target files info.
+func targetsCustom(targets *metadata.Metadata[metadata.TargetsType]) map[string]any {
+	custom, _ := targets.Signed.UnrecognizedFields["custom"].(map[string]any)
+	return custom
+}
+
+// Tombstones recorded in the targets metadata, oldest first.
+func tombstones(targets *metadata.Metadata[metadata.TargetsType]) ([]tombstone, error) {
+	list := []tombstone{}
+	raw, ok := targetsCustom(targets)[yankedKey]
+	if !ok {
+		return list, nil
+	}
+	bytes, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(bytes, &list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid tombstones in targets metadata: %w", err)
+	}
+	return list, nil
+}
+
+// Record the tombstones in the targets metadata, other custom fields are
+// kept.
+func setTombstones(targets *metadata.Metadata[metadata.TargetsType], list []tombstone) error {
+	if err := setTargetsCustom(targets, yankedKey, list); err != nil {
+		return fmt.Errorf("fail to marshal tombstones: %w", err)
+	}
+	return nil
+}
+
+// Set key of the targets custom metadata to the JSON of value, other custom
+// fields are kept.
+func setTargetsCustom(targets *metadata.Metadata[metadata.TargetsType], key string, value any) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var raw any
+	if err = json.Unmarshal(bytes, &raw); err != nil {
+		return err
+	}
+	custom := map[string]any{}
+	for name, field := range targetsCustom(targets) {
+		custom[name] = field
+	}
+	custom[key] = raw
+	if targets.Signed.UnrecognizedFields == nil {
+		targets.Signed.UnrecognizedFields = map[string]any{}
+	}
+	targets.Signed.UnrecognizedFields["custom"] = custom
+	return nil
+}
+
+// Whether target has one of the hashes of t.
+func (t tombstone) matches(target *metadata.TargetFiles) bool {
+	for algorithm, digest := range t.Hashes {
+		if other, ok := target.Hashes[algorithm]; ok && bytes.Equal(digest, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets whose content was yanked, by path.
+func yankedTargets(list []tombstone, targets map[string]*metadata.TargetFiles) []yankedTarget {
+	found := []yankedTarget{}
+	for name, target := range targets {
+		for _, t := range list {
+			if t.matches(target) {
+				found = append(found, yankedTarget{Path: name, Yanked: t.Path, Reason: t.Reason})
+				break
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	return found
+}
+
+func describeYanked(found []yankedTarget) string {
+	items := []string{}
+	for _, y := range found {
+		if y.Path == y.Yanked {
+			items = append(items, fmt.Sprintf("%s (%s)", y.Path, y.Reason))
+		} else {
+			items = append(items, fmt.Sprintf("%s (yanked as %s: %s)", y.Path, y.Yanked, y.Reason))
+		}
+	}
+	return strings.Join(items, ", ")
+}
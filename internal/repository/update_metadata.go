@@ -6,24 +6,33 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"log/slog"
-	"os"
-	"path/filepath"
 	"slices"
-	"text/tabwriter"
 
-	"see_updater/internal/pkg/cli"
 	"see_updater/internal/pkg/cryptography"
 	"see_updater/internal/pkg/datetime"
 	"see_updater/internal/pkg/filesystem"
 	"see_updater/internal/pkg/logging"
 	"see_updater/internal/pkg/metahelper"
+	"see_updater/internal/pkg/publish"
 
 	"github.com/sigstore/sigstore/pkg/signature"
 	"github.com/theupdateframework/go-tuf/v2/metadata"
 	"github.com/theupdateframework/go-tuf/v2/metadata/repository"
 )
 
-func updateMetadata(config configUpdate) error {
+// Top-level roles of a repository, as made by repository.New.
+type roleSet interface {
+	Root() *metadata.Metadata[metadata.RootType]
+	SetRoot(meta *metadata.Metadata[metadata.RootType])
+	Targets(name string) *metadata.Metadata[metadata.TargetsType]
+	SetTargets(name string, meta *metadata.Metadata[metadata.TargetsType])
+	Snapshot() *metadata.Metadata[metadata.SnapshotType]
+	SetSnapshot(meta *metadata.Metadata[metadata.SnapshotType])
+	Timestamp() *metadata.Metadata[metadata.TimestampType]
+	SetTimestamp(meta *metadata.Metadata[metadata.TimestampType])
+}
+
+func updateMetadata(config configUpdate, out *cmdOutput) error {
 	// Append context to logger
 	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
 		slog.String("repository_dir", config.repositoryDir),
@@ -35,63 +44,131 @@ func updateMetadata(config configUpdate) error {
 		slog.Bool("ask_confirmation", config.askConfirmation),
 	))
 
+	roles, newChanges, scan, err := newUpdateRoles(ctx, config)
+	if err != nil {
+		return err
+	}
+	sources, err := config.scan.sources(config.repositoryDir, scan)
+	if err != nil {
+		return err
+	}
+
+	// Show changes and ask user confirmation to continue the update operation
+	printTargetChanges(out, targetChanges(newChanges))
+	printScanReport(out, scan.Skipped, scan.Hardlinks)
+	if err = checkRemovals(out.result.Changes, config.failOnRemoval); err != nil {
+		return err
+	}
+	if config.askConfirmation {
+		if err = out.confirmer.Confirm(); err != nil {
+			return fmt.Errorf("fail to confirm operation: %w", err)
+		}
+	}
+	return signUpdate(ctx, UpdateVerb, config, roles, sources, out)
+}
+
+// New, unsigned targets, snapshot and timestamp metadata for the target files
+// of the repository dir. Returns the roles (with the current root), the
+// changes from the current targets and the scan result.
+// With --migrate-paths the current targets are renamed instead, see
+// configScan.migrate.
+func newUpdateRoles(ctx context.Context, config configUpdate) (roleSet, []metahelper.TargetChange, filesystem.ScanResult, error) {
+	var scan filesystem.ScanResult
+	roles, changes, err := nextTargetsRoles(ctx, config.metadataDir, config.expireIn, func(oldTargets *metadata.Metadata[metadata.TargetsType]) (*metadata.Metadata[metadata.TargetsType], error) {
+		var newTargets *metadata.Metadata[metadata.TargetsType]
+		var err error
+		if config.migratePaths {
+			var unmatched []string
+			newTargets, scan, unmatched, err = config.scan.migrate(config.repositoryDir, oldTargets)
+			if len(unmatched) > 0 {
+				slog.WarnContext(ctx, "targets not found in the repository dir kept their path", slog.Any("targets", unmatched))
+			}
+		} else {
+			// Generate new target metadata files from files in directory
+			newTargets, scan, err = config.scan.targets(config.repositoryDir, datetime.ExpireIn(7))
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to generate targets from repository dir", slog.Any("error", err))
+			return nil, err
+		}
+		if !config.migratePaths {
+			// Targets added from elsewhere have no file in the repository dir
+			kept, err := keepExternalTargets(oldTargets, newTargets)
+			if err != nil {
+				return nil, err
+			}
+			if len(kept) > 0 {
+				slog.InfoContext(ctx, "targets added from elsewhere kept", slog.Any("targets", kept))
+			}
+		}
+		return newTargets, nil
+	})
+	return roles, changes, scan, err
+}
+
+// Load the metadata files of metadataDir, verify them and make the next,
+// unsigned targets (by newTargets from the current ones), snapshot and
+// timestamp metadata. Returns the roles (with the current root) and the
+// changes from the current targets.
+func nextTargetsRoles(ctx context.Context, metadataDir string, expireIn uint16,
+	newTargets func(*metadata.Metadata[metadata.TargetsType]) (*metadata.Metadata[metadata.TargetsType], error)) (roleSet, []metahelper.TargetChange, error) {
 	roles := repository.New()
 
 	// Load old metadata files for all roles from files
-	root := metadata.Root(datetime.ExpireIn(int(config.expireIn)))
+	root := metadata.Root(datetime.ExpireIn(int(expireIn)))
 	roles.SetRoot(root)
-	rootFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(config.metadataDir, Root)
+	rootFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, Root)
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata filepaths", slog.Any("error", err), slog.String("role", Root))
-		return fmt.Errorf("fail to load metadata filepaths: %w", err)
+		return nil, nil, fmt.Errorf("fail to load metadata filepaths: %w", err)
 	}
 	_, err = roles.Root().FromFile(rootFilepaths[len(rootFilepaths)-1])
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata from file", slog.Any("error", err), slog.String("role", Root))
-		return fmt.Errorf("fail to load metadata from file: %w", err)
+		return nil, nil, fmt.Errorf("fail to load metadata from file: %w", err)
 	}
 
 	// Load old targets metadata file
-	targets := metadata.Targets(datetime.ExpireIn(int(config.expireIn)))
+	targets := metadata.Targets(datetime.ExpireIn(int(expireIn)))
 	roles.SetTargets(Targets, targets)
-	targetMetadataFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(config.metadataDir, Targets)
+	targetMetadataFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, Targets)
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata filepaths", slog.Any("error", err), slog.String("role", Targets))
-		return fmt.Errorf("fail to load metadata filepaths: %w", err)
+		return nil, nil, fmt.Errorf("fail to load metadata filepaths: %w", err)
 	}
 	oldTargets, err := roles.Targets(Targets).FromFile(targetMetadataFilepaths[len(targetMetadataFilepaths)-1])
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata from file", slog.Any("error", err), slog.String("role", Targets))
-		return fmt.Errorf("fail to load metadata from file: %w", err)
+		return nil, nil, fmt.Errorf("fail to load metadata from file: %w", err)
 	}
 
 	// Load old snapshot metadata file
-	snapshot := metadata.Snapshot(datetime.ExpireIn(int(config.expireIn)))
+	snapshot := metadata.Snapshot(datetime.ExpireIn(int(expireIn)))
 	roles.SetSnapshot(snapshot)
-	snapshotMetadataFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(config.metadataDir, Snapshot)
+	snapshotMetadataFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, Snapshot)
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata filepaths", slog.Any("error", err), slog.String("role", Snapshot))
-		return fmt.Errorf("fail to load metadata filepaths: %w", err)
+		return nil, nil, fmt.Errorf("fail to load metadata filepaths: %w", err)
 	}
 	oldSnapshot, err := roles.Snapshot().FromFile(snapshotMetadataFilepaths[len(snapshotMetadataFilepaths)-1])
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata from file", slog.Any("error", err), slog.String("role", Snapshot))
-		return fmt.Errorf("fail to load snapshot metadata from file: %w", err)
+		return nil, nil, fmt.Errorf("fail to load snapshot metadata from file: %w", err)
 	}
 
 	// Load old timestamp metadata file
-	timestamp := metadata.Timestamp(datetime.ExpireIn(int(config.expireIn)))
+	timestamp := metadata.Timestamp(datetime.ExpireIn(int(expireIn)))
 	roles.SetTimestamp(timestamp)
-	timestampMetadataFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(config.metadataDir, Timestamp)
+	timestampMetadataFilepaths, err := metahelper.GetRoleMetadataFilepathsFromDir(metadataDir, Timestamp)
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata filepaths", slog.Any("error", err), slog.String("role", Timestamp))
-		return fmt.Errorf("fail to load metadata filepaths: %w", err)
+		return nil, nil, fmt.Errorf("fail to load metadata filepaths: %w", err)
 
 	}
 	oldTimestamp, err := roles.Timestamp().FromFile(timestampMetadataFilepaths[len(timestampMetadataFilepaths)-1])
 	if err != nil {
 		slog.ErrorContext(ctx, "fail to load metadata from file", slog.Any("error", err), slog.String("role", Timestamp))
-		return fmt.Errorf("fail to load timestamp metadata from file: %w", err)
+		return nil, nil, fmt.Errorf("fail to load timestamp metadata from file: %w", err)
 	}
 
 	// Verify older version before proceeding to write the newer version
@@ -103,7 +180,7 @@ func updateMetadata(config configUpdate) error {
 				slog.ErrorContext(ctx, "fail to verify metadata signature for previous version",
 					slog.Any("error", err), slog.String("role", name))
 				slog.Info("Update aborted and no changes were made")
-				return fmt.Errorf("fail to verify TARGETS metadata signature for PREVIOUS version: %w", err)
+				return nil, nil, fmt.Errorf("fail to verify TARGETS metadata signature for PREVIOUS version: %w", err)
 
 			}
 		case Snapshot:
@@ -112,7 +189,7 @@ func updateMetadata(config configUpdate) error {
 				slog.ErrorContext(ctx, "fail to verify metadata signature for previous version",
 					slog.Any("error", err), slog.String("role", name))
 				slog.Info("Update aborted and no changes were made")
-				return fmt.Errorf("fail to verify SNAPSHOT metadata signature for PREVIOUS version: %w", err)
+				return nil, nil, fmt.Errorf("fail to verify SNAPSHOT metadata signature for PREVIOUS version: %w", err)
 
 			}
 		case Timestamp:
@@ -121,7 +198,7 @@ func updateMetadata(config configUpdate) error {
 				slog.ErrorContext(ctx, "fail to verify metadata signature for previous version",
 					slog.Any("error", err), slog.String("role", name))
 				slog.Info("Update aborted and no changes were made")
-				return fmt.Errorf("fail to verify TIMESTAMP metadata signature for PREVIOUS version: %w", err)
+				return nil, nil, fmt.Errorf("fail to verify TIMESTAMP metadata signature for PREVIOUS version: %w", err)
 
 			}
 		case Root:
@@ -130,20 +207,53 @@ func updateMetadata(config configUpdate) error {
 				slog.ErrorContext(ctx, "fail to verify metadata signature for previous version",
 					slog.Any("error", err), slog.String("role", name))
 				slog.Info("Update aborted and no changes were made")
-				return fmt.Errorf("fail to verify ROOT metadata signature for PREVIOUS version: %w", err)
+				return nil, nil, fmt.Errorf("fail to verify ROOT metadata signature for PREVIOUS version: %w", err)
 			}
 		}
 	}
 
-	// Generate new target metadata files from files in directory
-	newTargets, err := metahelper.GenerateNewTargetsFromDir(config.repositoryDir, datetime.ExpireIn(7))
+	nextTargets, err := newTargets(oldTargets)
 	if err != nil {
-		slog.ErrorContext(ctx, err.Error())
-		return err
+		return nil, nil, err
+	}
+	// Targets made from the repository dir keep the channels (see channel.go)
+	// and the tombstones of the yanked targets
+	if nextTargets.Signed.Delegations == nil {
+		nextTargets.Signed.Delegations = oldTargets.Signed.Delegations
+	}
+	if custom := targetsCustom(oldTargets); custom != nil && targetsCustom(nextTargets) == nil {
+		if nextTargets.Signed.UnrecognizedFields == nil {
+			nextTargets.Signed.UnrecognizedFields = map[string]any{}
+		}
+		nextTargets.Signed.UnrecognizedFields["custom"] = custom
+	}
+	// Removed targets are no longer external
+	external, err := externalTargets(nextTargets)
+	if err != nil {
+		return nil, nil, err
+	}
+	present := slices.DeleteFunc(slices.Clone(external), func(name string) bool { return nextTargets.Signed.Targets[name] == nil })
+	if len(present) != len(external) {
+		if err = setExternalTargets(nextTargets, present); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = checkChannelNamespace(nextTargets, ""); err != nil {
+		slog.ErrorContext(ctx, "target in the namespace of a channel", slog.Any("error", err))
+		return nil, nil, err
+	}
+	list, err := tombstones(nextTargets)
+	if err != nil {
+		return nil, nil, err
+	}
+	if found := yankedTargets(list, nextTargets.Signed.Targets); len(found) > 0 {
+		slog.ErrorContext(ctx, "yanked content in the new targets", slog.Any("targets", found))
+		return nil, nil, fmt.Errorf("%w: %d targets have the content of a yanked target, remove or exclude them from the repository dir: %s",
+			ErrVerification, len(found), describeYanked(found))
 	}
 
 	// Compare new and old versions
-	newChanges := metahelper.CompareNewOldTargets(newTargets, oldTargets, true)
+	newChanges := metahelper.CompareNewOldTargets(nextTargets, oldTargets, true)
 
 	// Check if no new changes and abort
 	// if (len(newChanges) == 0) {
@@ -151,40 +261,45 @@ func updateMetadata(config configUpdate) error {
 	// 	return
 	// }
 
-	// Show changes and ask user confirmation to continue the update operation
-	fmt.Printf("A total of %d new changes detected:\n", len(newChanges))
-	w := tabwriter.NewWriter(os.Stdout, 1, 2, 1, ' ', 0)
-	fmt.Fprintln(w, "\tNo.\tFilepath\tLength (old -> new)")
-	for i, change := range newChanges {
-		fmt.Fprintf(w, "\t%d.\t%s\t%d\t->\t%d\n", i+1, change.New.Path, change.Old.Length, change.New.Length)
-	}
-	w.Flush()
-	if config.askConfirmation && !cli.AskConfirmation(3) {
-		return fmt.Errorf("fail to confirm operation")
-	}
-
 	// Clear old signatures, update roles info, bump version
 	roleNames := []string{Targets, Snapshot, Timestamp} // root metadata won't be touched
 	for _, name := range roleNames {
 		switch name {
 		case Targets:
 			roles.Targets(Targets).ClearSignatures()
-			roles.SetTargets(Targets, newTargets)
+			roles.SetTargets(Targets, nextTargets)
 			roles.Targets(Targets).Signed.Version = oldTargets.Signed.Version + 1
-			roles.Targets(Targets).Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+			roles.Targets(Targets).Signed.Expires = datetime.ExpireIn(int(expireIn))
 		case Snapshot:
 			roles.Snapshot().ClearSignatures()
 			roles.Snapshot().Signed.Meta[Targets+".json"] = metadata.MetaFile(roles.Targets(Targets).Signed.Version)
 			roles.Snapshot().Signed.Version += 1
-			roles.Snapshot().Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+			roles.Snapshot().Signed.Expires = datetime.ExpireIn(int(expireIn))
 		case Timestamp:
 			roles.Timestamp().ClearSignatures()
 			roles.Timestamp().Signed.Meta[Snapshot+".json"] = metadata.MetaFile(roles.Snapshot().Signed.Version)
 			roles.Timestamp().Signed.Version += 1
-			roles.Timestamp().Signed.Expires = datetime.ExpireIn(int(config.expireIn))
+			roles.Timestamp().Signed.Expires = datetime.ExpireIn(int(expireIn))
 		}
 	}
 
+	return roles, newChanges, nil
+}
+
+// Sign the new roles with the keys of config and write them to the metadata
+// dir. Asks for confirmation if the thresholds are not met. The target files
+// are published from sources (target name -> content) beforehand, see
+// configPublish.
+func signUpdate(ctx context.Context, verb string, config configUpdate, roles roleSet, sources map[string]publish.Source, out *cmdOutput) error {
+	roleNames := []string{Targets, Snapshot, Timestamp} // root metadata won't be touched
+	hashed, err := metaHashes(config.metaHashes)
+	if err != nil {
+		return err
+	}
+	if hashed, err = keptMetaHashes(config.metadataDir, hashed); err != nil {
+		return err
+	}
+
 	// Load keys for signing
 	keys := map[string]*rsa.PrivateKey{}
 	for _, name := range roleNames {
@@ -225,8 +340,13 @@ func updateMetadata(config configUpdate) error {
 		}
 	}
 
-	// Signing
+	// Signing, in order: snapshot and timestamp may record the hashes of the
+	// signed targets and snapshot
 	for _, name := range roleNames {
+		if err = setMetaFile(roles, name, slices.Contains(hashed, name)); err != nil {
+			slog.ErrorContext(ctx, "fail to update meta", slog.Any("error", err), slog.String("role", name))
+			return err
+		}
 		key := keys[name]
 		if key == nil {
 			slog.InfoContext(ctx, fmt.Sprintf("No key provided for role: %s, skipping signing operation\n", name))
@@ -297,11 +417,13 @@ func updateMetadata(config configUpdate) error {
 			// Two scenarios:
 			// 1. User used the RIGHT key to sign, but total RIGHT signature < threshold
 			// 2. User used the WRONG key to sign, total RIGHT signature < threshold
-			fmt.Println("Please make sure that the right keys were used, otherwise please perform additional signing to meet the threshold")
-			fmt.Println("Program will now proceed to write the signature to the metadata file (irreversible)")
-			if config.askConfirmation && !cli.AskConfirmation(3) {
-				fmt.Println("Operation aborted, no changes were made")
-				return fmt.Errorf("fail to confirm operation")
+			fmt.Fprintln(out.text, "Please make sure that the right keys were used, otherwise please perform additional signing to meet the threshold")
+			fmt.Fprintln(out.text, "Program will now proceed to write the signature to the metadata file (irreversible)")
+			if config.askConfirmation {
+				if err = out.confirmer.Confirm(); err != nil {
+					fmt.Fprintln(out.text, "Operation aborted, no changes were made")
+					return fmt.Errorf("fail to confirm operation: %w", err)
+				}
 			}
 		}
 	}
@@ -313,30 +435,30 @@ func updateMetadata(config configUpdate) error {
 	if err != nil {
 		return (err)
 	}
-	succeededWrites := []string{} // To removed written files in case of error
+	// Clients must find the target files once the metadata is written
+	if err = config.publish.publish(ctx, roles, sources, out); err != nil {
+		return err
+	}
+	// All or none of the files are written
+	files := []metadataFile{}
 	for _, name := range roleNames {
-		filename := ""
 		switch name {
 		case Targets:
-			filename = fmt.Sprintf("%d.%s.json", roles.Targets(Targets).Signed.Version, name)
-			err = roles.Targets(Targets).ToFile(filepath.Join(config.metadataDir, filename), true)
+			files = append(files, metadataFile{fmt.Sprintf("%d.%s.json", roles.Targets(Targets).Signed.Version, name),
+				func(path string) error { return roles.Targets(Targets).ToFile(path, true) }})
 		case Snapshot:
-			filename = fmt.Sprintf("%d.%s.json", roles.Snapshot().Signed.Version, name)
-			err = roles.Snapshot().ToFile(filepath.Join(config.metadataDir, filename), true)
+			files = append(files, metadataFile{fmt.Sprintf("%d.%s.json", roles.Snapshot().Signed.Version, name),
+				func(path string) error { return roles.Snapshot().ToFile(path, true) }})
 		case Timestamp:
-			filename = fmt.Sprintf("%s.json", name)
-			err = roles.Timestamp().ToFile(filepath.Join(config.metadataDir, filename), true)
+			files = append(files, metadataFile{fmt.Sprintf("%s.json", name),
+				func(path string) error { return roles.Timestamp().ToFile(path, true) }})
 		}
-
-		if err != nil {
-			for _, path := range succeededWrites {
-				filesystem.Remove(path)
-			}
-			slog.ErrorContext(ctx, "fail to save metadata to file", slog.Any("error", err), slog.String("role", name))
-			slog.InfoContext(ctx, "all generated metadata files removed")
-			return fmt.Errorf("fail to save metadata to file\n\terror: %w", err)
-		}
-		succeededWrites = append(succeededWrites, filepath.Join(config.metadataDir, filename))
 	}
+	if err = writeMetadataFiles(config.metadataDir, verb, files); err != nil {
+		slog.ErrorContext(ctx, "fail to save metadata to file", slog.Any("error", err))
+		slog.InfoContext(ctx, "no metadata file was written")
+		return fmt.Errorf("fail to save metadata to file\n\terror: %w", err)
+	}
+	config.publish.prune(ctx, roles, out)
 	return nil
 }
@@ -0,0 +1,319 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/logging"
+	"see_updater/internal/pkg/metahelper"
+	"see_updater/internal/pkg/publish"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/repository"
+)
+
+const updatePlanFormat = 1
+
+// Target update made by `update plan` for review, signed and written by
+// `update apply`. The payloads are the new metadata without signatures.
+type updatePlan struct {
+	Format        int                      `json:"format"`
+	CreatedAt     time.Time                `json:"created_at"`
+	RepositoryDir string                   `json:"repository_dir"`
+	MetadataDir   string                   `json:"metadata_dir"`
+	Base          map[string]string        `json:"base"` // metadata filename -> sha256 of the files the plan was made from
+	Changes       []targetChange           `json:"changes"`
+	Skipped       []filesystem.SkippedFile `json:"skipped,omitempty"`   // left out of the scan
+	Hardlinks     [][]string               `json:"hardlinks,omitempty"` // groups of scanned files hardlinked together
+	// Contents of the targets by name, to publish them (consistent snapshots
+	// only). Paths are relative so that the plan can be applied elsewhere.
+	Sources   map[string]planSource `json:"sources,omitempty"`
+	Targets   json.RawMessage       `json:"targets"`
+	Snapshot  json.RawMessage       `json:"snapshot"`
+	Timestamp json.RawMessage       `json:"timestamp"`
+}
+
+// Content of a planned target, found again by `update apply` in its
+// --repository-dir.
+type planSource struct {
+	Path string `json:"path,omitempty"` // relative to the repository dir, '/'-separated
+	Data []byte `json:"data,omitempty"` // recorded symlinks: the link target
+}
+
+// Write the plan of an update of the metadata dir with the target files of the
+// repository dir, nothing is signed and the metadata dir is left untouched.
+func planUpdate(config configUpdatePlan, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("repository_dir", config.repositoryDir),
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("plan_filepath", config.planFilepath),
+		slog.Int("expire_in", int(config.expireIn)),
+	))
+
+	roles, newChanges, scan, err := newUpdateRoles(ctx, configUpdate{
+		repositoryDir: config.repositoryDir,
+		metadataDir:   config.metadataDir,
+		expireIn:      config.expireIn,
+		migratePaths:  config.migratePaths,
+		scan:          config.scan,
+	})
+	if err != nil {
+		return err
+	}
+	printTargetChanges(out, targetChanges(newChanges))
+	printScanReport(out, scan.Skipped, scan.Hardlinks)
+	if err = checkRemovals(out.result.Changes, config.failOnRemoval); err != nil {
+		return err
+	}
+
+	var sources map[string]planSource
+	if roles.Root().Signed.ConsistentSnapshot {
+		prefix, err := config.scan.prefix(config.repositoryDir)
+		if err != nil {
+			return err
+		}
+		sources = map[string]planSource{}
+		for _, file := range scan.Files {
+			source := planSource{Path: file.Path}
+			if file.Symlink != "" {
+				source = planSource{Data: []byte(file.Symlink)}
+			}
+			sources[metahelper.TargetPath(prefix, file.Path)] = source
+		}
+	}
+
+	base, err := metadataDigests(config.metadataDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to hash metadata files", slog.Any("error", err))
+		return err
+	}
+	plan := updatePlan{
+		Format:        updatePlanFormat,
+		CreatedAt:     time.Now().UTC(),
+		RepositoryDir: config.repositoryDir,
+		MetadataDir:   config.metadataDir,
+		Base:          base,
+		Changes:       out.result.Changes,
+		Skipped:       scan.Skipped,
+		Hardlinks:     scan.Hardlinks,
+		Sources:       sources,
+	}
+	if plan.Targets, err = roles.Targets(Targets).ToBytes(false); err == nil {
+		if plan.Snapshot, err = roles.Snapshot().ToBytes(false); err == nil {
+			plan.Timestamp, err = roles.Timestamp().ToBytes(false)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to serialize metadata", slog.Any("error", err))
+		return fmt.Errorf("fail to serialize metadata: %w", err)
+	}
+	bytes, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("fail to marshal plan: %w", err)
+	}
+	if err = filesystem.WriteBytesToFile(config.planFilepath, bytes); err != nil {
+		slog.ErrorContext(ctx, "fail to write plan", slog.Any("error", err))
+		return fmt.Errorf("fail to write plan %s: %w", config.planFilepath, err)
+	}
+
+	out.result.Versions = map[string]int64{
+		Targets:   roles.Targets(Targets).Signed.Version,
+		Snapshot:  roles.Snapshot().Signed.Version,
+		Timestamp: roles.Timestamp().Signed.Version,
+	}
+	out.result.Data = map[string]string{"plan": config.planFilepath}
+	fmt.Fprintf(out.text, "Plan written to: %s, sign and write it with `%s %s`\n", config.planFilepath, UpdateVerb, UpdateApplyVerb)
+	return nil
+}
+
+// Sign the metadata of a plan and write it to the metadata dir. Refuses with
+// ErrPlanOutdated if the metadata files changed since the plan was made.
+func applyUpdate(config configUpdateApply, out *cmdOutput) error {
+	// Append context to logger
+	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
+		slog.String("plan_filepath", config.planFilepath),
+		slog.String("metadata_dir", config.metadataDir),
+		slog.String("targets_privkey_filepath", config.targetsPrivkeyFilepath),
+		slog.String("snapshot_privkey_filepath", config.snapshotPrivkeyFilepath),
+		slog.String("timestamp_privkey_filepath", config.timestampPrivkeyFilepath),
+		slog.Bool("ask_confirmation", config.askConfirmation),
+	))
+
+	bytes, err := filesystem.ReadBytesFromFile(config.planFilepath)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to read plan", slog.Any("error", err))
+		return fmt.Errorf("fail to read plan %s: %w", config.planFilepath, err)
+	}
+	plan := updatePlan{}
+	if err = json.Unmarshal(bytes, &plan); err != nil {
+		return fmt.Errorf("%w: fail to parse plan %s: %w", ErrUsage, config.planFilepath, err)
+	}
+	if plan.Format != updatePlanFormat {
+		return fmt.Errorf("%w: unsupported plan format %d in %s", ErrUsage, plan.Format, config.planFilepath)
+	}
+
+	// The plan bumps the versions of the metadata it was made from
+	current, err := metadataDigests(config.metadataDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to hash metadata files", slog.Any("error", err))
+		return err
+	}
+	if changed := changedFilenames(plan.Base, current); len(changed) > 0 {
+		slog.ErrorContext(ctx, "metadata dir changed since the plan was made", slog.Any("files", changed))
+		return fmt.Errorf("%w (%s), make a new plan", ErrPlanOutdated, strings.Join(changed, ", "))
+	}
+
+	latest, err := loadChannelRoles(ctx, config.metadataDir, false)
+	if err != nil {
+		return err
+	}
+	roles := repository.New()
+	roles.SetRoot(latest.Root())
+	targets, err := metadata.Targets().FromBytes(plan.Targets)
+	if err == nil {
+		roles.SetTargets(Targets, targets)
+		var snapshot *metadata.Metadata[metadata.SnapshotType]
+		if snapshot, err = metadata.Snapshot().FromBytes(plan.Snapshot); err == nil {
+			roles.SetSnapshot(snapshot)
+			var timestamp *metadata.Metadata[metadata.TimestampType]
+			if timestamp, err = metadata.Timestamp().FromBytes(plan.Timestamp); err == nil {
+				roles.SetTimestamp(timestamp)
+			}
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "fail to load metadata from plan", slog.Any("error", err))
+		return fmt.Errorf("%w: fail to load metadata from plan %s: %w", ErrUsage, config.planFilepath, err)
+	}
+	if err = checkPlanVersions(latest, roles); err != nil {
+		slog.ErrorContext(ctx, "inconsistent plan", slog.Any("error", err))
+		return fmt.Errorf("%w, make a new plan", err)
+	}
+
+	// Show the changes of the targets to sign, the ones recorded in the plan
+	// are only for its review, and ask user confirmation to sign them
+	fmt.Fprintf(out.text, "Plan made at %s from %s\n", plan.CreatedAt.Format(time.RFC3339), plan.RepositoryDir)
+	printTargetChanges(out, targetChanges(metahelper.CompareNewOldTargets(targets, latest.Targets(Targets), true)))
+	printScanReport(out, plan.Skipped, plan.Hardlinks)
+	if err = checkRemovals(out.result.Changes, config.failOnRemoval); err != nil {
+		return err
+	}
+	sources, err := plan.sources(config)
+	if err != nil {
+		return err
+	}
+	if config.askConfirmation {
+		if err = out.confirmer.Confirm(); err != nil {
+			return fmt.Errorf("fail to confirm operation: %w", err)
+		}
+	}
+	return signUpdate(ctx, UpdateVerb, configUpdate{
+		metadataDir:              config.metadataDir,
+		targetsPrivkeyFilepath:   config.targetsPrivkeyFilepath,
+		snapshotPrivkeyFilepath:  config.snapshotPrivkeyFilepath,
+		timestampPrivkeyFilepath: config.timestampPrivkeyFilepath,
+		askConfirmation:          config.askConfirmation,
+		metaHashes:               config.metaHashes,
+		publish:                  config.publish,
+	}, roles, sources, out)
+}
+
+// Sources of the planned targets in the repository dir given to apply, read
+// from object storage if remote. None are needed without a publish dir.
+func (p updatePlan) sources(config configUpdateApply) (map[string]publish.Source, error) {
+	if config.publish.dir == "" || len(p.Sources) == 0 {
+		return nil, nil
+	}
+	if config.repositoryDir == "" {
+		return nil, fmt.Errorf("%w: the plan publishes target files to --%s, give the --%s they were planned from",
+			ErrUsage, PublishDir, UpdateRepositoryDir)
+	}
+	sources := map[string]publish.Source{}
+	for name, source := range p.Sources {
+		rel := source.Path
+		switch {
+		case source.Data != nil:
+			sources[name] = publish.Source{Data: source.Data}
+		case config.remote != nil:
+			sources[name] = publish.Source{Open: func() (io.ReadCloser, error) { return config.remote.open(rel) }}
+		default:
+			sources[name] = publish.Source{Path: filepath.Join(config.repositoryDir, filepath.FromSlash(rel))}
+		}
+	}
+	return sources, nil
+}
+
+// Refuse a plan whose metadata does not bump the current versions by one, or
+// whose snapshot and timestamp do not reference the targets and snapshot it
+// carries, e.g. a plan edited after its review.
+func checkPlanVersions(current roleSet, plan roleSet) error {
+	problems := []string{}
+	for _, v := range []struct {
+		role             string
+		current, planned int64
+	}{
+		{Targets, current.Targets(Targets).Signed.Version, plan.Targets(Targets).Signed.Version},
+		{Snapshot, current.Snapshot().Signed.Version, plan.Snapshot().Signed.Version},
+		{Timestamp, current.Timestamp().Signed.Version, plan.Timestamp().Signed.Version},
+	} {
+		if v.planned != v.current+1 {
+			problems = append(problems, fmt.Sprintf("%s version %d does not follow %d", v.role, v.planned, v.current))
+		}
+	}
+	if meta := plan.Snapshot().Signed.Meta[Targets+".json"]; meta == nil || meta.Version != plan.Targets(Targets).Signed.Version {
+		problems = append(problems, fmt.Sprintf("snapshot does not reference targets version %d", plan.Targets(Targets).Signed.Version))
+	}
+	if meta := plan.Timestamp().Signed.Meta[Snapshot+".json"]; meta == nil || meta.Version != plan.Snapshot().Signed.Version {
+		problems = append(problems, fmt.Sprintf("timestamp does not reference snapshot version %d", plan.Snapshot().Signed.Version))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: inconsistent plan, %s", ErrVerification, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Hex sha256 of every metadata file of dir, by filename.
+func metadataDigests(dir string) (map[string]string, error) {
+	contents, err := readMetadataDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]string{}
+	for filename, content := range contents {
+		sum := sha256.Sum256(content)
+		digests[filename] = hex.EncodeToString(sum[:])
+	}
+	return digests, nil
+}
+
+// Filenames added, removed or modified between two sets of digests, sorted.
+func changedFilenames(before map[string]string, after map[string]string) []string {
+	if maps.Equal(before, after) {
+		return nil
+	}
+	changed := []string{}
+	for filename, digest := range before {
+		if after[filename] != digest {
+			changed = append(changed, filename)
+		}
+	}
+	for filename := range after {
+		if _, ok := before[filename]; !ok {
+			changed = append(changed, filename)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
@@ -2,13 +2,16 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
+	"sort"
+	"strings"
 	"text/tabwriter"
 	"time"
 
 	"see_updater/internal/pkg/datetime"
+	"see_updater/internal/pkg/filesystem"
 	"see_updater/internal/pkg/logging"
 	"see_updater/internal/pkg/metahelper"
 
@@ -31,7 +34,15 @@ type verResult struct {
 
 type verResults map[string]verResult
 
-func verifyMetadata(config configVerify) error {
+func (r verResult) toRoleVerification(role string) roleVerification {
+	v := roleVerification{Role: role, Filepath: r.filepath, Threshold: r.threshold, Expires: r.expirationDate, Valid: r.valid}
+	for _, err := range r.errorMessages {
+		v.Errors = append(v.Errors, err.Error())
+	}
+	return v
+}
+
+func verifyMetadata(config configVerify, out *cmdOutput) error {
 	// Append context to logger
 	ctx := logging.AppendCtx(context.Background(), slog.Group("config",
 		slog.String("metadata_dir", config.metadataDir),
@@ -121,6 +132,36 @@ func verifyMetadata(config configVerify) error {
 		verResults[name] = entry
 	}
 
+	// Bytes of the files, snapshot and timestamp may record the length and
+	// hashes of the file they reference
+	fileBytes := map[string][]byte{}
+	for name, path := range map[string]string{
+		Targets:   targetMetadataFilepaths[len(targetMetadataFilepaths)-1],
+		Snapshot:  snapshotMetadataFilepaths[len(snapshotMetadataFilepaths)-1],
+		Timestamp: timestampMetadataFilepaths[len(timestampMetadataFilepaths)-1],
+	} {
+		if fileBytes[name], err = filesystem.ReadBytesFromFile(path); err != nil {
+			slog.ErrorContext(ctx, "fail to read metadata file", slog.Any("error", err), slog.String("role", name))
+			return fmt.Errorf("fail to read metadata file: %w", err)
+		}
+	}
+	for name, meta := range map[string]*metadata.MetaFiles{
+		Snapshot:  roles.Snapshot().Signed.Meta[Targets+".json"],
+		Timestamp: roles.Timestamp().Signed.Meta[Snapshot+".json"],
+	} {
+		if !isHashedMeta(meta) {
+			continue
+		}
+		referenced := referencedRole(name)
+		if err = checkMetaFile(referenced+".json", meta, fileBytes[referenced]); err != nil {
+			slog.Warn("referenced metadata file does not match", slog.Any("error", err), slog.String("role", name))
+			entry := verResults[name]
+			entry.errorMessages = append(entry.errorMessages, err)
+			entry.valid = false
+			verResults[name] = entry
+		}
+	}
+
 	// Verify
 	for _, name := range []string{Root, Timestamp, Snapshot, Targets} { // The ordering is IMPORTANT root > timestamp > snapshot > targets
 		entry := verResults[name]
@@ -134,7 +175,7 @@ func verifyMetadata(config configVerify) error {
 			}
 			if isExp := roles.Targets(Targets).Signed.IsExpired(time.Now()); isExp {
 				slog.Warn("targets metadata expired", slog.Any("valid_until", verResults[name].expirationDate))
-				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("TARGETS metadata expired"))
+				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("TARGETS %w", ErrExpired))
 				entry.valid = false
 			}
 		case Snapshot:
@@ -146,7 +187,7 @@ func verifyMetadata(config configVerify) error {
 			}
 			if isExp := roles.Snapshot().Signed.IsExpired(time.Now()); isExp {
 				slog.Warn("snapshot metadata expired", slog.Any("valid_until", verResults[name].expirationDate))
-				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("SNAPSHOT metadata expired"))
+				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("SNAPSHOT %w", ErrExpired))
 				entry.valid = false
 			}
 		case Timestamp:
@@ -158,7 +199,7 @@ func verifyMetadata(config configVerify) error {
 			}
 			if isExp := roles.Timestamp().Signed.IsExpired(time.Now()); isExp {
 				slog.Warn("timestamp metadata expired", slog.Any("valid_until", verResults[name].expirationDate))
-				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("TIMESTAMP metadata expired"))
+				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("TIMESTAMP %w", ErrExpired))
 				entry.valid = false
 			}
 		case Root:
@@ -170,28 +211,64 @@ func verifyMetadata(config configVerify) error {
 			}
 			if isExp := roles.Root().Signed.IsExpired(time.Now()); isExp {
 				slog.Warn("root metadata expired", slog.Any("valid_until", verResults[name].expirationDate))
-				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("ROOT metadata expired"))
+				entry.errorMessages = append(entry.errorMessages, fmt.Errorf("ROOT %w", ErrExpired))
 				entry.valid = false
 			}
 		}
 		verResults[name] = entry
 	}
 
-	newTargets, err := metahelper.GenerateNewTargetsFromDir(config.repositoryDir, datetime.ExpireIn(placeholderExpireIn))
+	newTargets, scan, err := config.scan.targets(config.repositoryDir, datetime.ExpireIn(placeholderExpireIn))
 	if err != nil {
+		slog.ErrorContext(ctx, "fail to generate targets from repository dir", slog.Any("error", err))
 		return err
 	}
-	newChanges := metahelper.CompareNewOldTargets(newTargets, targets, true)
-	fmt.Printf("A total of %d new changes detected:\n", len(newChanges))
-	w := tabwriter.NewWriter(os.Stdout, 1, 2, 1, ' ', 0)
-	fmt.Fprintln(w, "\tNo.\tFilepath\tLength (old -> new)")
-	for i, change := range newChanges {
-		fmt.Fprintf(w, "\t%d.\t%s\t%d\t->\t%d\n", i+1, change.New.Path, change.Old.Length, change.New.Length)
+	if _, err = keepExternalTargets(targets, newTargets); err != nil {
+		return err
 	}
-	w.Flush()
+	algorithms, err := hashAlgorithms(config.scan.algorithms)
+	if err != nil {
+		return err
+	}
+	newChanges, unhashed := splitRehashed(metahelper.CompareNewOldTargets(newTargets, targets, true), algorithms)
+	printTargetChanges(out, targetChanges(newChanges))
+	printScanReport(out, scan.Skipped, scan.Hardlinks)
+	printUnhashed(out, unhashed)
 
-	var hasError = false
-	w = tabwriter.NewWriter(os.Stdout, 1, 2, 1, ' ', 0)
+	// The content of a yanked target may never be served again, by targets
+	// or by a channel
+	yanked, err := tombstones(targets)
+	if err != nil {
+		return err
+	}
+	served := map[string]*metadata.TargetFiles{}
+	for name, target := range targets.Signed.Targets {
+		served[name] = target
+	}
+	for _, channel := range channelNames(targets) {
+		paths, err := metahelper.GetRoleMetadataFilepathsFromDir(config.metadataDir, channel)
+		if err != nil {
+			return fmt.Errorf("fail to load metadata filepaths: %w", err)
+		}
+		channelTargets, err := metadata.Targets().FromFile(paths[len(paths)-1])
+		if err != nil {
+			return fmt.Errorf("fail to load metadata from file\n\terror: %w", err)
+		}
+		for name, target := range channelTargets.Signed.Targets {
+			served[name] = target
+		}
+	}
+	if found := yankedTargets(yanked, served); len(found) > 0 {
+		slog.Warn("yanked content served again", slog.Any("targets", found))
+		out.result.Yanked = found
+		entry := verResults[Targets]
+		entry.errorMessages = append(entry.errorMessages, fmt.Errorf("%d targets have the content of a yanked target: %s", len(found), describeYanked(found)))
+		entry.valid = false
+		verResults[Targets] = entry
+	}
+
+	errs := []error{}
+	w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
 	fmt.Fprintf(w, "\tNo.\tRole\tFilepath\tThreshold\tExpiration\tValid\tError(s)")
 	for i, name := range getRoles() {
 		verRes := verResults[name]
@@ -204,14 +281,25 @@ func verifyMetadata(config configVerify) error {
 			fmt.Fprintf(w, "%d. %v", j+1, errMsg)
 		}
 
-		if len(verRes.errorMessages) > 0 {
-			hasError = true
-		}
+		errs = append(errs, verRes.errorMessages...)
+		out.result.Verification = append(out.result.Verification, verRes.toRoleVerification(name))
 	}
 	w.Flush()
-	fmt.Printf("\n")
-	if hasError {
-		return fmt.Errorf("errors are printed above")
+	fmt.Fprintf(out.text, "\n")
+	if len(errs) > 0 {
+		// Signature errors are typed by go-tuf, see ExitCode
+		return fmt.Errorf("%w, errors are printed above: %w", ErrVerification, errors.Join(errs...))
+	}
+	if len(unhashed) > 0 {
+		return fmt.Errorf("%w: %d targets lack hashes of --%s, add them with `%s %s`", ErrVerification, len(unhashed), ScanHashAlgorithms, TargetVerb, TargetRehashVerb)
+	}
+	if found := yankedTargets(yanked, newTargets.Signed.Targets); len(found) > 0 {
+		out.result.Yanked = found
+		return fmt.Errorf("%w: %d files of the repository dir have the content of a yanked target, remove or exclude them: %s",
+			ErrVerification, len(found), describeYanked(found))
+	}
+	if err = checkRemovals(out.result.Changes, config.failOnRemoval); err != nil {
+		return err
 	}
 
 	// Begin trusted metadata verification workflow
@@ -228,36 +316,41 @@ func verifyMetadata(config configVerify) error {
 	}
 	slog.Info("Root trusted metadata verification PASSED, remaining: timestamp & snapshot & targets")
 
-	// TIMESTAMP
-	if timestampBytes, err := roles.Timestamp().ToBytes(true); err != nil {
-		slog.ErrorContext(ctx, "fail to convert timestamp into bytes for verification")
-	} else {
-		if _, err = trustedMetadata.UpdateTimestamp(timestampBytes); err != nil {
-			slog.ErrorContext(ctx, "fail to verify timestamp", slog.Any("error", err))
-			return err
-		}
+	// TIMESTAMP, from the bytes of the files like a client
+	if _, err = trustedMetadata.UpdateTimestamp(fileBytes[Timestamp]); err != nil {
+		slog.ErrorContext(ctx, "fail to verify timestamp", slog.Any("error", err))
+		return err
 	}
 	slog.Info("Root & timestamp trusted metadata verification PASSED, remaining: snapshot & targets")
 
 	// SNAPSHOT
-	if snapshotBytes, err := roles.Snapshot().ToBytes(true); err != nil {
-		slog.ErrorContext(ctx, "fail to convert snapshot into bytes for verification")
-	} else {
-		if _, err = trustedMetadata.UpdateSnapshot(snapshotBytes, false); err != nil {
-			slog.ErrorContext(ctx, "fail to verify snpashot", slog.Any("error", err))
-			return err
-		}
+	if _, err = trustedMetadata.UpdateSnapshot(fileBytes[Snapshot], false); err != nil {
+		slog.ErrorContext(ctx, "fail to verify snpashot", slog.Any("error", err))
+		return err
 	}
 	slog.Info("Root & timestamp & snapshot trusted metadata verification PASSED, remaining: targets")
 
 	// TARGETS
-	if targetsBytes, err := roles.Targets(Targets).ToBytes(true); err != nil {
-		slog.ErrorContext(ctx, "fail to convert targets into bytes for verification")
+	if _, err = trustedMetadata.UpdateTargets(fileBytes[Targets]); err != nil {
+		slog.ErrorContext(ctx, "fail to verify targets", slog.Any("error", err))
+		return err
+	}
 
-	} else {
-		if _, err = trustedMetadata.UpdateTargets(targetsBytes); err != nil {
-			slog.ErrorContext(ctx, "fail to verify targets", slog.Any("error", err))
-			return err
+	// CHANNELS, delegated by targets
+	for _, channel := range channelNames(targets) {
+		paths, err := metahelper.GetRoleMetadataFilepathsFromDir(config.metadataDir, channel)
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to load metadata filepaths", slog.Any("error", err), slog.String("role", channel))
+			return fmt.Errorf("fail to load metadata filepaths: %w", err)
+		}
+		bytes, err := filesystem.ReadBytesFromFile(paths[len(paths)-1])
+		if err != nil {
+			slog.ErrorContext(ctx, "fail to read metadata file", slog.Any("error", err), slog.String("role", channel))
+			return fmt.Errorf("fail to read metadata file: %w", err)
+		}
+		if _, err = trustedMetadata.UpdateDelegatedTargets(bytes, channel, Targets); err != nil {
+			slog.ErrorContext(ctx, "fail to verify channel", slog.Any("error", err), slog.String("role", channel))
+			return fmt.Errorf("channel %s: %w", channel, err)
 		}
 	}
 	slog.Info("All trusted metadata verification PASSED")
@@ -286,3 +379,40 @@ func verifyMetadata(config configVerify) error {
 
 	return nil
 }
+
+// Verify compares the hashes of the listed algorithms: drop the rehashed
+// targets from changes, and return the targets of the metadata lacking some of
+// algorithms, with the missing ones.
+func splitRehashed(changes []metahelper.TargetChange, algorithms []string) ([]metahelper.TargetChange, map[string][]string) {
+	kept := []metahelper.TargetChange{}
+	unhashed := map[string][]string{}
+	for _, change := range changes {
+		if change.Kind != metahelper.ChangeRehashed {
+			kept = append(kept, change)
+		} else if missing := metahelper.MissingHashes(&change.Old, algorithms); len(missing) > 0 {
+			unhashed[change.Path()] = missing
+		}
+	}
+	return kept, unhashed
+}
+
+// Print the targets lacking hashes and record them in the result document.
+// Prints nothing if there are none.
+func printUnhashed(out *cmdOutput, unhashed map[string][]string) {
+	if len(unhashed) == 0 {
+		return
+	}
+	out.result.Unhashed = unhashed
+	fmt.Fprintf(out.text, "A total of %d targets lack hashes\n", len(unhashed))
+	w := tabwriter.NewWriter(out.text, 1, 2, 1, ' ', 0)
+	fmt.Fprintln(w, "\tNo.\tFilepath\tMissing")
+	paths := []string{}
+	for path := range unhashed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		fmt.Fprintf(w, "\t%d.\t%s\t%s\n", i+1, path, strings.Join(unhashed[path], ", "))
+	}
+	w.Flush()
+}
@@ -0,0 +1,368 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"see_updater/internal/pkg/filesystem"
+	"see_updater/internal/pkg/hashcache"
+	"see_updater/internal/pkg/objectstore"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	workspaceDirname  = ".updater-repo"
+	workspaceFilename = "config.yaml"
+)
+
+// Workspace configuration written by init, paths are relative to the
+// workspace root (the directory containing .updater-repo) unless absolute.
+type workspaceConfig struct {
+	MetadataDir   string              `yaml:"metadata_dir"`
+	RepositoryDir string              `yaml:"repository_dir"`
+	Keys          map[string][]string `yaml:"keys"` // role -> private key filepaths
+	Expire        uint16              `yaml:"expire"`
+	// Hash algorithms of the targets, see --hash-algorithms
+	HashAlgorithms []string `yaml:"hash_algorithms,omitempty"`
+	// Roles recording the length and hashes of the file they reference, see --meta-hashes
+	MetaHashes []string `yaml:"meta_hashes,omitempty"`
+	// Target files of a consistent snapshot repository, see --publish-dir
+	PublishDir string `yaml:"publish_dir,omitempty"`
+	// Custom metadata of the targets, see --custom-sidecars, --custom-manifest
+	// and --custom-schema
+	CustomSidecars bool   `yaml:"custom_sidecars,omitempty"`
+	CustomManifest string `yaml:"custom_manifest,omitempty"`
+	CustomSchema   string `yaml:"custom_schema,omitempty"`
+}
+
+type workspace struct {
+	root   string
+	config workspaceConfig
+}
+
+func workspaceConfigPath(root string) string {
+	return filepath.Join(root, workspaceDirname, workspaceFilename)
+}
+
+func workspaceExists(root string) bool {
+	_, err := os.Stat(workspaceConfigPath(root))
+	return err == nil
+}
+
+// Load the workspace at root, or the first one found walking up from the
+// current directory if root is empty. Returns nil if there is none.
+func findWorkspace(root string) (*workspace, error) {
+	if root == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("fail to get current dir: %w", err)
+		}
+		for !workspaceExists(dir) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				return nil, nil
+			}
+			dir = parent
+		}
+		root = dir
+	}
+
+	bytes, err := os.ReadFile(workspaceConfigPath(root))
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no workspace found in %s", root)
+	} else if err != nil {
+		return nil, fmt.Errorf("fail to read workspace config: %w", err)
+	}
+	w := &workspace{root: root}
+	if err = yaml.Unmarshal(bytes, &w.config); err != nil {
+		return nil, fmt.Errorf("fail to parse workspace config %s: %w", workspaceConfigPath(root), err)
+	}
+	return w, nil
+}
+
+// Apply edit to the config of the workspace at root, or found from the
+// current directory, and write it if it changed. Does nothing without a
+// workspace.
+func editWorkspace(root string, edit func(config *workspaceConfig)) error {
+	w, err := findWorkspace(root)
+	if err != nil || w == nil {
+		return err
+	}
+	config := w.config
+	edit(&config)
+	if reflect.DeepEqual(config, w.config) {
+		return nil
+	}
+	// writeWorkspace expects paths relative to the current directory
+	config.MetadataDir = w.resolve(config.MetadataDir)
+	config.RepositoryDir = w.resolve(config.RepositoryDir)
+	config.PublishDir = w.resolve(config.PublishDir)
+	config.CustomManifest = w.resolve(config.CustomManifest)
+	config.CustomSchema = w.resolve(config.CustomSchema)
+	keys := map[string][]string{}
+	for role, paths := range config.Keys {
+		for _, path := range paths {
+			keys[role] = append(keys[role], w.resolve(path))
+		}
+	}
+	config.Keys = keys
+	return writeWorkspace(w.root, config)
+}
+
+// Write the workspace config of an initialized repository.
+func writeWorkspace(root string, config workspaceConfig) error {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("fail to resolve workspace dir %s: %w", root, err)
+	}
+	config.MetadataDir = relativeToWorkspace(absRoot, config.MetadataDir)
+	config.RepositoryDir = relativeToWorkspace(absRoot, config.RepositoryDir)
+	config.PublishDir = relativeToWorkspace(absRoot, config.PublishDir)
+	config.CustomManifest = relativeToWorkspace(absRoot, config.CustomManifest)
+	config.CustomSchema = relativeToWorkspace(absRoot, config.CustomSchema)
+	keys := map[string][]string{}
+	for role, paths := range config.Keys {
+		for _, path := range paths {
+			keys[role] = append(keys[role], relativeToWorkspace(absRoot, path))
+		}
+	}
+	config.Keys = keys
+
+	bytes, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("fail to marshal workspace config: %w", err)
+	}
+	header := "# Updater repository workspace, relative paths are relative to the parent of .updater-repo\n"
+	if err = filesystem.MakeNewDirAll(filepath.Join(root, workspaceDirname)); err != nil {
+		return fmt.Errorf("fail to make workspace dir: %w", err)
+	}
+	if err = filesystem.WriteBytesToFile(workspaceConfigPath(root), append([]byte(header), bytes...)); err != nil {
+		return fmt.Errorf("fail to write workspace config: %w", err)
+	}
+	return nil
+}
+
+// Fails if metadataDir (the local copy of uri) already holds metadata files or
+// if a workspace exists at workspaceDir.
+func checkNoRepository(metadataDir string, uri string, workspaceDir string) error {
+	contents, err := readMetadataDir(metadataDir)
+	if err != nil {
+		return err
+	}
+	if len(contents) > 0 {
+		return fmt.Errorf("output dir %s already contains a repository, use --%s to overwrite it", uri, InitForce)
+	}
+	if workspaceExists(workspaceDir) {
+		return fmt.Errorf("a workspace already exists at %s, use --%s to overwrite it", workspaceConfigPath(workspaceDir), InitForce)
+	}
+	return nil
+}
+
+// Workspace root used by init when --workspace-dir is not given.
+func defaultWorkspaceRoot(outputDir string) string {
+	if objectstore.IsURI(outputDir) {
+		return "."
+	}
+	return filepath.Dir(filepath.Clean(outputDir))
+}
+
+func relativeToWorkspace(absRoot string, path string) string {
+	if path == "" || objectstore.IsURI(path) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(absRoot, abs); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return abs
+}
+
+func (w *workspace) resolve(path string) string {
+	if path == "" || objectstore.IsURI(path) || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(w.root, filepath.FromSlash(path))
+}
+
+func (w *workspace) key(role string) string {
+	if len(w.config.Keys[role]) == 0 {
+		return ""
+	}
+	return w.resolve(w.config.Keys[role][0])
+}
+
+// Keys of the channels, as <channel>=<filepath>,... for --channel-key.
+func (w *workspace) channelKeys() string {
+	keys := []string{}
+	for role := range w.config.Keys {
+		if role == Root || role == Targets || role == Snapshot || role == Timestamp {
+			continue
+		}
+		keys = append(keys, role+"="+w.key(role))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// Flag values of cmd provided by the workspace.
+func (w *workspace) flagDefaults(cmd *cobra.Command) map[string]string {
+	metadataDir := w.resolve(w.config.MetadataDir)
+	repositoryDir := w.resolve(w.config.RepositoryDir)
+	hashCache := filepath.Join(w.root, workspaceDirname, hashcache.Filename)
+	algorithms := strings.Join(w.config.HashAlgorithms, ",")
+	hashed := strings.Join(w.config.MetaHashes, ",")
+	publishDir := w.resolve(w.config.PublishDir)
+	sidecars := ""
+	if w.config.CustomSidecars {
+		sidecars = "true"
+	}
+	manifest := w.resolve(w.config.CustomManifest)
+	schema := w.resolve(w.config.CustomSchema)
+	expire := ""
+	if w.config.Expire > 0 {
+		expire = strconv.Itoa(int(w.config.Expire))
+	}
+
+	// The channel verbs share their names with the target ones
+	if cmd.HasParent() && cmd.Parent().Name() == ChannelVerb {
+		channel, _ := cmd.Flags().GetString(ChannelTo) // promote
+		return map[string]string{
+			ChannelMetadataDir:              metadataDir,
+			ChannelPrivkeyFilepath:          w.key(channel),
+			ChannelTargetsPrivkeyFilepath:   w.key(Targets),
+			ChannelSnapshotPrivkeyFilepath:  w.key(Snapshot),
+			ChannelTimestampPrivkeyFilepath: w.key(Timestamp),
+			ChannelExpire:                   expire,
+			MetaHashes:                      hashed,
+			PublishDir:                      publishDir,
+		}
+	}
+	switch cmd.Name() {
+	case UpdateVerb:
+		return map[string]string{
+			UpdateRepositoryDir:            repositoryDir,
+			UpdateMetadataDir:              metadataDir,
+			UpdateTargetsPrivkeyFilepath:   w.key(Targets),
+			UpdateSnapshotPrivkeyFilepath:  w.key(Snapshot),
+			UpdateTimestampPrivkeyFilepath: w.key(Timestamp),
+			UpdateExpire:                   expire,
+			ScanHashCache:                  hashCache,
+			ScanHashAlgorithms:             algorithms,
+			ScanCustomSidecars:             sidecars,
+			ScanCustomManifest:             manifest,
+			ScanCustomSchema:               schema,
+			MetaHashes:                     hashed,
+			PublishDir:                     publishDir,
+		}
+	case UpdatePlanVerb:
+		return map[string]string{
+			UpdateRepositoryDir: repositoryDir,
+			UpdateMetadataDir:   metadataDir,
+			UpdateExpire:        expire,
+			ScanHashCache:       hashCache,
+			ScanHashAlgorithms:  algorithms,
+			ScanCustomSidecars:  sidecars,
+			ScanCustomManifest:  manifest,
+			ScanCustomSchema:    schema,
+		}
+	case UpdateApplyVerb:
+		return map[string]string{
+			UpdateRepositoryDir:            repositoryDir,
+			UpdateMetadataDir:              metadataDir,
+			UpdateTargetsPrivkeyFilepath:   w.key(Targets),
+			UpdateSnapshotPrivkeyFilepath:  w.key(Snapshot),
+			UpdateTimestampPrivkeyFilepath: w.key(Timestamp),
+			MetaHashes:                     hashed,
+			PublishDir:                     publishDir,
+		}
+	case TargetAddVerb, TargetRemoveVerb, TargetRehashVerb, TargetYankVerb:
+		defaults := map[string]string{
+			TargetRepositoryDir:            repositoryDir,
+			TargetMetadataDir:              metadataDir,
+			TargetTargetsPrivkeyFilepath:   w.key(Targets),
+			TargetSnapshotPrivkeyFilepath:  w.key(Snapshot),
+			TargetTimestampPrivkeyFilepath: w.key(Timestamp),
+			TargetExpire:                   expire,
+			ScanHashCache:                  hashCache,
+			ScanHashAlgorithms:             algorithms,
+			ScanCustomSidecars:             sidecars,
+			ScanCustomManifest:             manifest,
+			ScanCustomSchema:               schema,
+			MetaHashes:                     hashed,
+			PublishDir:                     publishDir,
+		}
+		if cmd.Name() == TargetYankVerb {
+			defaults[TargetChannelKey] = w.channelKeys()
+		}
+		return defaults
+	case SignVerb:
+		role, _ := cmd.Flags().GetString(SignRole)
+		return map[string]string{
+			SignMetadataDir:     metadataDir,
+			SignPrivkeyFilepath: w.key(role),
+		}
+	case ChangeThresholdVerb:
+		return map[string]string{
+			ChangeThresholdMetadataDir:         metadataDir,
+			ChangeThresholdRootPrivkeyFilepath: w.key(Root),
+		}
+	case VerifyVerb:
+		return map[string]string{
+			VerifyRepositoryDir: repositoryDir,
+			VerifyMetadataDir:   metadataDir,
+			ScanHashCache:       hashCache,
+			ScanHashAlgorithms:  algorithms,
+			ScanCustomSidecars:  sidecars,
+			ScanCustomManifest:  manifest,
+			ScanCustomSchema:    schema,
+		}
+	case ChangeRootKeyVerb:
+		return map[string]string{
+			ChangeRootKeyMetadataDir:     metadataDir,
+			ChangeRootKeyPrivkeyFilepath: w.key(Root),
+			ChangeRootKeyExpire:          expire,
+		}
+	}
+	// Commands only taking the metadata dir
+	if cmd.Flags().Lookup(HistoryMetadataDir) != nil {
+		return map[string]string{HistoryMetadataDir: metadataDir}
+	}
+	return nil
+}
+
+// Set the flags of cmd that were not given on the command line from the
+// workspace found at root, or from the current directory upwards.
+func applyWorkspace(cmd *cobra.Command, root string) error {
+	// Commands creating files from scratch
+	if cmd.Name() == InitVerb || cmd.Name() == KeygenVerb {
+		return nil
+	}
+	w, err := findWorkspace(root)
+	if err != nil || w == nil {
+		return err
+	}
+	for name, value := range w.flagDefaults(cmd) {
+		if value == "" || cmd.Flags().Lookup(name) == nil || cmd.Flags().Changed(name) {
+			continue
+		}
+		if err = cmd.Flags().Set(name, value); err != nil {
+			return fmt.Errorf("fail to set --%s from workspace %s: %w", name, w.root, err)
+		}
+		cmd.Flags().SetAnnotation(name, sourceAnnotation, []string{SourceWorkspace})
+	}
+	slog.Debug("applied workspace config", slog.String("workspace", w.root), slog.String("command", cmd.CommandPath()))
+	return nil
+}